@@ -0,0 +1,35 @@
+package chat
+
+import (
+	"errors"
+	"math/rand/v2"
+	"syscall"
+	"time"
+)
+
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// transient reports whether an accept error is worth retrying: errors
+// reporting themselves as temporary or timeouts, and resource exhaustion.
+func transient(err error) bool {
+	var temp interface{ Temporary() bool }
+	if errors.As(err, &temp) && temp.Temporary() {
+		return true
+	}
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM)
+}
+
+// nextBackoff doubles the accept backoff up to maxAcceptBackoff
+// and adds up to 25% of jitter.
+func nextBackoff(prev time.Duration) time.Duration {
+	d := min(max(prev*2, minAcceptBackoff), maxAcceptBackoff)
+	return d + rand.N(d/4+1)
+}
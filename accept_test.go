@@ -0,0 +1,76 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/zhmlst/chat"
+)
+
+// failing is a listener whose Accept fails with err
+// the first fails times before reaching the wrapped listener.
+type failing struct {
+	chat.Listener
+	err   error
+	fails atomic.Int64
+}
+
+func (l *failing) Accept(ctx context.Context) (*quic.Conn, error) {
+	if l.fails.Add(-1) >= 0 {
+		return nil, l.err
+	}
+	return l.Listener.Accept(ctx)
+}
+
+func TestAcceptTransientError(t *testing.T) {
+	const fails = 3
+	err := fmt.Errorf("accept: %w", syscall.EMFILE)
+	srv, addr, ca := startServer(t, discard, chat.ServerOptions.WrapListener(func(l chat.Listener) chat.Listener {
+		f := &failing{Listener: l, err: err}
+		f.fails.Store(fails)
+		return f
+	}))
+
+	connect(t, addr, ca)
+	stats := srv.Stats()
+	if stats.AcceptErrors != fails {
+		t.Errorf("%d accept errors, want %d", stats.AcceptErrors, fails)
+	}
+	if stats.LastAcceptError != err.Error() {
+		t.Errorf("last accept error %q, want %q", stats.LastAcceptError, err)
+	}
+}
+
+func TestAcceptFatalError(t *testing.T) {
+	srv := chat.NewServer(
+		chat.ServerOptions.Addresses("127.0.0.1:0"),
+		chat.ServerOptions.DevTLS(),
+		chat.ServerOptions.Handler(discard),
+		chat.ServerOptions.Logger(quiet),
+		chat.ServerOptions.WrapListener(func(l chat.Listener) chat.Listener {
+			f := &failing{Listener: l, err: errors.New("listener broken")}
+			f.fails.Store(1)
+			return f
+		}),
+	)
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Run() }()
+	select {
+	case err := <-errCh:
+		if err == nil || !strings.Contains(err.Error(), "listener broken") {
+			t.Errorf("run: %v, want the accept error", err)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("server survived a fatal accept error")
+	}
+	if n := srv.Stats().AcceptErrors; n != 1 {
+		t.Errorf("%d accept errors, want 1", n)
+	}
+}
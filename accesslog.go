@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/zhmlst/chat/codes"
+)
+
+// Outcome describes how the handshake of a connection ended.
+type Outcome string
+
+const (
+	OutcomeAuthenticated Outcome = "authenticated"
+	OutcomeGuest         Outcome = "guest"
+	OutcomeAdmin         Outcome = "admin"
+	OutcomePeer          Outcome = "peer"
+	OutcomeRaw           Outcome = "raw"
+	OutcomeGuestDenied   Outcome = "guest denied"
+	OutcomeTokenDenied   Outcome = "token denied"
+	OutcomeForbidden     Outcome = "forbidden"
+	OutcomeDuplicate     Outcome = "duplicate login"
+	OutcomeRedirected    Outcome = "redirected"
+	OutcomeFailed        Outcome = "failed"
+)
+
+// AccessRecord describes a terminated connection.
+type AccessRecord struct {
+	RemoteAddr string `json:"remote_addr"`
+	ALPN       string `json:"alpn,omitempty"`
+	Version    string `json:"version,omitempty"`
+	SessionID  uint64 `json:"session_id,omitempty"`
+	// SID is the hex encoded Session.SessionID, also sent to the client.
+	SID string `json:"sid,omitempty"`
+	// TokenHash is the hex encoded SHA-256 of the session token, empty for guests.
+	TokenHash string        `json:"token_hash,omitempty"`
+	Outcome   Outcome       `json:"outcome"`
+	BytesIn   uint64        `json:"bytes_in"`
+	BytesOut  uint64        `json:"bytes_out"`
+	Started   time.Time     `json:"started"`
+	Duration  time.Duration `json:"duration"`
+	Code      codes.Code    `json:"code"`
+	// RemoteClose reports whether the client closed the connection.
+	RemoteClose bool `json:"remote_close"`
+	// Handshake holds the phases of the handshake.
+	Handshake HandshakeStats `json:"handshake"`
+	// MTU and Datagrams are those of the TransportInfo of the connection.
+	MTU       int  `json:"mtu,omitempty"`
+	Datagrams bool `json:"datagrams,omitempty"`
+}
+
+// AccessLog is called once for every terminated connection. It is called
+// from a dedicated goroutine, records that do not fit in its queue are
+// dropped and counted in Stats.AccessDropped.
+type AccessLog func(rec AccessRecord)
+
+const defaultAccessQueue = 1024
+
+// logAccess completes the record from the closed connection and queues it.
+func (s *Server) logAccess(c *quic.Conn, rec AccessRecord) {
+	if s.accessq == nil {
+		return
+	}
+	info := transportInfo(c)
+	stats := c.ConnectionStats()
+	rec.ALPN = info.ALPN
+	rec.Version = info.Version
+	rec.MTU = info.MTU
+	rec.Datagrams = info.Datagrams
+	rec.BytesIn = stats.BytesReceived
+	rec.BytesOut = stats.BytesSent
+	rec.Duration = time.Since(rec.Started)
+	var appErr *quic.ApplicationError
+	if errors.As(context.Cause(c.Context()), &appErr) {
+		rec.Code = codes.Code(appErr.ErrorCode)
+		rec.RemoteClose = appErr.Remote
+	}
+	select {
+	case s.accessq <- rec:
+	default:
+		s.mtx.Lock()
+		s.accessDropped++
+		s.mtx.Unlock()
+	}
+}
+
+// runAccessLog passes queued records to the hook until the server
+// has stopped and all connections are served, then drains the queue.
+func (s *Server) runAccessLog() {
+	defer close(s.accessDone)
+	write := func(rec AccessRecord) {
+		_ = s.guard("access log", func() error {
+			s.cfg.accessLog(rec)
+			return nil
+		})
+	}
+	stop := make(chan struct{})
+	go func() {
+		<-s.ctx.Done()
+		s.sessionsWG.Wait()
+		close(stop)
+	}()
+	for {
+		select {
+		case rec := <-s.accessq:
+			write(rec)
+		case <-stop:
+			for {
+				select {
+				case rec := <-s.accessq:
+					write(rec)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// JSONLAccessLog returns an AccessLog writing records to w as JSON lines.
+// Write errors are reported to onErr if it is not nil.
+func JSONLAccessLog(w io.Writer, onErr func(error)) AccessLog {
+	var mtx sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(rec AccessRecord) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if err := enc.Encode(rec); err != nil && onErr != nil {
+			onErr(err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package chat_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+// accessLog returns an AccessLog option sending records to the channel.
+func accessLog() (chat.ServerOption, <-chan chat.AccessRecord) {
+	recs := make(chan chat.AccessRecord, 4)
+	return chat.ServerOptions.AccessLog(func(rec chat.AccessRecord) { recs <- rec }), recs
+}
+
+// once returns the only record of recs.
+func once(t *testing.T, recs <-chan chat.AccessRecord) chat.AccessRecord {
+	t.Helper()
+	rec := receive(t, recs)
+	select {
+	case again := <-recs:
+		t.Errorf("second record %+v", again)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return rec
+}
+
+func TestAccessLogSession(t *testing.T) {
+	opt, recs := accessLog()
+	_, addr, ca := startServer(t, discard, opt)
+	c := connect(t, addr, ca)
+	tok, err := c.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid := c.SessionID()
+	send(t, c, "hello")
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := once(t, recs)
+	hash := sha256.Sum256(tok[:])
+	if rec.Outcome != chat.OutcomeAuthenticated || rec.TokenHash != hex.EncodeToString(hash[:]) || rec.SessionID == 0 {
+		t.Errorf("outcome %q, token hash %s, session %d", rec.Outcome, rec.TokenHash, rec.SessionID)
+	}
+	if rec.SID != hex.EncodeToString(sid[:]) || rec.ALPN != "quic-raw" || rec.RemoteAddr == "" {
+		t.Errorf("sid %s, alpn %q, remote %q", rec.SID, rec.ALPN, rec.RemoteAddr)
+	}
+	if rec.BytesIn == 0 || rec.BytesOut == 0 || rec.Duration <= 0 || rec.Started.IsZero() {
+		t.Errorf("bytes %d in, %d out, duration %s, started %v", rec.BytesIn, rec.BytesOut, rec.Duration, rec.Started)
+	}
+}
+
+func TestAccessLogFailedHandshake(t *testing.T) {
+	opt, recs := accessLog()
+	_, addr, ca := startServer(t, discard, opt, chat.ServerOptions.TokenApprover(inviteOnly))
+	if err := dial(t, newClient(t, addr, ca)); err == nil {
+		t.Fatal("dial succeeded without an invite")
+	}
+
+	rec := once(t, recs)
+	if rec.Outcome != chat.OutcomeTokenDenied || rec.Code != codes.InvalidToken || rec.RemoteClose {
+		t.Errorf("outcome %q, code %s, remote close %t", rec.Outcome, rec.Code, rec.RemoteClose)
+	}
+	if rec.TokenHash != "" || rec.SessionID != 0 {
+		t.Errorf("token hash %q, session %d for a denied token", rec.TokenHash, rec.SessionID)
+	}
+}
+
+func TestJSONLAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	log := chat.JSONLAccessLog(&buf, func(err error) { t.Error(err) })
+	log(chat.AccessRecord{RemoteAddr: "127.0.0.1:1", Outcome: chat.OutcomeGuest})
+	log(chat.AccessRecord{RemoteAddr: "127.0.0.1:2", Outcome: chat.OutcomeFailed})
+	dec := json.NewDecoder(&buf)
+	for _, want := range []chat.Outcome{chat.OutcomeGuest, chat.OutcomeFailed} {
+		var rec chat.AccessRecord
+		if err := dec.Decode(&rec); err != nil || rec.Outcome != want {
+			t.Errorf("decoded %+v, %v, want outcome %q", rec, err, want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package chat
+
+import (
+	"context"
+	"errors"
+)
+
+// AckKind defines what an acknowledgement confirms.
+type AckKind byte
+
+const (
+	// AckDelivery confirms that messages were delivered.
+	AckDelivery AckKind = iota
+	// AckRead confirms that messages were read.
+	AckRead
+)
+
+// ErrMalformedAck is returned when an ack payload cannot be parsed.
+var ErrMalformedAck = errors.New("malformed ack")
+
+// Receipt is the content of an ack message: the kind
+// in the first payload byte followed by the acknowledged IDs.
+type Receipt struct {
+	Kind AckKind
+	IDs  [][16]byte
+}
+
+// NewAck creates an ack message for the receipt.
+func NewAck(rcpt Receipt) *Message {
+	pld := make([]byte, 1, 1+len(rcpt.IDs)*16)
+	pld[0] = byte(rcpt.Kind)
+	for _, id := range rcpt.IDs {
+		pld = append(pld, id[:]...)
+	}
+	return &Message{Type: MsgTypeAck, Payload: pld}
+}
+
+// Receipt parses the payload of an ack message.
+func (m *Message) Receipt() (Receipt, error) {
+	if m.Type != MsgTypeAck || len(m.Payload) == 0 || (len(m.Payload)-1)%16 != 0 {
+		return Receipt{}, ErrMalformedAck
+	}
+	rcpt := Receipt{
+		Kind: AckKind(m.Payload[0]),
+		IDs:  make([][16]byte, 0, (len(m.Payload)-1)/16),
+	}
+	for i := 1; i < len(m.Payload); i += 16 {
+		rcpt.IDs = append(rcpt.IDs, [16]byte(m.Payload[i:i+16]))
+	}
+	return rcpt, nil
+}
+
+// MarkRead sends a single read receipt for all the given message IDs.
+func (s *Session) MarkRead(ctx context.Context, ids ...[16]byte) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.Send(ctx, NewAck(Receipt{Kind: AckRead, IDs: ids}))
+}
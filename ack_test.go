@@ -0,0 +1,79 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestReadReceiptRouted(t *testing.T) {
+	_, addr, ca := startServer(t, chat.NewHub().Serve)
+	receipts := make(chan chat.Receipt, 4)
+	joined := make(chan chat.PresenceEvent, 4)
+	a := connect(t, addr, ca,
+		chat.ClientOptions.OnMessage(func(m *chat.Message) {
+			if rcpt, err := m.Receipt(); err == nil && rcpt.Kind == chat.AckRead {
+				receipts <- rcpt
+			}
+		}),
+		chat.ClientOptions.OnEvent(func(e chat.Event) {
+			if e, ok := e.(chat.PresenceEvent); ok && e.Online {
+				joined <- e
+			}
+		}),
+	)
+	got := make(chan *chat.Message, 4)
+	b := connect(t, addr, ca, chat.ClientOptions.OnMessage(func(m *chat.Message) {
+		if m.Type == chat.MsgTypeText {
+			got <- m
+		}
+	}))
+
+	// messages reach the members of the hub at the time
+	receive(t, joined)
+	ctx := context.Background()
+	m := chat.NewTextMessage([]byte("hello"))
+	if err := a.SendMessage(ctx, m); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	relayed := receive(t, got)
+	if relayed.ID != m.ID {
+		t.Fatalf("B received message %x, A sent %x", relayed.ID, m.ID)
+	}
+
+	read := chat.NewAck(chat.Receipt{Kind: chat.AckRead, IDs: [][16]byte{relayed.ID, {1}}})
+	for range 2 {
+		// the unknown ID and the second receipt are ignored
+		if err := b.SendMessage(ctx, read); err != nil {
+			t.Fatalf("mark read: %v", err)
+		}
+	}
+	rcpt := receive(t, receipts)
+	if len(rcpt.IDs) != 1 || rcpt.IDs[0] != m.ID {
+		t.Errorf("A observed receipt for %x, want %x", rcpt.IDs, m.ID)
+	}
+	select {
+	case rcpt := <-receipts:
+		t.Errorf("A observed a second receipt for %x", rcpt.IDs)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestReceiptRoundTrip(t *testing.T) {
+	want := chat.Receipt{Kind: chat.AckRead, IDs: [][16]byte{{1}, {2, 3}}}
+	got, err := chat.NewAck(want).Receipt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Kind != want.Kind || len(got.IDs) != 2 || got.IDs[0] != want.IDs[0] || got.IDs[1] != want.IDs[1] {
+		t.Errorf("receipt %+v, want %+v", got, want)
+	}
+	for _, pld := range [][]byte{nil, {byte(chat.AckRead), 1}} {
+		if _, err := (&chat.Message{Type: chat.MsgTypeAck, Payload: pld}).Receipt(); !errors.Is(err, chat.ErrMalformedAck) {
+			t.Errorf("receipt of %x: %v, want %v", pld, err, chat.ErrMalformedAck)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package chat
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// defaultHalfOpen is the number of handshakes in flight from which
+// ValidateUnderLoad asks clients to validate their address.
+const defaultHalfOpen = 100
+
+// AddressValidationPolicy defines when clients have to prove they own
+// their source address with a QUIC Retry before the server does any
+// handshake work for them, which costs them a round trip.
+type AddressValidationPolicy int8
+
+const (
+	// ValidateNever never sends a Retry.
+	ValidateNever AddressValidationPolicy = iota
+	// ValidateAlways sends a Retry to every client without a valid token.
+	ValidateAlways
+	// ValidateUnderLoad sends a Retry while many handshakes are in flight,
+	// as with spoofed source addresses.
+	ValidateUnderLoad
+)
+
+// RetrySent is the Metric of a Retry sent to a client, see
+// ServerOptions.RequireAddressValidation.
+type RetrySent struct {
+	RemoteAddr net.Addr
+}
+
+func (RetrySent) metric() {}
+
+// AddressValidationFailed is the Metric of a client presenting
+// an invalid or expired Retry token.
+type AddressValidationFailed struct {
+	RemoteAddr net.Addr
+}
+
+func (AddressValidationFailed) metric() {}
+
+// RequireAddressValidation sets when clients have to validate their source
+// address, never by default. ValidateUnderLoad does it from halfOpen QUIC
+// handshakes in flight on, 100 if halfOpen is zero. Retries and failed
+// validations are counted in Stats.
+func (serverOptionsNamespace) RequireAddressValidation(policy AddressValidationPolicy, halfOpen int) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.addrValidation = policy
+		cfg.halfOpen = halfOpen
+		if policy == ValidateUnderLoad && halfOpen == 0 {
+			cfg.halfOpen = defaultHalfOpen
+		}
+	}
+}
+
+// closeTransports closes the transports and their sockets. Connections
+// still open on them end without notifying the peer, so the transports
+// are closed after the connections of the server, unlike the listeners.
+func closeTransports(trs []*quic.Transport) error {
+	var errs []error
+	for _, tr := range trs {
+		errs = append(errs, tr.Close(), tr.Conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// listen listens on addr, validating client addresses according to the policy.
+// The transport of the listener is returned to be closed, see closeTransports.
+func (s *Server) listen(address string, tlsCfg *tls.Config, quicCfg *quic.Config) (Listener, *quic.Transport, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	udp, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := &quic.Transport{
+		Conn:                udp,
+		VerifySourceAddress: s.verifySourceAddress,
+		ConnContext:         s.connContext,
+		Tracer:              &logging.Tracer{SentPacket: s.sentPacket},
+	}
+	var lnr Listener
+	if s.cfg.allow0RTT {
+		lnr, err = tr.ListenEarly(tlsCfg, quicCfg)
+	} else {
+		lnr, err = tr.Listen(tlsCfg, quicCfg)
+	}
+	if err != nil {
+		return nil, nil, errors.Join(err, tr.Close(), udp.Close())
+	}
+	return lnr, tr, nil
+}
+
+// verifySourceAddress reports whether the client has to validate its address.
+func (s *Server) verifySourceAddress(net.Addr) bool {
+	switch s.cfg.addrValidation {
+	case ValidateAlways:
+		return true
+	case ValidateUnderLoad:
+		return s.halfOpen.Load() >= int64(s.cfg.halfOpen)
+	}
+	return false
+}
+
+type halfOpenKey struct{}
+
+// connContext counts the handshake of a new connection as in flight
+// until it completes or fails, see established.
+func (s *Server) connContext(ctx context.Context, _ *quic.ClientInfo) (context.Context, error) {
+	s.halfOpen.Add(1)
+	done := sync.OnceFunc(func() { s.halfOpen.Add(-1) })
+	ctx = withPathMTU(context.WithValue(ctx, halfOpenKey{}, done))
+	context.AfterFunc(ctx, done)
+	return ctx, nil
+}
+
+// established stops counting the handshake of the accepted connection as
+// in flight once it is complete, which it is unless 0-RTT is allowed.
+func (s *Server) established(conn *quic.Conn) {
+	done, ok := conn.Context().Value(halfOpenKey{}).(func())
+	if !ok {
+		return
+	}
+	select {
+	case <-conn.HandshakeComplete():
+		done()
+	default:
+		go func() {
+			select {
+			case <-conn.HandshakeComplete():
+			case <-conn.Context().Done():
+			}
+			done()
+		}()
+	}
+}
+
+// sentPacket counts the Retry packets and the connection closes with
+// INVALID_TOKEN sent by the transport.
+func (s *Server) sentPacket(addr net.Addr, hdr *logging.Header, _ logging.ByteCount, frames []logging.Frame) {
+	if logging.PacketTypeFromHeader(hdr) == logging.PacketTypeRetry {
+		s.mtx.Lock()
+		s.retriesSent++
+		s.mtx.Unlock()
+		s.metric(RetrySent{RemoteAddr: addr})
+		return
+	}
+	for _, f := range frames {
+		if cc, ok := f.(*logging.ConnectionCloseFrame); ok && cc.ErrorCode == uint64(quic.InvalidToken) {
+			s.mtx.Lock()
+			s.validationsFailed++
+			s.mtx.Unlock()
+			s.metric(AddressValidationFailed{RemoteAddr: addr})
+		}
+	}
+}
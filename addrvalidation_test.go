@@ -0,0 +1,104 @@
+package chat_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/zhmlst/chat"
+)
+
+// spoofed leaves a handshake half open on the server at addr, as a client
+// with a spoofed source address would: the Initial of a real client is
+// replayed from a socket never answering the server.
+func spoofed(t *testing.T, addr string) {
+	t.Helper()
+	capture, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer capture.Close()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go func() {
+		_, _ = quic.DialAddr(ctx, capture.LocalAddr().String(), &tls.Config{NextProtos: []string{"quic-raw"}}, nil)
+	}()
+	buf := make([]byte, 1500)
+	_ = capture.SetReadDeadline(time.Now().Add(waitTimeout))
+	n, _, err := capture.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	victim, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = victim.Close() })
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := victim.WriteTo(buf[:n], raddr); err != nil {
+		t.Fatal(err)
+	}
+	// the server answers once it took the handshake up
+	_ = victim.SetReadDeadline(time.Now().Add(waitTimeout))
+	if _, _, err := victim.ReadFrom(buf); err != nil {
+		t.Fatalf("no answer to the spoofed Initial: %v", err)
+	}
+}
+
+func TestAddressValidation(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		policy   chat.AddressValidationPolicy
+		halfOpen int
+		load     bool
+		retry    bool
+	}{
+		{"never", chat.ValidateNever, 0, true, false},
+		{"always", chat.ValidateAlways, 0, false, true},
+		{"under load idle", chat.ValidateUnderLoad, 1, false, false},
+		{"under load", chat.ValidateUnderLoad, 1, true, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var metrics atomic.Uint64
+			srv, addr, ca := startServer(t, discard,
+				chat.ServerOptions.RequireAddressValidation(tt.policy, tt.halfOpen),
+				chat.ServerOptions.Metrics(func(m chat.Metric) {
+					if _, ok := m.(chat.RetrySent); ok {
+						metrics.Add(1)
+					}
+				}))
+			summary := srv.ConfigSummary()
+			if summary["address_validation"] != tt.policy || summary["half_open"] != tt.halfOpen {
+				t.Errorf("configured %v from %v half open", summary["address_validation"], summary["half_open"])
+			}
+			if tt.load {
+				spoofed(t, addr)
+			}
+
+			connect(t, addr, ca)
+			// a Retry for each Initial of the client, which may take several
+			stats := srv.Stats()
+			if (stats.RetriesSent > 0) != tt.retry || stats.RetriesSent != metrics.Load() {
+				t.Errorf("%d retries counted, %d reported, want some: %v", stats.RetriesSent, metrics.Load(), tt.retry)
+			}
+			if stats.ValidationsFailed != 0 {
+				t.Errorf("%d failed validations", stats.ValidationsFailed)
+			}
+		})
+	}
+}
+
+func TestAddressValidationDefault(t *testing.T) {
+	srv := chat.NewServer(chat.ServerOptions.RequireAddressValidation(chat.ValidateUnderLoad, 0))
+	if n := srv.ConfigSummary()["half_open"]; n != 100 {
+		t.Errorf("%v half open handshakes by default, want 100", n)
+	}
+}
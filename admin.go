@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zhmlst/chat/codes"
+)
+
+// adminHandler serves the admin commands on the session stream. Each
+// control message carries one command and is answered with a JSON text message.
+func (s *Server) adminHandler(ctx context.Context, session *Session) {
+	lgr := session.lgr.With("module", "admin")
+	for {
+		r, err := readMessageContext(ctx, session.stream)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				lgr.With("error", err).Error("failed to receive command")
+			}
+			return
+		}
+		cmd := r.Payload
+		lgr.With("cmd", string(cmd)).Info("admin command")
+
+		res, err := s.adminCommand(string(cmd))
+		if err != nil {
+			res = map[string]string{"error": err.Error()}
+		}
+		pld, err := json.Marshal(res)
+		if err != nil {
+			lgr.With("error", err).Error("failed to marshal response")
+			return
+		}
+		if err = session.sendMessage(&Message{Type: MsgTypeText, Payload: pld}); err != nil {
+			lgr.With("error", err).Error("failed to write response")
+			return
+		}
+	}
+}
+
+func (s *Server) adminCommand(cmd string) (any, error) {
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	switch args[0] {
+	case "list-sessions":
+		return s.Sessions(), nil
+
+	case "session-info":
+		if len(args) != 2 {
+			return nil, errors.New("usage: session-info <id>")
+		}
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id: %w", err)
+		}
+		return s.SessionInfo(id)
+
+	case "kick":
+		if len(args) < 3 {
+			return nil, errors.New("usage: kick <id> <code>")
+		}
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id: %w", err)
+		}
+		code, err := parseCode(strings.Join(args[2:], " "))
+		if err != nil {
+			return nil, err
+		}
+		if err = s.Disconnect(id, code); err != nil {
+			return nil, err
+		}
+		return map[string]string{"result": "ok"}, nil
+
+	case "mute":
+		if len(args) < 3 {
+			return nil, errors.New("usage: mute <id> <duration> [reason]")
+		}
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id: %w", err)
+		}
+		d, err := time.ParseDuration(args[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration: %w", err)
+		}
+		if err = s.Mute(id, d, strings.Join(args[3:], " ")); err != nil {
+			return nil, err
+		}
+		return map[string]string{"result": "ok"}, nil
+
+	case "unmute":
+		if len(args) != 2 {
+			return nil, errors.New("usage: unmute <id>")
+		}
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id: %w", err)
+		}
+		if err = s.Unmute(id); err != nil {
+			return nil, err
+		}
+		return map[string]string{"result": "ok"}, nil
+
+	case "stats":
+		return s.Stats(), nil
+
+	case "log-level":
+		if len(args) == 2 {
+			lvl, err := LogLevelString(strings.ToUpper(args[1]))
+			if err != nil {
+				return nil, err
+			}
+			s.SetLogLevel(lvl)
+		}
+		return map[string]LogLevel{"level": s.LogLevel()}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// parseCode accepts either a numeric code or its name.
+func parseCode(s string) (codes.Code, error) {
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return codes.Code(n), nil
+	}
+	return codes.CodeString(s)
+}
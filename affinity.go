@@ -0,0 +1,132 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"unicode"
+
+	"github.com/quic-go/quic-go"
+	"github.com/zhmlst/chat/codes"
+)
+
+// ErrRedirectLoop is returned by Dial when the server a client was
+// redirected to redirects it again, or a server redirects to itself.
+// Clients follow a single redirect.
+var ErrRedirectLoop = errors.New("redirect loop")
+
+// ErrRedirected is returned by server handshakes redirecting the client,
+// see ServerOptions.AffinityMismatchHandler.
+var ErrRedirected = errors.New("client redirected")
+
+// RedirectError is returned by the handshake of a client the server
+// redirected. Dial follows it, see ErrRedirectLoop.
+type RedirectError struct {
+	Addr string
+}
+
+func (e *RedirectError) Error() string {
+	return "redirected to " + e.Addr
+}
+
+// AffinityMismatch describes a client reconnecting with the instance ID
+// of another server, see ServerOptions.AffinityMismatchHandler.
+type AffinityMismatch struct {
+	// Instance is the ID of the server the client was last connected to.
+	Instance   string
+	RemoteAddr net.Addr
+	// Token is zero for guests, raw sessions and servers with NoAuth.
+	Token [16]byte
+}
+
+// InstanceID sets the ID of the server told to clients in the handshake,
+// a random one by default. Clients present it when they connect again, so
+// that servers sharing a hostname can tell a client which was connected
+// to another instance, see AffinityMismatchHandler. It must not be empty
+// or contain whitespace.
+func (serverOptionsNamespace) InstanceID(id string) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.instance = id
+	}
+}
+
+// AffinityMismatchHandler sets the function called for clients which were
+// connected to another instance, which lacks their replay buffer and
+// presence state. It returns the address to redirect the client to, which
+// the client follows once, or "" to admit the client afresh, as without
+// a handler. Redirected connections are closed with codes.Redirected.
+func (serverOptionsNamespace) AffinityMismatchHandler(fn func(ctx context.Context, m AffinityMismatch) (redirect string)) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.onMismatch = fn
+	}
+}
+
+// InstanceID returns the ID the server tells clients, see ServerOptions.InstanceID.
+func (s *Server) InstanceID() string {
+	return s.cfg.instance
+}
+
+// ServerInstance returns the instance ID of the server the client was last
+// admitted by, empty if it did not tell one, see ServerOptions.InstanceID.
+func (c *Client) ServerInstance() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.instance
+}
+
+// validInstance reports whether id can be sent as a handshake field.
+func validInstance(id string) bool {
+	return id != "" && !strings.ContainsFunc(id, unicode.IsSpace)
+}
+
+// affinity returns the address to redirect a client presenting the
+// instance ID to, if it is another one and the mismatch handler says so.
+func (s *Server) affinity(ctx context.Context, session *Session, instance string, tok [16]byte) string {
+	if instance == "" || instance == s.cfg.instance || s.cfg.onMismatch == nil {
+		return ""
+	}
+	var addr string
+	_ = session.guard("affinity mismatch", func() error {
+		addr = s.cfg.onMismatch(ctx, AffinityMismatch{
+			Instance:   instance,
+			RemoteAddr: session.conn.RemoteAddr(),
+			Token:      tok,
+		})
+		return nil
+	})
+	return addr
+}
+
+// redirection returns the RedirectError for a redirect response,
+// nil for any other response.
+func redirection(resp []byte) error {
+	addr, ok := bytes.CutPrefix(resp, []byte("redirect "))
+	if !ok || len(addr) == 0 {
+		return nil
+	}
+	return &RedirectError{Addr: string(addr)}
+}
+
+// follow connects to the server the client was redirected to by from.
+// A second redirect is not followed, so that servers cannot bounce
+// the client around.
+func (c *Client) follow(dial func(string) (*quic.Conn, error), from, to string, handle func(*quic.Conn) error) error {
+	if to == from {
+		return fmt.Errorf("%w: %s redirects to itself", ErrRedirectLoop, from)
+	}
+	c.cfg.logger.With("from", from, "to", to).Info("following redirect")
+	conn, err := dial(to)
+	if err != nil {
+		return fmt.Errorf("follow redirect to %s: %w", to, err)
+	}
+	err = handle(conn)
+	var again *RedirectError
+	if errors.As(err, &again) {
+		_ = closeConn(conn, codes.Done, "redirect loop")
+		return fmt.Errorf("%w: redirected from %s to %s and again to %s", ErrRedirectLoop, from, to, again.Addr)
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+)
+
+// greetInstance tells the session the instance ID of *srv, then
+// receives until it ends.
+func greetInstance(srv **chat.Server) chat.Handler {
+	return func(ctx context.Context, s *chat.Session) {
+		if err := s.Send(ctx, chat.NewTextMessage([]byte((*srv).InstanceID()))); err != nil {
+			return
+		}
+		discard(ctx, s)
+	}
+}
+
+// reconnectElsewhere connects a client with opts to a server with the
+// instance ID "home", then replaces that server by one with the instance
+// ID "away" at the same address, which redirects mismatched clients to
+// the address redirect returns. It returns the disconnected client and
+// the messages the servers send it.
+func reconnectElsewhere(t *testing.T, repo chat.TokenRepo, redirect func(instance string) string, opts ...chat.ClientOption) (*chat.Client, <-chan string) {
+	t.Helper()
+	var home *chat.Server
+	home, addr, _ := startServer(t, greetInstance(&home),
+		chat.ServerOptions.InstanceID("home"),
+		chat.ServerOptions.TokenRepo(repo),
+	)
+	got := make(chan string, 4)
+	opts = append([]chat.ClientOption{
+		chat.ClientOptions.Insec(true),
+		chat.ClientOptions.OnMessage(func(m *chat.Message) { got <- string(m.Payload) }),
+	}, opts...)
+	c := connect(t, addr, nil, opts...)
+	if instance := receive(t, got); instance != "home" {
+		t.Fatalf("client served by %q, want %q", instance, "home")
+	}
+	if instance := c.ServerInstance(); instance != "home" {
+		t.Fatalf("client stored instance %q, want %q", instance, "home")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	eventually(t, func() bool { return c.SessionID() == [16]byte{} })
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	if err := home.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	var away *chat.Server
+	away, _, _ = startServer(t, greetInstance(&away),
+		chat.ServerOptions.Addresses(addr),
+		chat.ServerOptions.InstanceID("away"),
+		chat.ServerOptions.TokenRepo(repo),
+		chat.ServerOptions.AffinityMismatchHandler(func(_ context.Context, m chat.AffinityMismatch) string {
+			return redirect(m.Instance)
+		}),
+	)
+	return c, got
+}
+
+func TestAffinityMismatchAdmitted(t *testing.T) {
+	mismatched := make(chan string, 1)
+	c, got := reconnectElsewhere(t, &chattest.TokenRepo{}, func(instance string) string {
+		mismatched <- instance
+		return ""
+	})
+	if err := dial(t, c); err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if instance := receive(t, mismatched); instance != "home" {
+		t.Errorf("mismatch of instance %q, want %q", instance, "home")
+	}
+	if instance := receive(t, got); instance != "away" {
+		t.Errorf("client served by %q, want %q", instance, "away")
+	}
+	if instance := c.ServerInstance(); instance != "away" {
+		t.Errorf("client stored instance %q, want %q", instance, "away")
+	}
+}
+
+func TestAffinityRedirect(t *testing.T) {
+	repo := &chattest.TokenRepo{}
+	var target *chat.Server
+	target, targetAddr, _ := startServer(t, greetInstance(&target),
+		chat.ServerOptions.InstanceID("target"),
+		chat.ServerOptions.TokenRepo(repo),
+	)
+	c, got := reconnectElsewhere(t, repo, func(string) string { return targetAddr })
+	if err := dial(t, c); err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if instance := receive(t, got); instance != "target" {
+		t.Errorf("redirected client served by %q, want %q", instance, "target")
+	}
+	if instance := c.ServerInstance(); instance != "target" {
+		t.Errorf("client stored instance %q, want %q", instance, "target")
+	}
+}
+
+func TestAffinityRedirectLoop(t *testing.T) {
+	repo := &chattest.TokenRepo{}
+	// the target redirects the client back, as it was not its home either
+	_, targetAddr, _ := startServer(t, discard,
+		chat.ServerOptions.InstanceID("target"),
+		chat.ServerOptions.TokenRepo(repo),
+		chat.ServerOptions.AffinityMismatchHandler(func(context.Context, chat.AffinityMismatch) string {
+			return "127.0.0.1:1"
+		}),
+	)
+	c, _ := reconnectElsewhere(t, repo, func(string) string { return targetAddr })
+	if err := dial(t, c); !errors.Is(err, chat.ErrRedirectLoop) {
+		t.Errorf("dial: %v, want %v", err, chat.ErrRedirectLoop)
+	}
+}
@@ -0,0 +1,37 @@
+package chat_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+var errBadInvite = errors.New("bad invite code")
+
+// inviteOnly approves the token requests carrying the invite code.
+func inviteOnly(_ context.Context, req *chat.TokenRequest) error {
+	if !bytes.Equal(req.Payload, []byte("open sesame")) {
+		return errBadInvite
+	}
+	return nil
+}
+
+func TestTokenApproverAccepts(t *testing.T) {
+	_, addr, ca := startServer(t, discard, chat.ServerOptions.TokenApprover(inviteOnly))
+	connect(t, addr, ca, chat.ClientOptions.RegistrationPayload([]byte("open sesame")))
+}
+
+func TestTokenApproverRejects(t *testing.T) {
+	_, addr, ca := startServer(t, discard, chat.ServerOptions.TokenApprover(inviteOnly))
+	for _, pld := range [][]byte{nil, []byte("open sesame!")} {
+		err := dial(t, newClient(t, addr, ca, chat.ClientOptions.RegistrationPayload(pld)))
+		var cerr *chat.CloseError
+		if !errors.As(err, &cerr) || cerr.Code != codes.InvalidToken {
+			t.Errorf("dial with payload %q: %v, want close code %s", pld, err, codes.InvalidToken)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTokenBatch = 100
+	defaultTokenFlush = 250 * time.Millisecond
+	// minFlushBackoff and maxFlushBackoff bound the wait before saving
+	// a batch of tokens again after a failure.
+	minFlushBackoff = 100 * time.Millisecond
+	maxFlushBackoff = 30 * time.Second
+	// tokenFlushTimeout bounds the final flush of a stopping server.
+	tokenFlushTimeout = 5 * time.Second
+)
+
+// TokenBatchSaver is implemented by a TokenRepo able to save many tokens
+// at once, see BatchingTokenRepo. Saving a token twice must succeed.
+type TokenBatchSaver interface {
+	SaveTokens(ctx context.Context, toks [][16]byte) error
+}
+
+// TokenFlush is the Metric of a batch of tokens saved by a BatchingTokenRepo.
+// Err is set if the batch failed, which is retried.
+type TokenFlush struct {
+	Tokens   int
+	Duration time.Duration
+	Err      error
+}
+
+func (TokenFlush) metric() {}
+
+// BatchingTokenRepo is a TokenRepo buffering new tokens and saving them to
+// another repo in batches, e.g. while many clients register at once.
+// A batch is saved once size tokens are buffered or every interval, with
+// SaveTokens if the repo is a TokenBatchSaver. Failed batches are retried
+// with a backoff. Buffered tokens are valid right away. Scopes are
+// buffered with their token. A server running with the repo saves the
+// buffered tokens when it stops, logs failed batches and reports them
+// as TokenFlush metrics.
+type BatchingTokenRepo struct {
+	repo  TokenRepo
+	size  int
+	every time.Duration
+
+	mtx sync.Mutex
+	// pending holds the tokens not saved yet with their scopes,
+	// queue those waiting for a batch in order.
+	pending map[[16]byte][]string
+	queue   [][16]byte
+	running bool
+	full    chan struct{}
+	lgr     Logger
+	metrics MetricsHook
+
+	// fmtx serializes the batches.
+	fmtx sync.Mutex
+}
+
+// NewBatchingTokenRepo wraps repo in batches of size tokens saved at least
+// every interval, 100 tokens and 250ms if zero.
+func NewBatchingTokenRepo(repo TokenRepo, size int, every time.Duration) *BatchingTokenRepo {
+	if size <= 0 {
+		size = defaultTokenBatch
+	}
+	if every <= 0 {
+		every = defaultTokenFlush
+	}
+	return &BatchingTokenRepo{
+		repo:    repo,
+		size:    size,
+		every:   every,
+		pending: make(map[[16]byte][]string),
+		full:    make(chan struct{}, 1),
+		lgr:     NopLogger,
+	}
+}
+
+// SaveToken buffers the token.
+func (r *BatchingTokenRepo) SaveToken(_ context.Context, tok [16]byte) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.pending[tok]; ok {
+		return nil
+	}
+	r.pending[tok] = nil
+	r.queue = append(r.queue, tok)
+	if len(r.queue) >= r.size {
+		select {
+		case r.full <- struct{}{}:
+		default:
+		}
+	}
+	if !r.running {
+		r.running = true
+		go r.run()
+	}
+	return nil
+}
+
+// HasToken reports whether the token is buffered or in the repo.
+func (r *BatchingTokenRepo) HasToken(ctx context.Context, tok [16]byte) (bool, error) {
+	r.mtx.Lock()
+	_, ok := r.pending[tok]
+	r.mtx.Unlock()
+	if ok {
+		return true, nil
+	}
+	return r.repo.HasToken(ctx, tok)
+}
+
+// SaveTokenScopes buffers the scopes of a buffered token, others are saved
+// to the repo. Scopes are dropped if the repo is no ScopedTokenRepo.
+func (r *BatchingTokenRepo) SaveTokenScopes(ctx context.Context, tok [16]byte, scopes []string) error {
+	r.mtx.Lock()
+	if _, ok := r.pending[tok]; ok {
+		r.pending[tok] = scopes
+		r.mtx.Unlock()
+		return nil
+	}
+	r.mtx.Unlock()
+	repo, ok := r.repo.(ScopedTokenRepo)
+	if !ok {
+		r.logger().Warn("token repo cannot store scopes, token saved without them")
+		return nil
+	}
+	return repo.SaveTokenScopes(ctx, tok, scopes)
+}
+
+// TokenScopes returns the scopes of the token, buffered or in the repo.
+func (r *BatchingTokenRepo) TokenScopes(ctx context.Context, tok [16]byte) ([]string, error) {
+	r.mtx.Lock()
+	scopes, ok := r.pending[tok]
+	r.mtx.Unlock()
+	if ok {
+		return scopes, nil
+	}
+	if repo, ok := r.repo.(ScopedTokenRepo); ok {
+		return repo.TokenScopes(ctx, tok)
+	}
+	return nil, nil
+}
+
+// DeleteToken drops the token from the buffer and deletes it from the repo
+// if it is a TokenDeleter. It waits for a batch being saved.
+func (r *BatchingTokenRepo) DeleteToken(ctx context.Context, tok [16]byte) error {
+	r.fmtx.Lock()
+	defer r.fmtx.Unlock()
+	r.mtx.Lock()
+	if _, ok := r.pending[tok]; ok {
+		delete(r.pending, tok)
+		for i, t := range r.queue {
+			if t == tok {
+				r.queue = append(r.queue[:i], r.queue[i+1:]...)
+				break
+			}
+		}
+	}
+	r.mtx.Unlock()
+	if repo, ok := r.repo.(TokenDeleter); ok {
+		return repo.DeleteToken(ctx, tok)
+	}
+	return nil
+}
+
+// Buffered returns the number of tokens not saved to the repo yet.
+func (r *BatchingTokenRepo) Buffered() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return len(r.pending)
+}
+
+// Flush saves the buffered tokens to the repo now.
+func (r *BatchingTokenRepo) Flush(ctx context.Context) error {
+	for r.queued() > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := r.flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queued returns the number of tokens waiting for a batch.
+func (r *BatchingTokenRepo) queued() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return len(r.queue)
+}
+
+// attach reports the batches to a server running with the repo.
+func (r *BatchingTokenRepo) attach(lgr Logger, metrics MetricsHook) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.lgr, r.metrics = lgr.With("module", "token-batch"), metrics
+}
+
+func (r *BatchingTokenRepo) logger() Logger {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.lgr
+}
+
+// run saves batches until no token is left, retrying failed ones.
+func (r *BatchingTokenRepo) run() {
+	var backoff time.Duration
+	timer := time.NewTimer(r.every)
+	defer timer.Stop()
+	full := r.full
+	for {
+		select {
+		case <-timer.C:
+		case <-full:
+		}
+		if err := r.flush(context.Background()); err != nil {
+			backoff = min(max(backoff*2, minFlushBackoff), maxFlushBackoff)
+			backoff += rand.N(backoff/4 + 1)
+			r.logger().With("error", err, "retry", backoff).Warn("failed to save token batch")
+			// a full buffer does not cut the backoff short
+			full = nil
+			timer.Reset(backoff)
+			continue
+		}
+		backoff, full = 0, r.full
+		r.mtx.Lock()
+		n := len(r.queue)
+		if n == 0 {
+			r.running = false
+		}
+		r.mtx.Unlock()
+		switch {
+		case n == 0:
+			return
+		case n >= r.size:
+			timer.Reset(0)
+		default:
+			timer.Reset(r.every)
+		}
+	}
+}
+
+// flush saves the next batch of queued tokens, queuing them again on failure.
+func (r *BatchingTokenRepo) flush(ctx context.Context) error {
+	r.fmtx.Lock()
+	defer r.fmtx.Unlock()
+	r.mtx.Lock()
+	n := min(len(r.queue), r.size)
+	batch := slices.Clone(r.queue[:n])
+	r.queue = r.queue[n:]
+	scopes := make(map[[16]byte][]string)
+	for _, tok := range batch {
+		if s := r.pending[tok]; len(s) > 0 {
+			scopes[tok] = s
+		}
+	}
+	metrics := r.metrics
+	r.mtx.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	err := r.save(ctx, batch, scopes)
+	if metrics != nil {
+		metrics(TokenFlush{Tokens: len(batch), Duration: time.Since(start), Err: err})
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if err != nil {
+		r.queue = append(batch, r.queue...)
+		if !r.running {
+			// failed in Flush, retry in the background
+			r.running = true
+			go r.run()
+		}
+		return err
+	}
+	for _, tok := range batch {
+		delete(r.pending, tok)
+	}
+	return nil
+}
+
+// save saves the tokens and their scopes to the repo.
+func (r *BatchingTokenRepo) save(ctx context.Context, toks [][16]byte, scopes map[[16]byte][]string) error {
+	if repo, ok := r.repo.(TokenBatchSaver); ok {
+		if err := repo.SaveTokens(ctx, toks); err != nil {
+			return err
+		}
+	} else {
+		for _, tok := range toks {
+			if err := r.repo.SaveToken(ctx, tok); err != nil {
+				return err
+			}
+		}
+	}
+	if len(scopes) == 0 {
+		return nil
+	}
+	repo, ok := r.repo.(ScopedTokenRepo)
+	if !ok {
+		r.logger().Warn("token repo cannot store scopes, tokens saved without them")
+		return nil
+	}
+	var errs []error
+	for tok, s := range scopes {
+		errs = append(errs, repo.SaveTokenScopes(ctx, tok, s))
+	}
+	return errors.Join(errs...)
+}
+
+// flushTokens saves the tokens buffered by a BatchingTokenRepo,
+// with tokenFlushTimeout more once ctx is done.
+func (s *Server) flushTokens(ctx context.Context) error {
+	repo, ok := s.cfg.tokenRepo.(*BatchingTokenRepo)
+	if !ok {
+		return nil
+	}
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.WithoutCancel(ctx), tokenFlushTimeout)
+		defer cancel()
+	}
+	if err := repo.Flush(ctx); err != nil {
+		return fmt.Errorf("failed to save buffered tokens: %w", err)
+	}
+	return nil
+}
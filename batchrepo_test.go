@@ -0,0 +1,160 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+)
+
+// batchSaver is a TokenBatchSaver recording its batches,
+// failing the first fails of them.
+type batchSaver struct {
+	chattest.TokenRepo
+	mtx     sync.Mutex
+	fails   int
+	batches [][][16]byte
+}
+
+func (r *batchSaver) SaveTokens(ctx context.Context, toks [][16]byte) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.fails > 0 {
+		r.fails--
+		return errors.New("store unavailable")
+	}
+	r.batches = append(r.batches, slices.Clone(toks))
+	for _, tok := range toks {
+		if err := r.TokenRepo.SaveToken(ctx, tok); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sizes returns the sizes of the batches saved.
+func (r *batchSaver) sizes() []int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	var sizes []int
+	for _, b := range r.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+func TestBatchingTokenRepoReadYourWrites(t *testing.T) {
+	backend := new(batchSaver)
+	repo := chat.NewBatchingTokenRepo(backend, 0, time.Hour)
+	_, addr, ca := startServer(t, discard, chat.ServerOptions.TokenRepo(repo))
+	tokenFile := sharedToken(t)
+	tok, err := connect(t, addr, ca, tokenFile).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := repo.Buffered(); n != 1 {
+		t.Fatalf("%d tokens buffered, want 1", n)
+	}
+	if has, _ := backend.HasToken(context.Background(), tok); has {
+		t.Fatal("token saved before a batch")
+	}
+	// the buffered token authenticates right away
+	again, err := connect(t, addr, ca, tokenFile).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != tok {
+		t.Errorf("logged in with %x, want the buffered %x", again, tok)
+	}
+}
+
+func TestBatchingTokenRepoTriggers(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		size  int
+		every time.Duration
+		saved int
+		// the batches saved and the tokens left buffered
+		want     []int
+		buffered int
+	}{
+		{"size", 3, time.Hour, 7, []int{3, 3}, 1},
+		{"interval", 100, 20 * time.Millisecond, 2, []int{2}, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := new(batchSaver)
+			repo := chat.NewBatchingTokenRepo(backend, tt.size, tt.every)
+			for i := range tt.saved {
+				if err := repo.SaveToken(context.Background(), [16]byte{byte(i + 1)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			eventually(t, func() bool { return slices.Equal(backend.sizes(), tt.want) })
+			// a partial batch waits for the interval
+			time.Sleep(10 * time.Millisecond)
+			if sizes := backend.sizes(); !slices.Equal(sizes, tt.want) {
+				t.Errorf("batches of %v, want %v", sizes, tt.want)
+			}
+			if n := repo.Buffered(); n != tt.buffered {
+				t.Errorf("%d tokens left buffered, want %d", n, tt.buffered)
+			}
+		})
+	}
+}
+
+func TestBatchingTokenRepoRetry(t *testing.T) {
+	backend := &batchSaver{fails: 2}
+	repo := chat.NewBatchingTokenRepo(backend, 1, time.Hour)
+	flushes := make(chan chat.TokenFlush, 4)
+	var rec recorder
+	_, addr, ca := startServer(t, discard,
+		chat.ServerOptions.TokenRepo(repo),
+		chat.ServerOptions.Logger(rec.log),
+		chat.ServerOptions.Metrics(func(m chat.Metric) {
+			if f, ok := m.(chat.TokenFlush); ok {
+				flushes <- f
+			}
+		}))
+	connect(t, addr, ca)
+
+	for i := range 3 {
+		f := receive(t, flushes)
+		if (f.Err != nil) != (i < 2) || f.Tokens != 1 {
+			t.Errorf("flush %d of %d tokens failed with %v", i, f.Tokens, f.Err)
+		}
+	}
+	if sizes := backend.sizes(); !slices.Equal(sizes, []int{1}) {
+		t.Errorf("batches of %v, want one token saved", sizes)
+	}
+	eventually(t, func() bool { return repo.Buffered() == 0 })
+	warned := 0
+	for _, l := range rec.recorded() {
+		if l.lvl == chat.LogLevelWarn && l.msg == "failed to save token batch" {
+			warned++
+		}
+	}
+	if warned != 2 {
+		t.Errorf("%d failed batches logged, want 2", warned)
+	}
+}
+
+func TestBatchingTokenRepoShutdown(t *testing.T) {
+	backend := new(batchSaver)
+	repo := chat.NewBatchingTokenRepo(backend, 0, time.Hour)
+	srv, addr, ca := startServer(t, discard, chat.ServerOptions.TokenRepo(repo))
+	tok, err := connect(t, addr, ca).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Shutdown(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := backend.HasToken(context.Background(), tok); !has || repo.Buffered() != 0 {
+		t.Errorf("token saved by the shutdown: %v, %d left buffered", has, repo.Buffered())
+	}
+}
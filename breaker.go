@@ -0,0 +1,189 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultBreakerFailures is the number of consecutive TokenRepo
+	// failures opening the circuit.
+	defaultBreakerFailures = 5
+	// defaultBreakerCooldown is how long the circuit stays open
+	// before a handshake probes the TokenRepo again.
+	defaultBreakerCooldown = 10 * time.Second
+)
+
+// ErrAuthUnavailable is returned by handshakes short-circuited while
+// the TokenRepo is failing, see ServerOptions.TokenRepoBreaker.
+// The connection is closed with codes.Internal.
+var ErrAuthUnavailable = errors.New("auth backend unavailable")
+
+// BreakerState is the state of the circuit breaker around the TokenRepo.
+type BreakerState int8
+
+const (
+	// BreakerClosed lets handshakes call the TokenRepo.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen short-circuits handshakes without calling the TokenRepo.
+	BreakerOpen
+	// BreakerHalfOpen lets a single handshake probe the TokenRepo,
+	// closing the circuit if it succeeds and opening it again if not.
+	BreakerHalfOpen
+)
+
+func (b BreakerState) String() string {
+	switch b {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerTransition is the Metric of the circuit breaker
+// around the TokenRepo changing its state.
+type BreakerTransition struct {
+	From, To BreakerState
+}
+
+func (BreakerTransition) metric() {}
+
+// TokenRepoBreaker sets how many consecutive TokenRepo failures open the
+// circuit, 5 by default, and how long it stays open, 10s by default.
+// While it is open, handshakes needing the TokenRepo fail right away
+// with a notice and codes.Internal instead of adding to the load of
+// a failing store. Zero failures disable the breaker.
+func (serverOptionsNamespace) TokenRepoBreaker(failures int, cooldown time.Duration) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.breakerFailures = failures
+		cfg.breakerCooldown = cooldown
+	}
+}
+
+// breaker is a circuit breaker counting consecutive failures.
+type breaker struct {
+	failures int
+	cooldown time.Duration
+	now      func() time.Time
+	changed  func(from, to BreakerState)
+
+	mtx    sync.Mutex
+	state  BreakerState
+	failed int
+	opened time.Time
+	// probing is set while the probe of the half-open circuit runs.
+	probing bool
+}
+
+// allow reports whether a call may go through, ErrAuthUnavailable if not.
+// Once the cooldown has passed the first caller probes the half-open circuit.
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.opened) < b.cooldown {
+			return ErrAuthUnavailable
+		}
+		b.set(BreakerHalfOpen)
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrAuthUnavailable
+		}
+	default:
+		return nil
+	}
+	b.probing = true
+	return nil
+}
+
+// done records the outcome of a call let through by allow.
+// Calls abandoned by the client are neither failures nor successes.
+func (b *breaker) done(err error) {
+	if b == nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.probing = false
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+	case err == nil:
+		b.failed = 0
+		if b.state != BreakerClosed {
+			b.set(BreakerClosed)
+		}
+	default:
+		b.failed++
+		if b.state == BreakerHalfOpen || b.failed >= b.failures {
+			b.opened = b.now()
+			if b.state != BreakerOpen {
+				b.set(BreakerOpen)
+			}
+		}
+	}
+}
+
+// set changes the state. The caller holds the mutex.
+func (b *breaker) set(to BreakerState) {
+	from := b.state
+	b.state = to
+	b.changed(from, to)
+}
+
+// newBreaker creates the breaker around the TokenRepo, nil if disabled.
+func (s *Server) newBreaker() *breaker {
+	if s.cfg.breakerFailures == 0 {
+		return nil
+	}
+	return &breaker{
+		failures: s.cfg.breakerFailures,
+		cooldown: s.cfg.breakerCooldown,
+		now:      s.cfg.src.Now,
+		changed: func(from, to BreakerState) {
+			lgr := s.cfg.logger.With("from", from, "to", to)
+			if to == BreakerOpen {
+				lgr.Error("token repo failing, short-circuiting handshakes")
+			} else {
+				lgr.Warn("token repo circuit changed")
+			}
+			s.metric(BreakerTransition{From: from, To: to})
+		},
+	}
+}
+
+// hasToken calls HasToken of the TokenRepo through the breaker.
+func (s *Server) hasToken(ctx context.Context, tok [16]byte) (bool, error) {
+	if err := s.breaker.allow(); err != nil {
+		return false, err
+	}
+	has, err := s.cfg.tokenRepo.HasToken(ctx, tok)
+	s.breaker.done(err)
+	if err != nil {
+		return false, fmt.Errorf("failed to check token: %w", err)
+	}
+	return has, nil
+}
+
+// saveToken calls SaveToken of the TokenRepo through the breaker.
+func (s *Server) saveToken(ctx context.Context, tok [16]byte) error {
+	if err := s.breaker.allow(); err != nil {
+		return err
+	}
+	err := s.cfg.tokenRepo.SaveToken(ctx, tok)
+	s.breaker.done(err)
+	if err != nil {
+		return fmt.Errorf("failed to save token: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package chat_test
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+	"github.com/zhmlst/chat/codes"
+)
+
+// flakyRepo is a TokenRepo failing while down, counting its calls.
+type flakyRepo struct {
+	chattest.TokenRepo
+	down  atomic.Bool
+	calls atomic.Int64
+}
+
+var errRepoDown = errors.New("repo down")
+
+func (r *flakyRepo) SaveToken(ctx context.Context, tok [16]byte) error {
+	r.calls.Add(1)
+	if r.down.Load() {
+		return errRepoDown
+	}
+	return r.TokenRepo.SaveToken(ctx, tok)
+}
+
+func (r *flakyRepo) HasToken(ctx context.Context, tok [16]byte) (bool, error) {
+	r.calls.Add(1)
+	if r.down.Load() {
+		return false, errRepoDown
+	}
+	return r.TokenRepo.HasToken(ctx, tok)
+}
+
+func TestTokenRepoBreaker(t *testing.T) {
+	repo := &flakyRepo{}
+	repo.down.Store(true)
+	clk := &manualClock{now: time.Now()}
+	var (
+		mtx         sync.Mutex
+		transitions []chat.BreakerTransition
+	)
+	_, addr, ca := startServer(t, discard,
+		chat.ServerOptions.TokenRepo(repo),
+		chat.ServerOptions.TokenRepoBreaker(2, 10*time.Second),
+		chat.ServerOptions.Source(chat.Source{Rand: rand.Reader, Now: clk.Now}),
+		chat.ServerOptions.Metrics(func(m chat.Metric) {
+			if tr, ok := m.(chat.BreakerTransition); ok {
+				mtx.Lock()
+				transitions = append(transitions, tr)
+				mtx.Unlock()
+			}
+		}))
+	login := func() error {
+		t.Helper()
+		return dial(t, newClient(t, addr, ca))
+	}
+	want := func(calls int64, states ...chat.BreakerState) {
+		t.Helper()
+		var got []chat.BreakerState
+		mtx.Lock()
+		for _, tr := range transitions {
+			got = append(got, tr.To)
+		}
+		mtx.Unlock()
+		if !slices.Equal(got, states) || repo.calls.Load() != calls {
+			t.Fatalf("transitions to %v after %d calls, want %v after %d", got, repo.calls.Load(), states, calls)
+		}
+	}
+
+	// consecutive failures open the circuit
+	for range 2 {
+		if err := login(); err == nil {
+			t.Fatal("logged in with the repo down")
+		}
+	}
+	want(2, chat.BreakerOpen)
+	// short-circuited without calling the repo
+	var cerr *chat.CloseError
+	if err := login(); !errors.As(err, &cerr) || cerr.Code != codes.Internal || cerr.Detail != chat.ErrAuthUnavailable.Error() {
+		t.Fatalf("login while open: %v, want closed as auth unavailable", err)
+	}
+	want(2, chat.BreakerOpen)
+
+	// a failed probe opens it again
+	clk.Add(11 * time.Second)
+	if err := login(); err == nil {
+		t.Fatal("logged in with the repo down")
+	}
+	want(3, chat.BreakerOpen, chat.BreakerHalfOpen, chat.BreakerOpen)
+
+	// and a successful one closes it
+	repo.down.Store(false)
+	if err := login(); err == nil {
+		t.Fatal("logged in before the cooldown passed")
+	}
+	clk.Add(11 * time.Second)
+	if err := login(); err != nil {
+		t.Fatalf("login after recovery: %v", err)
+	}
+	want(6, chat.BreakerOpen, chat.BreakerHalfOpen, chat.BreakerOpen, chat.BreakerHalfOpen, chat.BreakerClosed)
+}
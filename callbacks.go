@@ -0,0 +1,130 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// defaultCallbackPanics is the default CallbackPanicLimit.
+const defaultCallbackPanics = 3
+
+var (
+	// ErrCallbackPanic is returned in place of the result of a user
+	// callback which panicked, such as a MessageFilter.
+	ErrCallbackPanic = errors.New("callback panicked")
+
+	// ErrCallbackDisabled is returned in place of the result of a user
+	// callback disabled for the session, see SessionOptions.CallbackPanicLimit.
+	ErrCallbackDisabled = errors.New("callback disabled")
+)
+
+// CallbackPanic is the Metric of a panic recovered from a user callback,
+// named by Callback, e.g. "inbound filter" or "access log". Session is
+// nil for callbacks not called for a session. Disabled is set if the
+// callback is disabled for the session from now on.
+type CallbackPanic struct {
+	Session  *Session
+	Callback string
+	Disabled bool
+}
+
+func (CallbackPanic) metric() {}
+
+// CallbackPanicLimit disables a user callback for the session once it
+// panicked limit times, 3 by default, zero never disables it. Panics of
+// callbacks, such as filters, hooks and the OnMessage and OnEvent
+// functions of a client, are recovered and logged with their stack.
+// A filter which panicked or is disabled drops the message, the result
+// of other callbacks is skipped.
+func (sessionOptionsNamespace) CallbackPanicLimit(limit int) SessionOption {
+	return func(s *Session) {
+		s.cbs.limit = limit
+	}
+}
+
+// callbacks counts the panics of the user callbacks of a session by name.
+type callbacks struct {
+	mtx    sync.Mutex
+	limit  int
+	panics map[string]int
+}
+
+// disabled reports whether the callback panicked too often.
+func (c *callbacks) disabled(name string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.limit > 0 && c.panics[name] >= c.limit
+}
+
+// panicked counts a panic of the callback, returning the number of its
+// panics and whether it is disabled by this one.
+func (c *callbacks) panicked(name string) (int, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.panics == nil {
+		c.panics = make(map[string]int)
+	}
+	c.panics[name]++
+	n := c.panics[name]
+	return n, c.limit > 0 && n == c.limit
+}
+
+// guard calls fn, the user callback named name, unless it is disabled.
+// A panic in fn is recovered and returned as ErrCallbackPanic.
+func (s *Session) guard(name string, fn func() error) (err error) {
+	if s.cbs.disabled(name) {
+		return fmt.Errorf("%w: %s", ErrCallbackDisabled, name)
+	}
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		n, disabled := s.cbs.panicked(name)
+		lgr := s.lgr.With("callback", name, "panics", n)
+		logPanic(lgr, r)
+		if disabled {
+			lgr.Error("callback keeps panicking, disabled for the session")
+		}
+		if s.srv != nil {
+			s.srv.callbackPanicked(CallbackPanic{Session: s, Callback: name, Disabled: disabled})
+		}
+		err = fmt.Errorf("%w: %s: %v", ErrCallbackPanic, name, r)
+	}()
+	return fn()
+}
+
+// guard calls fn, the user callback named name not called for a session.
+// A panic in fn is recovered and returned as ErrCallbackPanic.
+func (s *Server) guard(name string, fn func() error) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		logPanic(s.cfg.logger.With("callback", name), r)
+		s.callbackPanicked(CallbackPanic{Callback: name})
+		err = fmt.Errorf("%w: %s: %v", ErrCallbackPanic, name, r)
+	}()
+	return fn()
+}
+
+// logPanic logs the value recovered from a panic with the stack
+// of the panicking goroutine.
+func logPanic(lgr Logger, r any) {
+	stack := debug.Stack()
+	lgr.With("panic", r, "stack", string(stack[:min(len(stack), maxLoggedStack)])).Error("panic in callback")
+}
+
+// callbackPanicked counts the panic in Stats.CallbackPanics and reports
+// it, unless the MetricsHook itself panicked.
+func (s *Server) callbackPanicked(p CallbackPanic) {
+	s.mtx.Lock()
+	s.callbackPanics++
+	s.mtx.Unlock()
+	if p.Callback != metricsCallback {
+		s.metric(p)
+	}
+}
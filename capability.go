@@ -0,0 +1,202 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Names of the built-in capabilities, offered by every server and client
+// unless disabled with DisableCapabilities.
+const (
+	// CapChannels is the capability of channels other than 0, see Session.Channel.
+	CapChannels = "channels"
+	// CapE2E is the capability of end-to-end encryption, see Session.SendEncrypted.
+	CapE2E = "e2e"
+	// CapHeartbeat is the capability of heartbeats, offered only when enabled,
+	// with the interval and timeout in milliseconds as parameters.
+	CapHeartbeat = "heartbeat"
+	// CapLoginHints is the capability of hints telling the client whether to
+	// retry a login with a token unknown to the server, see ClientOptions.LoginRetry.
+	CapLoginHints = "login-hints"
+	// CapMetadata is the capability of payload metadata, see Message.SetContentType.
+	// Messages are sent to a peer without it without their metadata.
+	CapMetadata = "metadata"
+)
+
+// ErrNoCapability is returned when using a feature the peer does not support.
+var ErrNoCapability = errors.New("capability not supported by peer")
+
+// Capability is an optional feature offered in the handshake. Both sides
+// offer their capabilities, the ones offered by both are negotiated, with
+// the parameters of the server. Names, keys and values must not contain
+// whitespace, ';' or '=', and names and keys must not be empty.
+type Capability struct {
+	Name   string
+	Params map[string]string
+}
+
+// field formats the capability as a handshake argument:
+// the name prefixed by '+' followed by ";key=value" parameters.
+func (c Capability) field() string {
+	var b strings.Builder
+	b.WriteString("+" + c.Name)
+	for _, k := range slices.Sorted(maps.Keys(c.Params)) {
+		b.WriteString(";" + k + "=" + c.Params[k])
+	}
+	return b.String()
+}
+
+// parseCapability parses a handshake argument made by Capability.field.
+func parseCapability(field string) (c Capability, ok bool) {
+	raw, ok := strings.CutPrefix(field, "+")
+	if !ok {
+		return c, false
+	}
+	name, rest, _ := strings.Cut(raw, ";")
+	c.Name = name
+	if rest != "" {
+		c.Params = make(map[string]string)
+		for kv := range strings.SplitSeq(rest, ";") {
+			if k, v, _ := strings.Cut(kv, "="); k != "" {
+				c.Params[k] = v
+			}
+		}
+	}
+	return c, name != ""
+}
+
+// validate checks the capability configured with a Capabilities option.
+func (c Capability) validate(p *problems) {
+	const reserved = " \t\r\n;="
+	p.check(c.Name == "" || strings.ContainsAny(c.Name, reserved), "capability name %q is invalid", c.Name)
+	for k, v := range c.Params {
+		p.check(k == "" || strings.ContainsAny(k, reserved) || strings.ContainsAny(v, reserved),
+			"capability %s parameter %q=%q is invalid", c.Name, k, v)
+	}
+}
+
+// offer returns the built-in capabilities not disabled, followed by extra.
+func offer(hb heartbeat, limit int, extra []Capability, disabled []string) []Capability {
+	caps := []Capability{{Name: CapChannels}, {Name: CapE2E}, {Name: CapLoginHints}, {Name: CapMetadata}}
+	if hb.enabled() {
+		caps = append(caps, hb.capability())
+	}
+	caps = append(caps, payloadCapability(limit)...)
+	caps = slices.DeleteFunc(caps, func(c Capability) bool { return slices.Contains(disabled, c.Name) })
+	return append(caps, extra...)
+}
+
+// capabilities are the negotiated capabilities of a session
+// and their parameters keyed by name.
+type capabilities map[string]map[string]string
+
+// intersect returns the capabilities of b also offered in a,
+// with the parameters of b.
+func intersect(a, b []Capability) capabilities {
+	caps := make(capabilities)
+	for _, c := range b {
+		if slices.ContainsFunc(a, func(o Capability) bool { return o.Name == c.Name }) {
+			caps[c.Name] = c.Params
+		}
+	}
+	return caps
+}
+
+// list returns the capabilities sorted by name.
+func (caps capabilities) list() []Capability {
+	list := make([]Capability, 0, len(caps))
+	for _, name := range slices.Sorted(maps.Keys(caps)) {
+		list = append(list, Capability{Name: name, Params: caps[name]})
+	}
+	return list
+}
+
+// heartbeat returns the negotiated heartbeat, if any.
+func (caps capabilities) heartbeat() heartbeat {
+	params, ok := caps[CapHeartbeat]
+	if !ok {
+		return heartbeat{}
+	}
+	hb, _ := parseHeartbeat(params["interval"], params["timeout"])
+	return hb
+}
+
+// Capabilities offers application defined capabilities to clients besides
+// the built-in ones. The parameters of the server are the negotiated ones.
+func (serverOptionsNamespace) Capabilities(caps ...Capability) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.caps = append(cfg.caps, caps...)
+	}
+}
+
+// DisableCapabilities stops offering the built-in capabilities with the
+// given names, which turns their features off for all sessions.
+func (serverOptionsNamespace) DisableCapabilities(names ...string) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.noCaps = append(cfg.noCaps, names...)
+	}
+}
+
+// Capabilities offers application defined capabilities to the server
+// besides the built-in ones.
+func (clientOptionsNamespace) Capabilities(caps ...Capability) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.caps = append(cfg.caps, caps...)
+	}
+}
+
+// DisableCapabilities stops offering the built-in capabilities with the
+// given names, which turns their features off for the client.
+func (clientOptionsNamespace) DisableCapabilities(names ...string) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.noCaps = append(cfg.noCaps, names...)
+	}
+}
+
+// HasCapability reports whether the capability was negotiated in the
+// handshake. Sessions whose capabilities were not negotiated, e.g. made
+// by NewSession or connected to a peer predating the exchange, have none.
+func (s *Session) HasCapability(name string) bool {
+	_, ok := s.caps[name]
+	return ok
+}
+
+// CapabilityParam returns the parameter of a negotiated capability.
+func (s *Session) CapabilityParam(name, key string) (string, bool) {
+	v, ok := s.caps[name][key]
+	return v, ok
+}
+
+// Capabilities returns the names of the negotiated capabilities, sorted.
+func (s *Session) Capabilities() []string {
+	return slices.Sorted(maps.Keys(s.caps))
+}
+
+// supports checks that the peer supports the built-in capability before
+// its feature is used. Without a negotiation the peer is assumed to.
+func (s *Session) supports(name string) error {
+	if s.caps == nil || s.HasCapability(name) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrNoCapability, name)
+}
+
+// HasCapability reports whether the capability was negotiated for the
+// active session, false when the client is not connected.
+func (c *Client) HasCapability(name string) bool {
+	session, err := c.activeSession()
+	return err == nil && session.HasCapability(name)
+}
+
+// CapabilityParam returns the parameter of a capability negotiated
+// for the active session.
+func (c *Client) CapabilityParam(name, key string) (string, bool) {
+	session, err := c.activeSession()
+	if err != nil {
+		return "", false
+	}
+	return session.CapabilityParam(name, key)
+}
@@ -0,0 +1,98 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestCapabilitiesIntersect(t *testing.T) {
+	sessions := make(chan *chat.Session, 1)
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		sessions <- s
+		discard(ctx, s)
+	},
+		chat.ServerOptions.Capabilities(
+			chat.Capability{Name: "shared", Params: map[string]string{"v": "server"}},
+			chat.Capability{Name: "server-only"},
+		),
+		chat.ServerOptions.DisableCapabilities(chat.CapChannels),
+	)
+	c := connect(t, addr, ca,
+		chat.ClientOptions.Capabilities(
+			chat.Capability{Name: "shared", Params: map[string]string{"v": "client"}},
+			chat.Capability{Name: "client-only"},
+		),
+		chat.ClientOptions.DisableCapabilities(chat.CapE2E),
+	)
+	s := receive(t, sessions)
+
+	// both ends agree on the capabilities offered by both
+	want := []string{chat.CapLoginHints, chat.CapMaxPayload, chat.CapMetadata, "shared"}
+	if got := s.Capabilities(); !slices.Equal(got, want) {
+		t.Errorf("server capabilities %q, want %q", got, want)
+	}
+	for _, name := range []string{"server-only", "client-only", chat.CapChannels, chat.CapE2E} {
+		if s.HasCapability(name) || c.HasCapability(name) {
+			t.Errorf("%s negotiated", name)
+		}
+	}
+	for _, name := range want {
+		if !c.HasCapability(name) {
+			t.Errorf("client lacks %s", name)
+		}
+	}
+	// with the parameters of the server
+	if v, _ := s.CapabilityParam("shared", "v"); v != "server" {
+		t.Errorf("server parameter %q, want server", v)
+	}
+	if v, _ := c.CapabilityParam("shared", "v"); v != "server" {
+		t.Errorf("client parameter %q, want server", v)
+	}
+
+	// features of capabilities not negotiated are off
+	if err := c.AnnounceKey(t.Context()); !errors.Is(err, chat.ErrNoCapability) {
+		t.Errorf("announce key: %v, want ErrNoCapability", err)
+	}
+}
+
+func TestCapabilityDisablesFeature(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		opts     []chat.ClientOption
+		wantType string
+	}{
+		{"negotiated", nil, "image/png"},
+		{"absent", []chat.ClientOption{chat.ClientOptions.DisableCapabilities(chat.CapMetadata)}, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions := make(chan *chat.Session, 1)
+			_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+				sessions <- s
+				discard(ctx, s)
+			})
+			got := make(chan *chat.Message, 1)
+			connect(t, addr, ca, append(tt.opts, chat.ClientOptions.OnMessage(func(m *chat.Message) {
+				if m.Type == chat.MsgTypeBinary {
+					got <- m
+				}
+			}))...)
+			s := receive(t, sessions)
+
+			m := chat.NewBinaryMessage([]byte("png"))
+			if err := m.SetContentType("image/png"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Send(t.Context(), m); err != nil {
+				t.Fatal(err)
+			}
+			// sent without its metadata rather than dropped by the peer
+			if m := receive(t, got); m.ContentType() != tt.wantType || string(m.Payload) != "png" {
+				t.Errorf("received %q of type %q, want type %q", m.Payload, m.ContentType(), tt.wantType)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/zhmlst/chat/codes"
+)
+
+// ErrChannelClosed is returned when sending on a closed channel.
+var ErrChannelClosed = errors.New("channel closed")
+
+// Channel is a logical stream of messages multiplexed over a session.
+// Frames without a channel ID belong to channel 0, which is the session
+// itself, so peers unaware of channels keep working.
+type Channel struct {
+	id      uint16
+	session *Session
+	in      chan *Message
+	closed  bool
+}
+
+// Channel returns the channel with the given ID, opening it if needed.
+// Channel messages are picked out of the stream by the session's Recv,
+// so somebody must be receiving messages for them to arrive. Messages
+// that do not fit in the channel buffer are dropped and counted,
+// see Session.Stats.
+func (s *Session) Channel(id uint16) *Channel {
+	s.chmtx.Lock()
+	defer s.chmtx.Unlock()
+	return s.openChannel(id)
+}
+
+// SetAutoOpenChannels sets whether messages of channels not opened
+// by Channel open them. Otherwise the session drops such messages
+// and replies with an error notice. It is disabled by default.
+func (s *Session) SetAutoOpenChannels(on bool) {
+	s.chmtx.Lock()
+	defer s.chmtx.Unlock()
+	s.autoOpen = on
+}
+
+func (s *Session) openChannel(id uint16) *Channel {
+	if ch, ok := s.chans[id]; ok {
+		return ch
+	}
+	ch := &Channel{id: id, session: s}
+	if id != 0 {
+		ch.in = make(chan *Message, chansz)
+	}
+	if s.chans == nil {
+		s.chans = make(map[uint16]*Channel)
+	}
+	s.chans[id] = ch
+	return ch
+}
+
+// ID returns the channel ID.
+func (c *Channel) ID() uint16 {
+	return c.id
+}
+
+// Send writes the message to the channel.
+func (c *Channel) Send(ctx context.Context, m *Message) error {
+	c.session.chmtx.Lock()
+	closed := c.closed
+	c.session.chmtx.Unlock()
+	if closed {
+		return ErrChannelClosed
+	}
+	if c.id != 0 {
+		if err := c.session.supports(CapChannels); err != nil {
+			return err
+		}
+	}
+	m.Channel = c.id
+	return c.session.Send(ctx, m)
+}
+
+// Recv returns the next message of the channel. Once the channel
+// is closed by either side and its buffer is drained, it returns io.EOF.
+func (c *Channel) Recv(ctx context.Context) (*Message, error) {
+	if c.id == 0 {
+		return c.session.Recv(ctx)
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case m, ok := <-c.in:
+		if !ok {
+			return nil, io.EOF
+		}
+		return m, nil
+	}
+}
+
+// Close closes the channel and tells the peer to close it as well.
+// Channel 0 is the session itself and is closed with Session.Close.
+func (c *Channel) Close() error {
+	if c.id == 0 {
+		return c.session.Close()
+	}
+	if !c.session.closeChannel(c.id) {
+		return ErrChannelClosed
+	}
+	return c.session.control([]byte("chclose " + strconv.FormatUint(uint64(c.id), 10)))
+}
+
+// closeChannel closes the channel with the given ID and reports whether it was open.
+func (s *Session) closeChannel(id uint16) bool {
+	s.chmtx.Lock()
+	defer s.chmtx.Unlock()
+	ch, ok := s.chans[id]
+	if !ok || ch.closed {
+		return false
+	}
+	ch.closed = true
+	close(ch.in)
+	delete(s.chans, id)
+	return true
+}
+
+// channelClosed handles the peer closing a channel.
+func (s *Session) channelClosed(m *Message) bool {
+	arg, ok := bytes.CutPrefix(m.Payload, []byte("chclose "))
+	if m.Type != MsgTypeControl || !ok {
+		return false
+	}
+	id, err := strconv.ParseUint(string(arg), 10, 16)
+	if err != nil || id == 0 {
+		s.lgr.With("payload", string(m.Payload)).Warn("invalid channel close")
+		s.protocolViolation(fmt.Errorf("%w: channel close %q", ErrMalformedFrame, arg))
+		return true
+	}
+	s.closeChannel(uint16(id))
+	return true
+}
+
+// routeChannel queues a message received on a channel other than 0.
+func (s *Session) routeChannel(ctx context.Context, m *Message) {
+	lgr := s.lgr.With("channel", m.Channel)
+	s.chmtx.Lock()
+	ch, ok := s.chans[m.Channel]
+	if !ok && s.autoOpen {
+		ch, ok = s.openChannel(m.Channel), true
+	}
+	if ok {
+		select {
+		case ch.in <- m:
+		default:
+			s.dropped(DropChannel)
+		}
+	}
+	s.chmtx.Unlock()
+	if ok {
+		return
+	}
+	lgr.Warn("message for unopened channel")
+	if err := s.SendError(ctx, codes.PolicyViolation, "unknown_channel", strconv.FormatUint(uint64(m.Channel), 10)); err != nil {
+		lgr.With("error", err).Error("failed to send error")
+	}
+}
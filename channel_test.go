@@ -0,0 +1,62 @@
+package chat_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestChannelsInterleaved(t *testing.T) {
+	// within the channel buffers, so that none is dropped
+	const n = 12
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		if s.Label() != "lanes" {
+			discard(ctx, s)
+			return
+		}
+		// echo every message on the channel it came on
+		for _, ch := range []*chat.Channel{s.Channel(1), s.Channel(2)} {
+			go func() {
+				for {
+					m, err := ch.Recv(ctx)
+					if err != nil {
+						return
+					}
+					if err := ch.Send(ctx, chat.NewTextMessage(m.Payload)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		discard(ctx, s)
+	})
+	c := connect(t, addr, ca)
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	s, err := c.NewSession(ctx, "lanes")
+	if err != nil {
+		t.Fatalf("new session: %v", err)
+	}
+	chans := []*chat.Channel{s.Channel(1), s.Channel(2)}
+	go discard(ctx, s)
+
+	for i := range n {
+		ch := chans[i%2]
+		if err := ch.Send(ctx, chat.NewTextMessage(fmt.Appendf(nil, "%d", i))); err != nil {
+			t.Fatalf("send on %d: %v", ch.ID(), err)
+		}
+	}
+	for j, ch := range chans {
+		for i := j; i < n; i += 2 {
+			m, err := ch.Recv(ctx)
+			if err != nil {
+				t.Fatalf("recv on %d: %v", ch.ID(), err)
+			}
+			if want := fmt.Sprint(i); string(m.Payload) != want || m.Channel != ch.ID() {
+				t.Errorf("channel %d received %q on %d, want %q", ch.ID(), m.Payload, m.Channel, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Package chattest provides utilities for testing code built on chat.
+package chattest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+// counter is a reader yielding consecutive byte values.
+type counter struct {
+	mtx sync.Mutex
+	n   byte
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for i := range p {
+		c.n++
+		p[i] = c.n
+	}
+	return len(p), nil
+}
+
+// clock returns start and then moves forward by step on every call.
+type clock struct {
+	mtx  sync.Mutex
+	now  time.Time
+	step time.Duration
+}
+
+func (c *clock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := c.now
+	c.now = c.now.Add(c.step)
+	return now
+}
+
+// Source returns a deterministic chat.Source. Message IDs are filled with
+// consecutive byte values starting at 1, so the first ID is 0x01..0x10,
+// and timestamps start at start and advance by step per message.
+func Source(start time.Time, step time.Duration) chat.Source {
+	return chat.Source{
+		Rand: &counter{},
+		Now:  (&clock{now: start, step: step}).Now,
+	}
+}
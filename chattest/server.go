@@ -0,0 +1,118 @@
+package chattest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/keygen"
+)
+
+// TokenRepo is an in-memory chat.ScopedTokenRepo.
+type TokenRepo struct {
+	mtx    sync.Mutex
+	toks   map[[16]byte]struct{}
+	scopes map[[16]byte][]string
+}
+
+func (r *TokenRepo) SaveToken(_ context.Context, tok [16]byte) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.toks == nil {
+		r.toks = make(map[[16]byte]struct{})
+	}
+	r.toks[tok] = struct{}{}
+	return nil
+}
+
+func (r *TokenRepo) SaveTokenScopes(_ context.Context, tok [16]byte, scopes []string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.scopes == nil {
+		r.scopes = make(map[[16]byte][]string)
+	}
+	r.scopes[tok] = slices.Clone(scopes)
+	return nil
+}
+
+func (r *TokenRepo) TokenScopes(_ context.Context, tok [16]byte) ([]string, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return slices.Clone(r.scopes[tok]), nil
+}
+
+func (r *TokenRepo) HasToken(_ context.Context, tok [16]byte) (bool, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	_, ok := r.toks[tok]
+	return ok, nil
+}
+
+func (r *TokenRepo) DeleteToken(_ context.Context, tok [16]byte) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	delete(r.toks, tok)
+	delete(r.scopes, tok)
+	return nil
+}
+
+// StartServer runs a server with handler on a random local port and
+// shuts it down when the test ends. The server uses an in-memory
+// certificate and TokenRepo, opts are applied after them. It returns
+// the address of the server and a pool trusting its certificate.
+func StartServer(tb testing.TB, handler chat.Handler, opts ...chat.ServerOption) (string, *x509.CertPool) {
+	tb.Helper()
+	certPEM, keyPEM, err := keygen.Cert([]string{"127.0.0.1"}, time.Hour)
+	if err != nil {
+		tb.Fatalf("generate certificate: %v", err)
+	}
+	crt, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		tb.Fatalf("load certificate: %v", err)
+	}
+	ca := x509.NewCertPool()
+	ca.AppendCertsFromPEM(certPEM)
+
+	opts = append([]chat.ServerOption{
+		chat.ServerOptions.Addresses("127.0.0.1:0"),
+		chat.ServerOptions.TLSCertificate(crt),
+		chat.ServerOptions.TokenRepo(&TokenRepo{}),
+		chat.ServerOptions.Handler(handler),
+	}, opts...)
+	srv := chat.NewServer(opts...)
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Run() }()
+	for srv.Addr() == nil {
+		select {
+		case err := <-errCh:
+			tb.Fatalf("run server: %v", err)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	tb.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			tb.Errorf("shutdown server: %v", err)
+		}
+	})
+	return srv.Addr().String(), ca
+}
+
+// NewClient creates a client connecting to addr and trusting ca, with its
+// token file in a temporary directory of the test. opts are applied last.
+func NewClient(tb testing.TB, addr string, ca *x509.CertPool, opts ...chat.ClientOption) *chat.Client {
+	tb.Helper()
+	opts = append([]chat.ClientOption{
+		chat.ClientOptions.Servers([]string{addr}),
+		chat.ClientOptions.RootCAs(ca),
+		chat.ClientOptions.TokenFile(filepath.Join(tb.TempDir(), "token")),
+	}, opts...)
+	return chat.NewClient(opts...)
+}
@@ -0,0 +1,101 @@
+package chattest_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+)
+
+func echo(ctx context.Context, s *chat.Session) {
+	for {
+		m, err := s.Recv(ctx)
+		if err != nil {
+			return
+		}
+		if err := s.Send(ctx, chat.NewTextMessage(m.Payload)); err != nil {
+			return
+		}
+	}
+}
+
+func TestStartServer(t *testing.T) {
+	addr, ca := chattest.StartServer(t, echo)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	got := make(chan string, 1)
+	var c *chat.Client
+	c = chattest.NewClient(t, addr, ca,
+		chat.ClientOptions.OnConnect(func() {
+			if err := c.Send(ctx, []byte("ping")); err != nil {
+				t.Errorf("send: %v", err)
+			}
+		}),
+		chat.ClientOptions.OnMessage(func(m *chat.Message) {
+			if m.Type == chat.MsgTypeText {
+				got <- string(m.Payload)
+			}
+		}),
+	)
+	done := make(chan error, 1)
+	go func() { done <- c.Dial(ctx) }()
+	select {
+	case pld := <-got:
+		if pld != "ping" {
+			t.Errorf("echo %q, want %q", pld, "ping")
+		}
+	case err := <-done:
+		t.Fatalf("dial: %v", err)
+	case <-ctx.Done():
+		t.Fatal("no echo")
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("close: %v", err)
+	}
+	<-done
+}
+
+func TestStartServerUntrusted(t *testing.T) {
+	addr, _ := chattest.StartServer(t, echo)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// the system pool does not trust the in-memory certificate
+	c := chattest.NewClient(t, addr, nil)
+	if err := c.Dial(ctx); err == nil {
+		t.Error("dial without the pool of the server: no error")
+	}
+}
+
+func TestTokenRepo(t *testing.T) {
+	ctx := context.Background()
+	var repo chattest.TokenRepo
+	tok := [16]byte{1}
+	if ok, err := repo.HasToken(ctx, tok); err != nil || ok {
+		t.Fatalf("empty repo has token: %v, %v", ok, err)
+	}
+	if err := repo.SaveToken(ctx, tok); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SaveTokenScopes(ctx, tok, []string{"read"}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := repo.HasToken(ctx, tok); err != nil || !ok {
+		t.Errorf("saved token missing: %v, %v", ok, err)
+	}
+	if scopes, err := repo.TokenScopes(ctx, tok); err != nil || !slices.Equal(scopes, []string{"read"}) {
+		t.Errorf("scopes %v, %v, want [read]", scopes, err)
+	}
+	if err := repo.DeleteToken(ctx, tok); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := repo.HasToken(ctx, tok); ok {
+		t.Error("deleted token still present")
+	}
+	if scopes, _ := repo.TokenScopes(ctx, tok); scopes != nil {
+		t.Errorf("deleted token has scopes %v", scopes)
+	}
+}
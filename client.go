@@ -4,28 +4,71 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/chzyer/readline"
 	"github.com/quic-go/quic-go"
+	"github.com/zhmlst/chat/codes"
 )
 
 type clientConfig struct {
-	servers []string
-	certs   []string
-	insec   bool
-	logger  Logger
-	token   string
+	servers  []string
+	certs    []string
+	roots    *x509.CertPool
+	sysPool  func() (*x509.CertPool, error)
+	insec    bool
+	logger   Logger
+	token    string
+	identity string
+	cache    tls.ClientSessionCache
+	noAuth   bool
+	raw      bool
+	guest    bool
+	regPld   []byte
+	scopes   []string
+	src      Source
+
+	heartbeat  heartbeat
+	caps       []Capability
+	noCaps     []string
+	tofu       *keyStore
+	confirmKey func(addr, fingerprint string) bool
+	// secret is the token of a server logging in to a peer,
+	// see ServerOptions.Cluster, or of an admin if admin is set.
+	secret *[16]byte
+	admin  bool
+	// loginRetries and loginBackoff are the LoginRetry policy.
+	loginRetries int
+	loginBackoff time.Duration
+	// ids replaces the IDs of src, see IDGenerator.
+	ids IDGenerator
+
+	sessionOpts []SessionOption
+	resume      int
+	maxPayload  int
+	outbox      int
+	queue       QueueStore
+	transcript  *transcript
+
+	onMessage func(*Message)
+	onEvent   func(Event)
+	onConnect func()
 }
 
 func defaultClientConfig() clientConfig {
 	return clientConfig{
-		servers: []string{"localhost:4242"},
-		certs:   []string{"cert.pem"},
-		logger:  NopLogger,
+		servers:    []string{DefaultAddr},
+		certs:      []string{"cert.pem"},
+		sysPool:    x509.SystemCertPool,
+		logger:     NopLogger,
+		src:        DefaultSource,
+		maxPayload: defaultMaxPayload,
 		token: func() string {
 			dataDir := os.Getenv("XDG_DATA_HOME")
 			if dataDir == "" {
@@ -33,6 +76,9 @@ func defaultClientConfig() clientConfig {
 			}
 			return dataDir + "/chat/token"
 		}(),
+
+		loginRetries: defaultLoginRetries,
+		loginBackoff: defaultLoginBackoff,
 	}
 }
 
@@ -56,6 +102,14 @@ func (clientOptionsNamespace) Certs(files []string) ClientOption {
 	}
 }
 
+// RootCAs sets the pool of certificate authorities
+// trusted for the server, instead of the system pool and Certs.
+func (clientOptionsNamespace) RootCAs(pool *x509.CertPool) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.roots = pool
+	}
+}
+
 func (clientOptionsNamespace) Insec(insec bool) ClientOption {
 	return func(cfg *clientConfig) {
 		cfg.insec = insec
@@ -68,15 +122,134 @@ func (clientOptionsNamespace) Logger(lgr Logger) ClientOption {
 	}
 }
 
+// TokenFile sets the file keeping the tokens of the client per server
+// and identity, see FileTokenStore.
 func (clientOptionsNamespace) TokenFile(file string) ClientOption {
 	return func(cfg *clientConfig) {
 		cfg.token = file
 	}
 }
 
+// SessionCache enables TLS session resumption and 0-RTT dialing.
+// The chat handshake may then travel in early data, but no
+// application data is written before the server answers "ok".
+func (clientOptionsNamespace) SessionCache(cache tls.ClientSessionCache) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.cache = cache
+	}
+}
+
+// Identity selects which of several tokens of the client for
+// the same server is used. The default identity is empty.
+func (clientOptionsNamespace) Identity(name string) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.identity = name
+	}
+}
+
+// NoAuth logs in with a zero token instead of obtaining one.
+// It only succeeds against a server running with ServerOptions.NoAuth.
+func (clientOptionsNamespace) NoAuth() ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.noAuth = true
+	}
+}
+
+// AdminSecret logs in with the secret of ServerOptions.AdminHandler as
+// token instead of obtaining one. The server then answers every control
+// message sent with SendMessage, carrying an admin command, with a text
+// message of its JSON result.
+func (clientOptionsNamespace) AdminSecret(secret [16]byte) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.secret = &secret
+		cfg.admin = true
+	}
+}
+
+// Guest asks the server for a guest session instead of logging in with a token.
+func (clientOptionsNamespace) Guest() ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.guest = true
+	}
+}
+
+// RegistrationPayload attaches an opaque payload, e.g. an invite code,
+// to token requests so the server's TokenApprover can inspect it.
+func (clientOptionsNamespace) RegistrationPayload(pld []byte) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.regPld = pld
+	}
+}
+
+// Scopes requests scopes for tokens issued to the client.
+// The server's TokenApprover may grant fewer of them.
+func (clientOptionsNamespace) Scopes(scopes ...string) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.scopes = scopes
+	}
+}
+
+// Source sets the source of IDs and timestamps for sent messages.
+func (clientOptionsNamespace) Source(src Source) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.src = src
+	}
+}
+
+// OnMessage sets the function called with every message received
+// from the server. It is called from the receive loop, which
+// does not read further messages until it returns.
+func (clientOptionsNamespace) OnMessage(fn func(*Message)) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.onMessage = fn
+	}
+}
+
+// OnEvent sets the function called with every event received from the server.
+// Token rotations are handled by the client before fn is called.
+func (clientOptionsNamespace) OnEvent(fn func(Event)) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.onEvent = fn
+	}
+}
+
+// OnConnect sets the function called in its own goroutine
+// once the client is logged in and messages can be sent.
+func (clientOptionsNamespace) OnConnect(fn func()) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.onConnect = fn
+	}
+}
+
 // Client is a QUIC chat client.
 type Client struct {
 	cfg clientConfig
+
+	store *FileTokenStore
+
+	mtx     sync.Mutex
+	addr    string
+	resumed bool
+	trust   TrustInfo
+	session *Session
+	// lastID and pending are kept for resuming, see ClientOptions.Resume.
+	lastID  [16]byte
+	pending []*Message
+	// topics holds the patterns subscribed to, see Client.Subscribe.
+	topics map[string]struct{}
+	// instance is the ID of the server last admitting the client.
+	instance string
+	hstats   HandshakeStats
+	level    levelVar
+	// loginToken is the token of the last login, carried in every frame
+	// if the server asks for it, see CapTokenFrames.
+	loginToken [16]byte
+	// warm is the connection made by Preconnect, see IsWarm.
+	warm *warmConn
+	// summaryOnce logs the ConfigSummary on the first connect.
+	summaryOnce sync.Once
+
+	outbox *outbox
 }
 
 // NewClient creates a client with specified options.
@@ -85,43 +258,96 @@ func NewClient(opts ...ClientOption) *Client {
 	for _, opt := range opts {
 		opt(&cfg)
 	}
-	return &Client{
-		cfg: cfg,
+	if cfg.ids != nil {
+		cfg.src.IDs = cfg.ids
 	}
+	c := &Client{cfg: cfg, store: NewFileTokenStore(cfg.token)}
+	c.cfg.logger = cfg.logger.leveled(&c.level)
+	if cfg.outbox > 0 {
+		if cfg.queue == nil {
+			cfg.queue = NewFileQueueStore(cfg.token + ".outbox")
+		}
+		c.outbox = newOutbox(cfg.queue, cfg.outbox)
+	}
+	return c
 }
 
-// Dial connects the client to a server and starts the chat loop.
-func (c *Client) Dial(ctx context.Context) error {
-	crts, err := x509.SystemCertPool()
-	if err != nil {
-		return fmt.Errorf("get system certs: %w", err)
+// SetLogLevel sets the minimum level of messages passed to the logger.
+func (c *Client) SetLogLevel(lvl LogLevel) {
+	c.level.Store(lvl)
+}
+
+// LogLevel returns the minimum level of messages passed to the logger.
+func (c *Client) LogLevel() LogLevel {
+	return c.level.Load()
+}
+
+// Dial connects the client to a server and serves the connection until
+// it is closed or ctx is done. Received messages and events are passed
+// to the OnMessage and OnEvent functions, messages are sent with Send.
+func (c *Client) Dial(ctx context.Context) (err error) {
+	defer func() { err = categorize("dial", err) }()
+	if err := c.Validate(); err != nil {
+		return err
 	}
+	c.logConfig()
+	if w := c.takeWarm(); w != nil {
+		return c.serve(ctx, w.session, w.args)
+	}
+	return c.connect(ctx, func(conn *quic.Conn) error {
+		return c.handleConn(ctx, conn)
+	})
+}
 
-	for _, certfile := range c.cfg.certs {
-		var crt []byte
-		crt, err = os.ReadFile(certfile)
-		if err != nil {
-			c.cfg.logger.With("error", err).Error("failed to read cert")
-			continue
-		}
-		if !crts.AppendCertsFromPEM(crt) {
-			c.cfg.logger.With("file", certfile).Warn("failed to append cert")
-		}
+// connect dials the first reachable server and passes the connection
+// to handle, following a redirect it returns once.
+func (c *Client) connect(ctx context.Context, handle func(*quic.Conn) error) error {
+	crts, err := c.rootCAs()
+	if err != nil {
+		return err
 	}
 
 	tlsCfg := &tls.Config{
 		RootCAs:            crts,
 		InsecureSkipVerify: c.cfg.insec,
 		NextProtos:         []string{"quic-raw"},
+		ClientSessionCache: c.cfg.cache,
 	}
 
 	quicCfg := &quic.Config{
 		KeepAlivePeriod: 20 * time.Second,
+		Tracer:          mtuTracer,
+	}
+
+	dial := func(addr string) (*quic.Conn, error) {
+		cfg := tlsCfg
+		if c.cfg.tofu != nil {
+			cfg = tlsCfg.Clone()
+			cfg.InsecureSkipVerify = true
+			cfg.VerifyConnection = c.verifyTOFU(addr)
+		}
+		var conn *quic.Conn
+		if c.cfg.cache != nil {
+			conn, err = quic.DialAddrEarly(withPathMTU(ctx), addr, cfg, quicCfg)
+		} else {
+			conn, err = quic.DialAddr(withPathMTU(ctx), addr, cfg, quicCfg)
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.mtx.Lock()
+		c.addr = addr
+		c.mtx.Unlock()
+		return conn, nil
 	}
 
 	var conn *quic.Conn
-	for _, addr := range c.cfg.servers {
-		conn, err = quic.DialAddr(ctx, addr, tlsCfg, quicCfg)
+	var addr string
+	for _, addr = range c.cfg.servers {
+		conn, err = dial(addr)
+		if errors.Is(err, ErrServerKeyChanged) {
+			return fmt.Errorf("connect: %w", err)
+		}
 		if err != nil {
 			c.cfg.logger.With("error", err).Error(fmt.Sprintf("failed to dial %s", addr))
 			continue
@@ -132,59 +358,346 @@ func (c *Client) Dial(ctx context.Context) error {
 		return fmt.Errorf("connect: %w", err)
 	}
 
-	return c.handleConn(ctx, conn)
+	err = handle(conn)
+	var redirect *RedirectError
+	if !errors.As(err, &redirect) {
+		return err
+	}
+	_ = closeConn(conn, codes.Done, "following redirect")
+	return c.follow(dial, addr, redirect.Addr, handle)
+}
+
+// Resumed reports whether the last connection resumed a previous TLS session.
+func (c *Client) Resumed() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.resumed
+}
+
+// ErrClientClosed is returned when sending while the client is not connected.
+var ErrClientClosed = errors.New("client closed")
+
+// CloseError is returned when sending fails because
+// the connection was closed with an application error code.
+type CloseError struct {
+	Code codes.Code
+	// Reason is the reason phrase as sent, Detail the part of it
+	// following the code name, e.g. "idle for 31m0s".
+	Reason string
+	Detail string
+	// Remote reports whether the server closed the connection.
+	Remote bool
+
+	err *quic.ApplicationError
+}
+
+// newCloseError parses the reason phrase of the close, see closeReason.
+// Peers sending only the code name leave the detail empty, a phrase in
+// any other format is taken as the detail as a whole.
+func newCloseError(appErr *quic.ApplicationError) *CloseError {
+	e := &CloseError{Code: codes.Code(appErr.ErrorCode), Reason: appErr.ErrorMessage, Remote: appErr.Remote, err: appErr}
+	if detail, ok := strings.CutPrefix(e.Reason, e.Code.String()+": "); ok {
+		e.Detail = detail
+	} else if e.Reason != e.Code.String() {
+		e.Detail = e.Reason
+	}
+	return e
+}
+
+func (e *CloseError) Error() string {
+	side := "locally"
+	if e.Remote {
+		side = "by server"
+	}
+	if e.Detail == "" {
+		return fmt.Sprintf("connection closed %s: %s", side, e.Code)
+	}
+	return fmt.Sprintf("connection closed %s: %s (%s)", side, e.Code, e.Detail)
+}
+
+// Unwrap returns the QUIC error the CloseError was parsed from.
+func (e *CloseError) Unwrap() error {
+	if e.err == nil {
+		return nil
+	}
+	return e.err
+}
+
+// Send sends the payload as a text message with a fresh ID
+// and the current timestamp over the active connection.
+func (c *Client) Send(ctx context.Context, pld []byte) error {
+	return c.SendMessage(ctx, &Message{Type: MsgTypeText, Payload: pld})
+}
+
+// SendText is like Send for a string payload.
+func (c *Client) SendText(ctx context.Context, text string) error {
+	return c.Send(ctx, []byte(text))
+}
+
+// SendMessage sends the message over the active connection. A zero ID
+// and timestamp are filled in before the message is written. With
+// ClientOptions.Outbox, the message is kept in the outbox instead while
+// the client is disconnected or older messages wait there.
+func (c *Client) SendMessage(ctx context.Context, m *Message) (err error) {
+	defer func() { err = categorize("send", err) }()
+	c.mtx.Lock()
+	session := c.session
+	c.mtx.Unlock()
+	if kept, err := c.spool(m, session != nil); kept || err != nil {
+		return err
+	}
+	if session == nil {
+		return ErrClientClosed
+	}
+	if err := c.sent(m); err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	err = session.Send(ctx, m)
+	var appErr *quic.ApplicationError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &appErr):
+		return newCloseError(appErr)
+	case errors.Is(err, ErrSendClosed):
+		return ErrClientClosed
+	}
+	return fmt.Errorf("failed to send message: %w", err)
+}
+
+// Close gracefully ends the active session: queued messages are written,
+// then the stream is closed and the server ends the connection. A warm
+// connection made by Preconnect is closed as well.
+func (c *Client) Close() error {
+	warm := c.dropWarm()
+	c.mtx.Lock()
+	session := c.session
+	c.mtx.Unlock()
+	if session == nil {
+		if warm {
+			return nil
+		}
+		return ErrClientClosed
+	}
+	return session.CloseSend()
+}
+
+// SessionID returns the ID the server assigned to the active session,
+// or a zero ID when the client is not connected or the server is too old
+// to send one. It matches Session.SessionID on the server.
+func (c *Client) SessionID() [16]byte {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.session == nil {
+		return [16]byte{}
+	}
+	return c.session.sid
+}
+
+// RTT returns the smoothed round trip time of the active connection,
+// or zero when the client is not connected.
+func (c *Client) RTT() time.Duration {
+	c.mtx.Lock()
+	session := c.session
+	c.mtx.Unlock()
+	if session == nil {
+		return 0
+	}
+	return session.conn.ConnectionStats().SmoothedRTT
+}
+
+// Token returns the token saved in the token file for the current
+// server and identity, or a zero token when the client has none.
+func (c *Client) Token() ([16]byte, error) {
+	return c.store.Token(c.server(), c.cfg.identity)
+}
+
+// server returns the address of the server the client is or was
+// last connected to, or the first configured one.
+func (c *Client) server() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.addr != "" || len(c.cfg.servers) == 0 {
+		return c.addr
+	}
+	return c.cfg.servers[0]
+}
+
+// rotated saves the token pushed by the server and acknowledges it.
+// Without the acknowledgement the server keeps accepting the old token.
+func (c *Client) rotated(tok [16]byte, session *Session) error {
+	if err := c.saveToken(tok); err != nil {
+		return err
+	}
+	ack := append([]byte("rotated "), tok[:]...)
+	if err := session.control(ack); err != nil {
+		return fmt.Errorf("failed to acknowledge token: %w", err)
+	}
+	// the server carries on with the new token once it reads the ack
+	if session.HasCapability(CapTokenFrames) {
+		session.setToken(tok)
+	}
+	return nil
 }
 
 func (c *Client) handleConn(ctx context.Context, conn *quic.Conn) error {
-	stream, err := c.handshake(ctx, conn)
+	session, args, err := c.login(ctx, conn)
 	if err != nil {
-		return fmt.Errorf("failed handshake: %w", err)
+		return err
 	}
-	defer stream.Close()
+	return c.serve(ctx, session, args)
+}
 
-	rl, err := readline.New("> ")
+// login runs the handshake on the connection and returns the session
+// logged in, ready to be served, with the arguments of the server.
+func (c *Client) login(ctx context.Context, conn *quic.Conn) (*Session, handshakeArgs, error) {
+	var hs HandshakeStats
+	start := time.Now()
+	stream, args, err := c.handshake(ctx, conn, &hs)
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) {
+		cerr := newCloseError(appErr)
+		if cerr.Code == codes.Redirected && cerr.Remote && cerr.Detail != "" {
+			// the close overtook the redirect response
+			err = &RedirectError{Addr: cerr.Detail}
+		} else {
+			err = cerr
+		}
+	}
+	if err != nil {
+		c.handshakeDone(&hs, start, err)
+		return nil, args, fmt.Errorf("failed handshake: %w", err)
+	}
+	session, err := NewSession(stream, c.cfg.logger, c.cfg.sessionOpts...)
 	if err != nil {
-		return fmt.Errorf("create readline: %w", err)
+		return nil, args, fmt.Errorf("failed to create session: %w", err)
+	}
+	session.src = c.cfg.src
+	session.conn = conn
+	session.sid = args.sid
+	if args.caps != nil {
+		session.caps = intersect(c.offer(), args.caps)
+	}
+	if session.HasCapability(CapTokenFrames) {
+		c.mtx.Lock()
+		session.token = c.loginToken
+		c.mtx.Unlock()
+	}
+	session.setMaxPayload(c.cfg.maxPayload, args.caps)
+	if args.instance != "" {
+		c.mtx.Lock()
+		c.instance = args.instance
+		c.mtx.Unlock()
+	}
+	if args.sid != [16]byte{} {
+		session.lgr = c.cfg.logger.With("sid", hex.EncodeToString(args.sid[:]))
 	}
-	defer rl.Close()
 
-	errCh := make(chan error, 2)
+	tlsStart := time.Now()
+	select {
+	case <-conn.HandshakeComplete():
+	case <-ctx.Done():
+		_ = session.CloseSend()
+		c.handshakeDone(&hs, start, ctx.Err())
+		return nil, args, ctx.Err()
+	}
+	hs.TLS += time.Since(tlsStart)
+	c.handshakeDone(&hs, start, nil)
+	session.lgr.With(session.TransportInfo().attrs()...).Debug("transport negotiated")
+	return session, args, nil
+}
+
+// serve serves the session logged in until it ends or ctx is done.
+func (c *Client) serve(ctx context.Context, session *Session, args handshakeArgs) error {
+	defer session.CloseSend()
+	c.mtx.Lock()
+	c.resumed = session.conn.ConnectionState().TLS.DidResume
+	c.session = session
+	c.mtx.Unlock()
+	defer func() {
+		c.mtx.Lock()
+		c.session = nil
+		c.mtx.Unlock()
+	}()
+
+	if hb := session.caps.heartbeat(); hb.enabled() {
+		hctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go session.runHeartbeat(hctx, hb)
+	}
+
+	errCh := make(chan error, 1)
 
 	go func() {
-		for {
-			input, err := rl.ReadSlice()
-			if err != nil {
-				if err == readline.ErrInterrupt || err == io.EOF {
-					errCh <- nil
-				} else {
-					errCh <- fmt.Errorf("read input: %w", err)
+		for ev := range session.Events(ctx) {
+			if tok, ok := ev.(TokenRotatedEvent); ok {
+				if err := c.rotated(tok.Token, session); err != nil {
+					c.cfg.logger.With("error", err).Error("failed to rotate token")
 				}
-				return
 			}
-
-			_, err = stream.Write(input)
-			if err != nil {
-				errCh <- fmt.Errorf("write to stream: %w", err)
-				return
+			if c.cfg.onEvent != nil {
+				_ = session.guard("on event", func() error {
+					c.cfg.onEvent(ev)
+					return nil
+				})
 			}
 		}
 	}()
 
 	go func() {
-		buf := make([]byte, buflen)
 		for {
-			n, err := stream.Read(buf)
-			if err != nil {
-				if err == io.EOF {
-					errCh <- nil
-				} else {
-					errCh <- fmt.Errorf("read from stream: %w", err)
+			m, err := session.Recv(ctx)
+			if err == nil {
+				c.received(m)
+				if c.cfg.onMessage != nil {
+					_ = session.guard("on message", func() error {
+						c.cfg.onMessage(m)
+						return nil
+					})
+				}
+				continue
+			}
+			var appErr *quic.ApplicationError
+			if err == io.EOF {
+				// the server may still be receiving, see Session.CloseSend,
+				// the session ends once the send direction is closed too
+				select {
+				case <-session.stream.Context().Done():
+				case <-ctx.Done():
 				}
-				return
+				errCh <- nil
+			} else if errors.As(err, &appErr) && codes.Code(appErr.ErrorCode) == codes.Done {
+				errCh <- nil
+			} else if appErr != nil {
+				errCh <- fmt.Errorf("read from stream: %w", newCloseError(appErr))
+			} else {
+				errCh <- fmt.Errorf("read from stream: %w", err)
 			}
+			return
+		}
+	}()
 
-			fmt.Println("\r" + string(buf[:n]))
-			rl.Refresh()
+	dctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if (args.resumed || args.reset) && c.cfg.onEvent != nil {
+		_ = session.guard("on event", func() error {
+			c.cfg.onEvent(ResumeEvent{Gap: args.reset})
+			return nil
+		})
+	}
+	go func() {
+		if c.cfg.resume > 0 {
+			c.resend(ctx, session)
+		}
+		c.resubscribe(ctx, session)
+		if c.outbox != nil {
+			go c.drain(dctx, session)
+		}
+		if c.cfg.onConnect != nil {
+			_ = session.guard("on connect", func() error {
+				c.cfg.onConnect()
+				return nil
+			})
 		}
 	}()
 
@@ -0,0 +1,43 @@
+package chat_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestOnMessageScripted(t *testing.T) {
+	script := []*chat.Message{
+		chat.NewTextMessage([]byte("welcome")),
+		chat.NewBinaryMessage([]byte{0, 1, 2}),
+		chat.NewTextMessage([]byte("bye")),
+	}
+	script[1].Timestamp = epoch
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		for _, m := range script {
+			// a copy, the writer may reuse the message
+			m := *m
+			if err := s.Send(ctx, &m); err != nil {
+				return
+			}
+		}
+		discard(ctx, s)
+	})
+	got := make(chan *chat.Message, len(script)+1)
+	connect(t, addr, ca, chat.ClientOptions.OnMessage(func(m *chat.Message) { got <- m }))
+	for i, want := range script {
+		m := receive(t, got)
+		if m.Type != want.Type || m.ID != want.ID || !m.Timestamp.Equal(want.Timestamp.Truncate(time.Millisecond)) || !bytes.Equal(m.Payload, want.Payload) {
+			t.Errorf("frame %d: type %d, id %x, timestamp %v, payload %q, want %d, %x, %v, %q",
+				i, m.Type, m.ID, m.Timestamp, m.Payload, want.Type, want.ID, want.Timestamp, want.Payload)
+		}
+	}
+	select {
+	case m := <-got:
+		t.Errorf("unexpected frame %q", m.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
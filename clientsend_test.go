@@ -0,0 +1,53 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestClientSendFrames(t *testing.T) {
+	got := make(chan *chat.Message, 2)
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		for {
+			m, err := s.Recv(ctx)
+			if err != nil {
+				return
+			}
+			got <- m
+		}
+	})
+	c := newClient(t, addr, ca)
+	done := serve(t, c)
+	ctx := context.Background()
+	if err := c.Send(ctx, []byte("hello")); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	send(t, c, "again")
+
+	var prev [16]byte
+	for _, want := range []string{"hello", "again"} {
+		m := receive(t, got)
+		if m.Type != chat.MsgTypeText || string(m.Payload) != want {
+			t.Errorf("received type %d %q, want text %q", m.Type, m.Payload, want)
+		}
+		if m.ID == [16]byte{} || m.ID == prev {
+			t.Errorf("message ID %x not fresh", m.ID)
+		}
+		prev = m.ID
+		if age := time.Since(m.Timestamp); age < 0 || age > time.Minute {
+			t.Errorf("timestamp %v is not recent", m.Timestamp)
+		}
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	receive(t, done)
+	if err := c.SendText(ctx, "late"); !errors.Is(err, chat.ErrClientClosed) {
+		t.Errorf("send after close: %v, want %v", err, chat.ErrClientClosed)
+	}
+}
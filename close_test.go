@@ -0,0 +1,80 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+	"github.com/zhmlst/chat/codes"
+)
+
+// closing is a listener closing every connection it accepts
+// with code and reason, as any peer may.
+type closing struct {
+	chat.Listener
+	code   codes.Code
+	reason string
+}
+
+func (l *closing) Accept(ctx context.Context) (*quic.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept(ctx)
+		if err != nil {
+			return nil, err
+		}
+		_ = conn.CloseWithError(quic.ApplicationErrorCode(l.code), l.reason)
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		code   codes.Code
+		reason string
+		detail string
+	}{
+		{"detail", codes.RateLimited, codes.RateLimited.String() + ": rate limit 10/s exceeded", "rate limit 10/s exceeded"},
+		{"detail with colons", codes.Internal, codes.Internal.String() + ": db: timeout", "db: timeout"},
+		{"unicode detail", codes.IdleTimeout, codes.IdleTimeout.String() + ": простой 31m0s", "простой 31m0s"},
+		{"name only", codes.IdleTimeout, codes.IdleTimeout.String(), ""},
+		{"empty", codes.Done, "", ""},
+		{"other format", codes.PolicyViolation, "go away", "go away"},
+		{"other code name", codes.Forbidden, codes.Internal.String() + ": boom", codes.Internal.String() + ": boom"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr, ca := startServer(t, discard, chat.ServerOptions.WrapListener(func(l chat.Listener) chat.Listener {
+				return &closing{l, tt.code, tt.reason}
+			}))
+			err := chattest.NewClient(t, addr, ca, chat.ClientOptions.Logger(quiet)).Dial(t.Context())
+			var cerr *chat.CloseError
+			if !errors.As(err, &cerr) {
+				t.Fatalf("dial: %v, want a CloseError", err)
+			}
+			if cerr.Code != tt.code || cerr.Detail != tt.detail || cerr.Reason != tt.reason || !cerr.Remote {
+				t.Errorf("closed with %+v, want code %v and detail %q", cerr, tt.code, tt.detail)
+			}
+		})
+	}
+}
+
+func TestCloseReasonDisconnect(t *testing.T) {
+	ids := make(chan uint64, 1)
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		ids <- s.ID()
+		discard(ctx, s)
+	})
+	done := serve(t, newClient(t, addr, ca))
+	if err := srv.Disconnect(receive(t, ids), codes.Forbidden); err != nil {
+		t.Fatal(err)
+	}
+	var cerr *chat.CloseError
+	if err := receive(t, done); !errors.As(err, &cerr) {
+		t.Fatalf("dial: %v, want a CloseError", err)
+	}
+	if cerr.Code != codes.Forbidden || cerr.Detail != "disconnected by the server" {
+		t.Errorf("closed with %v %q, want %v and the detail", cerr.Code, cerr.Detail, codes.Forbidden)
+	}
+}
@@ -0,0 +1,366 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// minPeerBackoff and maxPeerBackoff bound the wait before connecting
+	// to a peer again after its link failed.
+	minPeerBackoff = 500 * time.Millisecond
+	maxPeerBackoff = 30 * time.Second
+)
+
+// Peers sets the addresses of the other servers of the cluster, which the
+// server keeps a link to, see Cluster.
+func (serverOptionsNamespace) Peers(addrs ...string) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.peers = addrs
+	}
+}
+
+// Cluster sets the secret shared by the servers of a cluster, so that
+// clients connected to different servers reach each other. A server logs
+// in to each of its Peers with the secret as token, by a Client made with
+// opts, e.g. ClientOptions.RootCAs trusting their certificates, and tells
+// them which tokens are online there. Messages a Hub would store for an
+// offline member, and those sent with SendTo, are forwarded to the peer
+// their recipient is online at instead. While the link to the peer is
+// down they are stored offline as before. Messages received from a peer
+// are delivered to local sessions only, never forwarded again. Room state
+// such as hub history is not shared.
+func (serverOptionsNamespace) Cluster(secret [16]byte, opts ...ClientOption) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.clusterSecret = &secret
+		cfg.peerOpts = opts
+	}
+}
+
+// cluster is the state of a server shared with its peers.
+type cluster struct {
+	mtx   sync.Mutex
+	links []*peerLink
+	// remote holds the tokens online at each peer by its instance ID,
+	// as last told by the peer.
+	remote map[string]map[[16]byte]struct{}
+}
+
+// peerLink is the link of the server to a peer.
+type peerLink struct {
+	addr   string
+	client *Client
+	// sync is signalled when the peer is due a presence summary.
+	sync chan struct{}
+}
+
+// linkTo returns the link to the peer the token is online at, if any.
+func (c *cluster) linkTo(tok [16]byte) *peerLink {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for instance, toks := range c.remote {
+		if _, ok := toks[tok]; !ok {
+			continue
+		}
+		for _, link := range c.links {
+			if link.client.ServerInstance() == instance {
+				return link
+			}
+		}
+	}
+	return nil
+}
+
+// online replaces the tokens online at the peer.
+func (c *cluster) online(instance string, toks map[[16]byte]struct{}) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.remote[instance] = toks
+}
+
+// forget drops the tokens online at the peer once its link ends.
+func (c *cluster) forget(instance string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.remote, instance)
+}
+
+// changed signals every link that the tokens online here changed.
+func (c *cluster) changed() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, link := range c.links {
+		select {
+		case link.sync <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// peerLinks creates the links to the peers of the server.
+func (s *Server) peerLinks() ([]*peerLink, error) {
+	links := make([]*peerLink, 0, len(s.cfg.peers))
+	for _, addr := range s.cfg.peers {
+		link := &peerLink{addr: addr, sync: make(chan struct{}, 1)}
+		opts := append([]ClientOption{
+			ClientOptions.Logger(s.cfg.logger.With("module", "cluster", "peer", addr)),
+		}, s.cfg.peerOpts...)
+		opts = append(opts,
+			ClientOptions.Servers([]string{addr}),
+			func(cfg *clientConfig) {
+				cfg.secret = s.cfg.clusterSecret
+			},
+			ClientOptions.OnConnect(func() {
+				select {
+				case link.sync <- struct{}{}:
+				default:
+				}
+			}),
+		)
+		link.client = NewClient(opts...)
+		if err := link.client.Validate(); err != nil {
+			return nil, fmt.Errorf("peer %s: %w", addr, err)
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// connectPeers keeps the links to the peers up until the server stops.
+func (s *Server) connectPeers(links []*peerLink) {
+	s.cluster.mtx.Lock()
+	s.cluster.links = links
+	s.cluster.mtx.Unlock()
+	for _, link := range links {
+		go s.runLink(link)
+		go s.syncPresence(link)
+	}
+}
+
+// runLink connects to the peer again whenever its link fails.
+func (s *Server) runLink(link *peerLink) {
+	lgr := s.cfg.logger.With("module", "cluster", "peer", link.addr)
+	var backoff time.Duration
+	for {
+		start := time.Now()
+		err := link.client.Dial(s.ctx)
+		if s.ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > maxPeerBackoff {
+			backoff = 0
+		}
+		backoff = min(max(backoff*2, minPeerBackoff), maxPeerBackoff)
+		backoff += rand.N(backoff/4 + 1)
+		lgr.With("error", err, "retry", backoff).Warn("peer link down")
+		select {
+		case <-time.After(backoff):
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// syncPresence sends the tokens online here to the peer on every change.
+// Changes made while a summary is sent are summed up in the next one.
+func (s *Server) syncPresence(link *peerLink) {
+	for {
+		select {
+		case <-link.sync:
+		case <-s.ctx.Done():
+			return
+		}
+		m := &Message{Type: MsgTypeControl, Payload: s.presence()}
+		if err := link.client.SendMessage(s.ctx, m); err != nil && !errors.Is(err, ErrClientClosed) {
+			s.cfg.logger.With("peer", link.addr, "error", err).Warn("failed to send presence to peer")
+		}
+	}
+}
+
+// presence returns the summary of the tokens with a session here,
+// "presence <instance ID>" followed by the hex encoded tokens.
+func (s *Server) presence() []byte {
+	var b strings.Builder
+	b.WriteString("presence " + s.cfg.instance)
+	s.mtx.Lock()
+	for tok, sessions := range s.byToken {
+		for id := range sessions {
+			if _, ok := s.sessions[id]; ok {
+				b.WriteString(" " + hex.EncodeToString(tok[:]))
+				break
+			}
+		}
+	}
+	s.mtx.Unlock()
+	return []byte(b.String())
+}
+
+// presenceChanged tells the peers that a session came or went.
+func (s *Server) presenceChanged(session *Session) {
+	if s.cluster != nil && !session.anonymous() {
+		s.cluster.changed()
+	}
+}
+
+// servePeer reads the presence summaries and the messages relayed by
+// a peer until its link ends.
+func (s *Server) servePeer(ctx context.Context, session *Session) {
+	lgr := session.lgr.With("module", "cluster")
+	var instance string
+	defer func() {
+		if instance != "" {
+			s.cluster.forget(instance)
+		}
+	}()
+	for {
+		m, err := readMessageContext(ctx, session.stream)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				lgr.With("error", err).Warn("peer link failed")
+			}
+			return
+		}
+		if m.Type != MsgTypeControl {
+			continue
+		}
+		cmd, arg, _ := bytes.Cut(m.Payload, []byte(" "))
+		switch string(cmd) {
+		case "presence":
+			id, toks, err := parsePresence(arg)
+			if err != nil {
+				lgr.With("error", err).Warn("invalid presence from peer")
+				continue
+			}
+			if instance != "" && id != instance {
+				s.cluster.forget(instance)
+			}
+			instance = id
+			s.cluster.online(id, toks)
+		case "relay":
+			if err := s.relayed(ctx, arg); err != nil {
+				lgr.With("error", err).Warn("failed to deliver relayed message")
+			}
+		default:
+			lgr.With("cmd", string(cmd)).Debug("ignoring peer command")
+		}
+	}
+}
+
+// parsePresence parses the instance ID and the tokens of a presence summary.
+func parsePresence(arg []byte) (string, map[[16]byte]struct{}, error) {
+	fields := strings.Fields(string(arg))
+	if len(fields) == 0 {
+		return "", nil, fmt.Errorf("%w: presence without instance ID", ErrMalformedFrame)
+	}
+	toks := make(map[[16]byte]struct{}, len(fields)-1)
+	for _, f := range fields[1:] {
+		raw, err := hex.DecodeString(f)
+		if err != nil || len(raw) != 16 {
+			return "", nil, fmt.Errorf("%w: presence token %q", ErrMalformedFrame, f)
+		}
+		toks[[16]byte(raw)] = struct{}{}
+	}
+	return fields[0], toks, nil
+}
+
+// SendTo sends m to every session of the recipient token. Without one it
+// forwards m to the peer the token is online at, see ServerOptions.Cluster,
+// or stores it for the recipient in the MessageStore. The session attached
+// to ctx, if any, is the sender told to the OfflineNotifier.
+func (s *Server) SendTo(ctx context.Context, recipient [16]byte, m *Message) error {
+	if s.sendLocal(ctx, recipient, m) > 0 {
+		return nil
+	}
+	sender, _ := SessionFromContext(ctx)
+	return s.forward(ctx, sender, recipient, m)
+}
+
+// sendLocal sends a copy of m to every running session of the token
+// and returns the number of sessions it was sent to.
+func (s *Server) sendLocal(ctx context.Context, tok [16]byte, m *Message) int {
+	s.mtx.Lock()
+	var sessions []*Session
+	for id, session := range s.byToken[tok] {
+		if _, ok := s.sessions[id]; ok {
+			sessions = append(sessions, session)
+		}
+	}
+	s.mtx.Unlock()
+	n := 0
+	for _, session := range sessions {
+		relay := *m
+		if err := session.Send(ctx, &relay); err != nil {
+			session.lgr.With("error", err).Debug("failed to send message")
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// forward relays m for a recipient without a session here to the peer it
+// is online at, or stores it offline if there is none or the link fails.
+func (s *Server) forward(ctx context.Context, sender *Session, recipient [16]byte, m *Message) error {
+	if s.cluster != nil {
+		if link := s.cluster.linkTo(recipient); link != nil {
+			err := s.relay(ctx, link, recipient, m)
+			s.mtx.Lock()
+			if err == nil {
+				s.relayedOut++
+			} else {
+				s.relayFailed++
+			}
+			s.mtx.Unlock()
+			if err == nil {
+				return nil
+			}
+			s.cfg.logger.With("peer", link.addr, "error", err).Warn("failed to relay message, storing it offline")
+		}
+	}
+	return s.storeOffline(ctx, sender, recipient, m)
+}
+
+// relay sends m to the peer as "relay <origin instance ID> <recipient>"
+// followed by a line break and the frame of m.
+func (s *Server) relay(ctx context.Context, link *peerLink, recipient [16]byte, m *Message) error {
+	var b bytes.Buffer
+	b.WriteString("relay " + s.cfg.instance + " " + hex.EncodeToString(recipient[:]) + "\n")
+	if _, err := m.WriteTo(&b); err != nil {
+		return fmt.Errorf("encode message: %w", err)
+	}
+	return link.client.SendMessage(ctx, &Message{Type: MsgTypeControl, Payload: b.Bytes()})
+}
+
+// relayed delivers a message relayed by a peer to the sessions of its
+// recipient here, or stores it offline. Messages are never relayed again,
+// and those coming back to their origin are dropped, so that they cannot loop.
+func (s *Server) relayed(ctx context.Context, arg []byte) error {
+	line, frame, ok := bytes.Cut(arg, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if !ok || len(fields) != 2 {
+		return fmt.Errorf("%w: relay header %q", ErrMalformedFrame, line)
+	}
+	raw, err := hex.DecodeString(fields[1])
+	if err != nil || len(raw) != 16 {
+		return fmt.Errorf("%w: relay recipient %q", ErrMalformedFrame, fields[1])
+	}
+	if fields[0] == s.cfg.instance {
+		return errors.New("message relayed back to its origin, dropping it")
+	}
+	m, err := readMessage(bytes.NewReader(frame))
+	if err != nil {
+		return fmt.Errorf("decode message: %w", err)
+	}
+	if s.sendLocal(ctx, [16]byte(raw), m) > 0 {
+		return nil
+	}
+	return s.storeOffline(ctx, nil, [16]byte(raw), m)
+}
@@ -0,0 +1,98 @@
+package chat_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+// freeUDP returns a loopback address no UDP socket is bound to.
+func freeUDP(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	return pc.LocalAddr().String()
+}
+
+func TestCluster(t *testing.T) {
+	secret := [16]byte{1, 2, 3}
+	cert, ca := certificate(t, "127.0.0.1")
+	addrs := [2]string{freeUDP(t), freeUDP(t)}
+	var (
+		srvs   [2]*chat.Server
+		stores [2]*chat.MemMessageStore
+		stats  [2]<-chan chat.HandshakeStats
+	)
+	for i, addr := range addrs {
+		var metrics chat.ServerOption
+		metrics, stats[i] = handshakes()
+		stores[i] = chat.NewMemMessageStore()
+		srvs[i], _, _ = startServer(t, discard,
+			chat.ServerOptions.Addresses(addr),
+			cert,
+			metrics,
+			chat.ServerOptions.MessageStore(stores[i]),
+			chat.ServerOptions.Cluster(secret, chat.ClientOptions.RootCAs(ca)),
+			chat.ServerOptions.Peers(addrs[1-i]))
+	}
+	for i := range srvs {
+		if hs := receive(t, stats[i]); hs.Outcome != chat.OutcomePeer {
+			t.Errorf("server %d: link of its peer %s", i, hs.Outcome)
+		}
+	}
+
+	got := make(chan string, 1)
+	bob := connect(t, addrs[1], ca, chat.ClientOptions.OnMessage(func(m *chat.Message) { got <- string(m.Payload) }))
+	tok, err := bob.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// stored offline until the peer told bob is online there
+	eventually(t, func() bool {
+		if err := srvs[0].SendTo(ctx, tok, chat.NewTextMessage([]byte("hi"))); err != nil {
+			t.Fatal(err)
+		}
+		return srvs[0].Stats().Relayed > 0
+	})
+	if text := receive(t, got); text != "hi" {
+		t.Errorf("received %q, want hi", text)
+	}
+	if n := srvs[0].Stats().Relayed; n != 1 {
+		t.Errorf("%d messages relayed, want 1", n)
+	}
+
+	// without the peer, messages are stored offline
+	if err := srvs[1].Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool {
+		if err := srvs[0].SendTo(ctx, tok, chat.NewTextMessage([]byte("later"))); err != nil {
+			t.Fatal(err)
+		}
+		ms, _ := stores[0].Drain(ctx, tok)
+		return len(ms) > 0
+	})
+}
+
+func TestClusterSecretMismatch(t *testing.T) {
+	secret := [16]byte{1, 2, 3}
+	wrong := secret
+	wrong[15] ^= 1
+	cert, ca := certificate(t, "127.0.0.1")
+	metrics, stats := handshakes()
+	_, addr, _ := startServer(t, discard, cert, metrics, chat.ServerOptions.Cluster(secret, chat.ClientOptions.RootCAs(ca)))
+	startServer(t, discard, cert,
+		chat.ServerOptions.Cluster(wrong, chat.ClientOptions.RootCAs(ca)),
+		chat.ServerOptions.Peers(addr))
+
+	if hs := receive(t, stats); hs.Outcome == chat.OutcomePeer {
+		t.Error("logged in as a peer with another secret")
+	}
+}
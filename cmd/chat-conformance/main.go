@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/zhmlst/chat/conformance"
+)
+
+func main() {
+	listen := flag.String("listen", "", "address to wait for an external client on, the Go client runs in process if empty")
+	cert := flag.String("cert", "cert.pem", "certificate file presented to an external client")
+	key := flag.String("key", "key.pem", "private key file of the certificate")
+	run := flag.String("run", "", "only run scenarios whose name contains this")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: chat-conformance [flags]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var scenarios []conformance.Scenario
+	for _, sc := range conformance.Scenarios {
+		if strings.Contains(sc.Name, *run) {
+			scenarios = append(scenarios, sc)
+		}
+	}
+
+	h := &conformance.Harness{}
+	client := conformance.GoClient()
+	if *listen != "" {
+		crt, err := tls.LoadX509KeyPair(*cert, *key)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		h.Addr, h.Certificate = *listen, &crt
+		client = conformance.External
+	}
+
+	failed := false
+	for _, sc := range scenarios {
+		if *listen != "" {
+			fmt.Printf("%s: connect the client to %s\n", sc.Name, *listen)
+		}
+		r := h.Run(context.Background(), client, sc)[0]
+		if r.Passed() {
+			fmt.Printf("PASS %s\n", r.Scenario)
+			continue
+		}
+		failed = true
+		fmt.Printf("FAIL %s: %v\n", r.Scenario, r.Err)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zhmlst/chat/keygen"
+)
+
+const usage = `usage: chat-keygen <command> [flags]
+
+commands:
+  cert         generate a self-signed certificate and key
+  fingerprint  print the SPKI pin of a certificate
+  token        generate a token
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "cert":
+		err = cert(os.Args[2:])
+	case "fingerprint":
+		err = fingerprint(os.Args[2:])
+	case "token":
+		err = token(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func cert(args []string) error {
+	fs := flag.NewFlagSet("cert", flag.ExitOnError)
+	hosts := fs.String("hosts", strings.Join(keygen.DefaultHosts, ","), "comma separated DNS names and IP addresses")
+	validity := fs.Duration("validity", 365*24*time.Hour, "validity period")
+	certFile := fs.String("cert", "cert.pem", "certificate file")
+	keyFile := fs.String("key", "key.pem", "private key file")
+	stdout := fs.Bool("stdout", false, "print the PEM blocks instead of writing files")
+	_ = fs.Parse(args)
+
+	certPEM, keyPEM, err := keygen.Cert(strings.Split(*hosts, ","), *validity)
+	if err != nil {
+		return err
+	}
+	if *stdout {
+		_, err = os.Stdout.Write(append(certPEM, keyPEM...))
+		return err
+	}
+	if err = os.WriteFile(*certFile, certPEM, 0o644); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+	if err = os.WriteFile(*keyFile, keyPEM, 0o600); err != nil {
+		return fmt.Errorf("failed to write key: %w", err)
+	}
+	pin, err := keygen.Fingerprint(certPEM)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s and %s, fingerprint %s\n", *certFile, *keyFile, pin)
+	return nil
+}
+
+func fingerprint(args []string) error {
+	fs := flag.NewFlagSet("fingerprint", flag.ExitOnError)
+	certFile := fs.String("cert", "cert.pem", "certificate file")
+	_ = fs.Parse(args)
+
+	certPEM, err := os.ReadFile(*certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read certificate: %w", err)
+	}
+	pin, err := keygen.Fingerprint(certPEM)
+	if err != nil {
+		return err
+	}
+	fmt.Println(pin)
+	return nil
+}
+
+func token(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	file := fs.String("file", "", "client token file to write, none if empty")
+	_ = fs.Parse(args)
+
+	tok, err := keygen.Token()
+	if err != nil {
+		return err
+	}
+	if *file != "" {
+		if err = keygen.WriteTokenFile(*file, tok); err != nil {
+			return err
+		}
+	}
+	fmt.Println(hex.EncodeToString(tok[:]))
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/zhmlst/chat"
+)
+
+// maxShown bounds how much of a payload is printed.
+const maxShown = 96
+
+func main() {
+	session := flag.Uint64("session", 0, "only show the records of this session ID")
+	replay := flag.String("replay", "", "replay the client side of the handshake against this server address")
+	cert := flag.String("cert", "cert.pem", "server certificate file for -replay")
+	insec := flag.Bool("insecure", false, "skip server certificate verification for -replay")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: chat-transcript [flags] [file]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	in := io.Reader(os.Stdin)
+	if flag.NArg() > 0 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	}
+	recs, err := read(in, *session)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *replay == "" {
+		for _, r := range recs {
+			fmt.Println(format(r))
+		}
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := replayHandshake(ctx, *replay, *cert, *insec, recs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// read decodes the records of the transcript, keeping those of session
+// if it is not zero. Dropped markers are always kept.
+func read(r io.Reader, session uint64) ([]chat.TranscriptRecord, error) {
+	var recs []chat.TranscriptRecord
+	dec := json.NewDecoder(r)
+	for {
+		var rec chat.TranscriptRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return recs, nil
+		}
+		if err != nil {
+			return recs, fmt.Errorf("record %d: %w", len(recs)+1, err)
+		}
+		if session == 0 || rec.Session == session || rec.Dropped > 0 {
+			recs = append(recs, rec)
+		}
+	}
+}
+
+var typeNames = map[chat.MsgType]string{
+	chat.MsgTypeControl: "control",
+	chat.MsgTypeText:    "text",
+	chat.MsgTypeBinary:  "binary",
+	chat.MsgTypeAck:     "ack",
+}
+
+// format returns a line describing the record.
+func format(r chat.TranscriptRecord) string {
+	ts := r.Time.Format("15:04:05.000000")
+	if r.Dropped > 0 {
+		return fmt.Sprintf("%s -- %d records dropped --", ts, r.Dropped)
+	}
+	arrow := "->"
+	if r.Dir == chat.TranscriptReceived {
+		arrow = "<-"
+	}
+	peer := r.Remote
+	if r.Session != 0 {
+		peer = fmt.Sprintf("#%d %s", r.Session, r.Remote)
+	}
+	m, err := r.Message()
+	if err != nil {
+		return fmt.Sprintf("%s %s %s %v", ts, peer, arrow, err)
+	}
+	return fmt.Sprintf("%s %s %s %s", ts, peer, arrow, describe(m, r.Size, r.Hash))
+}
+
+// describe returns the header fields and the payload of m of size bytes.
+func describe(m *chat.Message, size int, hash string) string {
+	var b strings.Builder
+	name, ok := typeNames[m.Type]
+	if !ok {
+		name = fmt.Sprintf("type%d", m.Type)
+	}
+	fmt.Fprintf(&b, "%-7s id=%s", name, hex.EncodeToString(m.ID[:4]))
+	if m.Flags != 0 {
+		fmt.Fprintf(&b, " flags=%#02x", byte(m.Flags))
+	}
+	if m.TTL > 0 {
+		fmt.Fprintf(&b, " ttl=%s", m.TTL)
+	}
+	if m.Channel != 0 {
+		fmt.Fprintf(&b, " chan=%d", m.Channel)
+	}
+	if m.Token != [16]byte{} {
+		b.WriteString(" token")
+	}
+	fmt.Fprintf(&b, " len=%d", size)
+	if hash != "" {
+		fmt.Fprintf(&b, " sha256=%s", hash[:16])
+	}
+	if len(m.Payload) > 0 {
+		b.WriteString(" " + payload(m))
+	}
+	return b.String()
+}
+
+// payload returns the start of the payload of m, quoted unless binary.
+func payload(m *chat.Message) string {
+	pld, more := m.Payload, ""
+	if len(pld) > maxShown {
+		pld, more = pld[:maxShown], "..."
+	}
+	if m.Type == chat.MsgTypeBinary || m.Type == chat.MsgTypeAck {
+		return hex.EncodeToString(pld) + more
+	}
+	return fmt.Sprintf("%q%s", pld, more)
+}
+
+// replayHandshake sends the control frames the client sent in the recorded
+// handshake to the server at addr, one at a time, printing the recorded
+// response next to the one of the server, until the server admits the
+// client or the recorded handshake ends. The client is the peer writing
+// the first frame, so that transcripts of both sides can be replayed.
+func replayHandshake(ctx context.Context, addr, cert string, insec bool, recs []chat.TranscriptRecord) error {
+	var client chat.TranscriptDir
+	var session uint64
+	var hs []chat.TranscriptRecord
+	for _, r := range recs {
+		if r.Dropped > 0 {
+			continue
+		}
+		if client == "" {
+			client, session = r.Dir, r.Session
+		}
+		if r.Session != session {
+			continue
+		}
+		if m, err := r.Message(); err != nil || m.Type != chat.MsgTypeControl {
+			break
+		}
+		hs = append(hs, r)
+	}
+	if len(hs) == 0 {
+		return errors.New("no handshake in transcript")
+	}
+
+	crts, err := x509.SystemCertPool()
+	if err != nil {
+		return fmt.Errorf("get system certs: %w", err)
+	}
+	if crt, err := os.ReadFile(cert); err == nil {
+		crts.AppendCertsFromPEM(crt)
+	}
+	conn, err := quic.DialAddr(ctx, addr, &tls.Config{
+		RootCAs:            crts,
+		InsecureSkipVerify: insec,
+		NextProtos:         []string{"quic-raw"},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", addr, err)
+	}
+	defer func() { _ = conn.CloseWithError(0, "") }()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("open stream: %w", err)
+	}
+	defer stream.Close()
+
+	for i, r := range hs {
+		if r.Dir != client {
+			continue
+		}
+		m, _ := r.Message()
+		m.ID, m.Timestamp = [16]byte{}, time.Time{}
+		if err := m.Stamp(chat.DefaultSource); err != nil {
+			return err
+		}
+		if _, err := m.WriteTo(stream); err != nil {
+			return fmt.Errorf("write frame: %w", err)
+		}
+		fmt.Printf("-> %s\n", describe(m, len(m.Payload), ""))
+		if i+1 < len(hs) && hs[i+1].Dir != client {
+			fmt.Printf("   recorded %s\n", format(hs[i+1]))
+		}
+		var resp chat.Message
+		if _, err := resp.ReadFrom(stream); err != nil {
+			return fmt.Errorf("read response: %w", err)
+		}
+		fmt.Printf("<- %s\n", describe(&resp, len(resp.Payload), ""))
+		if done(resp.Payload) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// done reports whether the response ends the handshake.
+func done(resp []byte) bool {
+	for _, p := range []string{"ok", "redirect ", "denied", "notice "} {
+		if bytes.HasPrefix(resp, []byte(p)) {
+			return true
+		}
+	}
+	return false
+}
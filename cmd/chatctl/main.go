@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+// secretEnv is the environment variable holding the admin secret,
+// which is kept out of the command line and so of the process list.
+const secretEnv = "CHATCTL_SECRET"
+
+func main() {
+	addr := flag.String("addr", chat.DefaultAddr, "server address")
+	secretFile := flag.String("secret-file", "", "file holding the admin secret, 32 hex digits, instead of $"+secretEnv)
+	cert := flag.String("cert", "cert.pem", "server certificate file")
+	insec := flag.Bool("insecure", false, "skip server certificate verification")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: chatctl [flags] list-sessions | session-info <id> | kick <id> <code> | mute <id> <duration> [reason] | unmute <id> | stats | log-level [level]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "The admin secret is read from $%s unless -secret-file is set.\n", secretEnv)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	secret, err := loadSecret(*secretFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := run(ctx, *addr, *cert, *insec, secret, strings.Join(flag.Args(), " "))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(string(resp))
+}
+
+// loadSecret reads the admin secret from file if set, or else from
+// the environment variable.
+func loadSecret(file string) ([16]byte, error) {
+	text := os.Getenv(secretEnv)
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return [16]byte{}, fmt.Errorf("read secret: %w", err)
+		}
+		text = string(b)
+	}
+	if text == "" {
+		return [16]byte{}, fmt.Errorf("no secret, set $%s or -secret-file", secretEnv)
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(text))
+	if err != nil || len(raw) != 16 {
+		return [16]byte{}, errors.New("secret must be 32 hex digits")
+	}
+	return [16]byte(raw), nil
+}
+
+// run logs in to the server at addr with the admin secret
+// and returns its response to the command.
+func run(ctx context.Context, addr, cert string, insec bool, secret [16]byte, cmd string) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	connected := make(chan struct{}, 1)
+	resps := make(chan []byte, 1)
+	c := chat.NewClient(
+		chat.ClientOptions.Servers([]string{addr}),
+		chat.ClientOptions.Certs([]string{cert}),
+		chat.ClientOptions.Insec(insec),
+		chat.ClientOptions.AdminSecret(secret),
+		chat.ClientOptions.OnConnect(func() { connected <- struct{}{} }),
+		chat.ClientOptions.OnMessage(func(m *chat.Message) {
+			select {
+			case resps <- m.Payload:
+			default:
+			}
+		}),
+	)
+	done := make(chan error, 1)
+	go func() { done <- c.Dial(ctx) }()
+	defer func() {
+		_ = c.Close()
+		cancel()
+		<-done
+	}()
+
+	select {
+	case <-connected:
+	case err := <-done:
+		done <- err
+		return nil, fmt.Errorf("login: %w", err)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("login: %w", ctx.Err())
+	}
+	if err := c.SendMessage(ctx, &chat.Message{Type: chat.MsgTypeControl, Payload: []byte(cmd)}); err != nil {
+		return nil, fmt.Errorf("send command: %w", err)
+	}
+	select {
+	case resp := <-resps:
+		return resp, nil
+	case err := <-done:
+		done <- err
+		return nil, fmt.Errorf("connection lost: %w", err)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+	"github.com/zhmlst/chat/codes"
+)
+
+var secret = [16]byte{0: 0xad, 15: 0x01}
+
+func discard(ctx context.Context, s *chat.Session) {
+	for {
+		if _, err := s.Recv(ctx); err != nil {
+			return
+		}
+	}
+}
+
+// ctl runs the command against the server at addr with the admin secret.
+func ctl(t *testing.T, addr, cmd string) []byte {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := run(ctx, addr, "", true, secret, cmd)
+	if err != nil {
+		t.Fatalf("%s: %v", cmd, err)
+	}
+	return resp
+}
+
+func TestListAndKick(t *testing.T) {
+	addr, ca := chattest.StartServer(t, discard, chat.ServerOptions.AdminHandler(secret))
+	connected := make(chan struct{}, 1)
+	c := chattest.NewClient(t, addr, ca, chat.ClientOptions.OnConnect(func() { connected <- struct{}{} }))
+	done := make(chan error, 1)
+	go func() { done <- c.Dial(context.Background()) }()
+	t.Cleanup(func() { _ = c.Close() })
+	select {
+	case <-connected:
+	case err := <-done:
+		t.Fatalf("dial: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial timed out")
+	}
+	sid := c.SessionID()
+
+	var sessions []chat.SessionInfo
+	if err := json.Unmarshal(ctl(t, addr, "list-sessions"), &sessions); err != nil {
+		t.Fatalf("list-sessions: %v", err)
+	}
+	var id uint64
+	for _, s := range sessions {
+		if s.SID == hex.EncodeToString(sid[:]) {
+			id = s.ID
+		}
+	}
+	if id == 0 {
+		t.Fatalf("list-sessions %+v lacks the client session %x", sessions, sid)
+	}
+
+	var res map[string]string
+	if err := json.Unmarshal(ctl(t, addr, fmt.Sprintf("kick %d %s", id, codes.PolicyViolation)), &res); err != nil {
+		t.Fatalf("kick: %v", err)
+	}
+	if res["result"] != "ok" {
+		t.Fatalf("kick: %v", res)
+	}
+	select {
+	case err := <-done:
+		var cerr *chat.CloseError
+		if !errors.As(err, &cerr) || cerr.Code != codes.PolicyViolation {
+			t.Errorf("kicked client: %v, want close code %s", err, codes.PolicyViolation)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client was not kicked")
+	}
+
+	if err := json.Unmarshal(ctl(t, addr, fmt.Sprintf("kick %d %s", id, codes.PolicyViolation)), &res); err != nil {
+		t.Fatalf("kick: %v", err)
+	}
+	if res["error"] == "" {
+		t.Errorf("kicking a gone session: %v, want an error", res)
+	}
+}
+
+func TestWrongSecret(t *testing.T) {
+	addr, _ := chattest.StartServer(t, discard, chat.ServerOptions.AdminHandler(secret))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if resp, err := run(ctx, addr, "", true, [16]byte{1}, "stats"); err == nil {
+		t.Errorf("ran with a wrong secret: %s", resp)
+	}
+}
+
+func TestLoadSecret(t *testing.T) {
+	want := hex.EncodeToString(secret[:])
+	file := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(file, []byte(want+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name, env, file string
+		ok              bool
+	}{
+		{"env", want, "", true},
+		{"file", "", file, true},
+		{"file over env", "00", file, true},
+		{"none", "", "", false},
+		{"short", want[:30], "", false},
+		{"missing file", want, filepath.Join(t.TempDir(), "missing"), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(secretEnv, tt.env)
+			got, err := loadSecret(tt.file)
+			if tt.ok != (err == nil) || tt.ok && got != secret {
+				t.Errorf("loaded %x, %v", got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/chzyer/readline"
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/internal/tui"
+)
+
+// isTerminal reports whether stdin is a terminal the interactive mode can run on.
+// All readline usage stays in this file, so that the library does not pull it in.
+func isTerminal() bool {
+	return readline.DefaultIsTerminal()
+}
+
+// interactive adds the terminal UI to opts. The returned serve function
+// reads commands and messages until the user quits, stop releases the terminal.
+func interactive(ctx context.Context, cancel context.CancelFunc, client func() *chat.Client, opts []chat.ClientOption, lgr *slog.Logger) ([]chat.ClientOption, func(), func(), error) {
+	rl, err := readline.New("> ")
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create readline: %w", err)
+	}
+	show := func(line string) {
+		fmt.Fprintln(rl.Stdout(), "\r"+line)
+		rl.Refresh()
+	}
+	var (
+		rmtx   sync.Mutex
+		roster tui.Roster
+	)
+
+	opts = append(opts,
+		chat.ClientOptions.OnMessage(func(m *chat.Message) {
+			switch m.Type {
+			case chat.MsgTypeText:
+				show(tui.Message(m.Timestamp, "peer", string(m.Payload)))
+			case chat.MsgTypeBinary:
+				show(tui.Binary(m.Timestamp, "peer", len(m.Payload)))
+			}
+		}),
+		chat.ClientOptions.OnEvent(func(ev chat.Event) {
+			switch ev := ev.(type) {
+			case chat.NoticeEvent:
+				show(tui.Notice(ev.Reason, ev.Message, ev.Code.String()))
+			case chat.DrainEvent:
+				show(tui.Drain(ev.Deadline, time.Now()))
+			case chat.PresenceEvent:
+				rmtx.Lock()
+				roster.Set(ev.Sender, ev.Online)
+				rmtx.Unlock()
+				show(tui.Presence(ev.Sender, ev.Online))
+			}
+		}),
+	)
+
+	serve := func() {
+		client := client()
+		for {
+			line, err := rl.Readline()
+			if err != nil {
+				if err != readline.ErrInterrupt && err != io.EOF {
+					lgr.Error("failed to read input", "error", err)
+				}
+				cancel()
+				return
+			}
+			cmd, text, isCmd := tui.Parse(line)
+			if !isCmd {
+				if text == "" {
+					continue
+				}
+				if err = client.SendText(ctx, text); err != nil {
+					lgr.Error("failed to send message", "error", err)
+					continue
+				}
+				show(tui.Message(time.Now(), "me", text))
+				continue
+			}
+			switch cmd.Name {
+			case "quit":
+				// Dial returns once the server has ended the connection
+				if err = client.Close(); err != nil {
+					lgr.Error("failed to close session", "error", err)
+					cancel()
+				}
+				return
+			case "ping":
+				show(tui.RTT(client.RTT()))
+			case "who":
+				rmtx.Lock()
+				show(roster.String())
+				rmtx.Unlock()
+			case "token":
+				tok, err := client.Token()
+				if err != nil {
+					lgr.Error("failed to read token", "error", err)
+					continue
+				}
+				show(tui.Token(tok))
+			default:
+				show(tui.Help())
+			}
+		}
+	}
+	return opts, serve, func() { _ = rl.Close() }, nil
+}
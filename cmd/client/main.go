@@ -2,24 +2,111 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"io"
 	"log/slog"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"github.com/quic-go/quic-go"
 	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
 )
 
+// Exit codes of the client.
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+	exitConnect = 3
+	exitAuth    = 4
+)
+
+type mode int8
+
+const (
+	modeInteractive mode = iota
+	modePipe
+	modeOnce
+	modeListen
+)
+
+type config struct {
+	addr  string
+	cert  string
+	token string
+	insec bool
+	tofu  string
+	guest bool
+	mode  mode
+	// wait bounds how long the client waits for acknowledgements
+	// and for the server to end the connection before exiting.
+	wait time.Duration
+}
+
 func main() {
-	lgr := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	var cfg config
+	flag.StringVar(&cfg.addr, "addr", chat.DefaultAddr, "server address")
+	flag.StringVar(&cfg.cert, "cert", "cert.pem", "server certificate file")
+	flag.StringVar(&cfg.token, "token", "", "token file, defaults to $XDG_DATA_HOME/chat/token")
+	flag.BoolVar(&cfg.insec, "insecure", false, "skip server certificate verification")
+	flag.StringVar(&cfg.tofu, "tofu", "", "trust the server key on first use, recording it in this file")
+	flag.BoolVar(&cfg.guest, "guest", false, "log in as guest")
+	flag.DurationVar(&cfg.wait, "wait", 2*time.Second, "time to wait for acknowledgement before exiting")
+	once := flag.Bool("once", false, "send stdin as one message and exit")
+	listen := flag.Bool("listen", false, "print incoming messages line by line, do not send")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		_, _ = io.WriteString(out, "usage: client [flags]\n\n"+
+			"Without -once and -listen the client is interactive when stdin is a terminal,\n"+
+			"otherwise it sends every line of stdin and prints incoming messages.\n"+
+			"Exit codes: 1 failure, 2 usage, 3 connection failed, 4 authentication failed.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch {
+	case *once && *listen:
+		flag.Usage()
+		os.Exit(exitUsage)
+	case *once:
+		cfg.mode = modeOnce
+	case *listen:
+		cfg.mode = modeListen
+	case !isTerminal():
+		cfg.mode = modePipe
+	}
+
+	level := slog.LevelWarn
+	if cfg.mode == modeInteractive {
+		level = slog.LevelDebug
+	}
+	lgr := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
 	ctx, cancel := signal.NotifyContext(
 		context.Background(),
 		syscall.SIGINT,
 		syscall.SIGTERM,
 	)
+	code := run(ctx, cfg, os.Stdin, os.Stdout, lgr)
+	cancel()
+	os.Exit(code)
+}
+
+// run connects to the server and serves the connection
+// in the configured mode, returning the exit code.
+func run(ctx context.Context, cfg config, stdin io.Reader, stdout io.Writer, lgr *slog.Logger) int {
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	client := chat.NewClient(
-		chat.ClientOptions.Servers([]string{"localhost:4242"}),
+
+	opts := []chat.ClientOption{
+		chat.ClientOptions.Servers([]string{cfg.addr}),
+		chat.ClientOptions.Certs([]string{cfg.cert}),
+		chat.ClientOptions.Insec(cfg.insec),
 		chat.ClientOptions.Logger(func(lvl chat.LogLevel, msg string, arg ...any) {
 			switch lvl {
 			case chat.LogLevelDebug:
@@ -32,9 +119,94 @@ func main() {
 				lgr.Error(msg, arg...)
 			}
 		}),
-	)
-	if err := client.Dial(ctx); err != nil {
-		lgr.Error("failed while dial", "error", err)
-		cancel()
 	}
+	if cfg.token != "" {
+		opts = append(opts, chat.ClientOptions.TokenFile(cfg.token))
+	}
+	if cfg.guest {
+		opts = append(opts, chat.ClientOptions.Guest())
+	}
+	if cfg.tofu != "" {
+		opts = append(opts, chat.ClientOptions.TOFU(cfg.tofu))
+	}
+
+	var connected atomic.Bool
+	// result is the exit code decided by the mode, e.g. a failed send
+	var result atomic.Int32
+	var client *chat.Client
+	var serve func()
+	switch cfg.mode {
+	case modeInteractive:
+		var stop func()
+		var err error
+		opts, serve, stop, err = interactive(ctx, cancel, func() *chat.Client { return client }, opts, lgr)
+		if err != nil {
+			lgr.Error("failed to start terminal", "error", err)
+			return exitFailure
+		}
+		defer stop()
+	case modeOnce:
+		pld, err := io.ReadAll(stdin)
+		if err != nil {
+			lgr.Error("failed to read stdin", "error", err)
+			return exitFailure
+		}
+		var acked func([16]byte) bool
+		opts, acked = acks(opts)
+		serve = func() {
+			if err := sendOnce(ctx, client, pld, acked, cfg.wait); err != nil {
+				lgr.Error("failed to send message", "error", err)
+				result.Store(exitFailure)
+			}
+			closeAndWait(ctx, cancel, client, cfg.wait, lgr)
+		}
+	case modePipe:
+		opts = append(opts, chat.ClientOptions.OnMessage(printer(stdout)))
+		serve = func() {
+			if err := sendLines(ctx, client, stdin); err != nil {
+				lgr.Error("failed to send message", "error", err)
+				result.Store(exitFailure)
+			}
+			closeAndWait(ctx, cancel, client, cfg.wait, lgr)
+		}
+	case modeListen:
+		opts = append(opts, chat.ClientOptions.OnMessage(printer(stdout)))
+	}
+
+	opts = append(opts, chat.ClientOptions.OnConnect(func() {
+		connected.Store(true)
+		if serve != nil {
+			serve()
+		}
+	}))
+	client = chat.NewClient(opts...)
+	err := client.Dial(ctx)
+	if code := result.Load(); code != exitOK {
+		return int(code)
+	}
+	return exitCode(err, connected.Load())
+}
+
+// exitCode classifies the error Dial returned.
+func exitCode(err error, connected bool) int {
+	var appErr *quic.ApplicationError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, chat.ErrTokenDenied), errors.Is(err, chat.ErrAuthRequired),
+		errors.Is(err, chat.ErrGuestDenied), errors.Is(err, chat.ErrInvalidToken):
+		return exitAuth
+	case !connected && errors.As(err, &appErr):
+		switch codes.Code(appErr.ErrorCode) {
+		case codes.GuestDenied, codes.InvalidToken, codes.Forbidden:
+			return exitAuth
+		}
+		return exitConnect
+	case connected && errors.Is(err, context.Canceled):
+		// ended by the client itself or a signal
+		return exitOK
+	case !connected:
+		return exitConnect
+	}
+	return exitFailure
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func discard(ctx context.Context, s *chat.Session) {
+	for {
+		if _, err := s.Recv(ctx); err != nil {
+			return
+		}
+	}
+}
+
+// buffer is a bytes.Buffer safe for the printer and the test to share.
+type buffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *buffer) String() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.String()
+}
+
+// testConfig returns a config for the server at addr, skipping
+// verification of its in-memory certificate.
+func testConfig(t *testing.T, addr string, m mode) config {
+	return config{
+		addr:  addr,
+		token: filepath.Join(t.TempDir(), "token"),
+		insec: true,
+		mode:  m,
+		wait:  200 * time.Millisecond,
+	}
+}
+
+func TestOnce(t *testing.T) {
+	got := make(chan string, 1)
+	addr, _ := chattest.StartServer(t, func(ctx context.Context, s *chat.Session) {
+		m, err := s.Recv(ctx)
+		if err != nil {
+			return
+		}
+		got <- string(m.Payload)
+		discard(ctx, s)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	code := run(ctx, testConfig(t, addr, modeOnce), strings.NewReader("deploy done\n"), io.Discard, quiet)
+	if code != exitOK {
+		t.Errorf("exit code %d, want %d", code, exitOK)
+	}
+	select {
+	case pld := <-got:
+		if pld != "deploy done" {
+			t.Errorf("server received %q, want %q", pld, "deploy done")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("server received no message")
+	}
+}
+
+func TestListen(t *testing.T) {
+	addr, _ := chattest.StartServer(t, func(ctx context.Context, s *chat.Session) {
+		for _, text := range []string{"first", "second"} {
+			if err := s.Send(ctx, chat.NewTextMessage([]byte(text))); err != nil {
+				return
+			}
+		}
+		discard(ctx, s)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var out buffer
+	done := make(chan int, 1)
+	go func() { done <- run(ctx, testConfig(t, addr, modeListen), nil, &out, quiet) }()
+	for out.String() != "first\nsecond\n" {
+		select {
+		case code := <-done:
+			t.Fatalf("run returned %d, printed %q", code, out.String())
+		case <-ctx.Done():
+			t.Fatalf("printed %q, want both lines", out.String())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	cancel()
+	if code := <-done; code != exitOK {
+		t.Errorf("exit code %d, want %d", code, exitOK)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	addr, _ := chattest.StartServer(t, discard)
+
+	// a port nothing listens on
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := pc.LocalAddr().String()
+	_ = pc.Close()
+
+	for _, tt := range []struct {
+		name  string
+		addr  string
+		guest bool
+		want  int
+	}{
+		{"guest denied", addr, true, exitAuth},
+		{"unreachable", closed, false, exitConnect},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			cfg := testConfig(t, tt.addr, modeOnce)
+			cfg.guest = tt.guest
+			if code := run(ctx, cfg, strings.NewReader("hello"), io.Discard, quiet); code != tt.want {
+				t.Errorf("exit code %d, want %d", code, tt.want)
+			}
+		})
+	}
+}
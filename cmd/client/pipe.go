@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+// printer returns an OnMessage function writing text payloads to w line by line.
+func printer(w io.Writer) func(*chat.Message) {
+	var mtx sync.Mutex
+	return func(m *chat.Message) {
+		if m.Type != chat.MsgTypeText {
+			return
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		_, _ = fmt.Fprintln(w, string(bytes.TrimRight(m.Payload, "\n")))
+	}
+}
+
+// acks records the message IDs acknowledged by the server.
+// The returned function reports whether id has been acknowledged.
+func acks(opts []chat.ClientOption) ([]chat.ClientOption, func(id [16]byte) bool) {
+	var mtx sync.Mutex
+	acked := make(map[[16]byte]struct{})
+	opts = append(opts, chat.ClientOptions.OnMessage(func(m *chat.Message) {
+		rcpt, err := m.Receipt()
+		if err != nil || rcpt.Kind != chat.AckDelivery {
+			return
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		for _, id := range rcpt.IDs {
+			acked[id] = struct{}{}
+		}
+	}))
+	return opts, func(id [16]byte) bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		_, ok := acked[id]
+		return ok
+	}
+}
+
+// sendOnce sends pld as one message asking for a delivery receipt,
+// then waits up to wait for it. Servers not sending receipts
+// only delay the exit.
+func sendOnce(ctx context.Context, client *chat.Client, pld []byte, acked func([16]byte) bool, wait time.Duration) error {
+	m := chat.NewTextMessage(bytes.TrimRight(pld, "\n"))
+	m.SetFlag(chat.FlagAckRequested, true)
+	if err := client.SendMessage(ctx, m); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(wait)
+	for !acked(m.ID) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return nil
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// sendLines sends every non-empty line read from r as a message.
+func sendLines(ctx context.Context, client *chat.Client, r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		if err := client.Send(ctx, slices.Clone(sc.Bytes())); err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("failed to read stdin: %w", err)
+	}
+	return nil
+}
+
+// closeAndWait closes the session and gives the server wait to end
+// the connection before cancelling it.
+func closeAndWait(ctx context.Context, cancel context.CancelFunc, client *chat.Client, wait time.Duration, lgr *slog.Logger) {
+	if err := client.Close(); err != nil {
+		lgr.Error("failed to close session", "error", err)
+		cancel()
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(wait):
+		cancel()
+	}
+}
@@ -2,33 +2,87 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/zhmlst/chat"
 )
 
-type InmemTokenRepo map[[16]byte]struct{}
-
-func (i InmemTokenRepo) SaveToken(_ context.Context, tok [16]byte) error {
-	i[tok] = struct{}{}
-	return nil
+type config struct {
+	addr      string
+	cert      string
+	key       string
+	dev       bool
+	logLevel  chat.LogLevel
+	logFile   string
+	tokenFile string
+	maxTokens int
+	tokenTTL  time.Duration
+	mode      string
 }
-func (i InmemTokenRepo) HasToken(_ context.Context, tok [16]byte) (bool, error) {
-	_, ok := i[tok]
-	return ok, nil
+
+// parseConfig parses the command line flags. Flags not given
+// fall back to CHAT_* environment variables, e.g. CHAT_ADDR for -addr.
+func parseConfig(args []string, getenv func(string) string) (config, error) {
+	env := func(name, def string) string {
+		if v := getenv(name); v != "" {
+			return v
+		}
+		return def
+	}
+	var cfg config
+	var level, maxTokens, tokenTTL string
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.StringVar(&cfg.addr, "addr", env("CHAT_ADDR", chat.DefaultAddr), "comma separated listen addresses, env CHAT_ADDR")
+	fs.StringVar(&cfg.cert, "cert", env("CHAT_CERT", "cert.pem"), "TLS certificate file, env CHAT_CERT")
+	fs.StringVar(&cfg.key, "key", env("CHAT_KEY", "key.pem"), "TLS key file, env CHAT_KEY")
+	fs.BoolVar(&cfg.dev, "dev", env("CHAT_DEV", "") != "", "use a self-signed certificate, env CHAT_DEV")
+	fs.StringVar(&level, "log-level", env("CHAT_LOG_LEVEL", "debug"), "debug, info, warn or error, env CHAT_LOG_LEVEL")
+	fs.StringVar(&cfg.logFile, "log-file", env("CHAT_LOG_FILE", "server.log"), "log file, empty to log to stdout only, env CHAT_LOG_FILE")
+	fs.StringVar(&cfg.tokenFile, "token-file", env("CHAT_TOKEN_FILE", ""), "token file, tokens are kept in memory if empty, env CHAT_TOKEN_FILE")
+	fs.StringVar(&maxTokens, "max-tokens", env("CHAT_MAX_TOKENS", "100000"), "in-memory tokens kept at most, 0 for no limit, env CHAT_MAX_TOKENS")
+	fs.StringVar(&tokenTTL, "token-ttl", env("CHAT_TOKEN_TTL", "720h"), "in-memory tokens unused for this long are dropped, 0 to keep them, env CHAT_TOKEN_TTL")
+	fs.StringVar(&cfg.mode, "mode", env("CHAT_MODE", "echo"), "echo or hub, env CHAT_MODE")
+	if err := fs.Parse(args); err != nil {
+		return config{}, err
+	}
+	if fs.NArg() > 0 {
+		return config{}, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	var err error
+	if cfg.logLevel, err = chat.LogLevelString(level); err != nil {
+		return config{}, fmt.Errorf("invalid log level %q", level)
+	}
+	if cfg.maxTokens, err = strconv.Atoi(maxTokens); err != nil || cfg.maxTokens < 0 {
+		return config{}, fmt.Errorf("invalid max tokens %q", maxTokens)
+	}
+	if cfg.tokenTTL, err = time.ParseDuration(tokenTTL); err != nil || cfg.tokenTTL < 0 {
+		return config{}, fmt.Errorf("invalid token ttl %q", tokenTTL)
+	}
+	if cfg.mode != "echo" && cfg.mode != "hub" {
+		return config{}, fmt.Errorf("invalid mode %q", cfg.mode)
+	}
+	return cfg, nil
 }
 
 func main() {
-	logfile, err := os.OpenFile("server.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
-	if err != nil {
+	cfg, err := parseConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
 		return
 	}
-	lgr := slog.New(slog.NewTextHandler(io.MultiWriter(logfile, os.Stdout), &slog.HandlerOptions{Level: slog.LevelDebug}))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
 	ctx, cancel := signal.NotifyContext(
 		context.Background(),
@@ -37,23 +91,37 @@ func main() {
 	)
 	defer cancel()
 
-	inmemTokenRepo := make(InmemTokenRepo)
-	server := chat.NewServer(
-		chat.ServerOptions.Handler(func(ctx context.Context, s *chat.Session) {
-			lgr.Info("session started")
-			in, out := s.Input(ctx), s.Output(ctx)
-			defer func() { close(out); lgr.Info("session stopped") }()
+	if err := run(ctx, cfg, nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
 
-			out <- []byte("hello from server")
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case msg := <-in:
-					out <- msg
-				}
-			}
-		}),
+// run serves until ctx is done. If ready is not nil, it is
+// called with the server once the server is listening.
+func run(ctx context.Context, cfg config, ready func(*chat.Server)) error {
+	out := io.Writer(os.Stdout)
+	if cfg.logFile != "" {
+		logfile, err := os.OpenFile(cfg.logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+		if err != nil {
+			return fmt.Errorf("open log file: %w", err)
+		}
+		defer logfile.Close()
+		out = io.MultiWriter(logfile, os.Stdout)
+	}
+	lgr := slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	var repo chat.TokenRepo = chat.NewMemTokenRepo(cfg.maxTokens, cfg.tokenTTL)
+	if cfg.tokenFile != "" {
+		var err error
+		if repo, err = OpenFileTokenRepo(cfg.tokenFile); err != nil {
+			return err
+		}
+	}
+
+	opts := []chat.ServerOption{
+		chat.ServerOptions.Addresses(strings.Split(cfg.addr, ",")...),
+		chat.ServerOptions.Handler(handler(cfg.mode)),
 		chat.ServerOptions.Logger(func(lvl chat.LogLevel, msg string, arg ...any) {
 			switch lvl {
 			case chat.LogLevelDebug:
@@ -66,21 +134,59 @@ func main() {
 				lgr.Error(msg, arg...)
 			}
 		}),
-		chat.ServerOptions.TokenRepo(inmemTokenRepo),
-	)
+		chat.ServerOptions.TokenRepo(repo),
+	}
+	if cfg.dev {
+		opts = append(opts, chat.ServerOptions.DevTLS())
+	} else {
+		opts = append(opts, chat.ServerOptions.TLSCertFile(cfg.cert), chat.ServerOptions.TLSKeyFile(cfg.key))
+	}
+	server := chat.NewServer(opts...)
+	server.SetLogLevel(cfg.logLevel)
 
-	lgr.Info("starting server")
-	go func() {
-		if err := server.Run(); err != nil {
-			lgr.Error("server run: %v", "error", err)
-			return
+	lgr.Info("starting server", "addr", cfg.addr, "mode", cfg.mode)
+	errCh := make(chan error, 1)
+	go func() { errCh <- server.Run() }()
+
+	if ready != nil {
+		for server.Addr() == nil {
+			select {
+			case err := <-errCh:
+				return fmt.Errorf("server run: %w", err)
+			case <-time.After(10 * time.Millisecond):
+			}
 		}
-	}()
+		ready(server)
+	}
 
-	<-ctx.Done()
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("server run: %w", err)
+	case <-ctx.Done():
+	}
+	if server.Addr() == nil {
+		// not listening yet, nothing to shut down
+		return nil
+	}
 	lgr.Info("shutting down server")
-	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
-	if err := server.Shutdown(ctx); err != nil {
-		lgr.Error("server shutdown: %v", "error", err)
+	sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(sctx); err != nil {
+		return fmt.Errorf("server shutdown: %w", err)
 	}
+	return nil
+}
+
+// handler returns the example handler of the mode.
+func handler(mode string) chat.Handler {
+	if mode == "hub" {
+		return chat.NewHub().Serve
+	}
+	router := chat.NewRouter()
+	router.OnText(func(ctx context.Context, s *chat.Session, m *chat.Message) {
+		if err := s.Send(ctx, chat.NewTextMessage(m.Payload)); err != nil {
+			s.Logger().With("error", err).Error("failed to echo message")
+		}
+	})
+	return router.Serve
 }
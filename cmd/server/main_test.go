@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+)
+
+func TestParseConfig(t *testing.T) {
+	def := config{
+		addr:      chat.DefaultAddr,
+		cert:      "cert.pem",
+		key:       "key.pem",
+		logLevel:  chat.LogLevelDebug,
+		logFile:   "server.log",
+		maxTokens: 100000,
+		tokenTTL:  720 * time.Hour,
+		mode:      "echo",
+	}
+	for _, tt := range []struct {
+		name string
+		args []string
+		env  map[string]string
+		want func(*config)
+	}{
+		{name: "defaults"},
+		{
+			name: "flags",
+			args: []string{"-addr", ":1,:2", "-cert", "c", "-key", "k", "-dev", "-log-level", "warn",
+				"-log-file", "", "-token-file", "toks", "-max-tokens", "0", "-token-ttl", "1h", "-mode", "hub"},
+			want: func(cfg *config) {
+				*cfg = config{addr: ":1,:2", cert: "c", key: "k", dev: true, logLevel: chat.LogLevelWarn,
+					tokenFile: "toks", tokenTTL: time.Hour, mode: "hub"}
+			},
+		},
+		{
+			name: "env",
+			env:  map[string]string{"CHAT_ADDR": ":3", "CHAT_DEV": "1", "CHAT_LOG_LEVEL": "error", "CHAT_MODE": "hub"},
+			want: func(cfg *config) {
+				cfg.addr, cfg.dev, cfg.logLevel, cfg.mode = ":3", true, chat.LogLevelError, "hub"
+			},
+		},
+		{
+			name: "flag over env",
+			args: []string{"-addr", ":4"},
+			env:  map[string]string{"CHAT_ADDR": ":3"},
+			want: func(cfg *config) { cfg.addr = ":4" },
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			want := def
+			if tt.want != nil {
+				tt.want(&want)
+			}
+			got, err := parseConfig(tt.args, func(name string) string { return tt.env[name] })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("config %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		{"-log-level", "loud"},
+		{"-max-tokens", "-1"},
+		{"-token-ttl", "soon"},
+		{"-mode", "relay"},
+		{"-unknown"},
+		{"extra"},
+	} {
+		if _, err := parseConfig(args, func(string) string { return "" }); err == nil {
+			t.Errorf("%v: no error", args)
+		}
+	}
+	if _, err := parseConfig([]string{"-h"}, func(string) string { return "" }); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("-h: %v, want flag.ErrHelp", err)
+	}
+}
+
+func TestRunDev(t *testing.T) {
+	cfg := config{
+		addr:     "127.0.0.1:0",
+		dev:      true,
+		logLevel: chat.LogLevelError,
+		logFile:  filepath.Join(t.TempDir(), "server.log"),
+		mode:     "echo",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, cfg, func(s *chat.Server) { addrs <- s.Addr().String() }) }()
+
+	var addr string
+	select {
+	case addr = <-addrs:
+	case err := <-done:
+		t.Fatalf("run: %v", err)
+	}
+
+	echo := make(chan string, 1)
+	var c *chat.Client
+	c = chattest.NewClient(t, addr, nil,
+		chat.ClientOptions.Insec(true),
+		chat.ClientOptions.OnConnect(func() {
+			if err := c.Send(ctx, []byte("ping")); err != nil {
+				t.Errorf("send: %v", err)
+			}
+		}),
+		chat.ClientOptions.OnMessage(func(m *chat.Message) {
+			if m.Type == chat.MsgTypeText {
+				echo <- string(m.Payload)
+			}
+		}),
+	)
+	go func() { _ = c.Dial(ctx) }()
+	select {
+	case got := <-echo:
+		if got != "ping" {
+			t.Errorf("echo %q, want %q", got, "ping")
+		}
+	case <-ctx.Done():
+		t.Fatal("no echo")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("run: %v", err)
+	}
+}
+
+func TestRunLogFileError(t *testing.T) {
+	cfg := config{
+		addr:    "127.0.0.1:0",
+		dev:     true,
+		logFile: filepath.Join(t.TempDir(), "missing", "server.log"),
+		mode:    "echo",
+	}
+	if err := run(context.Background(), cfg, nil); err == nil {
+		t.Error("run with an unwritable log file: no error")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+)
+
+type InmemTokenRepo map[[16]byte]struct{}
+
+func (i InmemTokenRepo) SaveToken(_ context.Context, tok [16]byte) error {
+	i[tok] = struct{}{}
+	return nil
+}
+func (i InmemTokenRepo) HasToken(_ context.Context, tok [16]byte) (bool, error) {
+	_, ok := i[tok]
+	return ok, nil
+}
+
+func (i InmemTokenRepo) DeleteToken(_ context.Context, tok [16]byte) error {
+	delete(i, tok)
+	return nil
+}
+
+// FileTokenRepo keeps tokens in a file, one hex encoded token per line.
+type FileTokenRepo struct {
+	file string
+
+	mtx  sync.Mutex
+	toks InmemTokenRepo
+}
+
+// OpenFileTokenRepo loads the tokens of file, which is created if missing.
+func OpenFileTokenRepo(file string) (*FileTokenRepo, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open token file: %w", err)
+	}
+	defer f.Close()
+
+	r := &FileTokenRepo{file: file, toks: make(InmemTokenRepo)}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		raw, err := hex.DecodeString(sc.Text())
+		if err != nil || len(raw) != 16 {
+			return nil, fmt.Errorf("token file %s:%d: invalid token", file, n)
+		}
+		r.toks[[16]byte(raw)] = struct{}{}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read token file: %w", err)
+	}
+	return r, nil
+}
+
+func (r *FileTokenRepo) SaveToken(_ context.Context, tok [16]byte) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	f, err := os.OpenFile(r.file, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("open token file: %w", err)
+	}
+	if _, err = fmt.Fprintln(f, hex.EncodeToString(tok[:])); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("write token file: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("close token file: %w", err)
+	}
+	r.toks[tok] = struct{}{}
+	return nil
+}
+
+func (r *FileTokenRepo) HasToken(ctx context.Context, tok [16]byte) (bool, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.toks.HasToken(ctx, tok)
+}
+
+// DeleteToken removes the token and rewrites the file.
+func (r *FileTokenRepo) DeleteToken(_ context.Context, tok [16]byte) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.toks[tok]; !ok {
+		return nil
+	}
+	tmp := r.file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("create token file: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	for t := range r.toks {
+		if t != tok {
+			fmt.Fprintln(w, hex.EncodeToString(t[:]))
+		}
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Close()
+	} else {
+		_ = f.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("write token file: %w", err)
+	}
+	if err = os.Rename(tmp, r.file); err != nil {
+		return fmt.Errorf("replace token file: %w", err)
+	}
+	delete(r.toks, tok)
+	return nil
+}
@@ -0,0 +1,114 @@
+package chat
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+)
+
+const (
+	// idBatch is the number of message IDs read from crypto/rand at once.
+	idBatch = 64
+	// payloadChunk is how much of the declared length of a payload is
+	// allocated up front, the rest grows as the payload arrives.
+	payloadChunk = 64 << 10
+)
+
+// codec frames the messages of a session, reusing its header buffers
+// and taking IDs from a buffer of its own. The session reads and writes
+// on different goroutines, each using its own header buffer.
+type codec struct {
+	rhdr [hdrLen]byte
+	whdr [hdrLen]byte
+	// ids serves the writer stamping messages.
+	ids ids
+}
+
+// read reads the next message from r, see readLimited.
+func (c *codec) read(r io.Reader, limit int) (*Message, error) {
+	m := new(Message)
+	if _, err := m.readFrom(r, &c.rhdr, limit); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeTo writes the framed message to w.
+func (c *codec) writeTo(w io.Writer, m *Message) (int64, error) {
+	return m.writeTo(w, &c.whdr)
+}
+
+// ids hands out message IDs from random bytes read idBatch IDs at a time,
+// saving a crypto/rand call per message.
+type ids struct {
+	buf [16 * idBatch]byte
+	// left is the number of unused bytes at the end of buf.
+	left int
+}
+
+// next reads the next ID into id, refilling the buffer from r if needed.
+func (b *ids) next(r io.Reader, id *[16]byte) error {
+	if b.left == 0 {
+		if _, err := io.ReadFull(r, b.buf[:]); err != nil {
+			return err
+		}
+		b.left = len(b.buf)
+	}
+	off := len(b.buf) - b.left
+	copy(id[:], b.buf[off:off+16])
+	b.left -= 16
+	return nil
+}
+
+// defaultIDs serves the IDs of messages stamped by other than a session writer.
+var defaultIDs struct {
+	sync.Mutex
+	ids
+}
+
+// newID reads a random ID from src, unless it has an IDGenerator. IDs
+// from crypto/rand are taken from buf, or from a buffer shared by all
+// sessions if buf is nil, others are read one by one, so that
+// a deterministic Source yields the same IDs whichever way it is read.
+func (src Source) newID(id *[16]byte, buf *ids) error {
+	var err error
+	switch {
+	case src.IDs != nil:
+		*id, err = src.IDs.NewID()
+	case src.Rand != rand.Reader:
+		_, err = io.ReadFull(src.Rand, id[:])
+	case buf != nil:
+		err = buf.next(src.Rand, id)
+	default:
+		defaultIDs.Lock()
+		err = defaultIDs.next(src.Rand, id)
+		defaultIDs.Unlock()
+	}
+	if err != nil {
+		return fmt.Errorf("msg id gen: %w", err)
+	}
+	return nil
+}
+
+// readPayload reads a payload of size bytes from r. Rather than trusting
+// size, it allocates at most payloadChunk bytes up front and doubles
+// the buffer as the payload arrives.
+func readPayload(r io.Reader, size int64) ([]byte, error) {
+	pld := make([]byte, 0, min(size, payloadChunk))
+	for int64(len(pld)) < size {
+		if len(pld) == cap(pld) {
+			pld = slices.Grow(pld, int(min(size-int64(len(pld)), int64(len(pld)))))
+		}
+		n, err := r.Read(pld[len(pld):min(int64(cap(pld)), size)])
+		pld = pld[:len(pld)+n]
+		if err == io.EOF && int64(len(pld)) < size {
+			return pld, io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
+			return pld, err
+		}
+	}
+	return pld, nil
+}
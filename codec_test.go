@@ -0,0 +1,132 @@
+package chat_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestStampUnique(t *testing.T) {
+	const (
+		stampers = 8
+		each     = 2000
+	)
+	// more than a batch of IDs per stamper, drawn concurrently
+	ids := make(chan [16]byte, stampers*each)
+	var wg sync.WaitGroup
+	for range stampers {
+		wg.Go(func() {
+			for range each {
+				var m chat.Message
+				if err := m.Stamp(chat.DefaultSource); err != nil {
+					t.Error(err)
+					return
+				}
+				ids <- m.ID
+			}
+		})
+	}
+	wg.Wait()
+	close(ids)
+	seen := make(map[[16]byte]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("ID %x drawn twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestSessionIDsUnique(t *testing.T) {
+	const n = 300
+	ids := make(chan [16]byte, n)
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		for {
+			m, err := s.Recv(ctx)
+			if err != nil {
+				return
+			}
+			ids <- m.ID
+		}
+	})
+	// stamped by the writers of sessions on two connections
+	clients := []*chat.Client{connect(t, addr, ca), connect(t, addr, ca)}
+	for i := range n {
+		m := &chat.Message{Type: chat.MsgTypeText, Payload: []byte("x")}
+		if err := clients[i%2].SendMessage(t.Context(), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := make(map[[16]byte]bool)
+	for range n {
+		id := receive(t, ids)
+		if id == [16]byte{} || seen[id] {
+			t.Fatalf("ID %x zero or received twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+// textFrame returns a stamped text message with a 128-byte payload
+// and its encoding.
+func textFrame(b *testing.B) (*chat.Message, []byte) {
+	m := chat.NewTextMessage(bytes.Repeat([]byte("x"), 128))
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		b.Fatal(err)
+	}
+	return m, buf.Bytes()
+}
+
+func BenchmarkEncode(b *testing.B) {
+	m, enc := textFrame(b)
+	b.SetBytes(int64(len(enc)))
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := m.WriteTo(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	_, enc := textFrame(b)
+	r := bytes.NewReader(enc)
+	b.SetBytes(int64(len(enc)))
+	b.ReportAllocs()
+	for b.Loop() {
+		r.Reset(enc)
+		var m chat.Message
+		if _, err := m.ReadFrom(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStamp(b *testing.B) {
+	for _, bb := range []struct {
+		name string
+		src  chat.Source
+	}{
+		{"batched", chat.DefaultSource},
+		// read from crypto/rand one ID at a time, as before batching
+		{"unbatched", chat.Source{Rand: struct{ io.Reader }{rand.Reader}, Now: time.Now}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			var m chat.Message
+			b.ReportAllocs()
+			for b.Loop() {
+				m.ID = [16]byte{}
+				if err := m.Stamp(bb.src); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -23,4 +23,60 @@ const (
 	// Done indicates a normal termination of the connection, i.e.,
 	// the server is done interacting and closes the connection gracefully.
 	Done // bye
+
+	// GuestDenied indicates that the client asked for a guest session
+	// but the server does not admit guests.
+	GuestDenied // guests not allowed
+
+	// InvalidToken indicates that the server refused to issue or
+	// accept the client's token.
+	InvalidToken // invalid token
+
+	// RateLimited indicates that the client exceeded the message rate
+	// allowed for its token.
+	RateLimited // rate limited
+
+	// PolicyViolation indicates that the client sent too many messages
+	// rejected by the server's content filter.
+	PolicyViolation // policy violation
+
+	// Internal indicates that the server failed while serving the
+	// session, e.g. the handler panicked.
+	Internal // internal error
+
+	// Forbidden indicates that the client address is not allowed
+	// to connect to the server.
+	Forbidden // forbidden
+
+	// SessionReplaced indicates that the session was closed because
+	// the same token logged in again, see DuplicateLoginPolicy.
+	SessionReplaced // session replaced
+
+	// DuplicateLogin indicates that the server refused the login
+	// because the token already has an active session.
+	DuplicateLogin // duplicate login
+
+	// IdleTimeout indicates that the peer sent nothing within
+	// the negotiated heartbeat timeout.
+	IdleTimeout // idle timeout
+
+	// SlowConsumer indicates that the session could not keep up
+	// with the messages relayed to it, see chat.SlowMemberDisconnect.
+	SlowConsumer // slow consumer
+
+	// FrameTooLarge indicates that the peer sent a frame with a payload
+	// larger than the limit negotiated in the handshake.
+	FrameTooLarge // frame too large
+
+	// ProtocolError indicates that the peer spoke a different protocol,
+	// e.g. a token handshake to a server running raw sessions.
+	ProtocolError // protocol error
+
+	// Redirected indicates that the server sent the client to another
+	// server, whose address is the detail of the close reason.
+	Redirected // redirected
+
+	// HandlerTimeout indicates that the session handler did not return
+	// within the handler timeout and its grace period.
+	HandlerTimeout // handler timeout
 )
@@ -7,11 +7,11 @@ import (
 	"strings"
 )
 
-const _CodeName = "stop serverto many connectionsbye"
+const _CodeName = "stop serverto many connectionsbyeguests not allowedinvalid tokenrate limitedpolicy violationinternal errorforbiddensession replacedduplicate loginidle timeoutslow consumerframe too largeprotocol errorredirectedhandler timeout"
 
-var _CodeIndex = [...]uint8{0, 11, 30, 33}
+var _CodeIndex = [...]uint8{0, 11, 30, 33, 51, 64, 76, 92, 106, 115, 131, 146, 158, 171, 186, 200, 210, 225}
 
-const _CodeLowerName = "stop serverto many connectionsbye"
+const _CodeLowerName = "stop serverto many connectionsbyeguests not allowedinvalid tokenrate limitedpolicy violationinternal errorforbiddensession replacedduplicate loginidle timeoutslow consumerframe too largeprotocol errorredirectedhandler timeout"
 
 func (i Code) String() string {
 	if i >= Code(len(_CodeIndex)-1) {
@@ -27,23 +27,79 @@ func _CodeNoOp() {
 	_ = x[StopServer-(0)]
 	_ = x[ToManyConns-(1)]
 	_ = x[Done-(2)]
+	_ = x[GuestDenied-(3)]
+	_ = x[InvalidToken-(4)]
+	_ = x[RateLimited-(5)]
+	_ = x[PolicyViolation-(6)]
+	_ = x[Internal-(7)]
+	_ = x[Forbidden-(8)]
+	_ = x[SessionReplaced-(9)]
+	_ = x[DuplicateLogin-(10)]
+	_ = x[IdleTimeout-(11)]
+	_ = x[SlowConsumer-(12)]
+	_ = x[FrameTooLarge-(13)]
+	_ = x[ProtocolError-(14)]
+	_ = x[Redirected-(15)]
+	_ = x[HandlerTimeout-(16)]
 }
 
-var _CodeValues = []Code{StopServer, ToManyConns, Done}
+var _CodeValues = []Code{StopServer, ToManyConns, Done, GuestDenied, InvalidToken, RateLimited, PolicyViolation, Internal, Forbidden, SessionReplaced, DuplicateLogin, IdleTimeout, SlowConsumer, FrameTooLarge, ProtocolError, Redirected, HandlerTimeout}
 
 var _CodeNameToValueMap = map[string]Code{
-	_CodeName[0:11]:       StopServer,
-	_CodeLowerName[0:11]:  StopServer,
-	_CodeName[11:30]:      ToManyConns,
-	_CodeLowerName[11:30]: ToManyConns,
-	_CodeName[30:33]:      Done,
-	_CodeLowerName[30:33]: Done,
+	_CodeName[0:11]:         StopServer,
+	_CodeLowerName[0:11]:    StopServer,
+	_CodeName[11:30]:        ToManyConns,
+	_CodeLowerName[11:30]:   ToManyConns,
+	_CodeName[30:33]:        Done,
+	_CodeLowerName[30:33]:   Done,
+	_CodeName[33:51]:        GuestDenied,
+	_CodeLowerName[33:51]:   GuestDenied,
+	_CodeName[51:64]:        InvalidToken,
+	_CodeLowerName[51:64]:   InvalidToken,
+	_CodeName[64:76]:        RateLimited,
+	_CodeLowerName[64:76]:   RateLimited,
+	_CodeName[76:92]:        PolicyViolation,
+	_CodeLowerName[76:92]:   PolicyViolation,
+	_CodeName[92:106]:       Internal,
+	_CodeLowerName[92:106]:  Internal,
+	_CodeName[106:115]:      Forbidden,
+	_CodeLowerName[106:115]: Forbidden,
+	_CodeName[115:131]:      SessionReplaced,
+	_CodeLowerName[115:131]: SessionReplaced,
+	_CodeName[131:146]:      DuplicateLogin,
+	_CodeLowerName[131:146]: DuplicateLogin,
+	_CodeName[146:158]:      IdleTimeout,
+	_CodeLowerName[146:158]: IdleTimeout,
+	_CodeName[158:171]:      SlowConsumer,
+	_CodeLowerName[158:171]: SlowConsumer,
+	_CodeName[171:186]:      FrameTooLarge,
+	_CodeLowerName[171:186]: FrameTooLarge,
+	_CodeName[186:200]:      ProtocolError,
+	_CodeLowerName[186:200]: ProtocolError,
+	_CodeName[200:210]:      Redirected,
+	_CodeLowerName[200:210]: Redirected,
+	_CodeName[210:225]:      HandlerTimeout,
+	_CodeLowerName[210:225]: HandlerTimeout,
 }
 
 var _CodeNames = []string{
 	_CodeName[0:11],
 	_CodeName[11:30],
 	_CodeName[30:33],
+	_CodeName[33:51],
+	_CodeName[51:64],
+	_CodeName[64:76],
+	_CodeName[76:92],
+	_CodeName[92:106],
+	_CodeName[106:115],
+	_CodeName[115:131],
+	_CodeName[131:146],
+	_CodeName[146:158],
+	_CodeName[158:171],
+	_CodeName[171:186],
+	_CodeName[186:200],
+	_CodeName[200:210],
+	_CodeName[210:225],
 }
 
 // CodeString retrieves an enum value from the enum constants string name.
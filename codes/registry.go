@@ -0,0 +1,38 @@
+package codes
+
+import (
+	"fmt"
+	"sync"
+)
+
+var (
+	mtx   sync.RWMutex
+	names = make(map[Code]string)
+)
+
+// Register names an application defined code, e.g. one a handler passes
+// to Session.Abort, so that the peer receiving it can report it by name.
+// It panics if the code is built in or already registered.
+func Register(c Code, name string) {
+	if c.IsACode() {
+		panic(fmt.Sprintf("codes: register built-in code %s", c))
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if prev, ok := names[c]; ok {
+		panic(fmt.Sprintf("codes: code %d already registered as %q", uint64(c), prev))
+	}
+	names[c] = name
+}
+
+// Name returns the name of a built-in or registered code,
+// or false if the code is unknown.
+func Name(c Code) (string, bool) {
+	if c.IsACode() {
+		return c.String(), true
+	}
+	mtx.RLock()
+	defer mtx.RUnlock()
+	name, ok := names[c]
+	return name, ok
+}
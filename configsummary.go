@@ -0,0 +1,216 @@
+package chat
+
+import (
+	"crypto/rand"
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// ConfigSummary returns the effective configuration of the server by
+// option, e.g. to find out what a deployed server runs with: addresses,
+// the TLS source, timeouts, limits and the hooks set. Secrets such as the
+// admin and cluster secrets are never included, only whether they are set.
+// "defaulted" lists the entries left at their default. Run logs it.
+func (s *Server) ConfigSummary() map[string]any {
+	summary := s.cfg.summary()
+	defaults := defaultServerConfig()
+	defaulted(summary, defaults.summary(), "instance")
+	return summary
+}
+
+// ConfigSummary returns the effective configuration of the client by
+// option, like Server.ConfigSummary. The path of the token file is
+// included, tokens are not, nor the registration payload, which may be
+// an invite code. The first Dial logs it.
+func (c *Client) ConfigSummary() map[string]any {
+	summary := c.cfg.summary()
+	defaults := defaultClientConfig()
+	defaulted(summary, defaults.summary())
+	return summary
+}
+
+// logConfig logs the summary of the configuration of the client once.
+func (c *Client) logConfig() {
+	c.summaryOnce.Do(func() {
+		c.cfg.logger.With("config", c.ConfigSummary()).Info("client configuration")
+	})
+}
+
+// defaulted adds the sorted keys of the summary equal to those of the
+// summary of the defaults as "defaulted", but for the keys skipped.
+func defaulted(summary, defaults map[string]any, skip ...string) {
+	var keys []string
+	for k, v := range summary {
+		if d, ok := defaults[k]; ok && !slices.Contains(skip, k) && reflect.DeepEqual(v, d) {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	summary["defaulted"] = keys
+}
+
+// hooks returns the names of the hooks set.
+func hooks(set map[string]bool) []string {
+	var names []string
+	for name, ok := range set {
+		if ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// capNames returns the names of the capabilities.
+func capNames(caps []Capability) []string {
+	var names []string
+	for _, c := range caps {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// summary describes the source, "default" unless it was replaced.
+func (src Source) summary() string {
+	switch {
+	case src.IDs != nil:
+		return "custom ids"
+	case src.Rand != rand.Reader:
+		return "custom"
+	}
+	return "default"
+}
+
+func (cfg *serverConfig) summary() map[string]any {
+	tlsSource := "files"
+	switch {
+	case cfg.tlsCert != nil:
+		tlsSource = "certificate"
+	case cfg.devTLS:
+		tlsSource = "dev"
+	}
+	var allow, deny []string
+	for _, p := range cfg.ipFilter.allow {
+		allow = append(allow, p.String())
+	}
+	for _, p := range cfg.ipFilter.deny {
+		deny = append(deny, p.String())
+	}
+	summary := map[string]any{
+		"addresses":          cfg.addresses,
+		"best_effort":        cfg.bestEffort,
+		"tls":                tlsSource,
+		"health_addr":        cfg.healthAddr,
+		"max_streams":        cfg.maxStreams,
+		"max_conns":          cfg.maxConns,
+		"max_payload":        cfg.maxPayload,
+		"allow_0rtt":         cfg.allow0RTT,
+		"no_auth":            cfg.noAuth,
+		"raw":                cfg.raw,
+		"strict":             cfg.strict,
+		"instance":           cfg.instance,
+		"allow_guests":       cfg.allowGuests,
+		"token_repo":         fmt.Sprintf("%T", cfg.tokenRepo),
+		"token_repo_lag":     cfg.tokenRepoLag.String(),
+		"admin":              cfg.adminSecret != nil,
+		"cluster":            cfg.clusterSecret != nil,
+		"peers":              cfg.peers,
+		"per_message_auth":   cfg.tokenFrames,
+		"require_pm_auth":    cfg.requireTokenFrames,
+		"rate_limit":         cfg.rateLimit,
+		"rate_burst":         cfg.rateBurst,
+		"rate_limit_action":  cfg.rateLimitAction,
+		"duplicate_login":    cfg.duplicateLogin,
+		"address_validation": cfg.addrValidation,
+		"half_open":          cfg.halfOpen,
+		"write_rate":         cfg.writeRate,
+		"write_burst":        cfg.writeBurst,
+		"filter_timeout":     cfg.filterTimeout.String(),
+		"max_violations":     cfg.maxViolations,
+		"sink_queue":         cfg.sinkQueue,
+		"sink_overflow":      cfg.sinkOverflow,
+		"handler_timeout":    cfg.handlerTimeout.String(),
+		"token_rotation":     cfg.rotateEvery.String(),
+		"heartbeat":          cfg.heartbeat.interval.String() + "/" + cfg.heartbeat.timeout.String(),
+		"capabilities":       capNames(cfg.caps),
+		"disabled_caps":      cfg.noCaps,
+		"breaker_failures":   cfg.breakerFailures,
+		"breaker_cooldown":   cfg.breakerCooldown.String(),
+		"skew_threshold":     cfg.skewThreshold.String(),
+		"skew_policy":        cfg.skewPolicy,
+		"allow_cidr":         allow,
+		"deny_cidr":          deny,
+		"expvar":             cfg.expvar,
+		"usage_interval":     cfg.usageEvery.String(),
+		"usage_tokens":       cfg.usageTokens,
+		"replay_buffer":      cfg.replayBuffer,
+		"session_options":    len(cfg.sessionOpts),
+		"source":             cfg.src.summary(),
+		"hooks": hooks(map[string]bool{
+			"handler":           cfg.handler != nil,
+			"stream handler":    cfg.streamHandler != nil,
+			"affinity mismatch": cfg.onMismatch != nil,
+			"token approver":    cfg.approver != nil,
+			"inbound filter":    cfg.inboundFilter != nil,
+			"outbound filter":   cfg.outboundFilter != nil,
+			"sink":              cfg.sink != nil,
+			"offline store":     cfg.store != nil,
+			"offline notifier":  cfg.notifier != nil,
+			"panic hook":        cfg.onPanic != nil,
+			"metrics hook":      cfg.metrics != nil,
+			"access log":        cfg.accessLog != nil,
+			"usage sink":        cfg.usageSink != nil,
+			"listener wrapper":  cfg.wrapListener != nil,
+			"id generator":      cfg.ids != nil,
+		}),
+	}
+	if tlsSource == "files" {
+		summary["tls_cert_file"] = cfg.tlsCertFile
+		summary["tls_key_file"] = cfg.tlsKeyFile
+	}
+	return summary
+}
+
+func (cfg *clientConfig) summary() map[string]any {
+	var tofu string
+	if cfg.tofu != nil {
+		tofu = cfg.tofu.path
+	}
+	return map[string]any{
+		"servers":         cfg.servers,
+		"certs":           cfg.certs,
+		"root_cas":        cfg.roots != nil,
+		"insecure":        cfg.insec,
+		"tofu":            tofu,
+		"token_file":      cfg.token,
+		"identity":        cfg.identity,
+		"session_cache":   cfg.cache != nil,
+		"no_auth":         cfg.noAuth,
+		"raw":             cfg.raw,
+		"guest":           cfg.guest,
+		"registration":    len(cfg.regPld) > 0,
+		"scopes":          cfg.scopes,
+		"heartbeat":       cfg.heartbeat.interval.String() + "/" + cfg.heartbeat.timeout.String(),
+		"capabilities":    capNames(cfg.caps),
+		"disabled_caps":   cfg.noCaps,
+		"cluster_peer":    cfg.secret != nil && !cfg.admin,
+		"admin":           cfg.admin,
+		"login_retries":   cfg.loginRetries,
+		"login_backoff":   cfg.loginBackoff.String(),
+		"session_options": len(cfg.sessionOpts),
+		"resume":          cfg.resume,
+		"max_payload":     cfg.maxPayload,
+		"outbox":          cfg.outbox,
+		"transcript":      cfg.transcript != nil,
+		"source":          cfg.src.summary(),
+		"hooks": hooks(map[string]bool{
+			"on message":   cfg.onMessage != nil,
+			"on event":     cfg.onEvent != nil,
+			"on connect":   cfg.onConnect != nil,
+			"confirm key":  cfg.confirmKey != nil,
+			"queue store":  cfg.queue != nil,
+			"id generator": cfg.ids != nil,
+		}),
+	}
+}
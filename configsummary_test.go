@@ -0,0 +1,123 @@
+package chat_test
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+// leaks reports how the secret shows in the formatted values, if it does.
+func leaks(secret [16]byte, vs ...any) string {
+	s := fmt.Sprint(vs...)
+	for _, form := range []string{hex.EncodeToString(secret[:]), fmt.Sprint(secret), fmt.Sprint(secret[:]), string(secret[:])} {
+		if strings.Contains(s, form) {
+			return form
+		}
+	}
+	return ""
+}
+
+// logged returns the attributes of the first line logged with msg.
+func logged(t *testing.T, rec *recorder, msg string) map[any]any {
+	t.Helper()
+	for _, l := range rec.recorded() {
+		if l.msg == msg {
+			return l.attrs
+		}
+	}
+	t.Fatalf("%q not logged", msg)
+	return nil
+}
+
+func TestServerConfigSummary(t *testing.T) {
+	admin := [16]byte{0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	secret := admin
+	secret[0] = 0xca
+	var rec recorder
+	srv, _, _ := startServer(t, discard,
+		chat.ServerOptions.Logger(rec.log),
+		chat.ServerOptions.AdminHandler(admin),
+		chat.ServerOptions.Cluster(secret),
+		chat.ServerOptions.MaxConns(7),
+	)
+	summary := srv.ConfigSummary()
+	for k, want := range map[string]any{
+		"addresses":  []string{"127.0.0.1:0"},
+		"tls":        "certificate",
+		"max_conns":  7,
+		"admin":      true,
+		"cluster":    true,
+		"no_auth":    false,
+		"token_repo": "*chattest.TokenRepo",
+	} {
+		if got := summary[k]; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: %v, want %v", k, got, want)
+		}
+	}
+	if _, ok := summary["tls_cert_file"]; ok {
+		t.Error("certificate files summarized for a provided certificate")
+	}
+	hooks, _ := summary["hooks"].([]string)
+	if !slices.Contains(hooks, "handler") || slices.Contains(hooks, "sink") {
+		t.Errorf("hooks %v, want the handler only of handler and sink", hooks)
+	}
+	defaulted, _ := summary["defaulted"].([]string)
+	if !slices.Contains(defaulted, "max_payload") || slices.Contains(defaulted, "max_conns") || slices.Contains(defaulted, "instance") {
+		t.Errorf("defaulted %v", defaulted)
+	}
+
+	// logged once by Run, without the secrets
+	attrs := logged(t, &rec, "server configuration")
+	for _, secret := range [][16]byte{admin, secret} {
+		if form := leaks(secret, summary, attrs); form != "" {
+			t.Errorf("secret %q in the summary", form)
+		}
+	}
+}
+
+func TestClientConfigSummary(t *testing.T) {
+	_, addr, ca := startServer(t, discard)
+	var rec recorder
+	file := filepath.Join(t.TempDir(), "token")
+	c := connect(t, addr, ca,
+		chat.ClientOptions.Logger(rec.log),
+		chat.ClientOptions.TokenFile(file),
+		chat.ClientOptions.Identity("alice"),
+		chat.ClientOptions.RegistrationPayload([]byte("invite-code")),
+	)
+	tok, err := c.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := c.ConfigSummary()
+	for k, want := range map[string]any{
+		"servers":      []string{addr},
+		"root_cas":     true,
+		"token_file":   file,
+		"identity":     "alice",
+		"registration": true,
+		"guest":        false,
+	} {
+		if got := summary[k]; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: %v, want %v", k, got, want)
+		}
+	}
+	defaulted, _ := summary["defaulted"].([]string)
+	if !slices.Contains(defaulted, "guest") || slices.Contains(defaulted, "identity") {
+		t.Errorf("defaulted %v", defaulted)
+	}
+
+	// logged on the first connect, the token and invite code never
+	attrs := logged(t, &rec, "client configuration")
+	if form := leaks(tok, summary, attrs); form != "" {
+		t.Errorf("token %q in the summary", form)
+	}
+	if s := fmt.Sprint(summary, attrs); strings.Contains(s, "invite-code") {
+		t.Error("registration payload in the summary")
+	}
+}
@@ -0,0 +1,42 @@
+package conformance
+
+import (
+	"context"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+// GoClient returns the Client running chat.Client with opts, followed by
+// the options of the harness and those the scenario requires. Its token
+// file is kept in a temporary directory removed after the scenario.
+func GoClient(opts ...chat.ClientOption) Client {
+	return func(ctx context.Context, addr string, roots *x509.CertPool, sc Scenario) error {
+		dir, err := os.MkdirTemp("", "chat-conformance")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		opts := append(slices.Clone(opts),
+			chat.ClientOptions.Servers([]string{addr}),
+			chat.ClientOptions.RootCAs(roots),
+			chat.ClientOptions.TokenFile(filepath.Join(dir, "token")),
+		)
+		if slices.Contains(sc.Requires, chat.CapHeartbeat) {
+			opts = append(opts, chat.ClientOptions.Heartbeat(time.Second, 5*time.Second))
+		}
+		return chat.NewClient(opts...).Dial(ctx)
+	}
+}
+
+// External is the Client of an implementation run outside of the process,
+// which connects to the harness on its own. It waits for the scenario
+// to end, so the Harness needs a fixed Addr.
+func External(ctx context.Context, _ string, _ *x509.CertPool, _ Scenario) error {
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,304 @@
+// Package conformance checks client implementations of the chat protocol
+// against scripted scenarios played by a harness server, reporting
+// pass or fail per scenario. Scenarios are data, so protocol features
+// add cases to Scenarios rather than code.
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+	"github.com/zhmlst/chat/keygen"
+)
+
+const (
+	// alpn is the application protocol of the chat protocol.
+	alpn = "quic-raw"
+	// defaultTimeout bounds scenarios without a Timeout.
+	defaultTimeout = 10 * time.Second
+)
+
+// ErrMismatch is matched by the errors of scenarios in which
+// the client did not behave as expected.
+var ErrMismatch = errors.New("client does not conform")
+
+// Frame describes a frame the harness sends or expects.
+type Frame struct {
+	Type chat.MsgType
+	// Payload is the payload sent, or the prefix of the payload expected.
+	Payload string
+	// Contains are strings the payload expected must contain.
+	Contains []string
+	// Token makes the harness send a new random token as the payload,
+	// or expect the token of the frame to be the one it sent last.
+	Token bool
+	// Size pads the payload sent with 'x' to Size bytes.
+	Size int
+}
+
+// Step is one step of a scenario. Exactly one of its fields is set.
+type Step struct {
+	// Expect reads the next frame of the client, which must match.
+	Expect *Frame
+	// Send writes the frame to the client.
+	Send *Frame
+	// Close expects the client to close the connection with the code.
+	Close *codes.Code
+	// Reset expects the client to reset the stream with the code.
+	Reset *codes.Code
+}
+
+// Scenario is a script the harness plays against a client.
+type Scenario struct {
+	Name string
+	// Requires are the capabilities the client must offer in the handshake,
+	// e.g. chat.CapHeartbeat. A Client enables them for the scenario.
+	Requires []string
+	// ALPN overrides the application protocol offered by the harness.
+	ALPN string
+	// Refused expects the client not to establish a connection at all.
+	Refused bool
+	Steps   []Step
+	// Timeout bounds the scenario, 10s if zero.
+	Timeout time.Duration
+}
+
+// Result is the outcome of a scenario, passed if Err is nil.
+type Result struct {
+	Scenario string
+	Err      error
+}
+
+// Passed reports whether the client passed the scenario.
+func (r Result) Passed() bool {
+	return r.Err == nil
+}
+
+// Client runs the implementation under test against the harness at addr,
+// trusting roots, until ctx is done. It is started once per scenario.
+type Client func(ctx context.Context, addr string, roots *x509.CertPool, sc Scenario) error
+
+// Harness is a server playing scenarios against a client.
+type Harness struct {
+	// Addr is the address to listen on, a random local port if empty.
+	// External clients need a fixed one.
+	Addr string
+	// Certificate is the certificate of the harness. A self-signed one for
+	// the local host is generated if it is nil, see Roots.
+	Certificate *tls.Certificate
+
+	roots *x509.CertPool
+}
+
+// init generates the certificate of the harness if needed.
+func (h *Harness) init() error {
+	if h.roots != nil {
+		return nil
+	}
+	if h.Certificate == nil {
+		certPEM, keyPEM, err := keygen.Cert(nil, 24*time.Hour)
+		if err != nil {
+			return err
+		}
+		crt, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate: %w", err)
+		}
+		h.Certificate = &crt
+	}
+	h.roots = x509.NewCertPool()
+	for _, der := range h.Certificate.Certificate {
+		crt, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		h.roots.AddCert(crt)
+	}
+	return nil
+}
+
+// Roots returns a pool trusting the certificate of the harness.
+func (h *Harness) Roots() (*x509.CertPool, error) {
+	if err := h.init(); err != nil {
+		return nil, err
+	}
+	return h.roots, nil
+}
+
+// Run plays the scenarios one after another against the client.
+func (h *Harness) Run(ctx context.Context, client Client, scenarios ...Scenario) []Result {
+	results := make([]Result, 0, len(scenarios))
+	for _, sc := range scenarios {
+		results = append(results, Result{Scenario: sc.Name, Err: h.play(ctx, client, sc)})
+	}
+	return results
+}
+
+// play runs a single scenario.
+func (h *Harness) play(ctx context.Context, client Client, sc Scenario) error {
+	if err := h.init(); err != nil {
+		return err
+	}
+	timeout := sc.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	proto := alpn
+	if sc.ALPN != "" {
+		proto = sc.ALPN
+	}
+	addr := h.Addr
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{*h.Certificate}, NextProtos: []string{proto}}
+	ln, err := quic.ListenAddr(addr, tlsCfg, &quic.Config{})
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	defer ln.Close()
+
+	cctx, stop := context.WithCancel(ctx)
+	defer stop()
+	go func() { _ = client(cctx, ln.Addr().String(), h.roots, sc) }()
+
+	conn, err := ln.Accept(ctx)
+	if sc.Refused {
+		if err == nil {
+			_ = conn.CloseWithError(quic.ApplicationErrorCode(codes.Done), "bye")
+			return fmt.Errorf("%w: connection established", ErrMismatch)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: no connection: %w", ErrMismatch, err)
+	}
+	defer conn.CloseWithError(quic.ApplicationErrorCode(codes.Done), "bye")
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: no stream: %w", ErrMismatch, err)
+	}
+	p := &player{conn: conn, stream: stream}
+	for i, step := range sc.Steps {
+		if err := p.step(ctx, step); err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// player plays the steps of a scenario on a connection.
+type player struct {
+	conn   *quic.Conn
+	stream *quic.Stream
+	token  [16]byte
+}
+
+func (p *player) step(ctx context.Context, step Step) error {
+	switch {
+	case step.Expect != nil:
+		return p.expect(ctx, step.Expect)
+	case step.Send != nil:
+		return p.send(step.Send)
+	case step.Close != nil:
+		return p.closed(ctx, *step.Close)
+	case step.Reset != nil:
+		return p.reset(ctx, *step.Reset)
+	}
+	return errors.New("empty step")
+}
+
+func (p *player) send(f *Frame) error {
+	m := &chat.Message{Type: f.Type, Payload: []byte(f.Payload)}
+	if pad := f.Size - len(m.Payload); pad > 0 {
+		m.Payload = append(m.Payload, bytes.Repeat([]byte("x"), pad)...)
+	}
+	if f.Token {
+		if _, err := rand.Read(p.token[:]); err != nil {
+			return err
+		}
+		m.Payload = bytes.Clone(p.token[:])
+	}
+	if err := m.Stamp(chat.DefaultSource); err != nil {
+		return err
+	}
+	var serr *quic.StreamError
+	if _, err := m.WriteTo(p.stream); errors.As(err, &serr) && serr.Remote {
+		// the client stopped reading, which the next step checks
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to send frame: %w", err)
+	}
+	return nil
+}
+
+func (p *player) expect(ctx context.Context, f *Frame) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = p.stream.SetReadDeadline(deadline)
+	}
+	m := new(chat.Message)
+	if _, err := m.ReadFrom(p.stream); err != nil {
+		return fmt.Errorf("%w: expected %q: %w", ErrMismatch, f.Payload, err)
+	}
+	pld := string(m.Payload)
+	switch {
+	case m.Type != f.Type:
+		return fmt.Errorf("%w: expected type %d, got %d", ErrMismatch, f.Type, m.Type)
+	case !strings.HasPrefix(pld, f.Payload):
+		return fmt.Errorf("%w: expected %q, got %q", ErrMismatch, f.Payload, pld)
+	case f.Token && m.Token != p.token:
+		return fmt.Errorf("%w: frame does not carry the token sent", ErrMismatch)
+	}
+	for _, s := range f.Contains {
+		if !strings.Contains(pld, s) {
+			return fmt.Errorf("%w: %q does not contain %q", ErrMismatch, pld, s)
+		}
+	}
+	return nil
+}
+
+func (p *player) closed(ctx context.Context, code codes.Code) error {
+	select {
+	case <-p.conn.Context().Done():
+	case <-ctx.Done():
+		return fmt.Errorf("%w: connection not closed", ErrMismatch)
+	}
+	var appErr *quic.ApplicationError
+	err := context.Cause(p.conn.Context())
+	if !errors.As(err, &appErr) || !appErr.Remote {
+		return fmt.Errorf("%w: connection closed without a code: %w", ErrMismatch, err)
+	}
+	if got := codes.Code(appErr.ErrorCode); got != code {
+		return fmt.Errorf("%w: closed with %s, expected %s", ErrMismatch, got, code)
+	}
+	return nil
+}
+
+func (p *player) reset(ctx context.Context, code codes.Code) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = p.stream.SetReadDeadline(deadline)
+	}
+	_, err := io.Copy(io.Discard, p.stream)
+	var serr *quic.StreamError
+	if !errors.As(err, &serr) || !serr.Remote {
+		return fmt.Errorf("%w: stream not reset: %v", ErrMismatch, err)
+	}
+	if got := codes.Code(serr.ErrorCode); got != code {
+		return fmt.Errorf("%w: reset with %s, expected %s", ErrMismatch, got, code)
+	}
+	return nil
+}
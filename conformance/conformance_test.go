@@ -0,0 +1,41 @@
+package conformance_test
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/conformance"
+)
+
+// quiet is a logger dropping everything.
+var quiet = chat.Logger(func(chat.LogLevel, string, ...any) {})
+
+func TestGoClient(t *testing.T) {
+	h := &conformance.Harness{}
+	client := conformance.GoClient(chat.ClientOptions.Logger(quiet))
+	for _, sc := range conformance.Scenarios {
+		t.Run(sc.Name, func(t *testing.T) {
+			if r := h.Run(t.Context(), client, sc)[0]; !r.Passed() {
+				t.Error(r.Err)
+			}
+		})
+	}
+}
+
+func TestNonConforming(t *testing.T) {
+	// a client never connecting
+	absent := func(ctx context.Context, _ string, _ *x509.CertPool, _ conformance.Scenario) error {
+		<-ctx.Done()
+		return nil
+	}
+	h := &conformance.Harness{}
+	sc := conformance.Scenario{Name: "absent", Timeout: 100 * time.Millisecond}
+	r := h.Run(t.Context(), absent, sc)[0]
+	if r.Passed() || !errors.Is(r.Err, conformance.ErrMismatch) || r.Scenario != "absent" {
+		t.Errorf("result %+v, want a mismatch", r)
+	}
+}
@@ -0,0 +1,67 @@
+package conformance
+
+import (
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+// Steps shared by scenarios.
+var (
+	expectAck   = Step{Expect: &Frame{Type: chat.MsgTypeControl, Payload: "ack"}}
+	sendToken   = Step{Send: &Frame{Type: chat.MsgTypeControl, Token: true}}
+	expectLogin = Step{Expect: &Frame{Type: chat.MsgTypeControl, Payload: "login", Token: true}}
+	sendOK      = Step{Send: &Frame{Type: chat.MsgTypeControl, Payload: "ok"}}
+)
+
+func code(c codes.Code) *codes.Code {
+	return &c
+}
+
+// Scenarios are the scenarios every client is expected to pass.
+// Clients start them without a stored token.
+var Scenarios = []Scenario{
+	{
+		Name:  "handshake",
+		Steps: []Step{expectAck, sendToken, expectLogin, sendOK},
+	},
+	{
+		Name: "bad token retry",
+		Steps: []Step{
+			expectAck, sendToken, expectLogin,
+			// a plain "no" is retried with the same token
+			{Send: &Frame{Type: chat.MsgTypeControl, Payload: "no"}},
+			expectLogin,
+			{Send: &Frame{Type: chat.MsgTypeControl, Payload: "no reject"}},
+			expectAck, sendToken, expectLogin, sendOK,
+		},
+	},
+	{
+		Name: "oversized frame",
+		Steps: []Step{
+			expectAck, sendToken, expectLogin, sendOK,
+			// beyond the 1MiB clients accept by default
+			{Send: &Frame{Type: chat.MsgTypeText, Size: 1<<20 + 1}},
+			{Reset: code(codes.FrameTooLarge)},
+		},
+	},
+	{
+		Name:    "protocol mismatch",
+		ALPN:    "quic-raw/0",
+		Refused: true,
+		Timeout: 2 * time.Second,
+	},
+	{
+		Name:     "heartbeat timeout",
+		Requires: []string{chat.CapHeartbeat},
+		Steps: []Step{
+			expectAck, sendToken,
+			{Expect: &Frame{Type: chat.MsgTypeControl, Payload: "login", Token: true, Contains: []string{" caps", " +" + chat.CapHeartbeat}}},
+			{Send: &Frame{Type: chat.MsgTypeControl, Payload: "ok caps +heartbeat;interval=100;timeout=400"}},
+			{Expect: &Frame{Type: chat.MsgTypeControl, Payload: "ping"}},
+			{Close: code(codes.IdleTimeout)},
+		},
+		Timeout: 5 * time.Second,
+	},
+}
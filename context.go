@@ -0,0 +1,27 @@
+package chat
+
+import "context"
+
+type sessionKey struct{}
+
+// withSession returns a copy of ctx carrying the session.
+func withSession(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// SessionFromContext returns the session the server attached to ctx.
+// The server attaches it to contexts passed to handlers, filters,
+// hooks and TokenRepo calls.
+func SessionFromContext(ctx context.Context) (*Session, bool) {
+	s, ok := ctx.Value(sessionKey{}).(*Session)
+	return s, ok
+}
+
+// SessionIDFromContext returns the ID of the session attached to ctx.
+func SessionIDFromContext(ctx context.Context) (uint64, bool) {
+	s, ok := SessionFromContext(ctx)
+	if !ok {
+		return 0, false
+	}
+	return s.id, true
+}
@@ -0,0 +1,99 @@
+package chat_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+)
+
+// seen records the session IDs found in the contexts of calls.
+type seen struct {
+	mtx sync.Mutex
+	ids map[string][]uint64
+}
+
+func (s *seen) add(call string, ctx context.Context) {
+	// zero if ctx carries no session
+	id, _ := chat.SessionIDFromContext(ctx)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.ids == nil {
+		s.ids = make(map[string][]uint64)
+	}
+	s.ids[call] = append(s.ids[call], id)
+}
+
+func (s *seen) get(call string) []uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.ids[call]
+}
+
+// seenRepo is a TokenRepo recording the sessions of its calls.
+type seenRepo struct {
+	chattest.TokenRepo
+	seen *seen
+}
+
+func (r *seenRepo) SaveToken(ctx context.Context, tok [16]byte) error {
+	r.seen.add("save token", ctx)
+	return r.TokenRepo.SaveToken(ctx, tok)
+}
+
+func (r *seenRepo) HasToken(ctx context.Context, tok [16]byte) (bool, error) {
+	r.seen.add("has token", ctx)
+	return r.TokenRepo.HasToken(ctx, tok)
+}
+
+func TestSessionFromContext(t *testing.T) {
+	var calls seen
+	handlerSession := make(chan *chat.Session, 1)
+	handler := func(ctx context.Context, s *chat.Session) {
+		if got, ok := chat.SessionFromContext(ctx); !ok || got != s {
+			t.Errorf("handler context carries session %p, want %p", got, s)
+		}
+		handlerSession <- s
+		discard(ctx, s)
+	}
+	middleware := func(next chat.Handler) chat.Handler {
+		return func(ctx context.Context, s *chat.Session) {
+			calls.add("middleware", ctx)
+			next(ctx, s)
+		}
+	}
+	_, addr, ca := startServer(t, middleware(handler),
+		chat.ServerOptions.TokenRepo(&seenRepo{seen: &calls}),
+		chat.ServerOptions.InboundFilter(func(ctx context.Context, _ *chat.Session, m *chat.Message) (*chat.Message, error) {
+			calls.add("filter", ctx)
+			return m, nil
+		}),
+	)
+	c := connect(t, addr, ca)
+	id := receive(t, handlerSession).ID()
+	send(t, c, "hi")
+	eventually(t, func() bool { return len(calls.get("filter")) == 1 })
+
+	for _, call := range []string{"save token", "has token", "middleware", "filter"} {
+		ids := calls.get(call)
+		if len(ids) == 0 {
+			t.Errorf("%s was not called", call)
+		}
+		for _, got := range ids {
+			if got != id {
+				t.Errorf("%s called for session %d, want %d", call, got, id)
+			}
+		}
+	}
+}
+
+func TestSessionFromContextMissing(t *testing.T) {
+	if s, ok := chat.SessionFromContext(context.Background()); ok || s != nil {
+		t.Errorf("background context carries session %p", s)
+	}
+	if id, ok := chat.SessionIDFromContext(context.Background()); ok || id != 0 {
+		t.Errorf("background context carries session ID %d", id)
+	}
+}
@@ -0,0 +1,196 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/zhmlst/chat/codes"
+)
+
+// SetReadDeadline sets the deadline for receiving messages. Recv fails
+// with an error matching os.ErrDeadlineExceeded once it passes. A frame
+// interrupted by the deadline is completed by the next Recv, so traffic
+// resumes after the deadline is moved. A zero t means no deadline.
+func (s *Session) SetReadDeadline(t time.Time) error {
+	s.rmtx.Lock()
+	defer s.rmtx.Unlock()
+	s.rdeadline = t
+	return s.stream.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for writing messages. Send fails
+// with an error matching os.ErrDeadlineExceeded once it passes. A frame
+// only partly written by then makes the session abort, as the peer
+// could not read any further frames. A zero t means no deadline.
+func (s *Session) SetWriteDeadline(t time.Time) error {
+	var ns int64
+	if !t.IsZero() {
+		ns = t.UnixNano()
+	}
+	s.wdeadline.Store(ns)
+	return s.stream.SetWriteDeadline(t)
+}
+
+// WriteTimeout bounds the time a frame may take to be written to a peer
+// which stopped reading. Once it passes the session is aborted with
+// codes.SlowConsumer and its sends fail with an error matching
+// os.ErrDeadlineExceeded. Zero, the default, waits as long as the peer
+// keeps the connection alive.
+func (sessionOptionsNamespace) WriteTimeout(d time.Duration) SessionOption {
+	return func(s *Session) {
+		s.writeTimeout = max(d, 0)
+	}
+}
+
+// defaultCloseTimeout is the default CloseTimeout.
+const defaultCloseTimeout = 10 * time.Second
+
+// CloseTimeout bounds the time CloseSend waits for the queued messages
+// to be written to a peer which stopped reading. Once it passes, or the
+// write deadline does if earlier, the session is aborted with
+// codes.SlowConsumer and CloseSend fails with an error matching
+// os.ErrDeadlineExceeded. It defaults to 10 seconds, zero waits as long
+// as the peer keeps the connection alive.
+func (sessionOptionsNamespace) CloseTimeout(d time.Duration) SessionOption {
+	return func(s *Session) {
+		s.closeTimeout = max(d, 0)
+	}
+}
+
+// closeDeadline returns the time CloseSend gives up waiting at,
+// zero if it does not.
+func (s *Session) closeDeadline() time.Time {
+	var deadline time.Time
+	if ns := s.wdeadline.Load(); ns != 0 {
+		deadline = time.Unix(0, ns)
+	}
+	if s.closeTimeout > 0 {
+		deadline = earliest(deadline, time.Now().Add(s.closeTimeout))
+	}
+	return deadline
+}
+
+// write runs the write of frames to the stream under the earliest of the
+// write deadline, the WriteTimeout and the deadline of ctx. Cancelling ctx
+// interrupts the write too. A frame interrupted by a deadline leaves
+// the stream unusable, as does the WriteTimeout passing, so the session
+// is aborted then. ctx is nil for frames of several senders.
+func (s *Session) write(ctx context.Context, frames func() (int, error)) (int, error) {
+	now := time.Now()
+	var deadline, limit time.Time
+	if ns := s.wdeadline.Load(); ns != 0 {
+		deadline = time.Unix(0, ns)
+	}
+	if s.writeTimeout > 0 {
+		limit = now.Add(s.writeTimeout)
+		deadline = earliest(deadline, limit)
+	}
+	if ctx != nil {
+		if d, ok := ctx.Deadline(); ok {
+			deadline = earliest(deadline, d)
+		}
+		stop := context.AfterFunc(ctx, func() {
+			_ = s.stream.SetWriteDeadline(time.Now())
+		})
+		defer stop()
+	}
+	if err := s.stream.SetWriteDeadline(deadline); err != nil {
+		return 0, err
+	}
+	n, err := frames()
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, err
+	}
+	stalled := !limit.IsZero() && !time.Now().Before(limit)
+	if n > 0 || stalled {
+		s.lgr.With("written", n, "stalled", stalled).Warn("write interrupted, aborting session")
+		s.Abort(codes.SlowConsumer)
+	}
+	return n, err
+}
+
+// earliest returns the earlier of two deadlines, zero meaning none.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// RecvTimeout is like Recv but gives up after d.
+func (s *Session) RecvTimeout(ctx context.Context, d time.Duration) (*Message, error) {
+	if err := s.SetReadDeadline(time.Now().Add(d)); err != nil {
+		return nil, err
+	}
+	defer func() { _ = s.SetReadDeadline(time.Time{}) }()
+	return s.Recv(ctx)
+}
+
+// Err returns the error which stopped the Input or Output pump, or the
+// *StreamResetError of the peer resetting the stream, or nil if the
+// session is running or ended normally.
+func (s *Session) Err() error {
+	s.rmtx.Lock()
+	defer s.rmtx.Unlock()
+	return s.err
+}
+
+func (s *Session) setErr(err error) {
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) {
+		return
+	}
+	s.rmtx.Lock()
+	defer s.rmtx.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// recorder keeps the bytes read through it.
+type recorder struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.buf = append(r.buf, p[:n]...)
+	return n, err
+}
+
+// readDeadline returns the deadline set with SetReadDeadline.
+func (s *Session) readDeadline() time.Time {
+	s.rmtx.Lock()
+	defer s.rmtx.Unlock()
+	return s.rdeadline
+}
+
+// readFrame reads the next frame from the session stream until ctx is
+// done. With a read deadline set or ctx cancellable, the bytes of a frame
+// interrupted by either are kept for the next call.
+func (s *Session) readFrame(ctx context.Context) (*Message, error) {
+	s.rmtx.Lock()
+	partial, record := s.rpartial, !s.rdeadline.IsZero() || ctx.Done() != nil
+	s.rpartial = nil
+	s.rmtx.Unlock()
+	if !record && partial == nil {
+		return s.codec.read(s.stream, s.maxRecv)
+	}
+
+	var m *Message
+	rec := &recorder{r: s.stream}
+	err := readContext(ctx, s.stream, s.readDeadline, func() (err error) {
+		m, err = s.codec.read(io.MultiReader(bytes.NewReader(partial), rec), s.maxRecv)
+		return err
+	})
+	if err != nil && (errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, ctx.Err())) {
+		s.rmtx.Lock()
+		s.rpartial = append(partial, rec.buf...)
+		s.rmtx.Unlock()
+	}
+	return m, err
+}
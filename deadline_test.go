@@ -0,0 +1,170 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+func TestReadDeadline(t *testing.T) {
+	errs := make(chan error, 1)
+	got := make(chan string, 1)
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		// nothing is sent yet
+		_, err := s.RecvTimeout(ctx, 50*time.Millisecond)
+		errs <- err
+		if err := s.SetReadDeadline(time.Time{}); err != nil {
+			errs <- err
+			return
+		}
+		m, err := s.Recv(ctx)
+		if err != nil {
+			errs <- err
+			return
+		}
+		got <- string(m.Payload)
+		// the pump of the channel API stops at the deadline too
+		if err := s.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+			errs <- err
+			return
+		}
+		for range s.Input(ctx) {
+		}
+		errs <- s.Err()
+		discard(ctx, s)
+	})
+	c := connect(t, addr, ca)
+
+	if err := receive(t, errs); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("recv: %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	send(t, c, "hello")
+	select {
+	case text := <-got:
+		if text != "hello" {
+			t.Errorf("received %q after the reset", text)
+		}
+	case err := <-errs:
+		t.Fatalf("recv after the reset: %v", err)
+	case <-time.After(waitTimeout):
+		t.Fatal("nothing received after the reset")
+	}
+	if err := receive(t, errs); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("input ended with %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+// stall is the outcome of a send to a peer which stopped reading.
+type stall struct {
+	err  error
+	took time.Duration
+}
+
+// flood sends large messages until a send fails, as one does once the peer
+// stopped reading and the flow control window filled up.
+func flood(ctx context.Context, s *chat.Session) stall {
+	for {
+		start := time.Now()
+		if err := s.Send(ctx, chat.NewBinaryMessage(make([]byte, 256<<10))); err != nil {
+			return stall{err, time.Since(start)}
+		}
+	}
+}
+
+// stalledSession serves a stream session with h and returns it once
+// opened. The session is not read until the caller does.
+func stalledSession(t *testing.T, h chat.Handler, opts ...chat.ServerOption) *chat.Session {
+	t.Helper()
+	_, addr, ca := startServer(t, discard, append(opts, chat.ServerOptions.StreamHandler(h))...)
+	c := connect(t, addr, ca)
+	s, err := c.NewSession(t.Context(), "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// wantAbort reads what was written to s before it was aborted
+// and checks it was aborted with codes.SlowConsumer.
+func wantAbort(t *testing.T, s *chat.Session) {
+	t.Helper()
+	for {
+		_, err := s.Recv(t.Context())
+		if err == nil {
+			continue
+		}
+		var rerr *chat.StreamResetError
+		if !errors.As(err, &rerr) || rerr.Code != codes.SlowConsumer {
+			t.Errorf("session ended with %v, want the slow_consumer reset", err)
+		}
+		return
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	stalls := make(chan stall, 1)
+	s := stalledSession(t, func(ctx context.Context, s *chat.Session) {
+		st := flood(ctx, s)
+		// the session is done with, later sends fail at once
+		if err := s.Send(ctx, chat.NewTextMessage([]byte("late"))); err == nil {
+			st.err = errors.New("sent after the write timeout")
+		}
+		stalls <- st
+	}, chat.ServerOptions.SessionOptions(chat.SessionOptions.WriteTimeout(100*time.Millisecond)))
+
+	st := receive(t, stalls)
+	if !errors.Is(st.err, os.ErrDeadlineExceeded) {
+		t.Errorf("send: %v, want %v", st.err, os.ErrDeadlineExceeded)
+	}
+	if st.took > time.Second {
+		t.Errorf("send returned after %v, want about the write timeout", st.took)
+	}
+	wantAbort(t, s)
+}
+
+func TestSendCancelled(t *testing.T) {
+	stalls := make(chan stall, 1)
+	s := stalledSession(t, func(ctx context.Context, s *chat.Session) {
+		// long after the stall, without a write timeout to end it
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		time.AfterFunc(200*time.Millisecond, cancel)
+		stalls <- flood(ctx, s)
+	})
+
+	st := receive(t, stalls)
+	if !errors.Is(st.err, context.Canceled) {
+		t.Errorf("send: %v, want %v", st.err, context.Canceled)
+	}
+	if st.took > time.Second {
+		t.Errorf("send returned %v after the cancellation", st.took)
+	}
+	// the frame was cut short, so is the stream
+	wantAbort(t, s)
+}
+
+func TestCloseTimeout(t *testing.T) {
+	stalls := make(chan stall, 1)
+	s := stalledSession(t, func(ctx context.Context, s *chat.Session) {
+		go flood(ctx, s)
+		// the flow control window has filled up
+		time.Sleep(100 * time.Millisecond)
+		start := time.Now()
+		err := s.CloseSend()
+		stalls <- stall{err, time.Since(start)}
+	}, chat.ServerOptions.SessionOptions(chat.SessionOptions.CloseTimeout(100*time.Millisecond)))
+
+	st := receive(t, stalls)
+	if !errors.Is(st.err, os.ErrDeadlineExceeded) {
+		t.Errorf("close: %v, want %v", st.err, os.ErrDeadlineExceeded)
+	}
+	if st.took > time.Second {
+		t.Errorf("close returned after %v, want about the close timeout", st.took)
+	}
+	wantAbort(t, s)
+}
@@ -0,0 +1,69 @@
+package chat
+
+import "context"
+
+// SessionOption applies option to session.
+type SessionOption func(s *Session)
+
+// SessionOptions provides available options for sessions.
+var SessionOptions sessionOptionsNamespace
+
+type sessionOptionsNamespace struct{}
+
+// Dedupe drops text and binary messages whose ID was among the last
+// window received, counting them in Duplicates. A duplicate asking for
+// an ack is acknowledged again, so that its sender stops resending.
+// Messages with a zero ID are never dropped.
+func (sessionOptionsNamespace) Dedupe(window int) SessionOption {
+	return func(s *Session) {
+		if window <= 0 {
+			s.dedupe = nil
+			return
+		}
+		s.dedupe = newIDLRU(window)
+	}
+}
+
+// SessionOptions sets the options applied to every session of the server.
+func (serverOptionsNamespace) SessionOptions(opts ...SessionOption) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.sessionOpts = append(cfg.sessionOpts, opts...)
+	}
+}
+
+// SessionOptions sets the options applied to every session of the client.
+func (clientOptionsNamespace) SessionOptions(opts ...SessionOption) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.sessionOpts = append(cfg.sessionOpts, opts...)
+	}
+}
+
+// Duplicates returns the number of messages dropped by Dedupe.
+func (s *Session) Duplicates() uint64 {
+	return s.duplicates.Load()
+}
+
+// duplicate reports whether m repeats a recently received message,
+// acknowledging it again if its sender asked for an ack.
+func (s *Session) duplicate(ctx context.Context, m *Message) bool {
+	if s.dedupe == nil || m.ID == [16]byte{} || (m.Type != MsgTypeText && m.Type != MsgTypeBinary) {
+		return false
+	}
+	if !s.dedupe.seen(m.ID) {
+		return false
+	}
+	s.duplicates.Add(1)
+	if s.srv != nil {
+		s.srv.mtx.Lock()
+		s.srv.duplicates++
+		s.srv.mtx.Unlock()
+	}
+	s.lgr.With("id", m.ID).Debug("dropping duplicate message")
+	if m.HasFlag(FlagAckRequested) {
+		ack := NewAck(Receipt{Kind: AckDelivery, IDs: [][16]byte{m.ID}})
+		if err := s.enqueue(ctx, ack, ack.Type.priority()); err != nil {
+			s.lgr.With("error", err).Warn("failed to acknowledge duplicate")
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package chat_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+// zeros reads zero bytes, making a Source of zero message IDs as legacy senders use.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestDedupe(t *testing.T) {
+	got := make(chan string, 4)
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		for {
+			m, err := s.Recv(ctx)
+			if err != nil {
+				return
+			}
+			got <- string(m.Payload)
+			if m.HasFlag(chat.FlagAckRequested) {
+				if err := s.Send(ctx, chat.NewAck(chat.Receipt{Kind: chat.AckDelivery, IDs: [][16]byte{m.ID}})); err != nil {
+					return
+				}
+			}
+		}
+	}, chat.ServerOptions.SessionOptions(chat.SessionOptions.Dedupe(8)))
+
+	acks := make(chan [16]byte, 4)
+	c := connect(t, addr, ca, chat.ClientOptions.OnMessage(func(m *chat.Message) {
+		if rcpt, err := m.Receipt(); err == nil {
+			for _, id := range rcpt.IDs {
+				acks <- id
+			}
+		}
+	}))
+	m := chat.NewTextMessage([]byte("once"))
+	m.SetFlag(chat.FlagAckRequested, true)
+	ctx := context.Background()
+	for range 2 {
+		if err := c.SendMessage(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// delivered once, acknowledged twice
+	if text := receive(t, got); text != "once" {
+		t.Fatalf("received %q", text)
+	}
+	for range 2 {
+		if id := receive(t, acks); id != m.ID {
+			t.Errorf("ack of %x, want %x", id, m.ID)
+		}
+	}
+	select {
+	case text := <-got:
+		t.Errorf("duplicate %q delivered", text)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := srv.Stats().Duplicates; n != 1 {
+		t.Errorf("%d duplicates counted, want 1", n)
+	}
+
+	// messages without an ID are never dropped
+	legacy := connect(t, addr, ca, chat.ClientOptions.Source(chat.Source{Rand: zeros{}, Now: time.Now}))
+	for range 2 {
+		send(t, legacy, "legacy")
+	}
+	for range 2 {
+		if text := receive(t, got); text != "legacy" {
+			t.Errorf("received %q, want legacy", text)
+		}
+	}
+}
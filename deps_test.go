@@ -0,0 +1,24 @@
+package chat_test
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestNoTerminalDeps(t *testing.T) {
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	out, err := exec.Command(gobin, "list", "-deps", ".").Output()
+	if err != nil {
+		t.Fatalf("go list: %v", err)
+	}
+	// bots embedding the library have no terminal
+	for pkg := range strings.FieldsSeq(string(out)) {
+		if strings.HasPrefix(pkg, "github.com/chzyer/readline") || pkg == "github.com/zhmlst/chat/internal/tui" {
+			t.Errorf("chat depends on %s", pkg)
+		}
+	}
+}
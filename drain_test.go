@@ -0,0 +1,86 @@
+package chat_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+)
+
+func TestShutdownAnnouncesDrain(t *testing.T) {
+	release := make(chan struct{})
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		// the session outlives the cancelled context until released
+		<-release
+	})
+	drains := make(chan chat.DrainEvent, 1)
+	done := serve(t, newClient(t, addr, ca, chat.ClientOptions.OnEvent(func(e chat.Event) {
+		if e, ok := e.(chat.DrainEvent); ok {
+			drains <- e
+		}
+	})))
+
+	deadline := time.Now().Add(waitTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(ctx) }()
+
+	e := receive(t, drains)
+	if !e.Deadline.Equal(deadline.Truncate(time.Millisecond)) {
+		t.Errorf("drain deadline %v, want %v", e.Deadline, deadline)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("connection closed with the drain event: %v", err)
+	default:
+	}
+
+	close(release)
+	if err := receive(t, done); err != nil {
+		t.Errorf("dial: %v", err)
+	}
+	if err := receive(t, shutdown); err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+}
+
+func TestShutdownDuringConnectStorm(t *testing.T) {
+	srv, addr, ca := startServer(t, discard)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				c := chattest.NewClient(t, addr, ca, chat.ClientOptions.Logger(quiet))
+				ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+				_ = c.Dial(ctx)
+				cancel()
+			}
+		})
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+	close(stop)
+	wg.Wait()
+	// connections accepted meanwhile were refused rather than left open
+	if n := srv.Stats().Conns; n != 0 {
+		t.Errorf("%d connections open after shutdown", n)
+	}
+	if n := len(srv.Sessions()); n != 0 {
+		t.Errorf("%d sessions left after shutdown", n)
+	}
+}
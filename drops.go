@@ -0,0 +1,113 @@
+package chat
+
+import "sync/atomic"
+
+// DropSite is where a session dropped a message or an event
+// because its consumer did not keep up.
+type DropSite uint8
+
+const (
+	// DropEvent is an event which did not fit in the buffer of Events.
+	DropEvent DropSite = iota
+	// DropChannel is a message which did not fit in the buffer of a Channel.
+	DropChannel
+	// DropRelay is a message a Hub failed to relay to a member.
+	DropRelay
+)
+
+func (d DropSite) String() string {
+	switch d {
+	case DropEvent:
+		return "event"
+	case DropChannel:
+		return "channel"
+	case DropRelay:
+		return "relay"
+	}
+	return "unknown"
+}
+
+// Drops counts dropped messages and events by DropSite.
+type Drops struct {
+	Events  uint64 `json:"events"`
+	Channel uint64 `json:"channel"`
+	Relay   uint64 `json:"relay"`
+}
+
+// add counts a drop at the site.
+func (d *Drops) add(site DropSite) {
+	switch site {
+	case DropEvent:
+		d.Events++
+	case DropChannel:
+		d.Channel++
+	case DropRelay:
+		d.Relay++
+	}
+}
+
+// SessionStats holds session counters.
+type SessionStats struct {
+	Drops Drops `json:"drops"`
+	// Duplicates counts messages dropped by SessionOptions.Dedupe.
+	Duplicates uint64 `json:"duplicates"`
+	// Muted counts messages dropped while muted, see Server.Mute.
+	Muted uint64 `json:"muted"`
+}
+
+// Drop is the Metric of a message or event dropped by a session.
+type Drop struct {
+	Session *Session
+	Site    DropSite
+}
+
+func (Drop) metric() {}
+
+// drops counts the drops of a session.
+type drops struct {
+	events  atomic.Uint64
+	channel atomic.Uint64
+	relay   atomic.Uint64
+	// warned is set once the first drop was logged as a warning.
+	warned atomic.Bool
+}
+
+// Stats returns a snapshot of the session counters.
+func (s *Session) Stats() SessionStats {
+	return SessionStats{
+		Drops: Drops{
+			Events:  s.drops.events.Load(),
+			Channel: s.drops.channel.Load(),
+			Relay:   s.drops.relay.Load(),
+		},
+		Duplicates: s.duplicates.Load(),
+		Muted:      s.mutedDropped(),
+	}
+}
+
+// dropped counts a drop at the site, in the server too. Only the first
+// drop of the session is logged as a warning, so that a slow consumer
+// does not flood the log.
+func (s *Session) dropped(site DropSite) {
+	switch site {
+	case DropEvent:
+		s.drops.events.Add(1)
+	case DropChannel:
+		s.drops.channel.Add(1)
+	case DropRelay:
+		s.drops.relay.Add(1)
+	}
+	lgr := s.lgr.With("site", site)
+	if s.drops.warned.CompareAndSwap(false, true) {
+		lgr.Warn("dropping messages, consumer too slow")
+	} else {
+		lgr.Debug("dropping message")
+	}
+	if s.srv == nil {
+		return
+	}
+	s.srv.mtx.Lock()
+	s.srv.drops.add(site)
+	s.srv.mtx.Unlock()
+	s.srv.metric(Drop{Session: s, Site: site})
+}
@@ -0,0 +1,62 @@
+package chat_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestDropsCounted(t *testing.T) {
+	var rec recorder
+	var metrics atomic.Int64
+	stats := make(chan chat.SessionStats, 1)
+	// never consumes Events, so typing events pile up
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		for {
+			m, err := s.Recv(ctx)
+			if err != nil {
+				return
+			}
+			if m.Type == chat.MsgTypeText {
+				stats <- s.Stats()
+			}
+		}
+	},
+		chat.ServerOptions.Logger(rec.log),
+		chat.ServerOptions.Metrics(func(m chat.Metric) {
+			if d, ok := m.(chat.Drop); ok && d.Site == chat.DropEvent {
+				metrics.Add(1)
+			}
+		}))
+	c := connect(t, addr, ca)
+
+	// the events buffer holds 8
+	const sent, dropped = 12, 4
+	for range sent {
+		if err := c.SendMessage(context.Background(), typing()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(t, c, "done")
+
+	if s := receive(t, stats); s.Drops.Events != dropped {
+		t.Errorf("session dropped %d events, want %d", s.Drops.Events, dropped)
+	}
+	if n := srv.Stats().Drops.Events; n != dropped {
+		t.Errorf("server dropped %d events, want %d", n, dropped)
+	}
+	if n := metrics.Load(); n != dropped {
+		t.Errorf("%d drop metrics, want %d", n, dropped)
+	}
+	var warnings int
+	for _, l := range rec.recorded() {
+		if l.lvl == chat.LogLevelWarn && l.msg == "dropping messages, consumer too slow" {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Errorf("%d drop warnings, want 1", warnings)
+	}
+}
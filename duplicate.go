@@ -0,0 +1,75 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zhmlst/chat/codes"
+)
+
+// DuplicateLoginPolicy defines how the server treats a token
+// logging in while it already has active sessions.
+type DuplicateLoginPolicy int8
+
+const (
+	// DuplicateAllowAll admits every session of the token.
+	DuplicateAllowAll DuplicateLoginPolicy = iota
+	// DuplicateKickExisting closes the existing sessions of the token
+	// with codes.SessionReplaced before admitting the new one.
+	DuplicateKickExisting
+	// DuplicateRejectNew refuses the login with a notice
+	// and closes the connection with codes.DuplicateLogin.
+	DuplicateRejectNew
+)
+
+// ErrDuplicateLogin is returned when a login is refused by DuplicateRejectNew.
+var ErrDuplicateLogin = errors.New("token already logged in")
+
+// claimToken applies the duplicate login policy to the session logging in
+// with tok and records the session under the token on success.
+func (s *Server) claimToken(session *Session, tok [16]byte) error {
+	if tok == [16]byte{} {
+		return nil
+	}
+	s.mtx.Lock()
+	existing := s.byToken[tok]
+	if len(existing) > 0 && s.cfg.duplicateLogin == DuplicateRejectNew {
+		s.mtx.Unlock()
+		return ErrDuplicateLogin
+	}
+	var replaced []*Session
+	if s.cfg.duplicateLogin == DuplicateKickExisting {
+		for _, other := range existing {
+			replaced = append(replaced, other)
+		}
+		clear(existing)
+	}
+	if existing == nil {
+		existing = make(map[uint64]*Session)
+		s.byToken[tok] = existing
+	}
+	existing[session.id] = session
+	s.mtx.Unlock()
+
+	for _, other := range replaced {
+		other.lgr.With("by", session.id).Info("session replaced by new login")
+		if err := closeConn(other.conn, codes.SessionReplaced, fmt.Sprintf("replaced by session %d", session.id)); err != nil {
+			other.lgr.With("error", err).Error("failed to close replaced session")
+		}
+	}
+	return nil
+}
+
+// releaseToken removes the session from the index of its token.
+func (s *Server) releaseToken(session *Session, tok [16]byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	sessions, ok := s.byToken[tok]
+	if !ok {
+		return
+	}
+	delete(sessions, session.id)
+	if len(sessions) == 0 {
+		delete(s.byToken, tok)
+	}
+}
@@ -0,0 +1,54 @@
+package chat_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+func TestDuplicateAllowAll(t *testing.T) {
+	srv, addr, ca := startServer(t, discard)
+	tok := sharedToken(t)
+	connect(t, addr, ca, tok)
+	connect(t, addr, ca, tok)
+	if n := len(srv.Sessions()); n != 2 {
+		t.Errorf("%d sessions, want 2", n)
+	}
+}
+
+func TestDuplicateKickExisting(t *testing.T) {
+	_, addr, ca := startServer(t, discard,
+		chat.ServerOptions.DuplicateLoginPolicy(chat.DuplicateKickExisting))
+	tok := sharedToken(t)
+	first := serve(t, newClient(t, addr, ca, tok))
+	connect(t, addr, ca, tok)
+
+	err := receive(t, first)
+	var cerr *chat.CloseError
+	if !errors.As(err, &cerr) || cerr.Code != codes.SessionReplaced {
+		t.Errorf("replaced client: %v, want close code %s", err, codes.SessionReplaced)
+	}
+}
+
+func TestDuplicateRejectNew(t *testing.T) {
+	_, addr, ca := startServer(t, discard,
+		chat.ServerOptions.DuplicateLoginPolicy(chat.DuplicateRejectNew))
+	tok := sharedToken(t)
+	first := newClient(t, addr, ca, tok)
+	done := serve(t, first)
+
+	err := dial(t, newClient(t, addr, ca, tok))
+	var cerr *chat.CloseError
+	if !errors.As(err, &cerr) || cerr.Code != codes.DuplicateLogin {
+		t.Errorf("second login: %v, want close code %s", err, codes.DuplicateLogin)
+	}
+
+	// the token is free again once its session ends
+	_ = first.Close()
+	receive(t, done)
+	eventually(t, func() bool {
+		return dial(t, newClient(t, addr, ca, tok)) == nil
+	})
+}
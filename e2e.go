@@ -0,0 +1,343 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// e2eInfo binds the derived keys to this protocol.
+	e2eInfo = "chat e2e v1"
+	// e2eKeyLen is the size of an X25519 public key.
+	e2eKeyLen = 32
+	// e2eHdrLen is the size of the sender key and the counter
+	// preceding the sealed payload.
+	e2eHdrLen = e2eKeyLen + 8
+	// e2eWindow is how many of the latest counters of a peer are remembered,
+	// so that messages reordered by priorities are still accepted once.
+	e2eWindow = 64
+)
+
+var (
+	// ErrUntrustedKey is returned when encrypting for, or decrypting from,
+	// a peer whose public key was not passed to Session.TrustKey.
+	ErrUntrustedKey = errors.New("untrusted e2e key")
+
+	// ErrE2EInvalid is returned when an encrypted payload is malformed,
+	// was tampered with or was encrypted for another peer.
+	ErrE2EInvalid = errors.New("invalid e2e payload")
+
+	// ErrE2EReplay is returned when an encrypted payload was received before.
+	ErrE2EReplay = errors.New("replayed e2e payload")
+)
+
+// E2EKeyEvent reports the X25519 public key a peer announced for end-to-end
+// encryption, see Session.AnnounceKey. The server relaying it may have
+// replaced it, so compare its KeyFingerprint out of band before trusting it.
+type E2EKeyEvent struct {
+	Sender uint64
+	Key    []byte
+}
+
+func (E2EKeyEvent) event() {}
+
+// KeyFingerprint returns the SHA-256 of an end-to-end public key,
+// formatted like Fingerprint, for verifying it out of band.
+func KeyFingerprint(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// e2ePeer holds the keys shared with a trusted peer.
+type e2ePeer struct {
+	seal cipher.AEAD
+	open cipher.AEAD
+	// sent is the counter of the last message sealed for the peer.
+	sent uint64
+	// top is the highest counter received from the peer, bit i of seen
+	// is set if counter top-i was received.
+	top  uint64
+	seen uint64
+}
+
+// fresh reports whether counter n was not received yet.
+// Counters older than the window are refused.
+func (p *e2ePeer) fresh(n uint64) bool {
+	switch {
+	case n == 0:
+		return false
+	case n > p.top:
+		return true
+	case p.top-n >= e2eWindow:
+		return false
+	}
+	return p.seen&(1<<(p.top-n)) == 0
+}
+
+// mark records counter n as received.
+func (p *e2ePeer) mark(n uint64) {
+	if n > p.top {
+		if shift := n - p.top; shift < e2eWindow {
+			p.seen <<= shift
+		} else {
+			p.seen = 0
+		}
+		p.top = n
+	}
+	p.seen |= 1 << (p.top - n)
+}
+
+// e2e is the end-to-end encryption state of a session. Its key pair
+// is generated on first use and lives as long as the session, so that
+// message counters never repeat under the same key.
+type e2e struct {
+	mtx   sync.Mutex
+	priv  *ecdh.PrivateKey
+	peers map[[e2eKeyLen]byte]*e2ePeer
+}
+
+// key returns the private key of the session, generating it from src.
+// The caller holds the mutex.
+func (e *e2e) key(src Source) (*ecdh.PrivateKey, error) {
+	if e.priv != nil {
+		return e.priv, nil
+	}
+	priv, err := ecdh.X25519().GenerateKey(src.Rand)
+	if err != nil {
+		return nil, fmt.Errorf("e2e key gen: %w", err)
+	}
+	e.priv = priv
+	e.peers = make(map[[e2eKeyLen]byte]*e2ePeer)
+	return priv, nil
+}
+
+// PublicKey returns the X25519 public key of the session
+// used for end-to-end encryption.
+func (s *Session) PublicKey() ([]byte, error) {
+	s.e2e.mtx.Lock()
+	defer s.e2e.mtx.Unlock()
+	priv, err := s.e2e.key(s.src)
+	if err != nil {
+		return nil, err
+	}
+	return priv.PublicKey().Bytes(), nil
+}
+
+// AnnounceKey sends the public key of the session to the peer. A Hub relays
+// it to its other members, which receive it as an E2EKeyEvent.
+func (s *Session) AnnounceKey(ctx context.Context) error {
+	if err := s.supports(CapE2E); err != nil {
+		return err
+	}
+	pub, err := s.PublicKey()
+	if err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return s.control(append([]byte("e2ekey "), pub...))
+}
+
+// TrustKey derives the keys shared with the peer owning the public key,
+// so that messages can be encrypted for it with SendEncrypted and its
+// encrypted messages are decrypted by Recv. Trusting the key again keeps
+// the keys and counters already derived.
+func (s *Session) TrustKey(pub []byte) error {
+	peerKey, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUntrustedKey, err)
+	}
+	s.e2e.mtx.Lock()
+	defer s.e2e.mtx.Unlock()
+	priv, err := s.e2e.key(s.src)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.e2e.peers[[e2eKeyLen]byte(pub)]; ok {
+		return nil
+	}
+	own := priv.PublicKey().Bytes()
+	if bytes.Equal(own, pub) {
+		return fmt.Errorf("%w: own key", ErrUntrustedKey)
+	}
+	secret, err := priv.ECDH(peerKey)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUntrustedKey, err)
+	}
+	// Each direction has its own key, so both ends may count from 1.
+	lo, hi := own, pub
+	if bytes.Compare(lo, hi) > 0 {
+		lo, hi = hi, lo
+	}
+	keys, err := hkdf.Key(sha256.New, secret, append(bytes.Clone(lo), hi...), e2eInfo, 64)
+	if err != nil {
+		return err
+	}
+	up, err := newAEAD(keys[:32])
+	if err != nil {
+		return err
+	}
+	down, err := newAEAD(keys[32:])
+	if err != nil {
+		return err
+	}
+	p := &e2ePeer{seal: up, open: down}
+	if !bytes.Equal(lo, own) {
+		p.seal, p.open = down, up
+	}
+	s.e2e.peers[[e2eKeyLen]byte(pub)] = p
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonce returns the AEAD nonce of a counter.
+func nonce(n uint64) []byte {
+	var b [12]byte
+	binary.BigEndian.PutUint64(b[4:], n)
+	return b[:]
+}
+
+// additional returns the data authenticated along with the payload of m,
+// so that the server cannot pass it off as another message.
+func additional(m *Message) []byte {
+	return append([]byte{byte(m.Type)}, m.ID[:]...)
+}
+
+// SendEncrypted sends m with its payload encrypted for the peer owning
+// the public key, which must have been trusted with TrustKey. The frame
+// carries FlagEncrypted and the server passes its payload through as is.
+// Other peers drop it. The ID and Timestamp of m are filled in first.
+func (s *Session) SendEncrypted(ctx context.Context, m *Message, peer []byte) error {
+	if err := s.supports(CapE2E); err != nil {
+		return err
+	}
+	if len(peer) != e2eKeyLen {
+		return ErrUntrustedKey
+	}
+	if err := m.Stamp(s.source()); err != nil {
+		return err
+	}
+	s.e2e.mtx.Lock()
+	p, ok := s.e2e.peers[[e2eKeyLen]byte(peer)]
+	if !ok {
+		s.e2e.mtx.Unlock()
+		return ErrUntrustedKey
+	}
+	p.sent++
+	n := p.sent
+	enc := *m
+	enc.Payload = make([]byte, e2eHdrLen, e2eHdrLen+len(m.Payload)+p.seal.Overhead())
+	copy(enc.Payload, s.e2e.priv.PublicKey().Bytes())
+	binary.BigEndian.PutUint64(enc.Payload[e2eKeyLen:], n)
+	enc.Payload = p.seal.Seal(enc.Payload, nonce(n), m.Payload, additional(m))
+	s.e2e.mtx.Unlock()
+	enc.SetFlag(FlagEncrypted, true)
+	return s.Send(ctx, &enc)
+}
+
+// decrypt replaces the encrypted payload of m with the plaintext
+// and records the key of its sender, see Message.Peer.
+func (s *Session) decrypt(m *Message) error {
+	if len(m.Payload) < e2eHdrLen {
+		return ErrE2EInvalid
+	}
+	sender := [e2eKeyLen]byte(m.Payload)
+	n := binary.BigEndian.Uint64(m.Payload[e2eKeyLen:])
+	s.e2e.mtx.Lock()
+	defer s.e2e.mtx.Unlock()
+	p, ok := s.e2e.peers[sender]
+	if !ok {
+		return ErrUntrustedKey
+	}
+	if !p.fresh(n) {
+		return ErrE2EReplay
+	}
+	pld, err := p.open.Open(nil, nonce(n), m.Payload[e2eHdrLen:], additional(m))
+	if err != nil {
+		return ErrE2EInvalid
+	}
+	p.mark(n)
+	m.Payload = pld
+	m.peer = sender[:]
+	m.SetFlag(FlagEncrypted, false)
+	return nil
+}
+
+// Peer returns the public key of the peer which encrypted the message
+// end to end, nil if it was not encrypted. Received messages are
+// decrypted by the session with FlagEncrypted cleared.
+func (m *Message) Peer() []byte {
+	return m.peer
+}
+
+// activeSession returns the session of the active connection,
+// failing with ErrClientClosed when the client is not connected.
+func (c *Client) activeSession() (*Session, error) {
+	c.mtx.Lock()
+	session := c.session
+	c.mtx.Unlock()
+	if session == nil {
+		return nil, ErrClientClosed
+	}
+	return session, nil
+}
+
+// PublicKey returns the end-to-end public key of the active session,
+// see Session.PublicKey. Every connection has a key of its own, so keys
+// are announced and trusted again after reconnecting.
+func (c *Client) PublicKey() ([]byte, error) {
+	session, err := c.activeSession()
+	if err != nil {
+		return nil, err
+	}
+	return session.PublicKey()
+}
+
+// AnnounceKey sends the public key of the active session to the server,
+// see Session.AnnounceKey. Keys announced by peers are reported to OnEvent.
+func (c *Client) AnnounceKey(ctx context.Context) error {
+	session, err := c.activeSession()
+	if err != nil {
+		return err
+	}
+	return session.AnnounceKey(ctx)
+}
+
+// TrustKey trusts the public key of a peer for the active session,
+// see Session.TrustKey. Messages it encrypted are passed to OnMessage
+// decrypted, with their Peer set.
+func (c *Client) TrustKey(pub []byte) error {
+	session, err := c.activeSession()
+	if err != nil {
+		return err
+	}
+	return session.TrustKey(pub)
+}
+
+// SendEncrypted sends m over the active connection with its payload
+// encrypted for the peer, see Session.SendEncrypted.
+func (c *Client) SendEncrypted(ctx context.Context, m *Message, peer []byte) error {
+	session, err := c.activeSession()
+	if err != nil {
+		return err
+	}
+	return session.SendEncrypted(ctx, m, peer)
+}
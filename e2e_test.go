@@ -0,0 +1,133 @@
+package chat_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+// e2eClient is a client reporting the keys announced by its peers
+// and the text messages it receives.
+type e2eClient struct {
+	*chat.Client
+	keys chan []byte
+	msgs chan *chat.Message
+}
+
+func connectE2E(t *testing.T, addr string, ca *x509.CertPool) *e2eClient {
+	t.Helper()
+	e := &e2eClient{keys: make(chan []byte, 4), msgs: make(chan *chat.Message, 4)}
+	e.Client = connect(t, addr, ca,
+		chat.ClientOptions.OnEvent(func(ev chat.Event) {
+			if ev, ok := ev.(chat.E2EKeyEvent); ok {
+				e.keys <- ev.Key
+			}
+		}),
+		chat.ClientOptions.OnMessage(func(m *chat.Message) {
+			if m.Type == chat.MsgTypeText {
+				e.msgs <- m
+			}
+		}))
+	return e
+}
+
+// exchangeKeys announces the key of from until to receives it,
+// as the hub relays it only once both have joined, and has to trust it.
+func exchangeKeys(t *testing.T, from, to *e2eClient) []byte {
+	t.Helper()
+	pub, err := from.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.After(waitTimeout)
+	for {
+		if err := from.AnnounceKey(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case key := <-to.keys:
+			// verified out of band
+			if chat.KeyFingerprint(key) != chat.KeyFingerprint(pub) {
+				t.Fatalf("announced key %x, want %x", key, pub)
+			}
+			if err := to.TrustKey(key); err != nil {
+				t.Fatal(err)
+			}
+			return pub
+		case <-time.After(20 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("key not relayed")
+		}
+	}
+}
+
+func TestE2E(t *testing.T) {
+	seen := make(chan *chat.Message, 4)
+	records := make(chan chat.MessageRecord, 4)
+	srv, addr, ca := startServer(t, chat.NewHub().Serve,
+		chat.ServerOptions.InboundFilter(func(_ context.Context, _ *chat.Session, m *chat.Message) (*chat.Message, error) {
+			if m.Type == chat.MsgTypeText {
+				c := *m
+				c.Payload = bytes.Clone(m.Payload)
+				seen <- &c
+			}
+			return m, nil
+		}),
+		chat.ServerOptions.MessageSink(func(_ context.Context, rec chat.MessageRecord) error {
+			records <- rec
+			return nil
+		}))
+	alice := connectE2E(t, addr, ca)
+	bob := connectE2E(t, addr, ca)
+	alicePub := exchangeKeys(t, alice, bob)
+	bobPub := exchangeKeys(t, bob, alice)
+
+	secret := chat.NewTextMessage([]byte("meet at noon"))
+	if err := alice.SendEncrypted(context.Background(), secret, bobPub); err != nil {
+		t.Fatal(err)
+	}
+	m := receive(t, bob.msgs)
+	if string(m.Payload) != "meet at noon" || !bytes.Equal(m.Peer(), alicePub) || m.HasFlag(chat.FlagEncrypted) {
+		t.Errorf("received %q from %x, want the plaintext from %x", m.Payload, m.Peer(), alicePub)
+	}
+
+	// the server only ever has the ciphertext
+	relayed := receive(t, seen)
+	if !relayed.HasFlag(chat.FlagEncrypted) || bytes.Contains(relayed.Payload, []byte("noon")) {
+		t.Errorf("filter got %q, want ciphertext", relayed.Payload)
+	}
+	if rec := receive(t, records); !rec.Encrypted || !bytes.Equal(rec.Payload, relayed.Payload) {
+		t.Errorf("sink stored %q, encrypted %v, want the ciphertext", rec.Payload, rec.Encrypted)
+	}
+
+	// replaying the ciphertext to bob is refused
+	tok, err := bob.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SendTo(context.Background(), tok, relayed); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SendEncrypted(context.Background(), chat.NewTextMessage([]byte("after")), bobPub); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, bob.msgs); string(m.Payload) != "after" {
+		t.Errorf("received %q, want the replay dropped", m.Payload)
+	}
+
+	// other members cannot decrypt it
+	eve := connectE2E(t, addr, ca)
+	exchangeKeys(t, eve, alice) // eve has joined
+	if err := alice.SendEncrypted(context.Background(), chat.NewTextMessage([]byte("private")), bobPub); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, bob.msgs)
+	send(t, alice.Client, "public")
+	if m := receive(t, eve.msgs); string(m.Payload) != "public" {
+		t.Errorf("eve received %q, want only the plaintext message", m.Payload)
+	}
+}
@@ -0,0 +1,211 @@
+package chat_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+// edit is the control message a session sends for EditMessage.
+func edit(id [16]byte, pld string) *chat.Message {
+	return &chat.Message{Type: chat.MsgTypeControl, Payload: append(append([]byte("edit "), id[:]...), pld...)}
+}
+
+// member connects a client to the hub at addr, returning it with the
+// events and text messages it receives.
+func member(t *testing.T, addr string, ca *x509.CertPool) (*chat.Client, <-chan chat.Event, <-chan *chat.Message) {
+	t.Helper()
+	events := make(chan chat.Event, 8)
+	msgs := make(chan *chat.Message, 8)
+	c := connect(t, addr, ca,
+		chat.ClientOptions.OnEvent(func(e chat.Event) { events <- e }),
+		chat.ClientOptions.OnMessage(func(m *chat.Message) {
+			if m.Type == chat.MsgTypeText {
+				msgs <- m
+			}
+		}),
+	)
+	return c, events, msgs
+}
+
+// next returns the next event of type T of events.
+func next[T chat.Event](t *testing.T, events <-chan chat.Event) T {
+	t.Helper()
+	for {
+		if e, ok := receive(t, events).(T); ok {
+			return e
+		}
+	}
+}
+
+func TestEditPropagates(t *testing.T) {
+	_, addr, ca := startServer(t, chat.NewHub().Serve)
+	a, aEvents, _ := member(t, addr, ca)
+	_, bEvents, bMsgs := member(t, addr, ca)
+	next[chat.PresenceEvent](t, aEvents)
+
+	ctx := context.Background()
+	m := chat.NewTextMessage([]byte("helo"))
+	if err := a.SendMessage(ctx, m); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	receive(t, bMsgs)
+	if err := a.SendMessage(ctx, edit(m.ID, "hello")); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	e := next[chat.EditEvent](t, bEvents)
+	if e.ID != m.ID || !bytes.Equal(e.Payload, []byte("hello")) {
+		t.Errorf("edit event of %x to %q, want %x to %q", e.ID, e.Payload, m.ID, "hello")
+	}
+	del := &chat.Message{Type: chat.MsgTypeControl, Payload: append([]byte("delete "), m.ID[:]...)}
+	if err := a.SendMessage(ctx, del); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if e := next[chat.DeleteEvent](t, bEvents); e.ID != m.ID {
+		t.Errorf("delete event of %x, want %x", e.ID, m.ID)
+	}
+}
+
+func TestForgedEditRefused(t *testing.T) {
+	_, addr, ca := startServer(t, chat.NewHub().Serve)
+	a, aEvents, _ := member(t, addr, ca)
+	b, bEvents, bMsgs := member(t, addr, ca)
+	next[chat.PresenceEvent](t, aEvents)
+
+	ctx := context.Background()
+	m := chat.NewTextMessage([]byte("hello"))
+	if err := a.SendMessage(ctx, m); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	receive(t, bMsgs)
+	if err := b.SendMessage(ctx, edit(m.ID, "forged")); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	if e := next[chat.NoticeEvent](t, bEvents); e.Code != codes.PolicyViolation || e.Reason != "unknown_id" {
+		t.Errorf("notice %+v, want a refusal", e)
+	}
+	deadline := time.After(50 * time.Millisecond)
+	for {
+		select {
+		case e := <-aEvents:
+			if e, ok := e.(chat.EditEvent); ok {
+				t.Fatalf("forged edit relayed: %+v", e)
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+func TestEditFiltered(t *testing.T) {
+	edits := make(chan chat.MessageRecord, 4)
+	_, addr, ca := startServer(t, chat.NewHub().Serve,
+		chat.ServerOptions.InboundFilter(func(_ context.Context, _ *chat.Session, m *chat.Message) (*chat.Message, error) {
+			switch {
+			case bytes.Contains(m.Payload, []byte("bad")):
+				return nil, chat.ErrMessageRejected
+			case bytes.Contains(m.Payload, []byte("drop")):
+				return nil, nil
+			}
+			return m, nil
+		}),
+		chat.ServerOptions.MessageSink(func(_ context.Context, rec chat.MessageRecord) error {
+			if rec.Edited {
+				edits <- rec
+			}
+			return nil
+		}),
+	)
+	a, aEvents, _ := member(t, addr, ca)
+	_, bEvents, bMsgs := member(t, addr, ca)
+	next[chat.PresenceEvent](t, aEvents)
+
+	ctx := context.Background()
+	ok, dropped := chat.NewTextMessage([]byte("hello")), chat.NewTextMessage([]byte("drop me"))
+	for _, m := range []*chat.Message{dropped, ok} {
+		if err := a.SendMessage(ctx, m); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	if m := receive(t, bMsgs); m.ID != ok.ID {
+		t.Fatalf("received %q, want hello", m.Payload)
+	}
+
+	// edits are filtered like messages
+	if err := a.SendMessage(ctx, edit(ok.ID, "bad words")); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	if e := next[chat.NoticeEvent](t, aEvents); e.Reason != "rejected" {
+		t.Errorf("notice %+v, want a rejection", e)
+	}
+	// a message the filter dropped cannot be edited into another one
+	if err := a.SendMessage(ctx, edit(dropped.ID, "fine")); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	if e := next[chat.NoticeEvent](t, aEvents); e.Reason != "unknown_id" {
+		t.Errorf("notice %+v, want a refusal", e)
+	}
+	if err := a.SendMessage(ctx, edit(ok.ID, "hello again")); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	if e := next[chat.EditEvent](t, bEvents); e.ID != ok.ID || string(e.Payload) != "hello again" {
+		t.Errorf("edit event of %x to %q, want only the accepted edit", e.ID, e.Payload)
+	}
+	if rec := receive(t, edits); rec.ID != ok.ID || string(rec.Payload) != "hello again" {
+		t.Errorf("archived edit of %x to %q", rec.ID, rec.Payload)
+	}
+	select {
+	case rec := <-edits:
+		t.Errorf("archived edit to %q", rec.Payload)
+	default:
+	}
+}
+
+// stalled returns a session whose writes are stalled by a peer which
+// does not read.
+func stalled(t *testing.T) *chat.Session {
+	t.Helper()
+	sessions := make(chan *chat.Session, 1)
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		// more than the flow control window of the stream
+		go func() {
+			for range 64 {
+				if s.Send(ctx, chat.NewBinaryMessage(make([]byte, 64<<10))) != nil {
+					return
+				}
+			}
+		}()
+		sessions <- s
+		<-ctx.Done()
+	}, chat.ServerOptions.NoAuth())
+	bareLogin(t, addr, ca)
+	s := receive(t, sessions)
+	// the bulk frames have filled the window
+	time.Sleep(100 * time.Millisecond)
+	return s
+}
+
+func TestEditCancelled(t *testing.T) {
+	s := stalled(t)
+	for name, send := range map[string]func(context.Context) error{
+		"edit":   func(ctx context.Context) error { return s.EditMessage(ctx, [16]byte{1}, []byte("x")) },
+		"delete": func(ctx context.Context) error { return s.DeleteMessage(ctx, [16]byte{1}) },
+	} {
+		ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+		start := time.Now()
+		err := send(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s behind a stalled write: %v, want %v", name, err, context.DeadlineExceeded)
+		}
+		if d := time.Since(start); d > 200*time.Millisecond {
+			t.Errorf("%s returned %s after its context was done", name, d)
+		}
+	}
+}
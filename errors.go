@@ -0,0 +1,160 @@
+package chat
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+
+	"github.com/quic-go/quic-go"
+	"github.com/zhmlst/chat/codes"
+)
+
+// Error categories. Errors returned by Client.Dial, Client.Send, Session.Send,
+// Session.Recv, Server.Run, Server.Stop and Server.Shutdown are an *Error
+// matching one of them with errors.Is, unless they fall in none,
+// e.g. an invalid config or ctx being done.
+var (
+	// ErrAuth is the category of refused logins and untrusted peers,
+	// e.g. ErrInvalidToken, ErrLoginRefused and ErrServerKeyChanged.
+	ErrAuth = errors.New("authentication failed")
+	// ErrProtocol is the category of peers breaking the protocol or
+	// speaking another one, e.g. ErrUnknownType and ErrProtocolMismatch,
+	// and of servers failing the handshake, see ErrInternal.
+	ErrProtocol = errors.New("protocol violation")
+	// ErrTransport is the category of network failures.
+	ErrTransport = errors.New("transport failure")
+	// ErrClosed is the category of operations on a closed client, session
+	// or server, and connections closed with a code of no other category.
+	ErrClosed = errors.New("closed")
+)
+
+// Error is an error of the package, see ErrAuth.
+// It matches both its category and its cause.
+type Error struct {
+	// Op is the failed operation, e.g. "dial" or "recv".
+	Op string
+	// Category is one of ErrAuth, ErrProtocol, ErrTransport and ErrClosed,
+	// nil if the error falls in none.
+	Category error
+	// Code is the code the connection was closed or the stream reset with,
+	// if HasCode is set, see CloseError and StreamResetError.
+	Code    codes.Code
+	HasCode bool
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+// Unwrap returns the cause and the category.
+func (e *Error) Unwrap() []error {
+	if e.Category == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Err, e.Category}
+}
+
+// sentinels maps the sentinel errors of the package to their categories.
+var sentinels = []struct {
+	err      error
+	category error
+}{
+	{ErrInvalidToken, ErrAuth},
+	{ErrAuthRequired, ErrAuth},
+	{ErrGuestDenied, ErrAuth},
+	{ErrTokenDenied, ErrAuth},
+	{ErrLoginRefused, ErrAuth},
+	{ErrDuplicateLogin, ErrAuth},
+	{ErrAuthUnavailable, ErrAuth},
+	{ErrServerKeyChanged, ErrAuth},
+	{ErrServerKeyRejected, ErrAuth},
+	{ErrUntrustedKey, ErrAuth},
+	{ErrProtocolMismatch, ErrProtocol},
+	{ErrInternal, ErrProtocol},
+	{ErrRedirectLoop, ErrProtocol},
+	{ErrMalformedFrame, ErrProtocol},
+	{ErrUnknownType, ErrProtocol},
+	{ErrUnknownFlag, ErrProtocol},
+	{ErrPayloadTooLarge, ErrProtocol},
+	{ErrClockSkew, ErrProtocol},
+	{ErrUnexpectedToken, ErrProtocol},
+	{ErrMalformedAck, ErrProtocol},
+	{ErrNoCapability, ErrProtocol},
+	{ErrClientClosed, ErrClosed},
+	{ErrSendClosed, ErrClosed},
+	{ErrSessionClosed, ErrClosed},
+	{ErrChannelClosed, ErrClosed},
+	{ErrStreamRefused, ErrClosed},
+	{ErrServerNotRunning, ErrClosed},
+	{quic.ErrServerClosed, ErrClosed},
+}
+
+// codeCategory returns the category of a close or reset code.
+func codeCategory(code codes.Code) error {
+	switch code {
+	case codes.InvalidToken, codes.GuestDenied, codes.DuplicateLogin, codes.Forbidden:
+		return ErrAuth
+	case codes.ProtocolError, codes.FrameTooLarge:
+		return ErrProtocol
+	}
+	return ErrClosed
+}
+
+// categorize wraps err returned by the operation in an *Error.
+// An *Error is returned as is, and io.EOF too, as readers compare it.
+func categorize(op string, err error) error {
+	var e *Error
+	if err == nil || err == io.EOF || errors.As(err, &e) {
+		return err
+	}
+	e = &Error{Op: op, Err: err}
+	for _, s := range sentinels {
+		if errors.Is(err, s.err) {
+			e.Category = s.category
+			break
+		}
+	}
+	var (
+		cerr    *CloseError
+		appErr  *quic.ApplicationError
+		rerr    *StreamResetError
+		serr    *quic.StreamError
+		certErr *tls.CertificateVerificationError
+		trErr   *quic.TransportError
+		idleErr *quic.IdleTimeoutError
+		hsErr   *quic.HandshakeTimeoutError
+		srErr   *quic.StatelessResetError
+		vnErr   *quic.VersionNegotiationError
+		netErr  net.Error
+	)
+	switch {
+	case errors.As(err, &cerr):
+		e.Code, e.HasCode = cerr.Code, true
+	case errors.As(err, &appErr):
+		e.Code, e.HasCode = codes.Code(appErr.ErrorCode), true
+	case errors.As(err, &rerr):
+		e.Code, e.HasCode = rerr.Code, true
+	case errors.As(err, &serr):
+		e.Code, e.HasCode = codes.Code(serr.ErrorCode), true
+	}
+	switch {
+	case e.Category != nil:
+	case e.HasCode:
+		e.Category = codeCategory(e.Code)
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+	case errors.As(err, &certErr):
+		e.Category = ErrAuth
+	case errors.As(err, &trErr), errors.As(err, &idleErr), errors.As(err, &hsErr),
+		errors.As(err, &srErr), errors.As(err, &vnErr),
+		errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr):
+		e.Category = ErrTransport
+	case errors.Is(err, net.ErrClosed):
+		// quic errors of closed connections wrap it too
+		e.Category = ErrClosed
+	}
+	return e
+}
@@ -0,0 +1,200 @@
+package chat_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+	"github.com/zhmlst/chat/keygen"
+)
+
+// refusing runs a server answering every login with a plain "no",
+// issuing tokens on request, so that clients give up on it.
+func refusing(t *testing.T) (string, *x509.CertPool) {
+	t.Helper()
+	certPEM, keyPEM, err := keygen.Cert([]string{"127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := x509.NewCertPool()
+	ca.AppendCertsFromPEM(certPEM)
+	lnr, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{crt}, NextProtos: []string{"quic-raw"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lnr.Close() })
+	go func() {
+		for {
+			conn, err := lnr.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				for {
+					var m chat.Message
+					if _, err := m.ReadFrom(stream); err != nil {
+						return
+					}
+					resp := chat.NewControlMessage("no")
+					if bytes.HasPrefix(m.Payload, []byte("ack")) {
+						resp.Payload = []byte(rand.Text())[:16]
+					}
+					if _, err := resp.WriteTo(stream); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return lnr.Addr().String(), ca
+}
+
+// unsupported runs a UDP endpoint answering every QUIC Initial with
+// a version negotiation offering only a version nobody supports.
+func unsupported(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// long header: flags, version, DCID and SCID, each with its length
+			p := buf[:n]
+			if n < 7 || p[0]&0x80 == 0 {
+				continue
+			}
+			dcid := p[6 : 6+int(p[5])]
+			rest := p[6+len(dcid):]
+			scid := rest[1 : 1+int(rest[0])]
+			vn := []byte{0x80, 0, 0, 0, 0}
+			vn = append(append(vn, byte(len(scid))), scid...)
+			vn = append(append(vn, byte(len(dcid))), dcid...)
+			vn = binary.BigEndian.AppendUint32(vn, 0x0a0a0a0a)
+			_, _ = pc.WriteTo(vn, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestErrorCategories(t *testing.T) {
+	// dialServed returns the error of a client served until act ends its
+	// session
+	dialServed := func(t *testing.T, act func(srv *chat.Server, id uint64)) error {
+		ids := make(chan uint64, 1)
+		srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+			ids <- s.ID()
+			discard(ctx, s)
+		})
+		done := serve(t, newClient(t, addr, ca))
+		act(srv, receive(t, ids))
+		return receive(t, done)
+	}
+	for _, tt := range []struct {
+		name     string
+		err      func(t *testing.T) error
+		category error
+		code     codes.Code // if the error has one
+		hasCode  bool
+	}{
+		{"untrusted certificate", func(t *testing.T) error {
+			_, addr, _ := startServer(t, discard)
+			return newClient(t, addr, x509.NewCertPool()).Dial(t.Context())
+		}, chat.ErrAuth, 0, false},
+		{"guest denied", func(t *testing.T) error {
+			_, addr, ca := startServer(t, discard)
+			return newClient(t, addr, ca, chat.ClientOptions.Guest()).Dial(t.Context())
+		}, chat.ErrAuth, codes.GuestDenied, true},
+		{"disconnected as forbidden", func(t *testing.T) error {
+			return dialServed(t, func(srv *chat.Server, id uint64) { _ = srv.Disconnect(id, codes.Forbidden) })
+		}, chat.ErrAuth, codes.Forbidden, true},
+		{"internal server error", func(t *testing.T) error {
+			addr, ca := refusing(t)
+			return newClient(t, addr, ca).Dial(t.Context())
+		}, chat.ErrProtocol, 0, false},
+		{"protocol mismatch", func(t *testing.T) error {
+			_, addr, ca := startServer(t, discard)
+			return newClient(t, addr, ca, chat.ClientOptions.RawSessions()).Dial(t.Context())
+		}, chat.ErrProtocol, codes.ProtocolError, true},
+		{"unknown type", func(t *testing.T) error {
+			_, addr, ca := startServer(t, discard)
+			return connect(t, addr, ca).SendMessage(t.Context(), &chat.Message{Type: 0xFF})
+		}, chat.ErrProtocol, 0, false},
+		{"payload too large", func(t *testing.T) error {
+			_, addr, ca := startServer(t, discard, chat.ServerOptions.MaxPayloadSize(8))
+			return connect(t, addr, ca).SendText(t.Context(), "more than eight bytes")
+		}, chat.ErrProtocol, 0, false},
+		{"stream reset", func(t *testing.T) error {
+			_, addr, ca := startServer(t, discard, chat.ServerOptions.StreamHandler(func(ctx context.Context, s *chat.Session) {
+				if _, err := s.Recv(ctx); err == nil {
+					s.Abort(codes.FrameTooLarge)
+				}
+				<-ctx.Done()
+			}))
+			s, err := connect(t, addr, ca).NewSession(t.Context(), "upload")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Send(t.Context(), chat.NewTextMessage([]byte("chunk"))); err != nil {
+				t.Fatal(err)
+			}
+			_, err = s.Recv(t.Context())
+			return err
+		}, chat.ErrProtocol, codes.FrameTooLarge, true},
+		{"version negotiation", func(t *testing.T) error {
+			return newClient(t, unsupported(t), nil).Dial(t.Context())
+		}, chat.ErrTransport, 0, false},
+		{"replaced", func(t *testing.T) error {
+			return dialServed(t, func(srv *chat.Server, id uint64) { _ = srv.Disconnect(id, codes.SessionReplaced) })
+		}, chat.ErrClosed, codes.SessionReplaced, true},
+		{"send on a closed client", func(t *testing.T) error {
+			_, addr, ca := startServer(t, discard)
+			c := connect(t, addr, ca)
+			_ = c.Close()
+			return c.SendText(t.Context(), "late")
+		}, chat.ErrClosed, 0, false},
+		{"server not running", func(t *testing.T) error {
+			return chat.NewServer().Shutdown(t.Context())
+		}, chat.ErrClosed, 0, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.err(t)
+			var e *chat.Error
+			if !errors.As(err, &e) {
+				t.Fatalf("%v is no *chat.Error", err)
+			}
+			for _, category := range []error{chat.ErrAuth, chat.ErrProtocol, chat.ErrTransport, chat.ErrClosed} {
+				if errors.Is(err, category) != (category == tt.category) {
+					t.Errorf("%v matching %v: %v", err, category, errors.Is(err, category))
+				}
+			}
+			if e.HasCode != tt.hasCode || e.Code != tt.code {
+				t.Errorf("%v with code %v (%v), want %v (%v)", err, e.Code, e.HasCode, tt.code, tt.hasCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/zhmlst/chat/codes"
+)
+
+// typingInterval is the minimal time between typing events sent by a session.
+const typingInterval = 3 * time.Second
+
+// Event is a protocol event delivered outside the message flow.
+type Event interface {
+	event()
+}
+
+// TypingEvent reports that a peer is typing.
+// Sender is the ID of the typing session when relayed by a server.
+type TypingEvent struct {
+	Sender uint64
+}
+
+func (TypingEvent) event() {}
+
+// EditEvent reports that the peer replaced the payload of a sent message.
+// A server session reports only edits of messages the peer sent, after
+// passing the new payload through the mute, rate limit and inbound
+// filter of the session like a message.
+type EditEvent struct {
+	Sender  uint64
+	ID      [16]byte
+	Payload []byte
+}
+
+func (EditEvent) event() {}
+
+// DeleteEvent reports that the peer deleted a sent message.
+type DeleteEvent struct {
+	Sender uint64
+	ID     [16]byte
+}
+
+func (DeleteEvent) event() {}
+
+// NoticeEvent reports a problem the server handled without
+// closing the connection, e.g. a rejected message.
+// Reason is a short machine readable string, Message is meant for humans.
+type NoticeEvent struct {
+	Code    codes.Code
+	Reason  string
+	Message string
+}
+
+func (NoticeEvent) event() {}
+
+// PresenceEvent reports that a session joined or left the hub.
+type PresenceEvent struct {
+	Sender uint64
+	Online bool
+}
+
+func (PresenceEvent) event() {}
+
+// DrainEvent reports that the server is going to close
+// the connection at Deadline, or at an unknown time if it is zero.
+type DrainEvent struct {
+	Deadline time.Time
+}
+
+func (DrainEvent) event() {}
+
+// TokenRotatedEvent reports that the server issued a new token
+// replacing the one the session logged in with.
+type TokenRotatedEvent struct {
+	Token [16]byte
+}
+
+func (TokenRotatedEvent) event() {}
+
+// RawControlEvent carries a control message with an unknown
+// or malformed command, so that nothing is lost.
+type RawControlEvent struct {
+	Message *Message
+}
+
+func (RawControlEvent) event() {}
+
+// Events returns a channel of events received by the session.
+// Events are picked out of the stream by Recv, so somebody must be
+// receiving messages for events to arrive. Events that do not fit
+// in the buffer are dropped and counted, see DroppedEvents.
+func (s *Session) Events(ctx context.Context) <-chan Event {
+	ch := make(chan Event)
+	go func() {
+		defer s.trackPump()()
+		defer close(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.stream.Context().Done():
+				return
+			case ev := <-s.events:
+				select {
+				case ch <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// SendTyping tells the peer that the user is typing. Calls made within
+// three seconds of the last sent typing event are silently skipped.
+func (s *Session) SendTyping(ctx context.Context) error {
+	now := s.src.Now()
+	s.wmtx.Lock()
+	skip := now.Sub(s.typed) < typingInterval
+	s.wmtx.Unlock()
+	if skip {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.enqueue(ctx, &Message{Type: MsgTypeControl, Payload: []byte("typing")}, PriorityHigh); err != nil {
+		return err
+	}
+	s.wmtx.Lock()
+	s.typed = now
+	s.wmtx.Unlock()
+	return nil
+}
+
+// EditMessage replaces the payload of a message previously sent by the session.
+func (s *Session) EditMessage(ctx context.Context, id [16]byte, pld []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cmd := append(append([]byte("edit "), id[:]...), pld...)
+	return s.enqueue(ctx, &Message{Type: MsgTypeControl, Payload: cmd}, PriorityHigh)
+}
+
+// DeleteMessage deletes a message previously sent by the session.
+func (s *Session) DeleteMessage(ctx context.Context, id [16]byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.enqueue(ctx, &Message{Type: MsgTypeControl, Payload: append([]byte("delete "), id[:]...)}, PriorityHigh)
+}
+
+// SendError sends a notice to the peer, which receives it as a NoticeEvent.
+func (s *Session) SendError(ctx context.Context, code codes.Code, reason, msg string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.enqueue(ctx, &Message{Type: MsgTypeControl, Payload: notice(code, reason, msg)}, PriorityHigh)
+}
+
+// notice builds the payload of a notice control message.
+func notice(code codes.Code, reason, msg string) []byte {
+	return []byte("notice " + strconv.FormatUint(uint64(code), 10) + " " + reason + " " + msg)
+}
+
+// sendEvent relays an event to the peer, prefixing its
+// arguments with the ID of the session it originates from.
+func (s *Session) sendEvent(ev Event) error {
+	switch ev := ev.(type) {
+	case TypingEvent:
+		return s.control([]byte("typing " + strconv.FormatUint(ev.Sender, 10)))
+	case EditEvent:
+		pld := []byte("edit " + strconv.FormatUint(ev.Sender, 10) + " ")
+		return s.control(append(append(pld, ev.ID[:]...), ev.Payload...))
+	case DeleteEvent:
+		pld := []byte("delete " + strconv.FormatUint(ev.Sender, 10) + " ")
+		return s.control(append(pld, ev.ID[:]...))
+	case PresenceEvent:
+		state := "off"
+		if ev.Online {
+			state = "on"
+		}
+		return s.control([]byte("presence " + strconv.FormatUint(ev.Sender, 10) + " " + state))
+	case E2EKeyEvent:
+		pld := []byte("e2ekey " + strconv.FormatUint(ev.Sender, 10) + " ")
+		return s.control(append(pld, ev.Key...))
+	}
+	return nil
+}
+
+// parseEvent turns control messages into events.
+// Unknown commands become a RawControlEvent.
+func (s *Session) parseEvent(m *Message) (Event, bool) {
+	if m.Type != MsgTypeControl {
+		return nil, false
+	}
+	raw := RawControlEvent{Message: m}
+	cmd, arg, _ := bytes.Cut(m.Payload, []byte(" "))
+	// events originating from the server itself
+	switch string(cmd) {
+	case "notice":
+		if n, ok := parseNotice(arg); ok {
+			return n, true
+		}
+		return raw, true
+	case "drain":
+		ms, err := strconv.ParseInt(string(arg), 10, 64)
+		if err != nil {
+			return raw, true
+		}
+		if ms == 0 {
+			return DrainEvent{}, true
+		}
+		return DrainEvent{Deadline: time.UnixMilli(ms)}, true
+	case "rotate":
+		if len(arg) != 16 {
+			return raw, true
+		}
+		return TokenRotatedEvent{Token: [16]byte(arg)}, true
+	}
+	// events relayed by a server carry the originating session ID first
+	sender := s.id
+	if s.srv == nil {
+		var rawSender []byte
+		rawSender, arg, _ = bytes.Cut(arg, []byte(" "))
+		sender, _ = strconv.ParseUint(string(rawSender), 10, 64)
+	}
+	switch string(cmd) {
+	case "typing":
+		return TypingEvent{Sender: sender}, true
+	case "edit":
+		if len(arg) < 16 {
+			return raw, true
+		}
+		return EditEvent{Sender: sender, ID: [16]byte(arg), Payload: arg[16:]}, true
+	case "delete":
+		if len(arg) != 16 {
+			return raw, true
+		}
+		return DeleteEvent{Sender: sender, ID: [16]byte(arg)}, true
+	case "e2ekey":
+		if len(arg) != e2eKeyLen {
+			return raw, true
+		}
+		return E2EKeyEvent{Sender: sender, Key: bytes.Clone(arg)}, true
+	case "presence":
+		switch string(arg) {
+		case "on":
+			return PresenceEvent{Sender: sender, Online: true}, true
+		case "off":
+			return PresenceEvent{Sender: sender}, true
+		}
+	}
+	return raw, true
+}
+
+// parseNotice parses the arguments of a notice: code, reason and message.
+func parseNotice(arg []byte) (NoticeEvent, bool) {
+	rawCode, arg, _ := bytes.Cut(arg, []byte(" "))
+	code, err := strconv.ParseUint(string(rawCode), 10, 64)
+	if err != nil {
+		return NoticeEvent{}, false
+	}
+	reason, msg, _ := bytes.Cut(arg, []byte(" "))
+	return NoticeEvent{Code: codes.Code(code), Reason: string(reason), Message: string(msg)}, true
+}
+
+// dispatchEvent queues the event without blocking the receive loop.
+func (s *Session) dispatchEvent(ev Event) {
+	select {
+	case s.events <- ev:
+	default:
+		s.dropped(DropEvent)
+	}
+}
+
+// DroppedEvents returns the number of events dropped
+// because nobody consumed them in time.
+func (s *Session) DroppedEvents() uint64 {
+	return s.drops.events.Load()
+}
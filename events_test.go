@@ -0,0 +1,80 @@
+package chat_test
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+func TestEventRouting(t *testing.T) {
+	id := [16]byte{1, 2, 3}
+	deadline := time.UnixMilli(1735689600000)
+	tests := []struct {
+		cmd  string
+		want chat.Event
+	}{
+		{"notice " + strconv.Itoa(int(codes.PolicyViolation)) + " muted you are muted", chat.NoticeEvent{Code: codes.PolicyViolation, Reason: "muted", Message: "you are muted"}},
+		{"drain 0", chat.DrainEvent{}},
+		{"drain 1735689600000", chat.DrainEvent{Deadline: deadline}},
+		{"typing 4", chat.TypingEvent{Sender: 4}},
+		{"edit 4 " + string(id[:]) + "fixed", chat.EditEvent{Sender: 4, ID: id, Payload: []byte("fixed")}},
+		{"delete 4 " + string(id[:]), chat.DeleteEvent{Sender: 4, ID: id}},
+		{"presence 4 on", chat.PresenceEvent{Sender: 4, Online: true}},
+		{"presence 4 off", chat.PresenceEvent{Sender: 4}},
+	}
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		for _, tt := range tests {
+			if err := s.Send(ctx, &chat.Message{Type: chat.MsgTypeControl, Payload: []byte(tt.cmd)}); err != nil {
+				return
+			}
+		}
+		discard(ctx, s)
+	})
+	events := make(chan chat.Event, len(tests))
+	connect(t, addr, ca, chat.ClientOptions.OnEvent(func(e chat.Event) { events <- e }))
+	for _, tt := range tests {
+		if got := receive(t, events); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: event %#v, want %#v", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestRawControlEvent(t *testing.T) {
+	events := make(chan chat.Event, 4)
+	msgs := make(chan *chat.Message, 4)
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		go func() {
+			for ev := range s.Events(ctx) {
+				events <- ev
+			}
+		}()
+		for {
+			m, err := s.Recv(ctx)
+			if err != nil {
+				return
+			}
+			msgs <- m
+		}
+	})
+	c := connect(t, addr, ca)
+	ctx := context.Background()
+	// an unknown command, and a known one with malformed arguments
+	for _, cmd := range []string{"wave hello", "delete short"} {
+		if err := c.SendMessage(ctx, &chat.Message{Type: chat.MsgTypeControl, Payload: []byte(cmd)}); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		raw, ok := receive(t, events).(chat.RawControlEvent)
+		if !ok || string(raw.Message.Payload) != cmd {
+			t.Errorf("event for %q: %#v, want a RawControlEvent", cmd, raw)
+		}
+	}
+	send(t, c, "text")
+	if m := receive(t, msgs); string(m.Payload) != "text" {
+		t.Errorf("received %q, want the text only", m.Payload)
+	}
+}
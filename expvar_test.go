@@ -0,0 +1,55 @@
+package chat_test
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+// stats decodes the stats published under name.
+func stats(t *testing.T, name string) chat.Stats {
+	t.Helper()
+	v := expvar.Get(name)
+	if v == nil {
+		t.Fatalf("%s not published", name)
+	}
+	var st chat.Stats
+	if err := json.Unmarshal([]byte(v.String()), &st); err != nil {
+		t.Fatalf("decode %s: %v", name, err)
+	}
+	return st
+}
+
+// published counts the expvar names published by tests.
+var published atomic.Int64
+
+func TestExpvar(t *testing.T) {
+	// expvar names cannot be published twice, e.g. with -count
+	name := "chat_test_expvar_" + strconv.FormatInt(published.Add(1), 10)
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		for range s.Input(ctx) {
+		}
+	}, chat.ServerOptions.Expvar(name))
+	if st := stats(t, name); st.Sessions != 0 || st.Accepted != 0 {
+		t.Errorf("%d sessions, %d accepted before any client", st.Sessions, st.Accepted)
+	}
+	c := connect(t, addr, ca)
+	send(t, c, "hello")
+	eventually(t, func() bool {
+		st := stats(t, name)
+		return st.Sessions == 1 && st.Conns == 1 && st.Accepted == 1 && st.Pumps > 0 && st.BytesIn > 0
+	})
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the values are live, not a snapshot
+	eventually(t, func() bool {
+		st := stats(t, name)
+		return st.Sessions == 0 && st.Conns == 0 && st.Accepted == 1 && st.Pumps == 0
+	})
+}
@@ -0,0 +1,97 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zhmlst/chat/codes"
+)
+
+// MessageFilter inspects a message on its way through a session.
+// It may return a rewritten message, nil to drop the message silently,
+// or an error to reject it. The payload of a message with FlagEncrypted
+// is ciphertext the server cannot read and is best passed through as is.
+// The inbound filter also gets the new payload of an edit, as a text
+// message with the ID of the edited message, see Session.EditMessage.
+//
+// The filter runs on the session pump and must return once ctx is done,
+// which it is after the filter timeout, see ServerOptions.FilterTimeout.
+// Whatever it returns after that is discarded and the message is treated
+// as timed out, a filter ignoring ctx blocks the session until it returns.
+type MessageFilter func(ctx context.Context, s *Session, m *Message) (*Message, error)
+
+const defaultFilterTimeout = time.Second
+
+var (
+	// ErrFilterTimeout is returned when a message filter does not complete in time.
+	ErrFilterTimeout = errors.New("message filter timeout")
+
+	// ErrMessageRejected is returned when a message filter rejects a message.
+	ErrMessageRejected = errors.New("message rejected")
+)
+
+// runFilter calls f, the filter named name, with a context done after
+// the configured filter timeout, see MessageFilter.
+func (s *Server) runFilter(ctx context.Context, name string, f MessageFilter, session *Session, m *Message) (*Message, error) {
+	ctx, cancel := context.WithTimeout(withSession(ctx, session), s.cfg.filterTimeout)
+	defer cancel()
+
+	var r *Message
+	err := session.guard(name, func() (err error) {
+		r, err = f(ctx, session, m)
+		return err
+	})
+	if ctx.Err() != nil {
+		return nil, ErrFilterTimeout
+	}
+	return r, err
+}
+
+// filterInbound applies the inbound filter to a message received by the session.
+// It returns nil if the message must not be delivered.
+func (s *Server) filterInbound(ctx context.Context, session *Session, m *Message) *Message {
+	if s.cfg.inboundFilter == nil {
+		return m
+	}
+	lgr := session.lgr.With("op", "inbound filter")
+	m, err := s.runFilter(ctx, "inbound filter", s.cfg.inboundFilter, session, m)
+	switch {
+	case errors.Is(err, ErrFilterTimeout):
+		lgr.Error("filter timed out, dropping message")
+		return nil
+	case errors.Is(err, ErrCallbackPanic), errors.Is(err, ErrCallbackDisabled):
+		lgr.With("error", err).Warn("dropping message")
+		return nil
+	case err != nil:
+		session.violations++
+		lgr.With("error", err, "violations", session.violations).Warn("message rejected")
+		if cerr := session.SendError(ctx, codes.PolicyViolation, "rejected", err.Error()); cerr != nil {
+			lgr.With("error", cerr).Error("failed to send rejection")
+		}
+		if s.cfg.maxViolations > 0 && session.violations >= s.cfg.maxViolations {
+			lgr.Warn("too many violations, disconnecting")
+			if cerr := closeConn(session.conn, codes.PolicyViolation, fmt.Sprintf("%d messages rejected", session.violations)); cerr != nil {
+				lgr.With("error", cerr).Error("failed to close conn")
+			}
+		}
+		return nil
+	}
+	return m
+}
+
+// filterOutbound applies the outbound filter to a message sent by the session.
+func (s *Server) filterOutbound(ctx context.Context, session *Session, m *Message) (*Message, error) {
+	if s.cfg.outboundFilter == nil {
+		return m, nil
+	}
+	m, err := s.runFilter(ctx, "outbound filter", s.cfg.outboundFilter, session, m)
+	if errors.Is(err, ErrCallbackPanic) || errors.Is(err, ErrCallbackDisabled) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMessageRejected, err)
+	}
+	return m, nil
+}
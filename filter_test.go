@@ -0,0 +1,120 @@
+package chat_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+// echo sends every message received back to the session.
+func echo(ctx context.Context, s *chat.Session) {
+	for {
+		m, err := s.Recv(ctx)
+		if err != nil {
+			return
+		}
+		if err := s.Send(ctx, chat.NewTextMessage(m.Payload)); err != nil {
+			return
+		}
+	}
+}
+
+// censor rewrites profanity in text messages.
+func censor(_ context.Context, _ *chat.Session, m *chat.Message) (*chat.Message, error) {
+	if m.Type != chat.MsgTypeText {
+		return m, nil
+	}
+	m.Payload = bytes.ReplaceAll(m.Payload, []byte("darn"), []byte("****"))
+	return m, nil
+}
+
+// echoed connects a client to a server echoing messages and returns
+// the client along with the payloads it receives.
+func echoed(t *testing.T, opts ...chat.ServerOption) (*chat.Client, <-chan string) {
+	t.Helper()
+	_, addr, ca := startServer(t, echo, opts...)
+	got := make(chan string, 8)
+	c := connect(t, addr, ca, chat.ClientOptions.OnMessage(func(m *chat.Message) { got <- string(m.Payload) }))
+	return c, got
+}
+
+func TestInboundFilterRewrites(t *testing.T) {
+	c, got := echoed(t, chat.ServerOptions.InboundFilter(censor))
+	send(t, c, "darn it")
+	if text := receive(t, got); text != "**** it" {
+		t.Errorf("handler received %q, want %q", text, "**** it")
+	}
+}
+
+func TestOutboundFilterRewrites(t *testing.T) {
+	c, got := echoed(t, chat.ServerOptions.OutboundFilter(censor))
+	send(t, c, "darn it")
+	if text := receive(t, got); text != "**** it" {
+		t.Errorf("client received %q, want %q", text, "**** it")
+	}
+}
+
+func TestInboundFilterDrops(t *testing.T) {
+	c, got := echoed(t, chat.ServerOptions.InboundFilter(func(_ context.Context, _ *chat.Session, m *chat.Message) (*chat.Message, error) {
+		if string(m.Payload) == "spam" {
+			return nil, nil
+		}
+		return m, nil
+	}))
+	send(t, c, "spam")
+	send(t, c, "ham")
+	if text := receive(t, got); text != "ham" {
+		t.Errorf("handler received %q, want %q", text, "ham")
+	}
+}
+
+func TestInboundFilterViolations(t *testing.T) {
+	_, addr, ca := startServer(t, echo,
+		chat.ServerOptions.InboundFilter(func(_ context.Context, _ *chat.Session, m *chat.Message) (*chat.Message, error) {
+			if string(m.Payload) == "banned" {
+				return nil, errors.New("banned word")
+			}
+			return m, nil
+		}),
+		chat.ServerOptions.MaxViolations(2),
+	)
+	notices := make(chan chat.NoticeEvent, 4)
+	c := newClient(t, addr, ca, chat.ClientOptions.OnEvent(func(e chat.Event) {
+		if e, ok := e.(chat.NoticeEvent); ok {
+			notices <- e
+		}
+	}))
+	done := serve(t, c)
+
+	send(t, c, "banned")
+	if e := receive(t, notices); e.Code != codes.PolicyViolation || e.Reason != "rejected" {
+		t.Errorf("notice %+v, want a rejection", e)
+	}
+	send(t, c, "banned")
+	var cerr *chat.CloseError
+	if err := receive(t, done); !errors.As(err, &cerr) || cerr.Code != codes.PolicyViolation {
+		t.Errorf("dial: %v, want close code %s", err, codes.PolicyViolation)
+	}
+}
+
+func TestFilterTimeout(t *testing.T) {
+	c, got := echoed(t,
+		chat.ServerOptions.FilterTimeout(20*time.Millisecond),
+		chat.ServerOptions.InboundFilter(func(ctx context.Context, _ *chat.Session, m *chat.Message) (*chat.Message, error) {
+			if string(m.Payload) == "slow" {
+				<-ctx.Done()
+			}
+			return m, nil
+		}),
+	)
+	send(t, c, "slow")
+	send(t, c, "fast")
+	if text := receive(t, got); text != "fast" {
+		t.Errorf("handler received %q, want %q", text, "fast")
+	}
+}
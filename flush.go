@@ -0,0 +1,123 @@
+package chat
+
+import (
+	"bytes"
+	"time"
+)
+
+const (
+	// coalesceWindow is how long the writer waits for more frames
+	// to write them together when coalescing.
+	coalesceWindow = 2 * time.Millisecond
+	// maxBatch is the size of coalesced frames written without waiting further.
+	maxBatch = 16 << 10
+)
+
+// FlushMode defines whether the session writer writes a frame immediately
+// or coalesces it with the following frames into fewer packets.
+type FlushMode int8
+
+const (
+	// FlushDefault follows the session, see SessionOptions.ImmediateFlush.
+	FlushDefault FlushMode = iota
+	// FlushImmediate writes the frame right away, together with
+	// frames coalesced before it.
+	FlushImmediate
+	// FlushCoalesce waits up to 2ms for more frames to write them together.
+	FlushCoalesce
+)
+
+// ImmediateFlush sets whether the session writes every frame right away,
+// which is the default, or coalesces frames arriving within 2ms to reduce
+// the packet count at the cost of latency. Message.Flush overrides it.
+func (sessionOptionsNamespace) ImmediateFlush(on bool) SessionOption {
+	return func(s *Session) {
+		s.coalesceAll = !on
+	}
+}
+
+// coalesce reports whether the frame of m is to be coalesced.
+func (s *Session) coalesce(m *Message) bool {
+	switch m.Flush {
+	case FlushImmediate:
+		return false
+	case FlushCoalesce:
+		return true
+	}
+	return s.coalesceAll
+}
+
+type batched struct {
+	req *writeReq
+	m   Message
+	n   int64
+}
+
+// batch holds coalesced frames until they are written together.
+type batch struct {
+	buf    bytes.Buffer
+	frames []batched
+	timer  *time.Timer
+}
+
+// add frames m into the batch with the codec and reports whether it is full.
+func (b *batch) add(c *codec, req *writeReq, m *Message) bool {
+	n, _ := c.writeTo(&b.buf, m)
+	b.frames = append(b.frames, batched{req: req, m: *m, n: n})
+	if len(b.frames) == 1 {
+		if b.timer == nil {
+			b.timer = time.NewTimer(coalesceWindow)
+		} else {
+			b.timer.Reset(coalesceWindow)
+		}
+	}
+	return b.buf.Len() >= maxBatch
+}
+
+// wait returns the channel firing when the coalescing window
+// of the batch has passed, nil if the batch is empty.
+func (b *batch) wait() <-chan time.Time {
+	if len(b.frames) == 0 {
+		return nil
+	}
+	return b.timer.C
+}
+
+// fail completes the batched requests with err.
+func (b *batch) fail(err error) {
+	for _, f := range b.frames {
+		f.req.done <- err
+	}
+	b.reset()
+}
+
+func (b *batch) reset() {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.buf.Reset()
+	clear(b.frames)
+	b.frames = b.frames[:0]
+}
+
+// flush writes the batched frames to the stream at once.
+func (s *Session) flush(b *batch) {
+	if len(b.frames) == 0 {
+		return
+	}
+	n, err := s.write(nil, func() (int, error) {
+		return s.stream.Write(b.buf.Bytes())
+	})
+	left := int64(n)
+	for _, f := range b.frames {
+		fn := min(f.n, left)
+		left -= fn
+		ferr := err
+		if err != nil && fn == f.n {
+			// written completely before the failure
+			ferr = nil
+		}
+		f.req.done <- s.written(&f.m, fn, ferr)
+	}
+	b.reset()
+}
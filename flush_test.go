@@ -0,0 +1,124 @@
+package chat_test
+
+import (
+	"context"
+	"encoding/binary"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+// sessions returns a handler reporting its sessions on the returned channel.
+func sessions() (chat.Handler, <-chan *chat.Session) {
+	ch := make(chan *chat.Session, 1)
+	return func(ctx context.Context, s *chat.Session) {
+		ch <- s
+		discard(ctx, s)
+	}, ch
+}
+
+func TestFlushOverride(t *testing.T) {
+	// a coalesced frame waits 2ms for others, so sending n one after the
+	// other takes at least 2ms each
+	const n = 20
+	const coalesced = n * 2 * time.Millisecond
+	for _, tt := range []struct {
+		name      string
+		immediate bool
+		flush     chat.FlushMode
+		coalesce  bool
+	}{
+		{"session immediate", true, chat.FlushDefault, false},
+		{"session coalesces", false, chat.FlushDefault, true},
+		{"message immediate", false, chat.FlushImmediate, false},
+		{"message coalesces", true, chat.FlushCoalesce, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h, sess := sessions()
+			_, addr, ca := startServer(t, h, chat.ServerOptions.SessionOptions(
+				chat.SessionOptions.ImmediateFlush(tt.immediate)))
+			got := make(chan struct{}, n)
+			connect(t, addr, ca, chat.ClientOptions.OnMessage(func(m *chat.Message) {
+				if m.Type == chat.MsgTypeText {
+					got <- struct{}{}
+				}
+			}))
+			s := receive(t, sess)
+
+			start := time.Now()
+			for range n {
+				m := chat.NewTextMessage([]byte("hi"))
+				m.Flush = tt.flush
+				if err := s.Send(t.Context(), m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			took := time.Since(start)
+			for range n {
+				receive(t, got)
+			}
+			if took >= coalesced != tt.coalesce {
+				t.Errorf("%d messages sent in %v, coalesced %v", n, took, tt.coalesce)
+			}
+		})
+	}
+}
+
+func BenchmarkFlush(b *testing.B) {
+	for _, bb := range []struct {
+		name      string
+		immediate bool
+	}{
+		{"immediate", true},
+		{"coalesce", false},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			h, sess := sessions()
+			_, addr, ca := startServer(b, h, chat.ServerOptions.SessionOptions(
+				chat.SessionOptions.ImmediateFlush(bb.immediate)))
+			addr, packets := countingProxy(b, addr)
+
+			var (
+				mu        sync.Mutex
+				latencies []time.Duration
+			)
+			all := make(chan struct{})
+			connect(b, addr, ca, chat.ClientOptions.OnMessage(func(m *chat.Message) {
+				if m.Type != chat.MsgTypeText {
+					return
+				}
+				sent := time.Unix(0, int64(binary.BigEndian.Uint64(m.Payload)))
+				mu.Lock()
+				defer mu.Unlock()
+				latencies = append(latencies, time.Since(sent))
+				if len(latencies) == b.N {
+					close(all)
+				}
+			}))
+			s := receive(b, sess)
+			before := packets.Load()
+
+			// concurrent senders give the writer frames to coalesce
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					m := chat.NewTextMessage(binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano())))
+					if err := s.Send(context.Background(), m); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			receive(b, all)
+			b.StopTimer()
+
+			b.ReportMetric(float64(packets.Load()-before)/float64(b.N), "packets/msg")
+			slices.Sort(latencies)
+			b.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-µs")
+		})
+	}
+}
@@ -5,6 +5,7 @@ go 1.25.1
 require (
 	github.com/chzyer/readline v1.5.1
 	github.com/quic-go/quic-go v0.55.0
+	golang.org/x/sys v0.35.0
 )
 
 require (
@@ -12,6 +13,5 @@ require (
 	golang.org/x/mod v0.27.0 // indirect
 	golang.org/x/net v0.43.0 // indirect
 	golang.org/x/sync v0.16.0 // indirect
-	golang.org/x/sys v0.35.0 // indirect
 	golang.org/x/tools v0.36.0 // indirect
 )
@@ -0,0 +1,325 @@
+package chat_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+// frame is a golden wire-format vector: the exact bytes of a frame
+// together with the field values they encode.
+type frame struct {
+	Name      string
+	Hex       string
+	Type      chat.MsgType
+	Flags     chat.Flag
+	Len       uint32
+	ID        [16]byte
+	Timestamp time.Time
+	Token     [16]byte
+	Payload   []byte
+	TTL       time.Duration
+	Channel   uint16
+	// ContentType and Filename are the metadata of FlagMetadata frames,
+	// which Len covers.
+	ContentType string
+	Filename    string
+	// HeaderOnly marks frames whose payload is not included in Hex.
+	HeaderOnly bool
+	// DecodeOnly marks frames that decode to the fields
+	// but are not what encoding them produces.
+	DecodeOnly bool
+	// Err is the error decoding the frame must fail with.
+	Err error
+}
+
+var (
+	goldenTS  = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	goldenID  = [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	goldenTok = [16]byte{0xa0, 0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xab, 0xac, 0xad, 0xae, 0xaf}
+	maxBytes  = [16]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+)
+
+// golden are the vectors locking down the frame layout, meant to be
+// shared with implementations in other languages.
+var golden = []frame{
+	{
+		Name: "control ack",
+		Hex: "00" + "00000003" + "000001941f297c00" + "00" + "00000000000000" +
+			"0102030405060708090a0b0c0d0e0f10" + "00000000000000000000000000000000" +
+			"61636b",
+		Type:      chat.MsgTypeControl,
+		Len:       3,
+		ID:        goldenID,
+		Timestamp: goldenTS,
+		Payload:   []byte("ack"),
+	},
+	{
+		Name: "text with payload",
+		Hex: "01" + "00000005" + "000001941f297c00" + "00" + "00000000000000" +
+			"0102030405060708090a0b0c0d0e0f10" + "a0a1a2a3a4a5a6a7a8a9aaabacadaeaf" +
+			"68656c6c6f",
+		Type:      chat.MsgTypeText,
+		Len:       5,
+		ID:        goldenID,
+		Timestamp: goldenTS,
+		Token:     goldenTok,
+		Payload:   []byte("hello"),
+	},
+	{
+		Name: "zero-length payload",
+		Hex: "02" + "00000000" + "000001941f297c00" + "00" + "00000000000000" +
+			"0102030405060708090a0b0c0d0e0f10" + "00000000000000000000000000000000",
+		Type:      chat.MsgTypeBinary,
+		ID:        goldenID,
+		Timestamp: goldenTS,
+		Payload:   []byte{},
+	},
+	{
+		Name: "max-length header",
+		Hex: "02" + "ffffffff" + "000001941f297c00" + "00" + "00000000000000" +
+			"ffffffffffffffffffffffffffffffff" + "ffffffffffffffffffffffffffffffff",
+		Type:       chat.MsgTypeBinary,
+		Len:        0xffffffff,
+		ID:         maxBytes,
+		Timestamp:  goldenTS,
+		Token:      maxBytes,
+		HeaderOnly: true,
+	},
+	{
+		Name: "ack requested",
+		Hex: "01" + "00000002" + "000001941f297c00" + "01" + "00000000000000" +
+			"0102030405060708090a0b0c0d0e0f10" + "a0a1a2a3a4a5a6a7a8a9aaabacadaeaf" +
+			"6869",
+		Type:      chat.MsgTypeText,
+		Flags:     chat.FlagAckRequested,
+		Len:       2,
+		ID:        goldenID,
+		Timestamp: goldenTS,
+		Token:     goldenTok,
+		Payload:   []byte("hi"),
+	},
+	{
+		Name: "ttl",
+		Hex: "01" + "00000002" + "000001941f297c00" + "02" + "0000ea60" + "000000" +
+			"0102030405060708090a0b0c0d0e0f10" + "a0a1a2a3a4a5a6a7a8a9aaabacadaeaf" +
+			"6869",
+		Type:      chat.MsgTypeText,
+		Flags:     chat.FlagTTL,
+		Len:       2,
+		ID:        goldenID,
+		Timestamp: goldenTS,
+		Token:     goldenTok,
+		Payload:   []byte("hi"),
+		TTL:       time.Minute,
+	},
+	{
+		Name: "channel",
+		Hex: "01" + "00000002" + "000001941f297c00" + "04" + "00000000" + "0007" + "00" +
+			"0102030405060708090a0b0c0d0e0f10" + "a0a1a2a3a4a5a6a7a8a9aaabacadaeaf" +
+			"6869",
+		Type:      chat.MsgTypeText,
+		Flags:     chat.FlagChannel,
+		Len:       2,
+		ID:        goldenID,
+		Timestamp: goldenTS,
+		Token:     goldenTok,
+		Payload:   []byte("hi"),
+		Channel:   7,
+	},
+	{
+		Name: "unknown flags and reserved bytes",
+		Hex: "01" + "00000002" + "000001941f297c00" + "09" + "01020304050607" +
+			"0102030405060708090a0b0c0d0e0f10" + "00000000000000000000000000000000" +
+			"6869",
+		Type:       chat.MsgTypeText,
+		Flags:      0x09,
+		Len:        2,
+		ID:         goldenID,
+		Timestamp:  goldenTS,
+		Payload:    []byte("hi"),
+		DecodeOnly: true,
+	},
+	{
+		Name: "metadata",
+		Hex: "02" + "00000012" + "000001941f297c00" + "20" + "00000000000000" +
+			"0102030405060708090a0b0c0d0e0f10" + "00000000000000000000000000000000" +
+			"09" + "696d6167652f706e67" + "05" + "612e706e67" + "6869",
+		Type:        chat.MsgTypeBinary,
+		Flags:       chat.FlagMetadata,
+		Len:         18,
+		ID:          goldenID,
+		Timestamp:   goldenTS,
+		Payload:     []byte("hi"),
+		ContentType: "image/png",
+		Filename:    "a.png",
+	},
+	{
+		Name: "truncated metadata",
+		Hex: "02" + "00000004" + "000001941f297c00" + "20" + "00000000000000" +
+			"0102030405060708090a0b0c0d0e0f10" + "00000000000000000000000000000000" +
+			"09" + "696d61",
+		Err: chat.ErrInvalidMetadata,
+	},
+	{
+		Name: "unknown critical flag",
+		Hex: "01" + "00000002" + "000001941f297c00" + "80" + "00000000000000" +
+			"0102030405060708090a0b0c0d0e0f10" + "00000000000000000000000000000000" +
+			"6869",
+		Err: chat.ErrUnknownFlag,
+	},
+}
+
+// message returns the message f encodes.
+func (f frame) message(t *testing.T) *chat.Message {
+	t.Helper()
+	m := &chat.Message{Type: f.Type, Flags: f.Flags, TTL: f.TTL, Channel: f.Channel, ID: f.ID, Timestamp: f.Timestamp, Token: f.Token, Payload: f.Payload}
+	if err := m.SetContentType(f.ContentType); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetFilename(f.Filename); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func (f frame) bytes(t *testing.T) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(f.Hex)
+	if err != nil {
+		t.Fatalf("decode hex: %v", err)
+	}
+	return b
+}
+
+func TestGoldenEncode(t *testing.T) {
+	for _, f := range golden {
+		if f.HeaderOnly || f.DecodeOnly || f.Err != nil {
+			continue
+		}
+		t.Run(f.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if _, err := f.message(t).WriteTo(&buf); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			if got := hex.EncodeToString(buf.Bytes()); got != f.Hex {
+				t.Errorf("encoded\n%s, want\n%s", got, f.Hex)
+			}
+		})
+	}
+}
+
+func TestGoldenDecode(t *testing.T) {
+	for _, f := range golden {
+		t.Run(f.Name, func(t *testing.T) {
+			b := f.bytes(t)
+			var m chat.Message
+			rd := bytes.NewReader(b)
+			_, err := m.ReadFrom(rd)
+			switch {
+			case f.Err != nil:
+				if !errors.Is(err, f.Err) {
+					t.Fatalf("read: %v, want %v", err, f.Err)
+				}
+				if rd.Len() != 0 {
+					t.Errorf("%d bytes left unread", rd.Len())
+				}
+				return
+			case f.HeaderOnly:
+				// the payload is not part of the vector, only the header must decode
+				if !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Fatalf("read: %v, want a truncated payload", err)
+				}
+			case err != nil:
+				t.Fatalf("read: %v", err)
+			}
+			if n := binary.BigEndian.Uint32(b[1:5]); n != f.Len {
+				t.Errorf("len %d, want %d", n, f.Len)
+			}
+			if m.Type != f.Type || m.Flags != f.Flags || m.TTL != f.TTL || m.Channel != f.Channel {
+				t.Errorf("type %d, flags %#02x, ttl %v, channel %d, want %d, %#02x, %v, %d",
+					m.Type, m.Flags, m.TTL, m.Channel, f.Type, f.Flags, f.TTL, f.Channel)
+			}
+			if m.ID != f.ID || m.Token != f.Token || !m.Timestamp.Equal(f.Timestamp) {
+				t.Errorf("id %x, token %x, timestamp %v, want %x, %x, %v", m.ID, m.Token, m.Timestamp, f.ID, f.Token, f.Timestamp)
+			}
+			if m.ContentType() != f.ContentType || m.Filename() != f.Filename {
+				t.Errorf("metadata %q %q, want %q %q", m.ContentType(), m.Filename(), f.ContentType, f.Filename)
+			}
+			if !f.HeaderOnly && !bytes.Equal(m.Payload, f.Payload) {
+				t.Errorf("payload %q, want %q", m.Payload, f.Payload)
+			}
+		})
+	}
+}
+
+// TestMessageRoundTrip checks that decoding the encoding of any message
+// yields the message again, and that encoding it again yields the same
+// bytes. internal/msg, which this once compared with, is merged into
+// Message.
+func TestMessageRoundTrip(t *testing.T) {
+	roundTrip := func(typ uint8, flags uint8, ttl uint32, channel uint16, id, tok [16]byte, ms int64, pld []byte, ct, name bool) bool {
+		m := chat.Message{
+			Type:      chat.MsgType(typ % 4),
+			Flags:     chat.Flag(flags) & (chat.FlagAckRequested | chat.FlagHistory),
+			ID:        id,
+			Token:     tok,
+			Timestamp: time.UnixMilli(ms % (1 << 50)).UTC(),
+			Payload:   pld,
+		}
+		if ttl != 0 {
+			m.SetTTL(time.Duration(ttl) * time.Millisecond)
+			m.SetFlag(chat.FlagTTL, true)
+		}
+		if channel != 0 {
+			m.Channel = channel
+			m.SetFlag(chat.FlagChannel, true)
+		}
+		if ct && m.SetContentType("text/plain; charset=utf-8") != nil {
+			return false
+		}
+		if name && m.SetFilename("notes.txt") != nil {
+			return false
+		}
+
+		var buf bytes.Buffer
+		if _, err := m.WriteTo(&buf); err != nil {
+			t.Logf("write: %v", err)
+			return false
+		}
+		enc := bytes.Clone(buf.Bytes())
+		// metadata is framed with FlagMetadata, set or not
+		if ct || name {
+			m.SetFlag(chat.FlagMetadata, true)
+		}
+		var got chat.Message
+		if _, err := got.ReadFrom(&buf); err != nil {
+			t.Logf("read: %v", err)
+			return false
+		}
+		if got.Type != m.Type || got.Flags != m.Flags || got.TTL != m.TTL || got.Channel != m.Channel ||
+			got.ID != m.ID || got.Token != m.Token || !got.Timestamp.Equal(m.Timestamp) ||
+			!bytes.Equal(got.Payload, m.Payload) || got.ContentType() != m.ContentType() || got.Filename() != m.Filename() {
+			t.Logf("decoded %+v, want %+v", got, m)
+			return false
+		}
+		buf.Reset()
+		if _, err := got.WriteTo(&buf); err != nil || !bytes.Equal(buf.Bytes(), enc) {
+			t.Logf("encoded again %x, want %x", buf.Bytes(), enc)
+			return false
+		}
+		return true
+	}
+	cfg := &quick.Config{Rand: rand.New(rand.NewSource(1))}
+	if err := quick.Check(roundTrip, cfg); err != nil {
+		t.Error(err)
+	}
+}
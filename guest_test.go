@@ -0,0 +1,52 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+// greetRole tells the session whether it is a guest, then receives
+// until it ends.
+func greetRole(ctx context.Context, s *chat.Session) {
+	role := "member"
+	if s.IsGuest() {
+		role = "guest"
+	}
+	if err := s.Send(ctx, chat.NewTextMessage([]byte(role))); err != nil {
+		return
+	}
+	discard(ctx, s)
+}
+
+func TestGuestAdmitted(t *testing.T) {
+	_, addr, ca := startServer(t, greetRole, chat.ServerOptions.AllowGuests())
+	for _, guest := range []bool{true, false} {
+		got := make(chan string, 1)
+		opts := []chat.ClientOption{chat.ClientOptions.OnMessage(func(m *chat.Message) { got <- string(m.Payload) })}
+		want := "member"
+		if guest {
+			opts = append(opts, chat.ClientOptions.Guest())
+			want = "guest"
+		}
+		connect(t, addr, ca, opts...)
+		if role := receive(t, got); role != want {
+			t.Errorf("handler saw a %s, want a %s", role, want)
+		}
+	}
+}
+
+func TestGuestDenied(t *testing.T) {
+	_, addr, ca := startServer(t, greetRole)
+	err := dial(t, newClient(t, addr, ca, chat.ClientOptions.Guest()))
+	var cerr *chat.CloseError
+	if !errors.As(err, &cerr) || cerr.Code != codes.GuestDenied {
+		t.Fatalf("dial: %v, want close code %s", err, codes.GuestDenied)
+	}
+	if !errors.Is(err, chat.ErrAuth) {
+		t.Errorf("dial: %v is not an auth error", err)
+	}
+}
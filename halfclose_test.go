@@ -0,0 +1,50 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestCloseSendKeepsReceiving(t *testing.T) {
+	closed := make(chan error, 1)
+	got := make(chan string, 2)
+	ended := make(chan error, 1)
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		closed <- s.CloseSend()
+		for {
+			m, err := s.Recv(ctx)
+			if err != nil {
+				ended <- err
+				return
+			}
+			got <- string(m.Payload)
+		}
+	})
+	c := newClient(t, addr, ca)
+	done := serve(t, c)
+	if err := receive(t, closed); err != nil {
+		t.Fatalf("close send: %v", err)
+	}
+
+	// the client still has its last words
+	send(t, c, "one")
+	send(t, c, "two")
+	for _, want := range []string{"one", "two"} {
+		if text := receive(t, got); text != want {
+			t.Errorf("received %q, want %q", text, want)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := receive(t, ended); !errors.Is(err, io.EOF) {
+		t.Errorf("recv: %v, want io.EOF", err)
+	}
+	if err := receive(t, done); err != nil {
+		t.Errorf("dial: %v, want the session to end cleanly", err)
+	}
+}
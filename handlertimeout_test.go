@@ -0,0 +1,62 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+func TestHandlerTimeout(t *testing.T) {
+	returned := make(chan struct{})
+	srv, addr, ca := startServer(t, func(_ context.Context, s *chat.Session) {
+		defer close(returned)
+		// a buggy handler ignoring its context
+		discard(context.Background(), s)
+	}, chat.ServerOptions.HandlerTimeout(50*time.Millisecond))
+	done := serve(t, newClient(t, addr, ca))
+
+	var cerr *chat.CloseError
+	if err := receive(t, done); !errors.As(err, &cerr) || cerr.Code != codes.HandlerTimeout {
+		t.Fatalf("dial: %v, want close code %s", err, codes.HandlerTimeout)
+	}
+	receive(t, returned)
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("shutdown took %s", d)
+	}
+}
+
+func TestHandlerWithinTimeout(t *testing.T) {
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		if _, err := s.Recv(ctx); err != nil {
+			return
+		}
+		if err := s.Send(ctx, chat.NewTextMessage([]byte("bye"))); err != nil {
+			return
+		}
+		discard(ctx, s)
+	}, chat.ServerOptions.HandlerTimeout(time.Second))
+	got := make(chan string, 1)
+	c := newClient(t, addr, ca, chat.ClientOptions.OnMessage(func(m *chat.Message) { got <- string(m.Payload) }))
+	done := serve(t, c)
+	send(t, c, "hi")
+	if text := receive(t, got); text != "bye" {
+		t.Errorf("received %q, want %q", text, "bye")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := receive(t, done); err != nil {
+		t.Errorf("dial: %v, want the session to end normally", err)
+	}
+}
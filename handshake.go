@@ -0,0 +1,184 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// handshakeArgs are the optional arguments of the login and guest
+// commands and of the ok response, as space separated fields.
+// Unknown fields are ignored, so that either side may be older.
+type handshakeArgs struct {
+	// wantSID is a bare "sid" field of the client asking for the session ID,
+	// which the server answers with "sid" followed by the hex encoded ID.
+	wantSID bool
+	sid     [16]byte
+	// caps follow a bare "caps" field, so that an empty set is told
+	// apart from a peer not taking part in the exchange.
+	caps []Capability
+	// resume is the ID of the last message received by the client,
+	// which the server answers with a bare "resume" or with "reset"
+	// if it cannot replay the messages after it.
+	resume  [16]byte
+	resumed bool
+	reset   bool
+	// instance is the ID of the server admitting the client in the
+	// response, and of the server it was last admitted by in commands.
+	instance string
+}
+
+// format appends the arguments to the command.
+func (a handshakeArgs) format(cmd string) []byte {
+	var b strings.Builder
+	b.WriteString(cmd)
+	switch {
+	case a.sid != [16]byte{}:
+		b.WriteString(" sid " + hex.EncodeToString(a.sid[:]))
+	case a.wantSID:
+		b.WriteString(" sid")
+	}
+	if a.caps != nil {
+		b.WriteString(" caps")
+		for _, c := range a.caps {
+			b.WriteString(" " + c.field())
+		}
+	}
+	switch {
+	case a.resume != [16]byte{}:
+		b.WriteString(" resume " + hex.EncodeToString(a.resume[:]))
+	case a.resumed:
+		b.WriteString(" resume")
+	case a.reset:
+		b.WriteString(" reset")
+	}
+	if a.instance != "" {
+		b.WriteString(" instance " + a.instance)
+	}
+	return []byte(b.String())
+}
+
+// parseHandshakeArgs parses the arguments following a command.
+func parseHandshakeArgs(arg []byte) (a handshakeArgs) {
+	fields := strings.Fields(string(arg))
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "sid":
+			a.wantSID = true
+			if i+1 < len(fields) {
+				if raw, err := hex.DecodeString(fields[i+1]); err == nil && len(raw) == 16 {
+					a.sid = [16]byte(raw)
+					i++
+				}
+			}
+		case "resume":
+			a.resumed = true
+			if i+1 < len(fields) {
+				if raw, err := hex.DecodeString(fields[i+1]); err == nil && len(raw) == 16 {
+					a.resume = [16]byte(raw)
+					i++
+				}
+			}
+		case "reset":
+			a.reset = true
+		case "instance":
+			if i+1 < len(fields) {
+				a.instance = fields[i+1]
+				i++
+			}
+		case "caps":
+			a.caps = []Capability{}
+		default:
+			if c, ok := parseCapability(fields[i]); ok && a.caps != nil {
+				a.caps = append(a.caps, c)
+			}
+		}
+	}
+	return a
+}
+
+// admitted returns the ok response of the handshake for the client's arg,
+// carrying the session ID, the negotiated capabilities and the instance ID.
+// A client to redirect gets a redirect response and ErrRedirected instead,
+// see ServerOptions.AffinityMismatchHandler.
+func (s *Server) admitted(ctx context.Context, arg []byte, session *Session, lgn *login) ([]byte, error) {
+	req := parseHandshakeArgs(arg)
+	if addr := s.affinity(ctx, session, req.instance, lgn.token); addr != "" {
+		lgn.redirect = addr
+		return []byte("redirect " + addr), fmt.Errorf("%w to %s", ErrRedirected, addr)
+	}
+	resp := handshakeArgs{instance: s.cfg.instance}
+	if req.caps != nil {
+		session.caps = s.negotiate(req.caps)
+		resp.caps = session.caps.list()
+	}
+	session.setMaxPayload(s.cfg.maxPayload, req.caps)
+	if refusal, err := s.requireTokenFrames(session, lgn); err != nil {
+		return refusal, err
+	}
+	if lgn.peer {
+		// peers relay frames of up to the payload limit wrapped in
+		// control messages, which servePeer reads without a limit
+		resp.caps = slices.DeleteFunc(resp.caps, func(c Capability) bool { return c.Name == CapMaxPayload })
+	}
+	if req.wantSID {
+		resp.sid = session.sid
+	}
+	if req.resume != [16]byte{} {
+		lgn.replay, resp.resumed = s.resume(lgn.token, req.resume)
+		resp.reset = !resp.resumed
+	}
+	return resp.format("ok"), nil
+}
+
+// negotiate returns the capabilities offered by both the server and the
+// client. The stricter heartbeat of both sides is used.
+func (s *Server) negotiate(offered []Capability) capabilities {
+	caps := intersect(offered, offer(s.cfg.heartbeat, s.cfg.maxPayload, append(s.tokenCapability(), s.cfg.caps...), s.cfg.noCaps))
+	if _, ok := caps[CapHeartbeat]; ok {
+		hb := s.cfg.heartbeat.stricter(intersect(offered, offered).heartbeat())
+		if hb.enabled() {
+			caps[CapHeartbeat] = hb.capability().Params
+		} else {
+			delete(caps, CapHeartbeat)
+		}
+	}
+	return caps
+}
+
+// offer returns the capabilities offered by the client.
+func (c *Client) offer() []Capability {
+	caps := offer(c.cfg.heartbeat, c.cfg.maxPayload, c.cfg.caps, c.cfg.noCaps)
+	if !slices.Contains(c.cfg.noCaps, CapTokenFrames) {
+		caps = append(caps, Capability{Name: CapTokenFrames})
+	}
+	return caps
+}
+
+// loginArg appends the arguments of the client to a handshake command.
+func (c *Client) loginArg(cmd string) []byte {
+	args := handshakeArgs{wantSID: true, caps: c.offer()}
+	c.mtx.Lock()
+	if c.cfg.resume > 0 {
+		args.resume = c.lastID
+	}
+	args.instance = c.instance
+	c.mtx.Unlock()
+	return args.format(cmd)
+}
+
+// admitted reports whether resp is the ok response of the handshake,
+// returning the arguments sent by the server.
+func admitted(resp []byte) (handshakeArgs, bool) {
+	if string(resp) == "ok" {
+		return handshakeArgs{}, true
+	}
+	arg, ok := bytes.CutPrefix(resp, []byte("ok "))
+	if !ok {
+		return handshakeArgs{}, false
+	}
+	return parseHandshakeArgs(arg), true
+}
@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/zhmlst/chat/codes"
+)
+
+// HandshakeStats are the durations of the phases of a handshake,
+// see Handshake and Client.LastHandshakeStats.
+type HandshakeStats struct {
+	Outcome Outcome       `json:"outcome"`
+	Total   time.Duration `json:"total"`
+	// Stream is the time taken to open or accept the handshake stream.
+	Stream time.Duration `json:"stream"`
+	// TLS is the time spent waiting for the TLS handshake to complete
+	// once the handshake stream is open.
+	TLS time.Duration `json:"tls"`
+	// RoundTrip is the time taken by the control round trips: on the
+	// client from writing a command to reading the response, on the server
+	// waiting for the commands of the client.
+	RoundTrips int           `json:"round_trips"`
+	RoundTrip  time.Duration `json:"round_trip"`
+	// TokenRepo is the time taken by the calls to the TokenRepo,
+	// scope lookups of a ScopedTokenRepo included, zero on the client.
+	TokenRepoCalls int           `json:"token_repo_calls"`
+	TokenRepo      time.Duration `json:"token_repo"`
+}
+
+// String returns a compact summary of the stats.
+func (h HandshakeStats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s in %s: stream %s, tls %s, %d round trips %s",
+		h.Outcome, h.Total, h.Stream, h.TLS, h.RoundTrips, h.RoundTrip)
+	if h.TokenRepoCalls > 0 {
+		fmt.Fprintf(&b, ", %d token repo calls %s", h.TokenRepoCalls, h.TokenRepo)
+	}
+	return b.String()
+}
+
+// Handshake is the Metric of a server handshake having ended,
+// reported for every connection.
+type Handshake struct {
+	Session *Session
+	Stats   HandshakeStats
+}
+
+func (Handshake) metric() {}
+
+// roundTrip counts the round trip which started at start.
+func (h *HandshakeStats) roundTrip(start time.Time) {
+	h.RoundTrips++
+	h.RoundTrip += time.Since(start)
+}
+
+// tokenRepo counts the TokenRepo call which started at start.
+func (h *HandshakeStats) tokenRepo(start time.Time) {
+	h.TokenRepoCalls++
+	h.TokenRepo += time.Since(start)
+}
+
+// exchange writes a control message to the server and reads the response,
+// counting the round trip. The read gives up once ctx is done.
+func (h *HandshakeStats) exchange(ctx context.Context, stream io.ReadWriter, src Source, tok [16]byte, pld []byte) (*Message, error) {
+	start := time.Now()
+	if err := writeControl(stream, src, tok, pld); err != nil {
+		return nil, fmt.Errorf("failed to write message: %w", err)
+	}
+	r, err := readMessageContext(ctx, stream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive message: %w", err)
+	}
+	h.roundTrip(start)
+	return r, nil
+}
+
+// handshakeDone completes the stats of the handshake of the session with
+// the outcome of the record, adds them to it, reports them and logs them.
+func (s *Server) handshakeDone(session *Session, rec *AccessRecord) {
+	hs := &session.hs
+	hs.Outcome = rec.Outcome
+	hs.Total = time.Since(rec.Started)
+	rec.Handshake = *hs
+	s.metric(Handshake{Session: session, Stats: *hs})
+	session.lgr.With("handshake", hs).Debug("handshake ended")
+}
+
+// LastHandshakeStats returns the stats of the last handshake of the
+// client, zero before the first one.
+func (c *Client) LastHandshakeStats() HandshakeStats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.hstats
+}
+
+// handshakeDone saves the stats of the handshake started at start,
+// which ended with err.
+func (c *Client) handshakeDone(hs *HandshakeStats, start time.Time, err error) {
+	var (
+		redirect *RedirectError
+		cerr     *CloseError
+		code     = codes.Done
+	)
+	if errors.As(err, &cerr) {
+		code = cerr.Code
+	}
+	switch {
+	case err == nil && c.cfg.raw:
+		hs.Outcome = OutcomeRaw
+	case err == nil && c.cfg.guest:
+		hs.Outcome = OutcomeGuest
+	case err == nil:
+		hs.Outcome = OutcomeAuthenticated
+	case errors.As(err, &redirect):
+		hs.Outcome = OutcomeRedirected
+	case errors.Is(err, ErrGuestDenied) || code == codes.GuestDenied:
+		hs.Outcome = OutcomeGuestDenied
+	case errors.Is(err, ErrTokenDenied) || code == codes.InvalidToken:
+		hs.Outcome = OutcomeTokenDenied
+	case code == codes.DuplicateLogin:
+		hs.Outcome = OutcomeDuplicate
+	case code == codes.Forbidden:
+		hs.Outcome = OutcomeForbidden
+	default:
+		hs.Outcome = OutcomeFailed
+	}
+	hs.Total = time.Since(start)
+	c.mtx.Lock()
+	c.hstats = *hs
+	c.mtx.Unlock()
+	c.cfg.logger.With("handshake", hs).Debug("handshake ended")
+}
@@ -0,0 +1,72 @@
+package chat_test
+
+import (
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+// handshakes returns a Metrics option sending the stats of the
+// handshakes to the channel.
+func handshakes() (chat.ServerOption, <-chan chat.HandshakeStats) {
+	stats := make(chan chat.HandshakeStats, 4)
+	return chat.ServerOptions.Metrics(func(m chat.Metric) {
+		if h, ok := m.(chat.Handshake); ok {
+			stats <- h.Stats
+		}
+	}), stats
+}
+
+func TestHandshakeStats(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		opts    []chat.ClientOption
+		outcome chat.Outcome
+		// least round trips and token repo calls of the server,
+		// round trips of the client
+		roundTrips, repoCalls, clientTrips int
+	}{
+		// ack for a token, then login with it
+		{"authenticated", nil, chat.OutcomeAuthenticated, 2, 2, 2},
+		// the server closes the connection instead of answering
+		{"guest denied", []chat.ClientOption{chat.ClientOptions.Guest()}, chat.OutcomeGuestDenied, 1, 0, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics, stats := handshakes()
+			logged, recs := accessLog()
+			_, addr, ca := startServer(t, discard, metrics, logged)
+			c := newClient(t, addr, ca, tt.opts...)
+			err := dial(t, c)
+			if (err == nil) != (tt.outcome == chat.OutcomeAuthenticated) {
+				t.Fatalf("dial: %v", err)
+			}
+
+			srv := receive(t, stats)
+			if srv.Outcome != tt.outcome {
+				t.Errorf("server outcome %q, want %q", srv.Outcome, tt.outcome)
+			}
+			if srv.RoundTrips < tt.roundTrips || srv.TokenRepoCalls < tt.repoCalls {
+				t.Errorf("server: %v, want at least %d round trips and %d token repo calls", srv, tt.roundTrips, tt.repoCalls)
+			}
+			if srv.Total <= 0 || srv.Total < srv.Stream+srv.RoundTrip {
+				t.Errorf("server: phases of %v exceed the total", srv)
+			}
+			// recorded once the session ends
+			_ = c.Close()
+			if rec := receive(t, recs); rec.Handshake != srv {
+				t.Errorf("access record with %v, metric %v", rec.Handshake, srv)
+			}
+
+			cl := c.LastHandshakeStats()
+			if cl.Outcome != tt.outcome {
+				t.Errorf("client outcome %q, want %q", cl.Outcome, tt.outcome)
+			}
+			if cl.RoundTrips != tt.clientTrips || cl.TokenRepoCalls != 0 {
+				t.Errorf("client: %v, want %d round trips and no token repo calls", cl, tt.clientTrips)
+			}
+			if cl.Total <= 0 || cl.Total < cl.Stream+cl.TLS+cl.RoundTrip {
+				t.Errorf("client: phases of %v exceed the total", cl)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// healthTimeout bounds the requests of the health listener.
+const healthTimeout = 5 * time.Second
+
+// ServerState is the lifecycle state of a server.
+type ServerState int8
+
+const (
+	// StateStarting is the state of a server which is not listening yet.
+	StateStarting ServerState = iota
+	// StateServing is the state of a server accepting connections.
+	StateServing
+	// StateDraining is the state of a server shutting down gracefully.
+	StateDraining
+	// StateStopped is the state of a server which stopped.
+	StateStopped
+)
+
+func (st ServerState) String() string {
+	switch st {
+	case StateStarting:
+		return "starting"
+	case StateServing:
+		return "serving"
+	case StateDraining:
+		return "draining"
+	case StateStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (st ServerState) MarshalText() ([]byte, error) {
+	return []byte(st.String()), nil
+}
+
+// Health describes whether a server takes traffic and how loaded it is,
+// e.g. for load balancers.
+type Health struct {
+	State ServerState `json:"state"`
+	// Sessions and Conns count the active sessions and connections.
+	Sessions int `json:"sessions"`
+	Conns    int `json:"conns"`
+	// Capacity is the MaxConns option, zero if unlimited.
+	Capacity int `json:"capacity"`
+}
+
+// Live reports whether the server is running, including while draining.
+func (h Health) Live() bool {
+	return h.State != StateStopped
+}
+
+// Ready reports whether the server accepts new connections.
+func (h Health) Ready() bool {
+	return h.State == StateServing && (h.Capacity == 0 || h.Conns < h.Capacity)
+}
+
+// Health returns the current health of the server.
+func (s *Server) Health() Health {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return Health{
+		State:    s.state,
+		Sessions: len(s.sessions),
+		Conns:    len(s.conns),
+		Capacity: s.cfg.maxConns,
+	}
+}
+
+// MaxConns sets the number of connections the server serves at once.
+// Connections beyond it are closed with codes.ToManyConns. Zero, the
+// default, means no limit.
+func (serverOptionsNamespace) MaxConns(n int) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.maxConns = n
+	}
+}
+
+// HealthAddr makes Run serve the health of the server over HTTP on the
+// TCP address, /healthz answering 200 while it is live and /readyz while
+// it is ready, 503 otherwise, both with the Health as JSON.
+// Readiness turns false as soon as Shutdown starts draining.
+func (serverOptionsNamespace) HealthAddr(addr string) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.healthAddr = addr
+	}
+}
+
+// setState changes the state of the server.
+func (s *Server) setState(st ServerState) {
+	s.mtx.Lock()
+	s.state = st
+	s.mtx.Unlock()
+}
+
+// serveHealth starts the health listener if one is configured.
+func (s *Server) serveHealth() error {
+	if s.cfg.healthAddr == "" {
+		return nil
+	}
+	lnr, err := net.Listen("tcp", s.cfg.healthAddr)
+	if err != nil {
+		return fmt.Errorf("listen health %s: %w", s.cfg.healthAddr, err)
+	}
+	probe := func(ok func(Health) bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, _ *http.Request) {
+			h := s.Health()
+			w.Header().Set("Content-Type", "application/json")
+			if !ok(h) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			if err := json.NewEncoder(w).Encode(h); err != nil {
+				s.cfg.logger.With("error", err).Debug("failed to write health")
+			}
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /healthz", probe(Health.Live))
+	mux.Handle("GET /readyz", probe(Health.Ready))
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: healthTimeout,
+		WriteTimeout:      healthTimeout,
+	}
+	s.mtx.Lock()
+	s.health = srv
+	s.mtx.Unlock()
+	go func() {
+		if err := srv.Serve(lnr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.cfg.logger.With("error", err).Error("health listener failed")
+		}
+	}()
+	return nil
+}
+
+// stopped marks the server stopped and closes the health listener.
+func (s *Server) stopped() error {
+	s.mtx.Lock()
+	s.state = StateStopped
+	srv := s.health
+	s.health = nil
+	s.mtx.Unlock()
+	if srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
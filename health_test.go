@@ -0,0 +1,98 @@
+package chat_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+// probed is a Health as served by the health listener.
+type probed struct {
+	State    string
+	Sessions int
+	Conns    int
+	Capacity int
+}
+
+// freeAddr returns a TCP address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	lnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lnr.Close()
+	return lnr.Addr().String()
+}
+
+// probe requests a health endpoint and returns the status and the health.
+func probe(t *testing.T, url string) (int, probed) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("get %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	var h probed
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		t.Fatalf("decode %s: %v", url, err)
+	}
+	return resp.StatusCode, h
+}
+
+func TestHealthLifecycle(t *testing.T) {
+	if st := chat.NewServer().Health().State; st != chat.StateStarting {
+		t.Errorf("state before Run %v, want %v", st, chat.StateStarting)
+	}
+
+	healthAddr := freeAddr(t)
+	live, ready := "http://"+healthAddr+"/healthz", "http://"+healthAddr+"/readyz"
+	release := make(chan struct{})
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		// keeps the server draining until released
+		<-release
+	}, chat.ServerOptions.HealthAddr(healthAddr), chat.ServerOptions.MaxConns(4))
+	connect(t, addr, ca)
+
+	eventually(t, func() bool {
+		_, h := probe(t, live)
+		return h.Sessions == 1
+	})
+	for _, url := range []string{live, ready} {
+		code, h := probe(t, url)
+		if code != http.StatusOK || h != (probed{"serving", 1, 1, 4}) {
+			t.Errorf("serving %s: %d %+v", url, code, h)
+		}
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(t.Context()) }()
+	// not ready at once, yet still live
+	eventually(t, func() bool {
+		code, _ := probe(t, ready)
+		return code == http.StatusServiceUnavailable
+	})
+	if code, h := probe(t, live); code != http.StatusOK || h.State != "draining" {
+		t.Errorf("draining liveness: %d %+v", code, h)
+	}
+	if code, h := probe(t, ready); h.State != "draining" {
+		t.Errorf("draining readiness: %d %+v", code, h)
+	}
+
+	close(release)
+	if err := receive(t, shutdown); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if st := srv.Health().State; st != chat.StateStopped {
+		t.Errorf("state after Shutdown %v, want %v", st, chat.StateStopped)
+	}
+	// stops listening along with the server
+	if resp, err := http.Get(live); err == nil {
+		resp.Body.Close()
+		t.Errorf("health served after Shutdown: %s", resp.Status)
+	}
+}
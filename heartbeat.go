@@ -0,0 +1,115 @@
+package chat
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/zhmlst/chat/codes"
+)
+
+// heartbeat configures application level pings. A ping is sent after
+// interval without sending anything, the peer is considered dead
+// after timeout without receiving anything.
+type heartbeat struct {
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func (h heartbeat) enabled() bool {
+	return h.interval > 0 && h.timeout > 0
+}
+
+// stricter returns the shorter interval and timeout of h and o.
+// The heartbeat is only used when both peers enabled it.
+func (h heartbeat) stricter(o heartbeat) heartbeat {
+	if !h.enabled() || !o.enabled() {
+		return heartbeat{}
+	}
+	return heartbeat{interval: min(h.interval, o.interval), timeout: min(h.timeout, o.timeout)}
+}
+
+// capability returns the heartbeat as the capability offered in the handshake.
+func (h heartbeat) capability() Capability {
+	return Capability{Name: CapHeartbeat, Params: map[string]string{
+		"interval": strconv.FormatInt(h.interval.Milliseconds(), 10),
+		"timeout":  strconv.FormatInt(h.timeout.Milliseconds(), 10),
+	}}
+}
+
+// parseHeartbeat parses the interval and timeout parameters
+// of a capability made by heartbeat.capability.
+func parseHeartbeat(rawInterval, rawTimeout string) (h heartbeat, ok bool) {
+	interval, err := strconv.ParseInt(rawInterval, 10, 64)
+	if err != nil {
+		return h, false
+	}
+	timeout, err := strconv.ParseInt(rawTimeout, 10, 64)
+	if err != nil {
+		return h, false
+	}
+	h = heartbeat{interval: time.Duration(interval) * time.Millisecond, timeout: time.Duration(timeout) * time.Millisecond}
+	return h, h.enabled()
+}
+
+// Heartbeat makes sessions ping the client after interval without sending
+// and close the connection with codes.IdleTimeout after timeout without
+// receiving, if the client enables it too. The stricter values of both
+// sides are used. Only frames read by Recv count as received.
+func (serverOptionsNamespace) Heartbeat(interval, timeout time.Duration) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.heartbeat = heartbeat{interval: interval, timeout: timeout}
+	}
+}
+
+// Heartbeat makes the client ping the server after interval without sending
+// and close the connection with codes.IdleTimeout after timeout without
+// receiving, if the server enables it too. The stricter values of both
+// sides are used.
+func (clientOptionsNamespace) Heartbeat(interval, timeout time.Duration) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.heartbeat = heartbeat{interval: interval, timeout: timeout}
+	}
+}
+
+// pinged reports whether m is a heartbeat ping, which carries nothing
+// but the fact that it was received.
+func pinged(m *Message) bool {
+	return m.Type == MsgTypeControl && string(m.Payload) == "ping"
+}
+
+// runHeartbeat pings the peer after the interval of send silence and closes
+// the connection once nothing was received for the timeout, until ctx is done.
+func (s *Session) runHeartbeat(ctx context.Context, hb heartbeat) {
+	defer s.trackPump()()
+	now := s.src.Now().UnixNano()
+	s.lastSend.Store(now)
+	s.lastRecv.Store(now)
+	timer := time.NewTimer(hb.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		now := s.src.Now()
+		idle := now.Sub(time.Unix(0, s.lastRecv.Load()))
+		if idle >= hb.timeout {
+			s.lgr.With("idle", idle).Warn("heartbeat lost, closing connection")
+			_ = closeConn(s.conn, codes.IdleTimeout, "idle for "+idle.Round(time.Millisecond).String())
+			return
+		}
+		silent := now.Sub(time.Unix(0, s.lastSend.Load()))
+		if silent >= hb.interval {
+			pctx, cancel := context.WithTimeout(ctx, hb.timeout-idle)
+			err := s.enqueue(pctx, &Message{Type: MsgTypeControl, Payload: []byte("ping")}, PriorityHigh)
+			cancel()
+			if err != nil {
+				s.lgr.With("error", err).Debug("failed to send ping")
+			}
+			silent = 0
+		}
+		timer.Reset(min(hb.interval-silent, hb.timeout-idle))
+	}
+}
@@ -0,0 +1,74 @@
+package chat_test
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+const (
+	hbInterval = 20 * time.Millisecond
+	hbTimeout  = time.Minute
+)
+
+// heartbeating starts a server and a client with heartbeats, the server
+// reading its clock from clk and the client from a clock that never moves,
+// so that only the server judges the silence. It returns the client and
+// the channel Dial ends on, and receives every message read by the server
+// on got.
+func heartbeating(t *testing.T, clk *manualClock, got chan<- struct{}) (*chat.Client, <-chan error) {
+	t.Helper()
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		for {
+			if _, err := s.Recv(ctx); err != nil {
+				return
+			}
+			got <- struct{}{}
+		}
+	},
+		chat.ServerOptions.Heartbeat(hbInterval, hbTimeout),
+		chat.ServerOptions.Source(chat.Source{Rand: rand.Reader, Now: clk.Now}),
+	)
+	frozen := &manualClock{now: time.Now()}
+	c := newClient(t, addr, ca,
+		chat.ClientOptions.Heartbeat(hbInterval, hbTimeout),
+		chat.ClientOptions.Source(chat.Source{Rand: rand.Reader, Now: frozen.Now}),
+	)
+	return c, serve(t, c)
+}
+
+func TestHeartbeatHealthy(t *testing.T) {
+	clk := &manualClock{now: time.Now()}
+	got := make(chan struct{}, 1)
+	c, done := heartbeating(t, clk, got)
+
+	// traffic within every timeout keeps the session up for many of them
+	for range 5 {
+		clk.Add(hbTimeout / 2)
+		send(t, c, "alive")
+		receive(t, got)
+		time.Sleep(2 * hbInterval)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("connection closed: %v", err)
+	default:
+	}
+}
+
+func TestHeartbeatLost(t *testing.T) {
+	clk := &manualClock{now: time.Now()}
+	_, done := heartbeating(t, clk, make(chan struct{}, 1))
+
+	clk.Add(hbTimeout)
+	err := receive(t, done)
+	var cerr *chat.CloseError
+	if !errors.As(err, &cerr) || cerr.Code != codes.IdleTimeout {
+		t.Errorf("dial: %v, want close code %s", err, codes.IdleTimeout)
+	}
+}
@@ -0,0 +1,255 @@
+package chat_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+	"github.com/zhmlst/chat/keygen"
+)
+
+// waitTimeout bounds how long tests wait for something to happen.
+const waitTimeout = 5 * time.Second
+
+// quiet is a logger dropping everything.
+var quiet = chat.Logger(func(chat.LogLevel, string, ...any) {})
+
+// discard is a handler receiving messages until the session ends.
+func discard(ctx context.Context, s *chat.Session) {
+	for {
+		if _, err := s.Recv(ctx); err != nil {
+			return
+		}
+	}
+}
+
+// startServer runs a server like chattest.StartServer, without logging,
+// and returns it along with its address and a pool trusting it.
+func startServer(tb testing.TB, handler chat.Handler, opts ...chat.ServerOption) (*chat.Server, string, *x509.CertPool) {
+	tb.Helper()
+	certPEM, keyPEM, err := keygen.Cert([]string{"127.0.0.1"}, time.Hour)
+	if err != nil {
+		tb.Fatalf("generate certificate: %v", err)
+	}
+	crt, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		tb.Fatalf("load certificate: %v", err)
+	}
+	ca := x509.NewCertPool()
+	ca.AppendCertsFromPEM(certPEM)
+
+	opts = append([]chat.ServerOption{
+		chat.ServerOptions.Addresses("127.0.0.1:0"),
+		chat.ServerOptions.TLSCertificate(crt),
+		chat.ServerOptions.TokenRepo(&chattest.TokenRepo{}),
+		chat.ServerOptions.Handler(handler),
+		chat.ServerOptions.Logger(quiet),
+	}, opts...)
+	srv := chat.NewServer(opts...)
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Run() }()
+	for srv.Addr() == nil {
+		select {
+		case err := <-errCh:
+			tb.Fatalf("run server: %v", err)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	tb.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	})
+	return srv, srv.Addr().String(), ca
+}
+
+// connected holds a channel per client created by newClient,
+// signalled by OnConnect.
+var connected sync.Map
+
+// newClient creates a client like chattest.NewClient, without logging.
+// Tests setting OnConnect must not use dial.
+func newClient(tb testing.TB, addr string, ca *x509.CertPool, opts ...chat.ClientOption) *chat.Client {
+	tb.Helper()
+	ch := make(chan struct{}, 1)
+	opts = append([]chat.ClientOption{
+		chat.ClientOptions.Logger(quiet),
+		chat.ClientOptions.OnConnect(func() {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}),
+	}, opts...)
+	c := chattest.NewClient(tb, addr, ca, opts...)
+	connected.Store(c, ch)
+	tb.Cleanup(func() { connected.Delete(c) })
+	return c
+}
+
+// dial serves the client in the background until the test ends and
+// returns once it is connected, or the error of Dial if it ended first.
+func dial(tb testing.TB, c *chat.Client) error {
+	tb.Helper()
+	errCh := make(chan error, 1)
+	go func() { errCh <- c.Dial(context.Background()) }()
+	tb.Cleanup(func() {
+		_ = c.Close()
+		select {
+		case <-errCh:
+		case <-time.After(waitTimeout):
+		}
+	})
+	ch, _ := connected.Load(c)
+	select {
+	case <-ch.(chan struct{}):
+		return nil
+	case err := <-errCh:
+		errCh <- err // for the cleanup
+		if err == nil {
+			err = errors.New("dial returned early")
+		}
+		return err
+	case <-time.After(waitTimeout):
+		tb.Fatal("dial timed out")
+		return nil
+	}
+}
+
+// serve is like dial but fails the test unless the client connects,
+// and returns the error Dial ends with.
+func serve(tb testing.TB, c *chat.Client) <-chan error {
+	tb.Helper()
+	errCh := make(chan error, 1)
+	go func() { errCh <- c.Dial(context.Background()) }()
+	tb.Cleanup(func() { _ = c.Close() })
+	ch, _ := connected.Load(c)
+	select {
+	case <-ch.(chan struct{}):
+		return errCh
+	case err := <-errCh:
+		tb.Fatalf("dial: %v", err)
+	case <-time.After(waitTimeout):
+		tb.Fatal("dial timed out")
+	}
+	return nil
+}
+
+// connect creates a client of addr and dials it, see dial.
+func connect(tb testing.TB, addr string, ca *x509.CertPool, opts ...chat.ClientOption) *chat.Client {
+	tb.Helper()
+	c := newClient(tb, addr, ca, opts...)
+	if err := dial(tb, c); err != nil {
+		tb.Fatalf("dial: %v", err)
+	}
+	return c
+}
+
+// receive returns the next value of ch, failing the test after waitTimeout.
+func receive[T any](tb testing.TB, ch <-chan T) T {
+	tb.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(waitTimeout):
+		tb.Fatal("timed out waiting")
+		panic("unreachable")
+	}
+}
+
+// eventually fails the test unless cond holds within waitTimeout.
+func eventually(tb testing.TB, cond func() bool) {
+	tb.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// delayProxy relays the UDP datagrams of one client to target, delaying
+// them by delay in each direction, and returns its address.
+func delayProxy(tb testing.TB, target string, delay time.Duration) string {
+	tb.Helper()
+	return relay(tb, target, delay, nil)
+}
+
+// countingProxy relays the UDP datagrams of one client to target and
+// returns its address along with the count of datagrams sent to the client.
+func countingProxy(tb testing.TB, target string) (string, *atomic.Int64) {
+	tb.Helper()
+	var down atomic.Int64
+	return relay(tb, target, 0, &down), &down
+}
+
+// relay runs a proxy for delayProxy and countingProxy, counting the
+// datagrams to the client in down unless it is nil.
+func relay(tb testing.TB, target string, delay time.Duration, down *atomic.Int64) string {
+	tb.Helper()
+	front, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("listen: %v", err)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		tb.Fatalf("resolve: %v", err)
+	}
+	back, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		tb.Fatalf("dial: %v", err)
+	}
+	tb.Cleanup(func() {
+		_ = front.Close()
+		_ = back.Close()
+	})
+	after := func(f func()) {
+		if delay == 0 {
+			f()
+			return
+		}
+		time.AfterFunc(delay, f)
+	}
+	var client atomic.Pointer[net.Addr]
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, addr, err := front.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			client.Store(&addr)
+			p := bytes.Clone(buf[:n])
+			after(func() { _, _ = back.Write(p) })
+		}
+	}()
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := back.Read(buf)
+			if err != nil {
+				return
+			}
+			if down != nil {
+				down.Add(1)
+			}
+			p := bytes.Clone(buf[:n])
+			after(func() {
+				if addr := client.Load(); addr != nil {
+					_, _ = front.WriteTo(p, *addr)
+				}
+			})
+		}
+	}()
+	return front.LocalAddr().String()
+}
@@ -0,0 +1,81 @@
+package chat_test
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+// historian returns an OnMessage option reporting text messages
+// on the returned channel, prefixed with "h:" when flagged as history.
+func historian() (chat.ClientOption, <-chan string) {
+	got := make(chan string, 16)
+	return chat.ClientOptions.OnMessage(func(m *chat.Message) {
+		if m.Type != chat.MsgTypeText {
+			return
+		}
+		if m.HasFlag(chat.FlagHistory) {
+			got <- "h:" + string(m.Payload)
+			return
+		}
+		got <- string(m.Payload)
+	}), got
+}
+
+func TestHubHistory(t *testing.T) {
+	_, addr, ca := startServer(t, chat.NewHub(chat.HubOptions.History(3)).Serve)
+	sender := connect(t, addr, ca)
+	watch, watched := historian()
+	connect(t, addr, ca, watch)
+	for _, text := range []string{"1", "2", "3", "4", "5"} {
+		send(t, sender, text)
+	}
+	// relayed, so recorded
+	for range 5 {
+		receive(t, watched)
+	}
+
+	late, got := historian()
+	connect(t, addr, ca, late)
+	for _, want := range []string{"h:3", "h:4", "h:5"} {
+		if text := receive(t, got); text != want {
+			t.Errorf("received %q, want %q", text, want)
+		}
+	}
+	// replayed once joined, so live traffic follows
+	send(t, sender, "6")
+	if text := receive(t, got); text != "6" {
+		t.Errorf("received %q, want 6", text)
+	}
+}
+
+func TestHubHistoryTTL(t *testing.T) {
+	clk := &manualClock{now: time.Now()}
+	_, addr, ca := startServer(t, chat.NewHub(chat.HubOptions.History(3)).Serve,
+		chat.ServerOptions.Source(chat.Source{Rand: rand.Reader, Now: clk.Now}))
+	sender := connect(t, addr, ca)
+	watch, watched := historian()
+	connect(t, addr, ca, watch)
+	for text, ttl := range map[string]time.Duration{"gone": time.Minute, "kept": time.Hour} {
+		m := chat.NewTextMessage([]byte(text))
+		m.SetTTL(ttl)
+		if err := sender.SendMessage(context.Background(), m); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, watched)
+	}
+	clk.Add(2 * time.Minute)
+
+	late, got := historian()
+	connect(t, addr, ca, late)
+	if text := receive(t, got); text != "h:kept" {
+		t.Errorf("received %q, want h:kept", text)
+	}
+	send(t, sender, "live")
+	if text := receive(t, got); text != "live" {
+		t.Errorf("received %q, want live", text)
+	}
+}
@@ -0,0 +1,473 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/zhmlst/chat/codes"
+)
+
+// hubHistory bounds the number of relayed message IDs the hub remembers
+// for routing receipts back to their senders.
+const hubHistory = 4096
+
+// historyBytes bounds the payload bytes kept in the history of a hub.
+// The oldest messages are dropped first.
+const historyBytes = 1 << 20
+
+const (
+	// hubQueue is the default number of messages queued for a member.
+	hubQueue = 256
+	// hubWorkers is the default number of workers fanning out broadcasts.
+	hubWorkers = 4
+	// fanoutChunk is the number of members a worker queues a message for
+	// at once. Smaller broadcasts are queued by the sender itself.
+	fanoutChunk = 256
+)
+
+// SlowMemberPolicy defines how a hub treats a member whose queue is full.
+type SlowMemberPolicy int8
+
+const (
+	// SlowMemberDrop drops the message for the member, see DropRelay.
+	SlowMemberDrop SlowMemberPolicy = iota
+	// SlowMemberDisconnect drops the message and aborts the session
+	// of the member with codes.SlowConsumer.
+	SlowMemberDisconnect
+)
+
+// HubOption configures a Hub.
+type HubOption func(h *Hub)
+
+// HubOptions provides available options for hubs.
+var HubOptions hubOptionsNamespace
+
+type hubOptionsNamespace struct{}
+
+// History keeps the last n text and binary messages relayed by the hub,
+// up to 1MiB of payloads, and replays them to every session joining it
+// with FlagHistory set, before any live message. Expired messages are
+// not replayed.
+func (hubOptionsNamespace) History(n int) HubOption {
+	return func(h *Hub) {
+		h.historySize = max(n, 0)
+	}
+}
+
+// MemberQueue sets how many messages are queued for a member while it is
+// sending the previous ones, 256 by default. Messages beyond it are
+// handled according to SlowMember.
+func (hubOptionsNamespace) MemberQueue(n int) HubOption {
+	return func(h *Hub) {
+		h.queueSize = max(n, 1)
+	}
+}
+
+// SlowMember sets how a member whose queue is full is treated,
+// SlowMemberDrop by default. Other members are never delayed by it.
+func (hubOptionsNamespace) SlowMember(policy SlowMemberPolicy) HubOption {
+	return func(h *Hub) {
+		h.slow = policy
+	}
+}
+
+// Workers sets how many goroutines fan out broadcasts to large rooms,
+// 4 by default. They run while the hub has members.
+func (hubOptionsNamespace) Workers(n int) HubOption {
+	return func(h *Hub) {
+		h.workers = max(n, 1)
+	}
+}
+
+type ackKey struct {
+	reader *Session
+	kind   AckKind
+}
+
+type relayed struct {
+	sender *Session
+	acked  map[ackKey]struct{}
+}
+
+// member is the state of a session served by the hub. Messages relayed
+// to it wait in queue for its pump, which starts once the history is
+// replayed, so that the order is kept. left is closed when it leaves.
+type member struct {
+	s     *Session
+	queue chan *Message
+	left  chan struct{}
+}
+
+// fanout is a broadcast of a message to a chunk of members.
+type fanout struct {
+	m       *Message
+	members []*member
+}
+
+// Hub relays messages between all sessions it serves, announces
+// their presence and routes receipts back to the senders of the
+// acknowledged messages.
+// Messages for members which have joined before but are offline now
+// are kept in the server's MessageStore until they join again.
+// Sessions joining a hub with a history get its latest messages first,
+// see HubOptions.History.
+// A message is encoded once for all members and queued for each of them
+// without waiting, so that a slow member delays nobody else,
+// see HubOptions.SlowMember.
+type Hub struct {
+	historySize int
+	queueSize   int
+	workers     int
+	slow        SlowMemberPolicy
+
+	mtx     sync.Mutex
+	members map[*Session]*member
+	// jobs feeds the fanout workers, nil while none run.
+	jobs         chan fanout
+	known        map[[16]byte]struct{}
+	sent         map[[16]byte]*relayed
+	order        [][16]byte
+	history      []*Message
+	historyBytes int
+}
+
+// NewHub creates an empty hub.
+func NewHub(opts ...HubOption) *Hub {
+	h := &Hub{
+		queueSize: hubQueue,
+		workers:   hubWorkers,
+		members:   make(map[*Session]*member),
+		known:     make(map[[16]byte]struct{}),
+		sent:      make(map[[16]byte]*relayed),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// Serve joins the session to the hub until its stream ends.
+// It satisfies the Handler signature.
+func (h *Hub) Serve(ctx context.Context, s *Session) {
+	h.mtx.Lock()
+	history := slices.Clone(h.history)
+	joined := &member{s: s, queue: make(chan *Message, h.queueSize), left: make(chan struct{})}
+	h.members[s] = joined
+	if !s.anonymous() {
+		h.known[s.currentToken()] = struct{}{}
+	}
+	h.mtx.Unlock()
+	h.announce(s, true)
+	defer func() {
+		h.mtx.Lock()
+		delete(h.members, s)
+		if len(h.members) == 0 && h.jobs != nil {
+			close(h.jobs)
+			h.jobs = nil
+		}
+		h.mtx.Unlock()
+		close(joined.left)
+		h.announce(s, false)
+		_ = s.CloseSend()
+	}()
+
+	var delivered [][16]byte
+	if s.srv != nil && !s.anonymous() {
+		var err error
+		if delivered, err = s.srv.deliverOffline(ctx, s); err != nil {
+			s.lgr.With("error", err).Error("failed to deliver offline messages")
+		}
+	}
+	h.replay(ctx, s, history, delivered)
+	go h.pump(ctx, joined)
+
+	go func() {
+		for ev := range s.Events(ctx) {
+			h.relayEvent(s, ev)
+		}
+	}()
+
+	for {
+		m, err := s.Recv(ctx)
+		if err != nil {
+			return
+		}
+		switch m.Type {
+		case MsgTypeText, MsgTypeBinary:
+			h.remember(s, m.ID)
+			h.broadcast(ctx, s, m)
+		case MsgTypeAck:
+			h.routeAck(ctx, s, m)
+		default:
+			s.lgr.With("type", m.Type).Debug("hub ignores message")
+		}
+	}
+}
+
+func (h *Hub) remember(sender *Session, id [16]byte) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if _, ok := h.sent[id]; ok {
+		return
+	}
+	h.sent[id] = &relayed{sender: sender, acked: make(map[ackKey]struct{})}
+	h.order = append(h.order, id)
+	if len(h.order) > hubHistory {
+		delete(h.sent, h.order[0])
+		h.order = h.order[1:]
+	}
+}
+
+// record adds the message to the history, dropping the oldest messages
+// beyond its size and expired ones.
+func (h *Hub) record(sender *Session, m *Message) {
+	if h.historySize == 0 {
+		return
+	}
+	now := sender.src.Now()
+	h.history = slices.DeleteFunc(h.history, func(o *Message) bool {
+		if o.Expired(now) {
+			h.historyBytes -= len(o.Payload)
+			return true
+		}
+		return false
+	})
+	kept := *m
+	h.history = append(h.history, &kept)
+	h.historyBytes += len(m.Payload)
+	for len(h.history) > h.historySize || (h.historyBytes > historyBytes && len(h.history) > 1) {
+		h.historyBytes -= len(h.history[0].Payload)
+		h.history[0] = nil
+		h.history = h.history[1:]
+	}
+}
+
+// replay sends the history to the joining session, skipping messages
+// already delivered from the offline store. Live messages broadcast
+// meanwhile wait in its queue.
+func (h *Hub) replay(ctx context.Context, s *Session, history []*Message, delivered [][16]byte) {
+	for _, m := range history {
+		if slices.Contains(delivered, m.ID) {
+			continue
+		}
+		relay := *m
+		relay.SetFlag(FlagHistory, true)
+		if err := s.Send(ctx, &relay); err != nil {
+			s.lgr.With("error", err).Warn("failed to replay history")
+			return
+		}
+	}
+}
+
+// pump sends the messages queued for the member until it leaves.
+// Each is sent as a copy, as the queued one is shared by all members.
+func (h *Hub) pump(ctx context.Context, mem *member) {
+	for {
+		select {
+		case m := <-mem.queue:
+			relay := *m
+			if err := mem.s.Send(ctx, &relay); err != nil {
+				mem.s.lgr.With("error", err).Debug("failed to relay message")
+				mem.s.dropped(DropRelay)
+			}
+		case <-mem.left:
+			return
+		}
+	}
+}
+
+// enqueue queues the message for the member without waiting,
+// applying the SlowMemberPolicy if its queue is full.
+func (h *Hub) enqueue(mem *member, m *Message) {
+	select {
+	case <-mem.left:
+		return
+	case mem.queue <- m:
+		return
+	default:
+	}
+	mem.s.dropped(DropRelay)
+	if h.slow == SlowMemberDisconnect {
+		mem.s.lgr.Warn("hub member too slow, disconnecting")
+		mem.s.Abort(codes.SlowConsumer)
+	}
+}
+
+// work queues fanned out messages until the hub has no members.
+func (h *Hub) work(jobs <-chan fanout) {
+	for job := range jobs {
+		for _, mem := range job.members {
+			h.enqueue(mem, job.m)
+		}
+	}
+}
+
+// recipients records the message in the history and returns the members
+// to relay it to, except the sender, with the channel of the fanout
+// workers if there are too many of them to queue the message at once.
+func (h *Hub) recipients(sender *Session, m *Message) ([]*member, chan<- fanout) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.record(sender, m)
+	members := make([]*member, 0, len(h.members))
+	for s, mem := range h.members {
+		if s != sender {
+			members = append(members, mem)
+		}
+	}
+	if len(members) <= fanoutChunk {
+		return members, nil
+	}
+	if h.jobs == nil {
+		h.jobs = make(chan fanout, h.workers)
+		for range h.workers {
+			go h.work(h.jobs)
+		}
+	}
+	return members, h.jobs
+}
+
+// others returns all members except the sender.
+func (h *Hub) others(sender *Session) []*Session {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	members := make([]*Session, 0, len(h.members))
+	for member := range h.members {
+		if member != sender {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+func (h *Hub) broadcast(ctx context.Context, sender *Session, m *Message) {
+	if sender.expired(m) {
+		return
+	}
+	// The sender stays a member until broadcast returns,
+	// so the workers keep running meanwhile.
+	shared := *m
+	shared.encode()
+	members, jobs := h.recipients(sender, &shared)
+	if jobs == nil {
+		for _, mem := range members {
+			h.enqueue(mem, &shared)
+		}
+	} else {
+		for chunk := range slices.Chunk(members, fanoutChunk) {
+			jobs <- fanout{m: &shared, members: chunk}
+		}
+	}
+	if sender.srv == nil {
+		return
+	}
+	for _, recipient := range h.offline(sender) {
+		if err := sender.srv.forward(ctx, sender, recipient, m); err != nil {
+			sender.lgr.With("error", err).Error("failed to store offline message")
+		}
+	}
+}
+
+// offline returns tokens of known members without an online session,
+// except the sender's own token.
+func (h *Hub) offline(sender *Session) [][16]byte {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	online := make(map[[16]byte]struct{}, len(h.members))
+	for member := range h.members {
+		online[member.currentToken()] = struct{}{}
+	}
+	var toks [][16]byte
+	for tok := range h.known {
+		if _, ok := online[tok]; !ok && tok != sender.currentToken() {
+			toks = append(toks, tok)
+		}
+	}
+	return toks
+}
+
+// announce tells all other members that the session joined or left.
+func (h *Hub) announce(s *Session, online bool) {
+	for _, member := range h.others(s) {
+		if err := member.sendEvent(PresenceEvent{Sender: s.id, Online: online}); err != nil {
+			member.lgr.With("error", err).Debug("failed to send presence")
+		}
+	}
+}
+
+// relayEvent passes typing, edit, delete and e2e key events to all other members.
+// Events are neither remembered nor acknowledged.
+func (h *Hub) relayEvent(sender *Session, ev Event) {
+	switch ev.(type) {
+	case TypingEvent, EditEvent, DeleteEvent, E2EKeyEvent:
+	default:
+		sender.lgr.With("event", fmt.Sprintf("%T", ev)).Debug("hub ignores event")
+		return
+	}
+	if id, ok := eventTarget(ev); ok && !sender.ownMessage(id) {
+		return
+	}
+	for _, member := range h.others(sender) {
+		if err := member.sendEvent(ev); err != nil {
+			member.lgr.With("error", err).Debug("failed to relay event")
+		}
+	}
+}
+
+// ownMessage reports whether id is of a message the session sent and
+// the server accepted, refusing the event referring to it otherwise.
+func (s *Session) ownMessage(id [16]byte) bool {
+	if s.recent.contains(id) {
+		return true
+	}
+	s.lgr.Warn("refusing event for a message not sent by the session")
+	if err := s.SendError(context.Background(), codes.PolicyViolation, "unknown_id", "unknown message id"); err != nil {
+		s.lgr.With("error", err).Error("failed to send rejection")
+	}
+	return false
+}
+
+// eventTarget returns the ID of the message the event refers to.
+func eventTarget(ev Event) ([16]byte, bool) {
+	switch ev := ev.(type) {
+	case EditEvent:
+		return ev.ID, true
+	case DeleteEvent:
+		return ev.ID, true
+	}
+	return [16]byte{}, false
+}
+
+// routeAck forwards the receipt to the senders of the acknowledged messages.
+// Unknown and already acknowledged IDs are ignored.
+func (h *Hub) routeAck(ctx context.Context, reader *Session, m *Message) {
+	rcpt, err := m.Receipt()
+	if err != nil {
+		reader.lgr.With("error", err).Debug("ignoring ack")
+		return
+	}
+
+	h.mtx.Lock()
+	bySender := make(map[*Session][][16]byte)
+	for _, id := range rcpt.IDs {
+		r, ok := h.sent[id]
+		if !ok || r.sender == reader {
+			continue
+		}
+		key := ackKey{reader: reader, kind: rcpt.Kind}
+		if _, ok = r.acked[key]; ok {
+			continue
+		}
+		r.acked[key] = struct{}{}
+		bySender[r.sender] = append(bySender[r.sender], id)
+	}
+	h.mtx.Unlock()
+
+	for sender, ids := range bySender {
+		if err := sender.Send(ctx, NewAck(Receipt{Kind: rcpt.Kind, IDs: ids})); err != nil {
+			sender.lgr.With("error", err).Warn("failed to forward receipt")
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package chat_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+// streamsPerClient stays below the streams QUIC allows a connection by default.
+const streamsPerClient = 80
+
+// delivery is a message received by a hub member.
+type delivery struct {
+	member string
+	m      *chat.Message
+}
+
+// hubMembers opens n sessions on streams of clients of a server serving
+// them with a hub, and passes the messages they receive to got. Members
+// keep reading, as the presence events of every join would otherwise
+// exhaust the flow control window of their connection.
+func hubMembers(tb testing.TB, addr string, ca *x509.CertPool, n int, got chan<- delivery) {
+	tb.Helper()
+	var c *chat.Client
+	for i := range n {
+		if i%streamsPerClient == 0 {
+			c = connect(tb, addr, ca)
+		}
+		s, err := c.NewSession(context.Background(), fmt.Sprint("member-", i))
+		if err != nil {
+			tb.Fatalf("new session %d: %v", i, err)
+		}
+		go func() {
+			for {
+				m, err := s.Recv(context.Background())
+				if err != nil {
+					return
+				}
+				got <- delivery{s.Label(), m}
+			}
+		}()
+	}
+}
+
+func TestHubBroadcastIdentical(t *testing.T) {
+	// more members than a broadcast queues for without the workers;
+	// a member joining late gets the message from the history
+	const n = 270
+	hub := chat.NewHub(chat.HubOptions.History(1))
+	_, addr, ca := startServer(t, hub.Serve, chat.ServerOptions.StreamHandler(hub.Serve))
+	got := make(chan delivery, n)
+	hubMembers(t, addr, ca, n, got)
+	sender := connect(t, addr, ca)
+
+	m := chat.NewTextMessage(make([]byte, 1<<10))
+	if _, err := rand.Read(m.Payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.SendMessage(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for range n {
+		d := receive(t, got)
+		if d.m.ID != m.ID || !bytes.Equal(d.m.Payload, m.Payload) {
+			t.Fatalf("%s received %x with other bytes than %x", d.member, d.m.ID, m.ID)
+		}
+		if seen[d.member] {
+			t.Fatalf("%s received the message twice", d.member)
+		}
+		seen[d.member] = true
+	}
+}
+
+func BenchmarkHubBroadcast(b *testing.B) {
+	const n = 400
+	hub := chat.NewHub(chat.HubOptions.History(1))
+	_, addr, ca := startServer(b, hub.Serve, chat.ServerOptions.StreamHandler(hub.Serve))
+	got := make(chan delivery, n)
+	hubMembers(b, addr, ca, n, got)
+	sender := connect(b, addr, ca)
+	broadcast := func() {
+		if err := sender.SendMessage(context.Background(), chat.NewTextMessage(make([]byte, 1<<10))); err != nil {
+			b.Fatal(err)
+		}
+		for range n {
+			receive(b, got)
+		}
+	}
+	// every member has joined once it got the first message,
+	// live or from the history
+	broadcast()
+
+	b.ReportAllocs()
+	for b.Loop() {
+		broadcast()
+	}
+}
@@ -0,0 +1,90 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// IDGenerator creates message IDs in place of the random bytes of
+// a Source, e.g. time-ordered ones, see OrderedIDs.
+type IDGenerator interface {
+	NewID() ([16]byte, error)
+}
+
+// IDGenerator sets the generator of the IDs of messages sent by sessions
+// and of the server's control messages, overriding the IDs of the Source.
+func (serverOptionsNamespace) IDGenerator(gen IDGenerator) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.ids = gen
+	}
+}
+
+// IDGenerator sets the generator of the IDs of sent messages,
+// overriding the IDs of the Source.
+func (clientOptionsNamespace) IDGenerator(gen IDGenerator) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.ids = gen
+	}
+}
+
+// IDGenerator sets the generator of the IDs of messages sent by the
+// session, the responses of a server handshake included, overriding
+// the one of its server or client.
+func (sessionOptionsNamespace) IDGenerator(gen IDGenerator) SessionOption {
+	return func(s *Session) {
+		s.ids = gen
+	}
+}
+
+// source returns the Source of the session with its IDGenerator, if any.
+func (s *Session) source() Source {
+	src := s.src
+	if s.ids != nil {
+		src.IDs = s.ids
+	}
+	return src
+}
+
+// OrderedIDs generates time-ordered IDs: the milliseconds since the Unix
+// epoch in the first 6 bytes, big endian, followed by 10 random bytes,
+// like a UUIDv7 without version and variant bits. An ID which would not
+// sort after the previous one, because it is from the same millisecond
+// or the clock went back, is the previous one incremented instead, so
+// that IDs are strictly increasing. It is safe for concurrent use.
+type OrderedIDs struct {
+	src Source
+
+	mtx  sync.Mutex
+	last [16]byte
+}
+
+// NewOrderedIDs creates an OrderedIDs generator taking the time and the
+// random bytes from src, e.g. DefaultSource.
+func NewOrderedIDs(src Source) *OrderedIDs {
+	return &OrderedIDs{src: src}
+}
+
+// NewID returns an ID sorting after all IDs returned before.
+func (g *OrderedIDs) NewID() (id [16]byte, err error) {
+	ms := max(g.src.Now().UnixMilli(), 0)
+	binary.BigEndian.PutUint64(id[:8], uint64(ms)<<16)
+	if _, err := io.ReadFull(g.src.Rand, id[6:]); err != nil {
+		return id, fmt.Errorf("ordered id: %w", err)
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if bytes.Compare(id[:], g.last[:]) <= 0 {
+		id = g.last
+		for i := len(id) - 1; i >= 0; i-- {
+			id[i]++
+			if id[i] != 0 {
+				break
+			}
+		}
+	}
+	g.last = id
+	return id, nil
+}
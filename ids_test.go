@@ -0,0 +1,178 @@
+package chat_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+// seqIDs generates sequential IDs starting with its tag.
+type seqIDs struct {
+	tag byte
+	n   atomic.Uint64
+}
+
+func (g *seqIDs) NewID() (id [16]byte, _ error) {
+	id[0] = g.tag
+	binary.BigEndian.PutUint64(id[8:], g.n.Add(1))
+	return id, nil
+}
+
+func TestOrderedIDs(t *testing.T) {
+	clk := &manualClock{now: time.UnixMilli(1 << 40)}
+	gen := chat.NewOrderedIDs(chat.Source{Rand: rand.Reader, Now: clk.Now})
+	var last [16]byte
+	for i := range 10000 {
+		// the clock going back too
+		if i == 5000 {
+			clk.Add(-time.Second)
+		}
+		id, err := gen.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Compare(id[:], last[:]) <= 0 {
+			t.Fatalf("ID %d %x not after %x", i, id, last)
+		}
+		last = id
+	}
+	if ms := binary.BigEndian.Uint64(last[:8]) >> 16; ms != 1<<40 {
+		t.Errorf("ID timestamp %d, want %d", ms, 1<<40)
+	}
+
+	clk.Add(time.Hour)
+	id, _ := gen.NewID()
+	if ms := binary.BigEndian.Uint64(id[:8]) >> 16; ms != uint64(clk.Now().UnixMilli()) {
+		t.Errorf("ID timestamp %d, want %d", ms, clk.Now().UnixMilli())
+	}
+}
+
+func TestOrderedIDsConcurrent(t *testing.T) {
+	gen := chat.NewOrderedIDs(chat.DefaultSource)
+	var (
+		mtx  sync.Mutex
+		seen = make(map[[16]byte]bool)
+		wg   sync.WaitGroup
+	)
+	for range 8 {
+		wg.Go(func() {
+			var last [16]byte
+			for range 1000 {
+				id, err := gen.NewID()
+				if err != nil || bytes.Compare(id[:], last[:]) <= 0 {
+					t.Errorf("ID %x after %x: %v", id, last, err)
+					return
+				}
+				last = id
+				mtx.Lock()
+				if seen[id] {
+					t.Errorf("ID %x drawn twice", id)
+				}
+				seen[id] = true
+				mtx.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func TestIDGenerator(t *testing.T) {
+	serverIDs, sessionIDs, clientIDs := &seqIDs{tag: 's'}, &seqIDs{tag: 'x'}, &seqIDs{tag: 'c'}
+	for _, tt := range []struct {
+		name   string
+		opts   []chat.ServerOption
+		server *seqIDs
+	}{
+		{"server", []chat.ServerOption{chat.ServerOptions.IDGenerator(serverIDs)}, serverIDs},
+		{"session", []chat.ServerOption{
+			chat.ServerOptions.IDGenerator(serverIDs),
+			chat.ServerOptions.SessionOptions(chat.SessionOptions.IDGenerator(sessionIDs)),
+		}, sessionIDs},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var clientT, serverT transcriptBuffer
+			received := make(chan [16]byte, 1)
+			_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+				m, err := s.Recv(ctx)
+				if err != nil {
+					return
+				}
+				received <- m.ID
+				_ = s.Send(ctx, &chat.Message{Type: chat.MsgTypeText, Payload: []byte("hi")})
+				discard(ctx, s)
+			}, append(tt.opts, chat.ServerOptions.Transcript(&serverT, chat.TranscriptFull))...)
+			got := make(chan [16]byte, 1)
+			c := connect(t, addr, ca,
+				chat.ClientOptions.IDGenerator(clientIDs),
+				chat.ClientOptions.Transcript(&clientT, chat.TranscriptFull),
+				chat.ClientOptions.OnMessage(func(m *chat.Message) { got <- m.ID }))
+			send(t, c, "hello")
+			if id := receive(t, received); id[0] != clientIDs.tag {
+				t.Errorf("server received ID %x, not from the client generator", id)
+			}
+			if id := receive(t, got); id[0] != tt.server.tag {
+				t.Errorf("client received ID %x, not from the %s generator", id, tt.name)
+			}
+
+			// every frame sent, the handshake included
+			for _, side := range []struct {
+				name string
+				buf  *transcriptBuffer
+				gen  *seqIDs
+			}{{"client", &clientT, clientIDs}, {"server", &serverT, tt.server}} {
+				for _, r := range side.buf.records(t) {
+					m, err := r.Message()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if r.Dir == chat.TranscriptSent && m.ID[0] != side.gen.tag {
+						t.Errorf("%s sent %v %q with ID %x", side.name, m.Type, m.Payload, m.ID)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestIDGeneratorStamp(t *testing.T) {
+	gen := &seqIDs{tag: 'm'}
+	src := chat.DefaultSource
+	src.IDs = gen
+	for _, m := range []*chat.Message{{Type: chat.MsgTypeText, Payload: []byte("x")}, {Type: chat.MsgTypeControl}, {Type: chat.MsgTypeBinary}} {
+		if err := m.Stamp(src); err != nil {
+			t.Fatal(err)
+		}
+		if m.ID[0] != gen.tag {
+			t.Errorf("%v stamped with ID %x", m.Type, m.ID)
+		}
+	}
+	if n := gen.n.Load(); n != 3 {
+		t.Errorf("%d IDs generated, want 3", n)
+	}
+}
+
+// failingIDs fails to generate IDs.
+type failingIDs struct{}
+
+func (failingIDs) NewID() ([16]byte, error) {
+	return [16]byte{}, errors.New("no IDs left")
+}
+
+func TestConstructorsUnstamped(t *testing.T) {
+	defer func(src chat.Source) { chat.DefaultSource = src }(chat.DefaultSource)
+	chat.DefaultSource.IDs = failingIDs{}
+	// left for the session sending them to stamp
+	for _, m := range []*chat.Message{chat.NewTextMessage(nil), chat.NewBinaryMessage(nil), chat.NewControlMessage("x")} {
+		if m.ID != [16]byte{} || !m.Timestamp.IsZero() {
+			t.Errorf("%v stamped with ID %x at %v", m.Type, m.ID, m.Timestamp)
+		}
+	}
+}
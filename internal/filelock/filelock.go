@@ -0,0 +1,72 @@
+// Package filelock implements advisory locks on files shared by processes,
+// with flock on Unix and LockFileEx on Windows. Elsewhere locks only
+// exclude the holders within the process.
+package filelock
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// File is a locked file.
+type File struct {
+	f *os.File
+	// mtx is the lock of the path within the process, as flock
+	// does not exclude file descriptors of the same process on all
+	// systems and the fallback does not lock at all.
+	mtx *sync.Mutex
+}
+
+var (
+	mtx   sync.Mutex
+	paths = make(map[string]*sync.Mutex)
+)
+
+// Lock locks the file at path exclusively, creating it and its directory
+// if needed, and waits until no other process holds it. The file is meant
+// to be a lock file of its own, files replaced by renaming cannot be locked.
+func Lock(path string) (*File, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	mtx.Lock()
+	pm, ok := paths[abs]
+	if !ok {
+		pm = new(sync.Mutex)
+		paths[abs] = pm
+	}
+	mtx.Unlock()
+	pm.Lock()
+
+	if err = os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
+		pm.Unlock()
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	f, err := os.OpenFile(abs, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		pm.Unlock()
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	if err = lock(f); err != nil {
+		_ = f.Close()
+		pm.Unlock()
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	return &File{f: f, mtx: pm}, nil
+}
+
+// Unlock releases the lock and closes the file.
+func (l *File) Unlock() error {
+	defer l.mtx.Unlock()
+	err := unlock(l.f)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("unlock %s: %w", l.f.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Package tui implements input parsing and rendering of the terminal client.
+package tui
+
+import (
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Command is a slash command entered by the user.
+type Command struct {
+	Name string
+	Args []string
+}
+
+// Commands known to the client with their descriptions.
+var commands = []struct{ name, desc string }{
+	{"quit", "close the session and exit"},
+	{"ping", "show the round trip time to the server"},
+	{"who", "list sessions known to be online"},
+	{"token", "show the redacted session token"},
+	{"help", "show this help"},
+}
+
+// Parse parses an input line. Lines starting with a slash are commands,
+// a double slash escapes a message starting with a slash. It returns
+// the text to send if the line is not a command.
+func Parse(line string) (cmd Command, text string, isCmd bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "/") {
+		return Command{}, line, false
+	}
+	if strings.HasPrefix(line, "//") {
+		return Command{}, line[1:], false
+	}
+	fields := strings.Fields(line[1:])
+	if len(fields) == 0 {
+		return Command{}, "", true
+	}
+	return Command{Name: strings.ToLower(fields[0]), Args: fields[1:]}, "", true
+}
+
+// Help returns the list of commands.
+func Help() string {
+	var b strings.Builder
+	b.WriteString("commands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "  /%-6s %s\n", c.name, c.desc)
+	}
+	b.WriteString("  //text  send a message starting with a slash")
+	return b.String()
+}
+
+// Message renders a chat message line.
+func Message(ts time.Time, sender, text string) string {
+	return ts.Local().Format(time.TimeOnly) + " " + sender + ": " + text
+}
+
+// Binary renders a binary message line.
+func Binary(ts time.Time, sender string, n int) string {
+	return Message(ts, sender, fmt.Sprintf("<%d bytes>", n))
+}
+
+// Notice renders a notice from the server.
+func Notice(reason, msg, code string) string {
+	return fmt.Sprintf("! %s: %s (%s)", reason, msg, code)
+}
+
+// Presence renders a session joining or leaving.
+func Presence(id uint64, online bool) string {
+	if online {
+		return fmt.Sprintf("* %d joined", id)
+	}
+	return fmt.Sprintf("* %d left", id)
+}
+
+// Drain renders the server announcing it closes the connection at deadline.
+func Drain(deadline, now time.Time) string {
+	if deadline.IsZero() {
+		return "! server is stopping"
+	}
+	return "! server is stopping in " + max(deadline.Sub(now), 0).Round(time.Second).String()
+}
+
+// RTT renders a round trip time.
+func RTT(d time.Duration) string {
+	if d <= 0 {
+		return "rtt: unknown"
+	}
+	return "rtt: " + d.Round(100*time.Microsecond).String()
+}
+
+// Token renders a token showing only its first and last two bytes.
+func Token(tok [16]byte) string {
+	if tok == [16]byte{} {
+		return "token: none"
+	}
+	return "token: " + hex.EncodeToString(tok[:2]) + strings.Repeat("*", 24) + hex.EncodeToString(tok[14:])
+}
+
+// Roster tracks the sessions reported online by presence events.
+type Roster struct {
+	online map[uint64]struct{}
+	seen   bool
+}
+
+// Set records a presence change.
+func (r *Roster) Set(id uint64, online bool) {
+	r.seen = true
+	if r.online == nil {
+		r.online = make(map[uint64]struct{})
+	}
+	if online {
+		r.online[id] = struct{}{}
+	} else {
+		delete(r.online, id)
+	}
+}
+
+// String renders the sessions online, ordered by ID.
+func (r *Roster) String() string {
+	if !r.seen {
+		return "no presence information"
+	}
+	if len(r.online) == 0 {
+		return "nobody else is online"
+	}
+	ids := make([]string, 0, len(r.online))
+	for _, id := range slices.Sorted(maps.Keys(r.online)) {
+		ids = append(ids, fmt.Sprint(id))
+	}
+	return "online: " + strings.Join(ids, ", ")
+}
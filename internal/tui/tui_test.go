@@ -0,0 +1,90 @@
+package tui_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat/internal/tui"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line  string
+		cmd   tui.Command
+		text  string
+		isCmd bool
+	}{
+		{"hello\n", tui.Command{}, "hello", false},
+		{"", tui.Command{}, "", false},
+		{"/quit", tui.Command{Name: "quit", Args: []string{}}, "", true},
+		{"/PING\r\n", tui.Command{Name: "ping", Args: []string{}}, "", true},
+		{"/who  all now", tui.Command{Name: "who", Args: []string{"all", "now"}}, "", true},
+		{"/", tui.Command{}, "", true},
+		{"/ ", tui.Command{}, "", true},
+		{"//etc/hosts", tui.Command{}, "/etc/hosts", false},
+		{"a /quit", tui.Command{}, "a /quit", false},
+	}
+	for _, tt := range tests {
+		cmd, text, isCmd := tui.Parse(tt.line)
+		if !reflect.DeepEqual(cmd, tt.cmd) || text != tt.text || isCmd != tt.isCmd {
+			t.Errorf("Parse(%q) = %+v, %q, %t, want %+v, %q, %t", tt.line, cmd, text, isCmd, tt.cmd, tt.text, tt.isCmd)
+		}
+	}
+}
+
+func TestHelp(t *testing.T) {
+	help := tui.Help()
+	for _, cmd := range []string{"/quit", "/ping", "/who", "/token", "/help", "//text"} {
+		if !strings.Contains(help, cmd) {
+			t.Errorf("help lacks %s:\n%s", cmd, help)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	ts := time.Date(2025, 1, 1, 12, 30, 5, 0, time.UTC)
+	clock := ts.Local().Format(time.TimeOnly)
+	tok := [16]byte{0xab, 0xcd, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 0xef, 0x01}
+	tests := []struct {
+		got, want string
+	}{
+		{tui.Message(ts, "7", "hi"), clock + " 7: hi"},
+		{tui.Binary(ts, "you", 12), clock + " you: <12 bytes>"},
+		{tui.Notice("muted", "you are muted", "policy violation"), "! muted: you are muted (policy violation)"},
+		{tui.Presence(3, true), "* 3 joined"},
+		{tui.Presence(3, false), "* 3 left"},
+		{tui.Drain(time.Time{}, ts), "! server is stopping"},
+		{tui.Drain(ts.Add(1500*time.Millisecond), ts), "! server is stopping in 2s"},
+		{tui.Drain(ts.Add(-time.Second), ts), "! server is stopping in 0s"},
+		{tui.RTT(0), "rtt: unknown"},
+		{tui.RTT(1234567 * time.Nanosecond), "rtt: 1.2ms"},
+		{tui.Token([16]byte{}), "token: none"},
+		{tui.Token(tok), "token: abcd" + strings.Repeat("*", 24) + "ef01"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("rendered %q, want %q", tt.got, tt.want)
+		}
+	}
+}
+
+func TestRoster(t *testing.T) {
+	var r tui.Roster
+	if s := r.String(); s != "no presence information" {
+		t.Errorf("empty roster %q", s)
+	}
+	r.Set(12, true)
+	r.Set(3, true)
+	r.Set(5, true)
+	r.Set(5, false)
+	if s := r.String(); s != "online: 3, 12" {
+		t.Errorf("roster %q, want online: 3, 12", s)
+	}
+	r.Set(3, false)
+	r.Set(12, false)
+	if s := r.String(); s != "nobody else is online" {
+		t.Errorf("roster %q after everybody left", s)
+	}
+}
@@ -0,0 +1,66 @@
+package chat
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ipFilter decides which remote addresses may connect.
+// Denied prefixes win over allowed ones, an empty allowlist allows everything.
+type ipFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// parsePrefixes parses CIDRs or bare addresses, treating
+// IPv4-mapped IPv6 prefixes as their IPv4 counterparts.
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		var p netip.Prefix
+		var err error
+		if strings.Contains(cidr, "/") {
+			p, err = netip.ParsePrefix(cidr)
+		} else {
+			var addr netip.Addr
+			if addr, err = netip.ParseAddr(cidr); err == nil {
+				p = netip.PrefixFrom(addr, addr.BitLen())
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		if p.Addr().Is4In6() {
+			if p.Bits() < 96 {
+				return nil, fmt.Errorf("invalid CIDR %q: IPv4-mapped prefix shorter than 96 bits", cidr)
+			}
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+func (f *ipFilter) allowed(addr net.Addr) bool {
+	udp, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	ip := udp.AddrPort().Addr().Unmap()
+	for _, p := range f.deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, p := range f.allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
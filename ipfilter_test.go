@@ -0,0 +1,64 @@
+package chat_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+	"github.com/zhmlst/chat/codes"
+)
+
+func TestIPFilter(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny []string
+		allowed     bool
+	}{
+		{"no lists", nil, nil, true},
+		{"allowed", []string{"127.0.0.0/8"}, nil, true},
+		{"allowed address", []string{"127.0.0.1"}, nil, true},
+		{"allowed mapped", []string{"::ffff:127.0.0.0/104"}, nil, true},
+		{"not allowed", []string{"10.0.0.0/8"}, nil, false},
+		{"IPv6 only", []string{"::1/128"}, nil, false},
+		{"denied", nil, []string{"127.0.0.1/32"}, false},
+		{"denied mapped", nil, []string{"::ffff:127.0.0.1"}, false},
+		{"denied inside allowed", []string{"127.0.0.0/8"}, []string{"127.0.0.0/24"}, false},
+		{"denied elsewhere", []string{"127.0.0.0/8"}, []string{"127.1.0.0/16"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, addr, ca := startServer(t, discard,
+				chat.ServerOptions.AllowCIDR(tt.allow...),
+				chat.ServerOptions.DenyCIDR(tt.deny...),
+			)
+			err := dial(t, newClient(t, addr, ca))
+			if tt.allowed {
+				if err != nil {
+					t.Fatalf("dial: %v", err)
+				}
+				return
+			}
+			var cerr *chat.CloseError
+			if !errors.As(err, &cerr) || cerr.Code != codes.Forbidden {
+				t.Fatalf("dial: %v, want close code %s", err, codes.Forbidden)
+			}
+			if n := srv.Stats().Forbidden; n != 1 {
+				t.Errorf("%d forbidden, want 1", n)
+			}
+		})
+	}
+}
+
+func TestIPFilterInvalidCIDR(t *testing.T) {
+	srv := chat.NewServer(
+		chat.ServerOptions.DevTLS(),
+		chat.ServerOptions.Handler(discard),
+		chat.ServerOptions.TokenRepo(&chattest.TokenRepo{}),
+		chat.ServerOptions.AllowCIDR("10.0.0.0/33"),
+	)
+	if err := srv.Validate(); err == nil || !strings.Contains(err.Error(), "10.0.0.0/33") {
+		t.Errorf("validate: %v, want the invalid CIDR", err)
+	}
+}
@@ -0,0 +1,137 @@
+// Package keygen generates the certificates and tokens needed to run chat.
+package keygen
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultHosts are the hosts of certificates generated without explicit hosts.
+var DefaultHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+// ErrNoCertificate is returned when PEM data holds no certificate.
+var ErrNoCertificate = errors.New("no certificate in PEM data")
+
+// Cert generates a self-signed ECDSA P-256 certificate for hosts, which
+// are DNS names or IP addresses, valid for the given duration. It returns
+// the PEM encoded certificate and private key.
+func Cert(hosts []string, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	if len(hosts) == 0 {
+		hosts = DefaultHosts
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal key: %w", err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey})
+	return certPEM, keyPEM, nil
+}
+
+// TLSCert is like Cert but returns a certificate ready for a tls.Config.
+func TLSCert(hosts []string, validity time.Duration) (tls.Certificate, error) {
+	certPEM, keyPEM, err := Cert(hosts, validity)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// Fingerprint returns the SPKI pin of the first certificate in the PEM data:
+// the base64 encoded SHA-256 of its subject public key info.
+func Fingerprint(certPEM []byte) (string, error) {
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			return "", ErrNoCertificate
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		return SPKIPin(crt), nil
+	}
+}
+
+// SPKIPin returns the base64 encoded SHA-256 of the certificate's subject public key info.
+func SPKIPin(crt *x509.Certificate) string {
+	sum := sha256.Sum256(crt.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Token generates a random token.
+func Token() (tok [16]byte, err error) {
+	if _, err = io.ReadFull(rand.Reader, tok[:]); err != nil {
+		return tok, fmt.Errorf("failed to generate token: %w", err)
+	}
+	return tok, nil
+}
+
+// WriteTokenFile writes the token in the format of the client's token file,
+// creating the parent directories.
+func WriteTokenFile(file string, tok [16]byte) (err error) {
+	dir := filepath.Dir(file)
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to mkdir %s for token file: %w", dir, err)
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open token file: %w", err)
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close token file: %w", cerr))
+		}
+	}()
+	if _, err = f.Write(tok[:]); err != nil {
+		return fmt.Errorf("failed to save token file %s: %w", file, err)
+	}
+	return nil
+}
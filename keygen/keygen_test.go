@@ -0,0 +1,123 @@
+package keygen_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/keygen"
+)
+
+func TestCert(t *testing.T) {
+	certPEM, keyPEM, err := keygen.Cert([]string{"chat.example", "10.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		t.Fatalf("certificate PEM %q", certPEM)
+	}
+	crt, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, ok := crt.PublicKey.(*ecdsa.PublicKey)
+	if !ok || pub.Curve != elliptic.P256() {
+		t.Errorf("public key %T, want ECDSA P-256", crt.PublicKey)
+	}
+	if !slices.Equal(crt.DNSNames, []string{"chat.example"}) {
+		t.Errorf("DNS names %v", crt.DNSNames)
+	}
+	if len(crt.IPAddresses) != 1 || !crt.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("IP addresses %v", crt.IPAddresses)
+	}
+	if d := time.Until(crt.NotAfter); d <= 0 || d > time.Hour {
+		t.Errorf("expires in %v, want within an hour", d)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(crt)
+	if _, err := crt.Verify(x509.VerifyOptions{DNSName: "chat.example", Roots: pool}); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		t.Fatalf("key PEM %q", keyPEM)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.PublicKey.Equal(pub) {
+		t.Error("key does not match the certificate")
+	}
+}
+
+func TestCertDefaultHosts(t *testing.T) {
+	crt, err := keygen.TLSCert(nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(crt.Leaf.DNSNames, []string{"localhost"}) || len(crt.Leaf.IPAddresses) != 2 {
+		t.Errorf("hosts %v %v, want %v", crt.Leaf.DNSNames, crt.Leaf.IPAddresses, keygen.DefaultHosts)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	certPEM, keyPEM, err := keygen.Cert(nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the key first, the certificate is found after it
+	pin, err := keygen.Fingerprint(append(keyPEM, certPEM...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	crt, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := keygen.SPKIPin(crt); pin != want {
+		t.Errorf("fingerprint %s, want %s", pin, want)
+	}
+
+	if _, err := keygen.Fingerprint(keyPEM); !errors.Is(err, keygen.ErrNoCertificate) {
+		t.Errorf("fingerprint of a key: %v, want ErrNoCertificate", err)
+	}
+}
+
+func TestTokenFile(t *testing.T) {
+	tok, err := keygen.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok == ([16]byte{}) {
+		t.Fatal("zero token")
+	}
+	file := filepath.Join(t.TempDir(), "chat", "token")
+	if err := keygen.WriteTokenFile(file, tok); err != nil {
+		t.Fatal(err)
+	}
+
+	store := chat.NewFileTokenStore(file)
+	got, err := store.Token("chat.example:4242", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != tok {
+		t.Errorf("store token %x, want %x", got, tok)
+	}
+	// migrated, the token stays with the server it was first read for
+	if got, err = chat.NewFileTokenStore(file).Token("chat.example:4242", ""); err != nil || got != tok {
+		t.Errorf("reopened store token %x, %v, want %x", got, err, tok)
+	}
+}
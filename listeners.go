@@ -0,0 +1,109 @@
+package chat
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// DefaultAddr is the address servers listen on and clients connect to
+// unless told otherwise.
+const DefaultAddr = "localhost:4242"
+
+// Addresses sets the addresses the server listens on, e.g. an IPv4 and
+// an IPv6 one. Connections accepted on any of them are served alike.
+// Run fails if one of them cannot be bound, see BestEffortBind.
+func (serverOptionsNamespace) Addresses(addrs ...string) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.addresses = addrs
+	}
+}
+
+// BestEffortBind lets Run go on with the addresses it could bind,
+// logging those it could not. It still fails if it could bind none.
+func (serverOptionsNamespace) BestEffortBind() ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.bestEffort = true
+	}
+}
+
+// Addrs returns the addresses the server listens on,
+// or nil if it is not running.
+func (s *Server) Addrs() []net.Addr {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.lnrs) == 0 {
+		return nil
+	}
+	addrs := make([]net.Addr, len(s.lnrs))
+	for i, lnr := range s.lnrs {
+		addrs[i] = lnr.Addr()
+	}
+	return addrs
+}
+
+// listenAll listens on every address of the server, closing the listeners
+// already created if one fails, unless binding is best effort.
+// The transports of the listeners are returned as well.
+func (s *Server) listenAll(tlsCfg *tls.Config, quicCfg *quic.Config) ([]Listener, []*quic.Transport, error) {
+	var (
+		lnrs []Listener
+		trs  []*quic.Transport
+		errs []error
+	)
+	for _, addr := range s.cfg.addresses {
+		lnr, tr, err := s.listen(addr, tlsCfg, quicCfg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listen %s: %w", addr, err))
+			continue
+		}
+		if s.cfg.wrapListener != nil {
+			lnr = s.cfg.wrapListener(lnr)
+		}
+		lnrs = append(lnrs, lnr)
+		trs = append(trs, tr)
+	}
+	err := errors.Join(errs...)
+	if err != nil && (!s.cfg.bestEffort || len(lnrs) == 0) {
+		return nil, nil, errors.Join(err, closeListeners(lnrs), closeTransports(trs))
+	}
+	if err != nil {
+		s.cfg.logger.With("error", err).Warn("not listening on every address")
+	}
+	return lnrs, trs, nil
+}
+
+// closeListeners closes every listener.
+func closeListeners(lnrs []Listener) error {
+	var errs []error
+	for _, lnr := range lnrs {
+		if err := lnr.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close listener %s: %w", lnr.Addr(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// serve runs an accept loop per listener until all of them end.
+func (s *Server) serve() error {
+	var (
+		wg   sync.WaitGroup
+		mtx  sync.Mutex
+		errs []error
+	)
+	for _, lnr := range s.lnrs {
+		wg.Go(func() {
+			if err := s.accept(lnr); err != nil {
+				mtx.Lock()
+				errs = append(errs, err)
+				mtx.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,93 @@
+package chat_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/keygen"
+)
+
+// loopbacks returns a certificate for the IPv4 and IPv6 loopback
+// addresses and a pool trusting it, skipping the test without IPv6.
+func loopbacks(t *testing.T) (chat.ServerOption, *x509.CertPool) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	_ = pc.Close()
+	return certificate(t, "127.0.0.1", "::1")
+}
+
+// certificate returns a certificate for the hosts and a pool trusting it.
+func certificate(t *testing.T, hosts ...string) (chat.ServerOption, *x509.CertPool) {
+	t.Helper()
+	certPEM, keyPEM, err := keygen.Cert(hosts, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := x509.NewCertPool()
+	ca.AppendCertsFromPEM(certPEM)
+	return chat.ServerOptions.TLSCertificate(crt), ca
+}
+
+func TestAddresses(t *testing.T) {
+	cert, ca := loopbacks(t)
+	h, got := received()
+	srv, _, _ := startServer(t, h, cert, chat.ServerOptions.Addresses("127.0.0.1:0", "[::1]:0"))
+	addrs := srv.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("listening on %v, want two addresses", addrs)
+	}
+	for _, addr := range addrs {
+		send(t, connect(t, addr.String(), ca), addr.String())
+		if text := receive(t, got); text != addr.String() {
+			t.Errorf("received %q, want %s", text, addr)
+		}
+	}
+	if n := srv.Stats().Sessions; n != 2 {
+		t.Errorf("%d sessions, want one per address", n)
+	}
+}
+
+func TestAddressesBind(t *testing.T) {
+	busy, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	cert, _ := certificate(t, "127.0.0.1")
+	run := func(opts ...chat.ServerOption) error {
+		return chat.NewServer(append([]chat.ServerOption{
+			cert,
+			chat.ServerOptions.Handler(discard),
+			chat.ServerOptions.Logger(quiet),
+		}, opts...)...).Run()
+	}
+	both := chat.ServerOptions.Addresses("127.0.0.1:0", busy.LocalAddr().String())
+
+	err = run(both)
+	if err == nil || !strings.Contains(err.Error(), busy.LocalAddr().String()) {
+		t.Errorf("run with a busy address: %v", err)
+	}
+
+	srv, addr, ca := startServer(t, discard, both, chat.ServerOptions.BestEffortBind())
+	if addrs := srv.Addrs(); len(addrs) != 1 {
+		t.Errorf("listening on %v, want the free address only", addrs)
+	}
+	connect(t, addr, ca)
+
+	// best effort still needs an address
+	if err := run(chat.ServerOptions.Addresses(busy.LocalAddr().String()), chat.ServerOptions.BestEffortBind()); err == nil {
+		t.Error("run without any address bound succeeded")
+	}
+}
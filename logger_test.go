@@ -0,0 +1,84 @@
+package chat_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+// line is a recorded log call with its attributes.
+type line struct {
+	lvl   chat.LogLevel
+	msg   string
+	attrs map[any]any
+}
+
+// recorder is a Logger recording every line.
+type recorder struct {
+	mtx   sync.Mutex
+	lines []line
+}
+
+func (r *recorder) log(lvl chat.LogLevel, msg string, arg ...any) {
+	attrs := make(map[any]any, len(arg)/2)
+	for i := 0; i+1 < len(arg); i += 2 {
+		attrs[arg[i]] = arg[i+1]
+	}
+	r.mtx.Lock()
+	r.lines = append(r.lines, line{lvl: lvl, msg: msg, attrs: attrs})
+	r.mtx.Unlock()
+}
+
+func (r *recorder) recorded() []line {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.lines
+}
+
+func TestSessionLogger(t *testing.T) {
+	var rec recorder
+	handled := make(chan uint64, 2)
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		s.Logger().Info("handled")
+		handled <- s.ID()
+		for range s.Input(ctx) {
+		}
+	}, chat.ServerOptions.Logger(rec.log))
+	srv.SetLogLevel(chat.LogLevelDebug)
+	for range 2 {
+		send(t, connect(t, addr, ca), "hello")
+	}
+	ids := map[uint64]bool{receive(t, handled): true, receive(t, handled): true}
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lines of a connection carry the ID of its session once it has one
+	sessions := make(map[any]any)
+	for _, l := range rec.recorded() {
+		addr, ok := l.attrs["addr"]
+		id, hasID := l.attrs["session"]
+		if !ok || !hasID {
+			continue
+		}
+		if prev, ok := sessions[addr]; ok && prev != id {
+			t.Errorf("%q of %v logged with session %v, want %v", l.msg, addr, id, prev)
+		}
+		sessions[addr] = id
+		if l.msg == "handled" && !ids[id.(uint64)] {
+			t.Errorf("handler logged with session %v", id)
+		}
+	}
+	if len(sessions) != 2 {
+		t.Errorf("lines of %d sessions, want 2", len(sessions))
+	}
+	for _, l := range rec.recorded() {
+		if _, ok := sessions[l.attrs["addr"]]; ok && l.msg != "connection accepted" && l.attrs["session"] == nil {
+			t.Errorf("%q of %v logged without the session", l.msg, l.attrs["addr"])
+		}
+	}
+}
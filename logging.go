@@ -1,5 +1,7 @@
 package chat
 
+import "sync/atomic"
+
 // LogLevel represents the severity level of a log message.
 //
 //go:generate enumer -output=loglevel.go -text -transform=upper -trimprefix=LogLevel -type=LogLevel
@@ -46,5 +48,27 @@ func (l Logger) With(arg ...any) Logger {
 	}
 }
 
+// levelVar is a minimum log level which may be changed at any time.
+type levelVar struct {
+	v atomic.Int32
+}
+
+func (v *levelVar) Load() LogLevel     { return LogLevel(v.v.Load()) }
+func (v *levelVar) Store(lvl LogLevel) { v.v.Store(int32(lvl)) }
+
+// leveled returns a logger dropping messages below the current level of min.
+// Loggers derived from it with With follow later changes of the level.
+// A nil logger discards all messages.
+func (l Logger) leveled(min *levelVar) Logger {
+	if l == nil {
+		l = NopLogger
+	}
+	return func(lvl LogLevel, msg string, arg ...any) {
+		if lvl >= min.Load() {
+			l(lvl, msg, arg...)
+		}
+	}
+}
+
 // NopLogger is a no-operation logger that discards all log messages.
 func NopLogger(LogLevel, string, ...any) {}
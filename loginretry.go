@@ -0,0 +1,85 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultLoginRetries = 2
+	defaultLoginBackoff = 100 * time.Millisecond
+)
+
+// LoginRetry sets how often the client logs in again with the same token
+// the server did not know, and the delay before the first retry, doubled
+// on each further one, before it requests a new token. A token issued
+// moments ago may not be visible yet to a server with an eventually
+// consistent TokenRepo, see ServerOptions.TokenRepoLag. Servers negotiating
+// CapLoginHints tell whether a retry can help and for how long to wait at
+// least. The default is 2 retries after 100ms, zero retries disables them.
+func (clientOptionsNamespace) LoginRetry(retries int, backoff time.Duration) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.loginRetries = retries
+		cfg.loginBackoff = backoff
+	}
+}
+
+// TokenRepoLag declares the TokenRepo eventually consistent, such as a
+// replicated database, with new tokens visible to HasToken after up to lag.
+// Clients negotiating CapLoginHints are then told to retry logging in with
+// an unknown token after lag rather than to request a new one.
+func (serverOptionsNamespace) TokenRepoLag(lag time.Duration) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.tokenRepoLag = lag
+	}
+}
+
+// unknownToken returns the response to a login with an unknown token.
+// Clients offering CapLoginHints in arg are told "no retry <milliseconds>"
+// if the repo may lag, "no reject" otherwise, and others a plain "no".
+func (s *Server) unknownToken(arg []byte) []byte {
+	offered := parseHandshakeArgs(arg).caps
+	if !slices.ContainsFunc(offered, func(c Capability) bool { return c.Name == CapLoginHints }) {
+		return []byte("no")
+	}
+	if s.cfg.tokenRepoLag > 0 {
+		return []byte("no retry " + strconv.FormatInt(s.cfg.tokenRepoLag.Milliseconds(), 10))
+	}
+	return []byte("no reject")
+}
+
+// loginRetry returns the delay before the retries-th retry of the login
+// with the same token the server answered resp to, if it is due one.
+// Plain "no" responses of servers without hints are retried as well.
+func (c *Client) loginRetry(resp []byte, retries int) (time.Duration, bool) {
+	cmd, arg, _ := bytes.Cut(resp, []byte(" "))
+	if string(cmd) != "no" || retries >= c.cfg.loginRetries {
+		return 0, false
+	}
+	delay := c.cfg.loginBackoff << retries
+	hint, arg, _ := bytes.Cut(arg, []byte(" "))
+	switch string(hint) {
+	case "reject":
+		return 0, false
+	case "retry":
+		if ms, err := strconv.ParseUint(string(arg), 10, 32); err == nil {
+			delay = max(delay, time.Duration(ms)*time.Millisecond)
+		}
+	}
+	return delay, true
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,70 @@
+package chat_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+)
+
+// lagging is a TokenRepo missing saved tokens the first misses times
+// they are looked up, as an eventually consistent one would.
+type lagging struct {
+	chattest.TokenRepo
+	misses atomic.Int64
+}
+
+func (r *lagging) HasToken(ctx context.Context, tok [16]byte) (bool, error) {
+	has, err := r.TokenRepo.HasToken(ctx, tok)
+	if !has || err != nil {
+		return has, err
+	}
+	return r.misses.Add(-1) < 0, nil
+}
+
+func TestLoginRetry(t *testing.T) {
+	const lag = 50 * time.Millisecond
+	for _, tt := range []struct {
+		name       string
+		server     []chat.ServerOption
+		client     []chat.ClientOption
+		misses     int64
+		issued     int64
+		minLatency time.Duration
+	}{
+		{"lag hinted", []chat.ServerOption{chat.ServerOptions.TokenRepoLag(lag)},
+			[]chat.ClientOption{chat.ClientOptions.LoginRetry(2, time.Millisecond)}, 1, 1, lag},
+		{"without hints", nil,
+			[]chat.ClientOption{chat.ClientOptions.DisableCapabilities(chat.CapLoginHints)}, 2, 1, 0},
+		{"rejected", nil, nil, 1, 2, 0},
+		{"retries disabled", []chat.ServerOption{chat.ServerOptions.TokenRepoLag(lag)},
+			[]chat.ClientOption{chat.ClientOptions.LoginRetry(0, 0)}, 1, 2, 0},
+		{"retries exhausted", []chat.ServerOption{chat.ServerOptions.TokenRepoLag(time.Millisecond)},
+			[]chat.ClientOption{chat.ClientOptions.LoginRetry(1, time.Millisecond)}, 2, 2, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var issued atomic.Int64
+			repo := new(lagging)
+			repo.misses.Store(tt.misses)
+			_, addr, ca := startServer(t, discard, append([]chat.ServerOption{
+				chat.ServerOptions.TokenRepo(repo),
+				issuing(&issued),
+			}, tt.server...)...)
+			start := time.Now()
+			c := connect(t, addr, ca, append([]chat.ClientOption{sharedToken(t)}, tt.client...)...)
+			if d := time.Since(start); d < tt.minLatency {
+				t.Errorf("logged in after %s, before the hinted %s", d, tt.minLatency)
+			}
+			if _, err := c.Token(); err != nil {
+				t.Fatal(err)
+			}
+			// the first token survives unless the client gave up on it
+			if n := issued.Load(); n != tt.issued {
+				t.Errorf("%d tokens issued, want %d", n, tt.issued)
+			}
+		})
+	}
+}
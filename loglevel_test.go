@@ -0,0 +1,68 @@
+package chat_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestSetLogLevel(t *testing.T) {
+	var rec recorder
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		for {
+			m, err := s.Recv(ctx)
+			if err != nil {
+				return
+			}
+			s.Logger().With("text", string(m.Payload)).Debug("got")
+			if err := s.Send(ctx, chat.NewTextMessage(m.Payload)); err != nil {
+				return
+			}
+		}
+	}, chat.ServerOptions.Logger(rec.log))
+	srv.SetLogLevel(chat.LogLevelInfo)
+	echoes := make(chan string, 1)
+	c := connect(t, addr, ca, chat.ClientOptions.OnMessage(func(m *chat.Message) { echoes <- string(m.Payload) }))
+
+	// the level changes for the session already running
+	for _, step := range []struct {
+		lvl  chat.LogLevel
+		text string
+	}{{chat.LogLevelInfo, "a"}, {chat.LogLevelDebug, "b"}, {chat.LogLevelInfo, "c"}} {
+		srv.SetLogLevel(step.lvl)
+		if lvl := srv.LogLevel(); lvl != step.lvl {
+			t.Fatalf("level %s, want %s", lvl, step.lvl)
+		}
+		send(t, c, step.text)
+		receive(t, echoes)
+	}
+	var got []any
+	for _, l := range rec.recorded() {
+		if l.msg == "got" {
+			got = append(got, l.attrs["text"])
+		}
+	}
+	if len(got) != 1 || got[0] != "b" {
+		t.Errorf("debug lines of %v, want only b", got)
+	}
+}
+
+func TestClientLogLevel(t *testing.T) {
+	var rec recorder
+	_, addr, ca := startServer(t, discard)
+	c := newClient(t, addr, ca, chat.ClientOptions.Logger(rec.log))
+	c.SetLogLevel(chat.LogLevelWarn)
+	if lvl := c.LogLevel(); lvl != chat.LogLevelWarn {
+		t.Errorf("level %s, want %s", lvl, chat.LogLevelWarn)
+	}
+	if err := dial(t, c); err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	send(t, c, "hello")
+	for _, l := range rec.recorded() {
+		if l.lvl < chat.LogLevelWarn {
+			t.Errorf("%s line %q below the level", l.lvl, l.msg)
+		}
+	}
+}
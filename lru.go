@@ -0,0 +1,53 @@
+package chat
+
+import (
+	"container/list"
+	"sync"
+)
+
+// idLRU is a bounded set of message IDs evicting the least recently used one.
+type idLRU struct {
+	mtx   sync.Mutex
+	size  int
+	ll    *list.List
+	items map[[16]byte]*list.Element
+}
+
+func newIDLRU(size int) *idLRU {
+	return &idLRU{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[[16]byte]*list.Element),
+	}
+}
+
+func (l *idLRU) add(id [16]byte) {
+	l.seen(id)
+}
+
+// seen adds the ID and reports whether it was present already.
+func (l *idLRU) seen(id [16]byte) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if e, ok := l.items[id]; ok {
+		l.ll.MoveToFront(e)
+		return true
+	}
+	l.items[id] = l.ll.PushFront(id)
+	if l.ll.Len() > l.size {
+		e := l.ll.Back()
+		l.ll.Remove(e)
+		delete(l.items, e.Value.([16]byte))
+	}
+	return false
+}
+
+func (l *idLRU) contains(id [16]byte) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	e, ok := l.items[id]
+	if ok {
+		l.ll.MoveToFront(e)
+	}
+	return ok
+}
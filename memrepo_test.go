@@ -0,0 +1,96 @@
+package chat_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestMemTokenRepoCap(t *testing.T) {
+	const capacity = 3
+	var rec recorder
+	repo := chat.NewMemTokenRepo(capacity, 0)
+	h, got := received()
+	_, addr, ca := startServer(t, h, chat.ServerOptions.TokenRepo(repo), chat.ServerOptions.Logger(rec.log))
+	dir := t.TempDir()
+	tokenFile := func(i int) chat.ClientOption {
+		return chat.ClientOptions.TokenFile(filepath.Join(dir, fmt.Sprint(i)))
+	}
+
+	// a token each, the first ones evicted by the later ones
+	var (
+		clients []*chat.Client
+		toks    [][16]byte
+	)
+	for i := range capacity + 2 {
+		c := connect(t, addr, ca, tokenFile(i))
+		tok, err := c.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients, toks = append(clients, c), append(toks, tok)
+	}
+	if n := repo.Len(); n != capacity {
+		t.Errorf("%d tokens kept, want %d", n, capacity)
+	}
+	if n := repo.Evictions(); n != 2 {
+		t.Errorf("%d evictions, want 2", n)
+	}
+	for i, tok := range toks {
+		if has, _ := repo.HasToken(context.Background(), tok); has != (i >= 2) {
+			t.Errorf("token %d kept: %v", i, has)
+		}
+	}
+
+	// sessions of evicted tokens go on, with a warning
+	send(t, clients[0], "still here")
+	if text := receive(t, got); text != "still here" {
+		t.Errorf("received %q, want still here", text)
+	}
+	warned := false
+	for _, l := range rec.recorded() {
+		warned = warned || (l.lvl == chat.LogLevelWarn && l.msg == "evicted token of active sessions")
+	}
+	if !warned {
+		t.Error("eviction of a token in use not logged")
+	}
+
+	// the oldest token no longer authenticates, the latest still does
+	for _, tt := range []struct {
+		i        int
+		wantSame bool
+	}{{0, false}, {capacity + 1, true}} {
+		c := connect(t, addr, ca, tokenFile(tt.i))
+		tok, err := c.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (tok == toks[tt.i]) != tt.wantSame {
+			t.Errorf("client %d logged in again with its token: %v, want %v", tt.i, tok == toks[tt.i], tt.wantSame)
+		}
+	}
+}
+
+func TestMemTokenRepoTTL(t *testing.T) {
+	const ttl = 50 * time.Millisecond
+	repo := chat.NewMemTokenRepo(0, ttl)
+	_, addr, ca := startServer(t, discard, chat.ServerOptions.TokenRepo(repo))
+	tok, err := connect(t, addr, ca, sharedToken(t)).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := repo.HasToken(context.Background(), tok); !has {
+		t.Fatal("token not saved")
+	}
+	time.Sleep(2 * ttl)
+	if has, _ := repo.HasToken(context.Background(), tok); has {
+		t.Error("token kept past its ttl")
+	}
+	if n := repo.Evictions(); n != 1 {
+		t.Errorf("%d evictions, want 1", n)
+	}
+}
@@ -0,0 +1,568 @@
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/zhmlst/chat/codes"
+)
+
+// MsgType defines the message payload type.
+type MsgType byte
+
+const (
+	// MsgTypeControl represents a control message.
+	MsgTypeControl MsgType = iota
+	// MsgTypeText represents a text message.
+	MsgTypeText
+	// MsgTypeBinary represents a binary message.
+	MsgTypeBinary
+	// MsgTypeAck represents an acknowledgement of other messages, see Receipt.
+	MsgTypeAck
+)
+
+// Flag is a bit in the header flags byte.
+type Flag byte
+
+const (
+	// FlagAckRequested asks the recipient to confirm delivery with a receipt.
+	FlagAckRequested Flag = 1 << iota
+	// FlagTTL marks frames carrying a time to live, see Message.TTL.
+	FlagTTL
+	// FlagChannel marks frames carrying a channel ID, see Message.Channel.
+	FlagChannel
+	// FlagHistory marks messages sent before the recipient joined,
+	// replayed from the history of a Hub.
+	FlagHistory
+)
+
+// FlagEncrypted marks frames whose payload is encrypted end to end,
+// see Session.SendEncrypted. It is critical, so that a receiver unable
+// to decrypt it does not take the ciphertext for the payload.
+const FlagEncrypted Flag = 1 << 4
+
+// FlagMetadata marks frames whose payload is preceded by metadata, see
+// Message.SetContentType. It is critical, so that a receiver unable to
+// split it off does not take the metadata for the payload.
+const FlagMetadata Flag = 1 << 5
+
+// FlagCritical masks the flags a receiver must understand. Unknown flags
+// outside of it are ignored, unknown critical flags make the frame invalid.
+const FlagCritical Flag = 0xf0
+
+// knownFlags are the flags this implementation understands.
+const knownFlags = FlagAckRequested | FlagTTL | FlagChannel | FlagHistory | FlagEncrypted | FlagMetadata
+
+// ErrUnknownFlag is returned when a frame has an unknown critical flag set.
+var ErrUnknownFlag = errors.New("unknown critical flag")
+
+// maxClockSkew is how far in the future a message timestamp may be.
+const maxClockSkew = time.Hour
+
+// Errors returned by Message.Validate.
+var (
+	// ErrUnknownType is returned for a message of an unknown MsgType.
+	ErrUnknownType = errors.New("unknown message type")
+	// ErrPayloadTooLarge is returned for a payload longer than
+	// the length field of the header can describe.
+	ErrPayloadTooLarge = errors.New("payload too large")
+	// ErrClockSkew is returned for a timestamp before the unix epoch
+	// or too far in the future.
+	ErrClockSkew = errors.New("timestamp out of range")
+	// ErrUnexpectedToken is returned for a message other than
+	// a control message carrying a token, which would leak it.
+	ErrUnexpectedToken = errors.New("token on non-control message")
+)
+
+// Header layout: type, payload length, timestamp in unix milliseconds,
+// flags, time to live in milliseconds if FlagTTL is set, channel ID
+// if FlagChannel is set, 1 reserved byte, message ID and token. The
+// payload length covers the metadata preceding it if FlagMetadata is set.
+// Reserved bytes are zero on send and ignored on receive,
+// except by strict servers, see ServerOptions.Strict.
+const (
+	offType     = 0
+	offLen      = 1
+	offTS       = 5
+	offFlags    = 13
+	offTTL      = 14
+	offChan     = 18
+	offReserved = 20
+	offID       = 21
+	offTok      = 37
+	hdrLen      = 53
+)
+
+// Message is a single chat message exchanged over a session.
+// Zero ID and Timestamp are filled in when the message is sent.
+type Message struct {
+	Type      MsgType
+	Flags     Flag
+	ID        [16]byte
+	Timestamp time.Time
+	Token     [16]byte
+	Payload   []byte
+	// TTL is how long the message may be delivered after it is received,
+	// with millisecond precision. Zero means it never expires.
+	TTL time.Duration
+	// Channel is the logical channel of the message, see Session.Channel.
+	Channel uint16
+	// Flush overrides how the session writer flushes the message,
+	// see FlushMode. It is not sent.
+	Flush FlushMode
+
+	// received is when the message was read from a session.
+	received time.Time
+	// peer is the public key of the sender of a decrypted message.
+	peer []byte
+	// frame is the encoded message shared by its copies, see encode.
+	frame []byte
+	// original is the timestamp replaced because of clock skew.
+	original time.Time
+	// contentType and filename are the metadata of the payload.
+	contentType, filename string
+}
+
+// Source provides randomness for message IDs and the clock for timestamps.
+// Replacing it makes IDs and timestamps deterministic, e.g. in tests.
+type Source struct {
+	Rand io.Reader
+	Now  func() time.Time
+	// IDs, if set, generates the message IDs instead of Rand.
+	IDs IDGenerator
+}
+
+// DefaultSource reads IDs from crypto/rand and timestamps from the system clock.
+// It stamps the messages of NewTextMessage and the other constructors. The
+// messages sent without an ID get theirs from the source of the session,
+// see ServerOptions.IDGenerator and ClientOptions.IDGenerator.
+var DefaultSource = Source{Rand: rand.Reader, Now: time.Now}
+
+// NewText creates a text message with the given payload.
+//
+// Deprecated: Use NewTextMessage, which NewText calls.
+func NewText(pld []byte) *Message {
+	return NewTextMessage(pld)
+}
+
+// NewTextMessage creates a text message with the given payload,
+// stamped with a new ID and the current time.
+func NewTextMessage(pld []byte) *Message {
+	return stamped(&Message{Type: MsgTypeText, Payload: pld})
+}
+
+// NewBinaryMessage creates a binary message with the given payload,
+// stamped with a new ID and the current time.
+func NewBinaryMessage(pld []byte) *Message {
+	return stamped(&Message{Type: MsgTypeBinary, Payload: pld})
+}
+
+// NewControlMessage creates a control message of the command followed
+// by its space separated arguments, stamped with a new ID and the current time.
+func NewControlMessage(cmd string, args ...[]byte) *Message {
+	pld := []byte(cmd)
+	for _, arg := range args {
+		pld = append(append(pld, ' '), arg...)
+	}
+	return stamped(&Message{Type: MsgTypeControl, Payload: pld})
+}
+
+// stamped stamps m from DefaultSource. A message it fails to stamp is
+// left without an ID and timestamp, for the session sending it to stamp.
+func stamped(m *Message) *Message {
+	_ = m.Stamp(DefaultSource)
+	return m
+}
+
+// SetFlag sets or clears the flag.
+func (m *Message) SetFlag(f Flag, on bool) {
+	if on {
+		m.Flags |= f
+	} else {
+		m.Flags &^= f
+	}
+}
+
+// HasFlag reports whether the flag is set.
+func (m *Message) HasFlag(f Flag) bool {
+	return m.Flags&f == f
+}
+
+// SetTTL sets the time to live of the message.
+func (m *Message) SetTTL(d time.Duration) {
+	m.TTL = max(d, 0)
+}
+
+// Expired reports whether the TTL of the message has passed at now.
+// It counts from the time the message was received rather than
+// its sender's timestamp, so that clock skew between peers does not matter.
+func (m *Message) Expired(now time.Time) bool {
+	if m.TTL <= 0 {
+		return false
+	}
+	base := m.received
+	if base.IsZero() {
+		base = m.Timestamp
+	}
+	return !base.IsZero() && !now.Before(base.Add(m.TTL))
+}
+
+// remaining returns the TTL left at now for a received message.
+func (m *Message) remaining(now time.Time) time.Duration {
+	if m.TTL <= 0 || m.received.IsZero() {
+		return m.TTL
+	}
+	return m.received.Add(m.TTL).Sub(now)
+}
+
+// Validate checks that m can be framed and sent as is: its type and
+// critical flags are known, its payload fits the header, its timestamp
+// is not more than an hour ahead and only a control message carries
+// a token. A zero ID and Timestamp are valid, they are filled in on send.
+// Session.Send validates messages before queueing them.
+func (m *Message) Validate() error {
+	if m.Type > MsgTypeAck {
+		return fmt.Errorf("%w: %d", ErrUnknownType, m.Type)
+	}
+	if unknown := m.Flags &^ knownFlags & FlagCritical; unknown != 0 {
+		return fmt.Errorf("%w: %#02x", ErrUnknownFlag, byte(unknown))
+	}
+	if uint64(m.metadataLen()+len(m.Payload)) > math.MaxUint32 {
+		return fmt.Errorf("%w: %d bytes", ErrPayloadTooLarge, len(m.Payload))
+	}
+	if !m.Timestamp.IsZero() {
+		if m.Timestamp.UnixMilli() < 0 || m.Timestamp.After(time.Now().Add(maxClockSkew)) {
+			return fmt.Errorf("%w: %s", ErrClockSkew, m.Timestamp.Format(time.RFC3339))
+		}
+	}
+	if m.Token != [16]byte{} && m.Type != MsgTypeControl {
+		return ErrUnexpectedToken
+	}
+	return nil
+}
+
+// Stamp fills in a zero ID and Timestamp from src.
+func (m *Message) Stamp(src Source) error {
+	return m.stamp(src, nil)
+}
+
+// stamp is Stamp taking IDs from buf, see Source.newID.
+func (m *Message) stamp(src Source, buf *ids) error {
+	if m.ID == [16]byte{} {
+		if err := src.newID(&m.ID, buf); err != nil {
+			return err
+		}
+	}
+	if m.Timestamp.IsZero() {
+		m.Timestamp = src.Now().UTC()
+	}
+	return nil
+}
+
+func (m *Message) header() (hdr [hdrLen]byte) {
+	m.putHeader(&hdr)
+	return hdr
+}
+
+// putHeader frames the header of m into hdr.
+func (m *Message) putHeader(hdr *[hdrLen]byte) {
+	*hdr = [hdrLen]byte{}
+	hdr[offType] = byte(m.Type)
+	binary.BigEndian.PutUint32(hdr[offLen:], uint32(m.metadataLen()+len(m.Payload)))
+	binary.BigEndian.PutUint64(hdr[offTS:], uint64(m.Timestamp.UnixMilli()))
+	hdr[offFlags] = byte(m.Flags &^ (FlagTTL | FlagChannel | FlagMetadata))
+	if m.hasMetadata() {
+		hdr[offFlags] |= byte(FlagMetadata)
+	}
+	if m.TTL > 0 {
+		hdr[offFlags] |= byte(FlagTTL)
+		ms := min(max(m.TTL.Milliseconds(), 1), math.MaxUint32)
+		binary.BigEndian.PutUint32(hdr[offTTL:], uint32(ms))
+	}
+	if m.Channel != 0 {
+		hdr[offFlags] |= byte(FlagChannel)
+		binary.BigEndian.PutUint16(hdr[offChan:], m.Channel)
+	}
+	copy(hdr[offID:], m.ID[:])
+	copy(hdr[offTok:], m.Token[:])
+}
+
+// WriteTo writes the framed message to w. It implements io.WriterTo.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	var hdr [hdrLen]byte
+	return m.writeTo(w, &hdr)
+}
+
+// writeTo is WriteTo framing the header into hdr.
+func (m *Message) writeTo(w io.Writer, hdr *[hdrLen]byte) (int64, error) {
+	m.putHeader(hdr)
+	if m.framed(hdr) {
+		n, err := w.Write(m.frame)
+		return int64(n), err
+	}
+	n, err := w.Write(hdr[:])
+	if err != nil {
+		return int64(n), err
+	}
+	if m.hasMetadata() {
+		nm, err := w.Write(m.appendMetadata(nil))
+		n += nm
+		if err != nil {
+			return int64(n), err
+		}
+	}
+	np, err := w.Write(m.Payload)
+	return int64(n + np), err
+}
+
+// encode frames m once into a buffer its payload then points into,
+// so that its copies sent to many sessions share the bytes.
+func (m *Message) encode() {
+	off := hdrLen + m.metadataLen()
+	frame := make([]byte, off+len(m.Payload))
+	m.putHeader((*[hdrLen]byte)(frame))
+	m.appendMetadata(frame[hdrLen:hdrLen])
+	copy(frame[off:], m.Payload)
+	m.frame = frame
+	m.Payload = frame[off:len(frame):len(frame)]
+}
+
+// framed reports whether the frame encoded before is still that of m,
+// which is not the case once its header changed, e.g. by the TTL left,
+// or its payload was replaced.
+func (m *Message) framed(hdr *[hdrLen]byte) bool {
+	off := hdrLen + m.metadataLen()
+	return len(m.frame) == off+len(m.Payload) && [hdrLen]byte(m.frame) == *hdr &&
+		(len(m.Payload) == 0 || &m.Payload[0] == &m.frame[off])
+}
+
+// ReadFrom reads exactly one framed message from r into m.
+// It implements io.ReaderFrom.
+func (m *Message) ReadFrom(r io.Reader) (int64, error) {
+	var hdr [hdrLen]byte
+	return m.readFrom(r, &hdr, 0)
+}
+
+// readFrom is ReadFrom reading the header into hdr and refusing a payload
+// larger than limit bytes with ErrPayloadTooLarge before reading it, zero
+// meaning no limit. The stream is out of sync then.
+func (m *Message) readFrom(r io.Reader, hdr *[hdrLen]byte, limit int) (int64, error) {
+	n, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return int64(n), err
+	}
+	m.parseHeader(hdr)
+	// Grow the payload as it arrives rather than trusting the declared length.
+	size := int64(binary.BigEndian.Uint32(hdr[offLen:]))
+	if limit > 0 && size > int64(limit) {
+		return int64(n), fmt.Errorf("%w: %d bytes, limit %d", ErrPayloadTooLarge, size, limit)
+	}
+	m.Payload, err = readPayload(r, size)
+	np := int64(len(m.Payload))
+	// The payload is consumed first so the stream stays in sync.
+	if unknown := m.Flags &^ knownFlags & FlagCritical; err == nil && unknown != 0 {
+		err = fmt.Errorf("%w: %#02x", ErrUnknownFlag, byte(unknown))
+	}
+	if err == nil && m.HasFlag(FlagMetadata) {
+		err = m.splitMetadata()
+	}
+	return int64(n) + np, err
+}
+
+// parseHeader sets the fields of m framed in hdr, but for the payload.
+func (m *Message) parseHeader(hdr *[hdrLen]byte) {
+	m.Type = MsgType(hdr[offType])
+	m.Flags = Flag(hdr[offFlags])
+	m.frame = nil
+	m.TTL = 0
+	if m.HasFlag(FlagTTL) {
+		m.TTL = time.Duration(binary.BigEndian.Uint32(hdr[offTTL:])) * time.Millisecond
+	}
+	m.Channel = 0
+	if m.HasFlag(FlagChannel) {
+		m.Channel = binary.BigEndian.Uint16(hdr[offChan:])
+	}
+	m.contentType, m.filename = "", ""
+	m.Timestamp = time.UnixMilli(int64(binary.BigEndian.Uint64(hdr[offTS:])))
+	m.ID = [16]byte(hdr[offID:])
+	m.Token = [16]byte(hdr[offTok:])
+}
+
+// readMessage reads the next message from r.
+func readMessage(r io.Reader) (*Message, error) {
+	return readLimited(r, 0)
+}
+
+// readLimited reads the next message from r with a payload
+// of at most limit bytes, see readFrom.
+func readLimited(r io.Reader, limit int) (*Message, error) {
+	var hdr [hdrLen]byte
+	m := new(Message)
+	if _, err := m.readFrom(r, &hdr, limit); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeControl writes a control message with the token and payload to w.
+func writeControl(w io.Writer, src Source, tok [16]byte, pld []byte) error {
+	m := &Message{Type: MsgTypeControl, Token: tok, Payload: pld}
+	if err := m.Stamp(src); err != nil {
+		return err
+	}
+	_, err := m.WriteTo(w)
+	return err
+}
+
+// rcvMessage reads the next message from the session stream until ctx
+// is done and records when it was received.
+func (s *Session) rcvMessage(ctx context.Context) (*Message, error) {
+	m, err := s.readFrame(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.received = s.src.Now()
+	s.lastRecv.Store(m.received.UnixNano())
+	s.traffic.received(m)
+	s.transcribe(TranscriptReceived, m)
+	return m, nil
+}
+
+// expired reports whether m has expired, counting it in the server stats.
+func (s *Session) expired(m *Message) bool {
+	if !m.Expired(s.src.Now()) {
+		return false
+	}
+	if s.srv != nil {
+		s.srv.mtx.Lock()
+		s.srv.expired++
+		s.srv.mtx.Unlock()
+	}
+	s.lgr.With("id", m.ID).Debug("dropping expired message")
+	return true
+}
+
+// sendMessage queues m for the session writer at the default
+// priority of its type and waits until it is written.
+func (s *Session) sendMessage(m *Message) error {
+	return s.enqueue(context.Background(), m, m.Type.priority())
+}
+
+// post queues m for the session writer without waiting for it to be
+// written. The returned channel receives the outcome of the write.
+func (s *Session) post(m *Message, prio Priority) <-chan error {
+	s.writer.Do(func() { go s.writeLoop() })
+	req := &writeReq{ctx: s.ctx, m: m, done: make(chan error, 1)}
+	s.outq.push(req, prio)
+	return req.done
+}
+
+// enqueue queues m for the session writer and waits until it is written
+// or ctx is done. A message whose ctx is done before its turn is not written.
+func (s *Session) enqueue(ctx context.Context, m *Message, prio Priority) error {
+	s.writer.Do(func() { go s.writeLoop() })
+	req := &writeReq{ctx: ctx, m: m, done: make(chan error, 1)}
+	s.outq.push(req, prio)
+	select {
+	case err := <-req.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeLoop frames queued messages and writes them to the session stream,
+// filling in a zero ID and Timestamp, until the stream is closed.
+// Frames to be coalesced are collected in a batch written at once.
+func (s *Session) writeLoop() {
+	defer s.trackPump()()
+	done := s.stream.Context().Done()
+	var b batch
+	for {
+		req, ok := s.outq.pop(done, b.wait())
+		if !ok {
+			err := s.peerReset(context.Cause(s.stream.Context()))
+			b.fail(err)
+			s.outq.fail(err)
+			return
+		}
+		if req == nil {
+			// the coalescing window has passed
+			s.flush(&b)
+			continue
+		}
+		if req.m == nil {
+			// CloseSend, everything queued before has been written
+			s.flush(&b)
+			req.done <- s.stream.Close()
+			continue
+		}
+		if err := req.ctx.Err(); err != nil {
+			req.done <- err
+			continue
+		}
+		if s.expired(req.m) {
+			req.done <- nil
+			continue
+		}
+		if s.wlim.Load() != nil {
+			s.flush(&b)
+		}
+		if err := s.throttle(req, done); err != nil {
+			req.done <- err
+			continue
+		}
+		if err := req.m.stamp(s.source(), &s.codec.ids); err != nil {
+			req.done <- err
+			continue
+		}
+		// A relayed message carries on with the TTL it has left.
+		m := *req.m
+		m.TTL = m.remaining(s.src.Now())
+		if s.srv == nil && s.HasCapability(CapTokenFrames) {
+			m.Token = s.currentToken()
+		}
+		if m.hasMetadata() && s.supports(CapMetadata) != nil {
+			// the peer would drop the frame for its critical flag
+			m.contentType, m.filename = "", ""
+		}
+		if s.coalesce(req.m) {
+			if b.add(&s.codec, req, &m) {
+				s.flush(&b)
+			}
+			continue
+		}
+		s.flush(&b)
+		n, err := s.write(req.ctx, func() (int, error) {
+			n, err := s.codec.writeTo(s.stream, &m)
+			return int(n), err
+		})
+		req.done <- s.written(&m, int64(n), err)
+	}
+}
+
+// written does the bookkeeping of a frame of m written to the stream
+// and returns the error of the write, see peerReset.
+func (s *Session) written(m *Message, n int64, err error) error {
+	s.traffic.sent(m, n)
+	if err == nil {
+		s.transcribe(TranscriptSent, m)
+		s.lastSend.Store(s.src.Now().UnixNano())
+		if s.srv != nil && s.srv.replay != nil && !s.anonymous() {
+			s.srv.replay.retain(s.currentToken(), m)
+		}
+	}
+	// an interrupted write has aborted the session already
+	if err != nil && n > 0 && !errors.Is(err, os.ErrDeadlineExceeded) {
+		s.lgr.With("error", err).Error("frame written partly, aborting session")
+		s.Abort(codes.Internal)
+	}
+	return s.peerReset(err)
+}
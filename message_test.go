@@ -0,0 +1,205 @@
+package chat_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+)
+
+// epoch is the first timestamp of the deterministic sources of tests.
+var epoch = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestStampDeterministic(t *testing.T) {
+	src := chattest.Source(epoch, time.Second)
+	var ms [2]chat.Message
+	for i := range ms {
+		if err := ms[i].Stamp(src); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantIDs := [2]string{"0102030405060708090a0b0c0d0e0f10", "1112131415161718191a1b1c1d1e1f20"}
+	for i, m := range ms {
+		if id := hex.EncodeToString(m.ID[:]); id != wantIDs[i] {
+			t.Errorf("message %d ID %s, want %s", i, id, wantIDs[i])
+		}
+		if want := epoch.Add(time.Duration(i) * time.Second); !m.Timestamp.Equal(want) {
+			t.Errorf("message %d timestamp %v, want %v", i, m.Timestamp, want)
+		}
+	}
+}
+
+func TestStampKeepsSetFields(t *testing.T) {
+	m := chat.Message{ID: [16]byte{0xff}, Timestamp: epoch.Add(time.Hour)}
+	if err := m.Stamp(chattest.Source(epoch, time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != [16]byte{0xff} || !m.Timestamp.Equal(epoch.Add(time.Hour)) {
+		t.Errorf("stamp replaced ID %x and timestamp %v", m.ID, m.Timestamp)
+	}
+}
+
+func TestEncodeStamped(t *testing.T) {
+	m := &chat.Message{Type: chat.MsgTypeText, Payload: []byte("hello")}
+	if err := m.Stamp(chattest.Source(epoch, time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "01" + "00000005" + "000001941f297c00" + "00" + "00000000000000" +
+		"0102030405060708090a0b0c0d0e0f10" + "00000000000000000000000000000000" +
+		"68656c6c6f"
+	if got := hex.EncodeToString(buf.Bytes()); got != want {
+		t.Errorf("encoded\n%s, want\n%s", got, want)
+	}
+}
+
+func TestMessageStream(t *testing.T) {
+	ms := []*chat.Message{
+		chat.NewTextMessage([]byte("first")),
+		chat.NewBinaryMessage(nil),
+		chat.NewControlMessage("ping", []byte("x")),
+	}
+	var buf bytes.Buffer
+	var sizes []int64
+	for _, m := range ms {
+		n, err := m.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, n)
+	}
+	// Each ReadFrom takes exactly one frame off the stream.
+	for i, want := range ms {
+		var got chat.Message
+		n, err := got.ReadFrom(&buf)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if n != sizes[i] {
+			t.Errorf("message %d read %d bytes, wrote %d", i, n, sizes[i])
+		}
+		if got.Type != want.Type || !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("message %d read %v %q, want %v %q", i, got.Type, got.Payload, want.Type, want.Payload)
+		}
+	}
+	var m chat.Message
+	if _, err := m.ReadFrom(&buf); !errors.Is(err, io.EOF) {
+		t.Errorf("read past the stream: %v, want io.EOF", err)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	var m chat.Message
+	m.SetFlag(chat.FlagAckRequested, true)
+	m.SetFlag(chat.FlagHistory, true)
+	m.SetFlag(chat.FlagHistory, false)
+	if !m.HasFlag(chat.FlagAckRequested) || m.HasFlag(chat.FlagHistory) {
+		t.Errorf("flags %#02x, want %#02x", byte(m.Flags), byte(chat.FlagAckRequested))
+	}
+	if err := m.Validate(); err != nil {
+		t.Errorf("validate known flags: %v", err)
+	}
+	m.SetFlag(0x80, true)
+	if err := m.Validate(); !errors.Is(err, chat.ErrUnknownFlag) {
+		t.Errorf("validate unknown critical flag: %v, want %v", err, chat.ErrUnknownFlag)
+	}
+}
+
+func TestUnknownCriticalFlagKeepsSync(t *testing.T) {
+	var buf bytes.Buffer
+	bad := chat.NewTextMessage([]byte("first"))
+	bad.Flags = 0x80
+	next := chat.NewTextMessage([]byte("second"))
+	for _, m := range []*chat.Message{bad, next} {
+		if _, err := m.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var m chat.Message
+	if _, err := m.ReadFrom(&buf); !errors.Is(err, chat.ErrUnknownFlag) {
+		t.Fatalf("read: %v, want %v", err, chat.ErrUnknownFlag)
+	}
+	if _, err := m.ReadFrom(&buf); err != nil || string(m.Payload) != "second" {
+		t.Errorf("read next: %q, %v", m.Payload, err)
+	}
+}
+
+func TestConstructors(t *testing.T) {
+	before := time.Now()
+	for _, tt := range []struct {
+		m       *chat.Message
+		typ     chat.MsgType
+		payload string
+	}{
+		{chat.NewTextMessage([]byte("hi")), chat.MsgTypeText, "hi"},
+		{chat.NewBinaryMessage([]byte{1, 2}), chat.MsgTypeBinary, "\x01\x02"},
+		{chat.NewControlMessage("subscribe", []byte("room.*"), []byte("x")), chat.MsgTypeControl, "subscribe room.* x"},
+		{chat.NewControlMessage("ping"), chat.MsgTypeControl, "ping"},
+	} {
+		m := tt.m
+		if m.Type != tt.typ || string(m.Payload) != tt.payload {
+			t.Errorf("message of type %d with %q, want %d with %q", m.Type, m.Payload, tt.typ, tt.payload)
+		}
+		if m.ID == ([16]byte{}) || m.Timestamp.Before(before.Truncate(time.Millisecond)) || m.Timestamp.Location() != time.UTC {
+			t.Errorf("%q stamped with %x at %v", m.Payload, m.ID, m.Timestamp)
+		}
+		if err := m.Validate(); err != nil {
+			t.Errorf("%q invalid: %v", m.Payload, err)
+		}
+	}
+	if a, b := chat.NewTextMessage(nil), chat.NewTextMessage(nil); a.ID == b.ID {
+		t.Error("constructors share an ID")
+	}
+	// the deprecated NewText is NewTextMessage
+	if m := chat.NewText(nil); m.ID == ([16]byte{}) || m.Timestamp.IsZero() {
+		t.Error("NewText left unstamped")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		modify func(m *chat.Message)
+		want   error
+	}{
+		{"unknown type", func(m *chat.Message) { m.Type = chat.MsgTypeAck + 1 }, chat.ErrUnknownType},
+		{"unknown critical flag", func(m *chat.Message) { m.Flags = 0x80 }, chat.ErrUnknownFlag},
+		{"timestamp ahead", func(m *chat.Message) { m.Timestamp = time.Now().Add(2 * time.Hour) }, chat.ErrClockSkew},
+		{"timestamp before 1970", func(m *chat.Message) { m.Timestamp = time.Unix(-1, 0) }, chat.ErrClockSkew},
+		{"token on text", func(m *chat.Message) { m.Token = [16]byte{1} }, chat.ErrUnexpectedToken},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := chat.NewTextMessage([]byte("hi"))
+			tt.modify(m)
+			if err := m.Validate(); !errors.Is(err, tt.want) {
+				t.Errorf("validate: %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// a control message may carry a token
+	m := chat.NewControlMessage("login")
+	m.Token = [16]byte{1}
+	if err := m.Validate(); err != nil {
+		t.Errorf("validate: %v", err)
+	}
+}
+
+func TestSendValidates(t *testing.T) {
+	_, addr, ca := startServer(t, discard)
+	c := connect(t, addr, ca)
+	m := chat.NewTextMessage([]byte("hi"))
+	m.Type = chat.MsgTypeAck + 1
+	if err := c.SendMessage(context.Background(), m); !errors.Is(err, chat.ErrUnknownType) {
+		t.Errorf("send: %v, want ErrUnknownType", err)
+	}
+}
@@ -0,0 +1,151 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// maxMetadata is the longest content type and filename in bytes,
+// as their length is framed in a byte.
+const maxMetadata = 255
+
+// ErrInvalidMetadata is returned for a content type or filename which is
+// too long or malformed, and for a frame whose metadata is.
+var ErrInvalidMetadata = errors.New("invalid metadata")
+
+// SetContentType sets the MIME type of the payload, e.g. "image/png",
+// telling the receiver whether to show it inline or offer a download.
+// An empty ct clears it. It must parse as a media type and be at most
+// 255 bytes long. Metadata is framed in FlagMetadata frames, it is not
+// encrypted by Session.SendEncrypted.
+func (m *Message) SetContentType(ct string) error {
+	if err := checkContentType(ct); err != nil {
+		return err
+	}
+	m.contentType = ct
+	m.frame = nil
+	return nil
+}
+
+// SetFilename sets the name of the file the payload is the content of.
+// An empty name clears it. It must be a base name of at most 255 bytes,
+// without path separators or control characters.
+func (m *Message) SetFilename(name string) error {
+	if err := checkFilename(name); err != nil {
+		return err
+	}
+	m.filename = name
+	m.frame = nil
+	return nil
+}
+
+// ContentType returns the MIME type of the payload, empty if not set.
+func (m *Message) ContentType() string {
+	return m.contentType
+}
+
+// Filename returns the name of the file the payload is the content of,
+// empty if not set.
+func (m *Message) Filename() string {
+	return m.filename
+}
+
+// NewFileMessage creates a binary message of the content of the file at
+// path, with its base name as Filename and its ContentType guessed from
+// the extension or else the content, stamped with a new ID and the
+// current time.
+func NewFileMessage(path string) (*Message, error) {
+	pld, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{Type: MsgTypeBinary, Payload: pld}
+	if err := m.SetFilename(filepath.Base(path)); err != nil {
+		return nil, err
+	}
+	ct := mime.TypeByExtension(filepath.Ext(path))
+	if ct == "" {
+		ct = http.DetectContentType(pld)
+	}
+	if err := m.SetContentType(ct); err != nil {
+		return nil, err
+	}
+	return stamped(m), nil
+}
+
+func checkContentType(ct string) error {
+	if ct == "" {
+		return nil
+	}
+	if len(ct) > maxMetadata {
+		return fmt.Errorf("%w: content type of %d bytes", ErrInvalidMetadata, len(ct))
+	}
+	if _, _, err := mime.ParseMediaType(ct); err != nil {
+		return fmt.Errorf("%w: content type %q: %v", ErrInvalidMetadata, ct, err)
+	}
+	return nil
+}
+
+func checkFilename(name string) error {
+	switch {
+	case name == "":
+		return nil
+	case len(name) > maxMetadata:
+		return fmt.Errorf("%w: filename of %d bytes", ErrInvalidMetadata, len(name))
+	case name == "." || name == ".." || strings.ContainsAny(name, `/\`) || strings.ContainsFunc(name, unicode.IsControl):
+		return fmt.Errorf("%w: filename %q", ErrInvalidMetadata, name)
+	}
+	return nil
+}
+
+// hasMetadata reports whether m carries metadata, framed with FlagMetadata.
+func (m *Message) hasMetadata() bool {
+	return m.contentType != "" || m.filename != ""
+}
+
+// metadataLen returns the length of the framed metadata of m.
+func (m *Message) metadataLen() int {
+	if !m.hasMetadata() {
+		return 0
+	}
+	return 2 + len(m.contentType) + len(m.filename)
+}
+
+// appendMetadata appends the framed metadata of m to b: the length of
+// the content type in a byte, the content type, the length of the
+// filename in a byte and the filename.
+func (m *Message) appendMetadata(b []byte) []byte {
+	if !m.hasMetadata() {
+		return b
+	}
+	b = append(append(b, byte(len(m.contentType))), m.contentType...)
+	return append(append(b, byte(len(m.filename))), m.filename...)
+}
+
+// splitMetadata splits the metadata framed by appendMetadata off
+// the payload of m.
+func (m *Message) splitMetadata() error {
+	pld := m.Payload
+	var fields [2]string
+	for i := range fields {
+		if len(pld) == 0 || len(pld) < 1+int(pld[0]) {
+			return fmt.Errorf("%w: truncated", ErrInvalidMetadata)
+		}
+		n := 1 + int(pld[0])
+		fields[i], pld = string(pld[1:n]), pld[n:]
+	}
+	if err := checkContentType(fields[0]); err != nil {
+		return err
+	}
+	if err := checkFilename(fields[1]); err != nil {
+		return err
+	}
+	m.contentType, m.filename, m.Payload = fields[0], fields[1], pld
+	return nil
+}
@@ -0,0 +1,114 @@
+package chat_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestFileMessage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "photo.png")
+	if err := os.WriteFile(path, []byte("\x89PNG\r\n\x1a\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan *chat.Message, 1)
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		for {
+			m, err := s.Recv(ctx)
+			if err != nil {
+				return
+			}
+			if m.Type == chat.MsgTypeBinary {
+				got <- m
+			}
+		}
+	})
+	c := connect(t, addr, ca)
+	m, err := chat.NewFileMessage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendMessage(t.Context(), m); err != nil {
+		t.Fatal(err)
+	}
+	r := receive(t, got)
+	if r.ContentType() != "image/png" || r.Filename() != "photo.png" || !bytes.Equal(r.Payload, m.Payload) {
+		t.Errorf("received %q %q of %q, want image/png photo.png of %q", r.ContentType(), r.Filename(), r.Payload, m.Payload)
+	}
+}
+
+func TestMetadataLegacyDecode(t *testing.T) {
+	const offFlags = 13
+	m := chat.NewBinaryMessage([]byte("png"))
+	if err := m.SetContentType("image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetFilename("a.png"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	for _, m := range []*chat.Message{m, chat.NewTextMessage([]byte("next"))} {
+		if _, err := m.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// to a receiver predating metadata its flag is an unknown critical one
+	frames := buf.Bytes()
+	frames[offFlags] = frames[offFlags]&^byte(chat.FlagMetadata) | 1<<7
+
+	var r chat.Message
+	if _, err := r.ReadFrom(&buf); !errors.Is(err, chat.ErrUnknownFlag) {
+		t.Errorf("decoded %q with %v, want %v", r.Payload, err, chat.ErrUnknownFlag)
+	}
+	// the length covers the metadata, so the next frame is in sync
+	if _, err := r.ReadFrom(&buf); err != nil || string(r.Payload) != "next" || r.ContentType() != "" {
+		t.Errorf("next frame %q of type %q: %v", r.Payload, r.ContentType(), err)
+	}
+}
+
+func TestMetadataLimits(t *testing.T) {
+	long := strings.Repeat("x", 256)
+	for _, tt := range []struct {
+		name string
+		set  func(*chat.Message) error
+		ok   bool
+	}{
+		{"content type", func(m *chat.Message) error { return m.SetContentType("text/plain; charset=utf-8") }, true},
+		{"longest content type", func(m *chat.Message) error { return m.SetContentType("x/" + long[:253]) }, true},
+		{"long content type", func(m *chat.Message) error { return m.SetContentType("x/" + long[:254]) }, false},
+		{"malformed content type", func(m *chat.Message) error { return m.SetContentType("not a type") }, false},
+		{"filename", func(m *chat.Message) error { return m.SetFilename("notes.txt") }, true},
+		{"longest filename", func(m *chat.Message) error { return m.SetFilename(long[:255]) }, true},
+		{"long filename", func(m *chat.Message) error { return m.SetFilename(long) }, false},
+		{"path", func(m *chat.Message) error { return m.SetFilename("../notes.txt") }, false},
+		{"control character", func(m *chat.Message) error { return m.SetFilename("notes\n.txt") }, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := chat.NewBinaryMessage(nil)
+			err := tt.set(m)
+			if tt.ok != (err == nil) || err != nil && !errors.Is(err, chat.ErrInvalidMetadata) {
+				t.Fatalf("set: %v", err)
+			}
+			if !tt.ok {
+				if m.ContentType() != "" || m.Filename() != "" {
+					t.Errorf("set to %q %q though invalid", m.ContentType(), m.Filename())
+				}
+				return
+			}
+			var buf bytes.Buffer
+			if _, err := m.WriteTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+			var r chat.Message
+			if _, err := r.ReadFrom(&buf); err != nil || r.ContentType() != m.ContentType() || r.Filename() != m.Filename() {
+				t.Errorf("decoded %q %q: %v", r.ContentType(), r.Filename(), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package chat
+
+// Metric is an occurrence reported to the MetricsHook,
+// such as a Drop or a BreakerTransition.
+type Metric interface {
+	metric()
+}
+
+// MetricsHook is called with every Metric of the server,
+// e.g. to feed a metrics system. It must not block.
+type MetricsHook func(m Metric)
+
+// Metrics sets the hook called with the metrics of the server, see MetricsHook.
+func (serverOptionsNamespace) Metrics(hook MetricsHook) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.metrics = hook
+	}
+}
+
+// metricsCallback names the MetricsHook in CallbackPanic.
+const metricsCallback = "metrics hook"
+
+// metric reports m to the MetricsHook, if any.
+func (s *Server) metric(m Metric) {
+	if s.cfg.metrics != nil {
+		_ = s.guard(metricsCallback, func() error {
+			s.cfg.metrics(m)
+			return nil
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zhmlst/chat/codes"
+)
+
+// mute is the state of a session muted by Server.Mute.
+type mute struct {
+	mtx    sync.Mutex
+	until  time.Time
+	reason string
+	// dropped counts the messages dropped while muted.
+	dropped uint64
+}
+
+// Mute drops the text and binary messages and the edits of the session
+// with the given ID for d, without disconnecting it. Other control
+// messages still flow. The session is sent a NoticeEvent with the reason
+// and the time left, as for every message dropped, and the mute expires
+// on its own, see Unmute to lift it early. Muting a muted session
+// replaces its mute. The dropped messages are counted in Stats.Muted.
+func (s *Server) Mute(id uint64, d time.Duration, reason string) error {
+	if d <= 0 {
+		return fmt.Errorf("mute duration %s is not positive", d)
+	}
+	s.mtx.Lock()
+	session, ok := s.sessions[id]
+	s.mtx.Unlock()
+	if !ok {
+		return ErrSessionNotFound
+	}
+	session.mute.mtx.Lock()
+	session.mute.until = s.cfg.src.Now().Add(d)
+	session.mute.reason = reason
+	session.mute.mtx.Unlock()
+	session.lgr.With("duration", d, "reason", reason).Info("session muted")
+	session.muteNotice(session.ctx, d, reason)
+	return nil
+}
+
+// Unmute lifts the mute of the session with the given ID, telling it
+// with a NoticeEvent. Unmuting a session which is not muted does nothing.
+func (s *Server) Unmute(id uint64) error {
+	s.mtx.Lock()
+	session, ok := s.sessions[id]
+	s.mtx.Unlock()
+	if !ok {
+		return ErrSessionNotFound
+	}
+	if _, _, ok := session.Muted(); !ok {
+		return nil
+	}
+	session.mute.mtx.Lock()
+	session.mute.until, session.mute.reason = time.Time{}, ""
+	session.mute.mtx.Unlock()
+	session.lgr.Info("session unmuted")
+	if err := session.SendError(session.ctx, codes.PolicyViolation, "unmuted", "mute lifted"); err != nil {
+		session.lgr.With("error", err).Warn("failed to send unmute notice")
+	}
+	return nil
+}
+
+// Muted returns until when the session is muted and why, see Server.Mute.
+// ok is false if it is not muted or the mute expired, so that filters and
+// handlers can tell.
+func (s *Session) Muted() (until time.Time, reason string, ok bool) {
+	s.mute.mtx.Lock()
+	defer s.mute.mtx.Unlock()
+	if s.mute.until.IsZero() {
+		return time.Time{}, "", false
+	}
+	if !s.src.Now().Before(s.mute.until) {
+		s.mute.until, s.mute.reason = time.Time{}, ""
+		s.lgr.Info("mute expired")
+		return time.Time{}, "", false
+	}
+	return s.mute.until, s.mute.reason, true
+}
+
+// muted reports whether m is a text or binary message of a muted session,
+// counting and dropping it with a notice to the session.
+func (s *Server) muted(ctx context.Context, session *Session, m *Message) bool {
+	if m.Type != MsgTypeText && m.Type != MsgTypeBinary {
+		return false
+	}
+	until, reason, ok := session.Muted()
+	if !ok {
+		return false
+	}
+	session.mute.mtx.Lock()
+	session.mute.dropped++
+	session.mute.mtx.Unlock()
+	s.mtx.Lock()
+	s.mutedDropped++
+	s.mtx.Unlock()
+	session.lgr.With("id", m.ID).Debug("dropping message of muted session")
+	session.muteNotice(ctx, until.Sub(s.cfg.src.Now()), reason)
+	return true
+}
+
+// muteNotice tells the session it is muted for left because of reason.
+func (s *Session) muteNotice(ctx context.Context, left time.Duration, reason string) {
+	msg := "muted for " + left.Round(time.Second).String()
+	if reason != "" {
+		msg += ": " + reason
+	}
+	if err := s.SendError(ctx, codes.PolicyViolation, "muted", msg); err != nil {
+		s.lgr.With("error", err).Warn("failed to send mute notice")
+	}
+}
+
+// mutedDropped returns the number of messages dropped while muted.
+func (s *Session) mutedDropped() uint64 {
+	s.mute.mtx.Lock()
+	defer s.mute.mtx.Unlock()
+	return s.mute.dropped
+}
@@ -0,0 +1,150 @@
+package chat_test
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+// muting is a client of a hub with a session to mute, observed by
+// another member of the hub.
+type muting struct {
+	srv *chat.Server
+	s   *chat.Session
+	c   *chat.Client
+	// before is the message the client sent before any mute.
+	before *chat.Message
+	// notices are received by the client, texts and events relayed by
+	// the hub by the observer.
+	notices <-chan chat.NoticeEvent
+	texts   <-chan *chat.Message
+	events  <-chan chat.Event
+}
+
+// muteHub starts a hub on clk, connecting a client and an observer to it.
+func muteHub(t *testing.T, clk *manualClock) muting {
+	t.Helper()
+	hub := chat.NewHub()
+	sessions := make(chan *chat.Session, 2)
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		sessions <- s
+		hub.Serve(ctx, s)
+	}, chat.ServerOptions.Source(chat.Source{Rand: rand.Reader, Now: clk.Now}))
+	notices := make(chan chat.NoticeEvent, 4)
+	joined := make(chan struct{}, 1)
+	c := connect(t, addr, ca, chat.ClientOptions.OnEvent(func(e chat.Event) {
+		switch e := e.(type) {
+		case chat.NoticeEvent:
+			notices <- e
+		case chat.PresenceEvent:
+			joined <- struct{}{}
+		}
+	}))
+	s := receive(t, sessions)
+	_, events, texts := member(t, addr, ca)
+	receive(t, joined)
+
+	before := chat.NewTextMessage([]byte("before"))
+	if err := c.SendMessage(t.Context(), before); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, texts); m.ID != before.ID {
+		t.Fatalf("received %q, want before", m.Payload)
+	}
+	return muting{srv: srv, s: s, c: c, before: before, notices: notices, texts: texts, events: events}
+}
+
+func TestMute(t *testing.T) {
+	clk := &manualClock{now: time.Now()}
+	mt := muteHub(t, clk)
+	srv, s, c, notices := mt.srv, mt.s, mt.c, mt.notices
+	if err := srv.Mute(s.ID(), 5*time.Minute, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if n := receive(t, notices); n.Reason != "muted" || n.Message != "muted for 5m0s: spam" {
+		t.Errorf("notice %+v", n)
+	}
+	if _, reason, ok := s.Muted(); !ok || reason != "spam" {
+		t.Errorf("muted %v for %q, want for spam", ok, reason)
+	}
+
+	// dropped with a notice of the time left
+	clk.Add(time.Minute)
+	send(t, c, "during")
+	if n := receive(t, notices); n.Reason != "muted" || n.Message != "muted for 4m0s: spam" {
+		t.Errorf("notice %+v", n)
+	}
+	// edits too
+	if err := c.SendMessage(t.Context(), edit(mt.before.ID, "edited")); err != nil {
+		t.Fatal(err)
+	}
+	if n := receive(t, notices); n.Reason != "muted" {
+		t.Errorf("notice %+v", n)
+	}
+	if n := s.Stats().Muted; n != 2 {
+		t.Errorf("%d messages counted as muted, want 2", n)
+	}
+	if n := srv.Stats().Muted; n != 2 {
+		t.Errorf("server counted %d messages as muted, want 2", n)
+	}
+
+	// delivered once the mute expired
+	clk.Add(4 * time.Minute)
+	if _, _, ok := s.Muted(); ok {
+		t.Error("muted past expiry")
+	}
+	send(t, c, "after")
+	if m := receive(t, mt.texts); string(m.Payload) != "after" {
+		t.Errorf("received %q, want after", m.Payload)
+	}
+	select {
+	case n := <-notices:
+		t.Errorf("notice %+v after expiry", n)
+	default:
+	}
+	// nothing sent during the mute was relayed ahead of it
+	for len(mt.events) > 0 {
+		if e, ok := (<-mt.events).(chat.EditEvent); ok {
+			t.Errorf("edit to %q relayed", e.Payload)
+		}
+	}
+}
+
+func TestUnmute(t *testing.T) {
+	clk := &manualClock{now: time.Now()}
+	mt := muteHub(t, clk)
+	srv, s, c, notices := mt.srv, mt.s, mt.c, mt.notices
+	if err := srv.Unmute(s.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Mute(s.ID(), time.Hour, ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := receive(t, notices); n.Message != "muted for 1h0m0s" {
+		t.Errorf("notice %+v", n)
+	}
+	if err := srv.Unmute(s.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if n := receive(t, notices); n.Reason != "unmuted" {
+		t.Errorf("notice %+v, want unmuted", n)
+	}
+	send(t, c, "lifted")
+	if m := receive(t, mt.texts); string(m.Payload) != "lifted" {
+		t.Errorf("received %q, want lifted", m.Payload)
+	}
+
+	if err := srv.Mute(s.ID(), 0, ""); err == nil {
+		t.Error("muted for no time")
+	}
+	for _, err := range []error{srv.Mute(math.MaxUint64, time.Minute, ""), srv.Unmute(math.MaxUint64)} {
+		if !errors.Is(err, chat.ErrSessionNotFound) {
+			t.Errorf("unknown session: %v, want %v", err, chat.ErrSessionNotFound)
+		}
+	}
+}
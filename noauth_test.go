@@ -0,0 +1,41 @@
+package chat_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestNoAuthCombinations(t *testing.T) {
+	tests := []struct {
+		name           string
+		server, client bool
+		err            error
+	}{
+		{name: "both authenticate"},
+		{name: "open server, open client", server: true, client: true},
+		{name: "open server, authenticating client", server: true},
+		{name: "authenticating server, open client", client: true, err: chat.ErrAuthRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sopts []chat.ServerOption
+			if tt.server {
+				sopts = append(sopts, chat.ServerOptions.NoAuth())
+			}
+			var copts []chat.ClientOption
+			if tt.client {
+				copts = append(copts, chat.ClientOptions.NoAuth())
+			}
+			_, addr, ca := startServer(t, discard, sopts...)
+			err := dial(t, newClient(t, addr, ca, copts...))
+			if tt.err == nil && err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("dial: %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package chat_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+func TestNotice(t *testing.T) {
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		if err := s.SendError(ctx, codes.PolicyViolation, "too_long", "message rejected: too long"); err != nil {
+			return
+		}
+		if err := s.Send(ctx, chat.NewTextMessage([]byte("still here"))); err != nil {
+			return
+		}
+		discard(ctx, s)
+	})
+	notices := make(chan chat.NoticeEvent, 1)
+	texts := make(chan string, 2)
+	connect(t, addr, ca,
+		chat.ClientOptions.OnEvent(func(e chat.Event) {
+			if e, ok := e.(chat.NoticeEvent); ok {
+				notices <- e
+			}
+		}),
+		chat.ClientOptions.OnMessage(func(m *chat.Message) { texts <- string(m.Payload) }),
+	)
+
+	want := chat.NoticeEvent{Code: codes.PolicyViolation, Reason: "too_long", Message: "message rejected: too long"}
+	if got := receive(t, notices); got != want {
+		t.Errorf("notice %+v, want %+v", got, want)
+	}
+	// the notice is not chat text and the session goes on
+	if text := receive(t, texts); text != "still here" {
+		t.Errorf("received %q, want %q", text, "still here")
+	}
+}
@@ -0,0 +1,92 @@
+// Package webhook provides a chat.OfflineNotifier posting
+// message summaries to an HTTP endpoint.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+// Summary is the JSON body posted for every offline message.
+type Summary struct {
+	Recipient string    `json:"recipient"`
+	ID        string    `json:"id"`
+	Type      byte      `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	Size      int       `json:"size"`
+	// Payload is set only with Options.IncludePayload.
+	Payload []byte `json:"payload,omitempty"`
+}
+
+type config struct {
+	client  *http.Client
+	payload bool
+}
+
+// Option applies option to webhook notifier.
+type Option func(cfg *config)
+
+// Options provides available options for webhook notifier.
+var Options optionsNamespace
+
+type optionsNamespace struct{}
+
+// Client sets the HTTP client posting summaries, one with a timeout of
+// ten seconds by default.
+func (optionsNamespace) Client(client *http.Client) Option {
+	return func(cfg *config) {
+		cfg.client = client
+	}
+}
+
+// IncludePayload adds the message payload to the posted summary.
+func (optionsNamespace) IncludePayload() Option {
+	return func(cfg *config) {
+		cfg.payload = true
+	}
+}
+
+// New creates a notifier posting a Summary to url for every offline message.
+func New(url string, opts ...Option) chat.OfflineNotifier {
+	cfg := config{client: &http.Client{Timeout: 10 * time.Second}}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return func(ctx context.Context, recipient [16]byte, m *chat.Message) error {
+		sum := Summary{
+			Recipient: hex.EncodeToString(recipient[:]),
+			ID:        hex.EncodeToString(m.ID[:]),
+			Type:      byte(m.Type),
+			Timestamp: m.Timestamp,
+			Size:      len(m.Payload),
+		}
+		if cfg.payload {
+			sum.Payload = m.Payload
+		}
+		body, err := json.Marshal(sum)
+		if err != nil {
+			return fmt.Errorf("marshal summary: %w", err)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := cfg.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("post summary: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("post summary: unexpected status %s", resp.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,151 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+	"github.com/zhmlst/chat/notify/webhook"
+)
+
+// hook is an endpoint recording the summaries posted to it.
+type hook struct {
+	mtx    sync.Mutex
+	sums   []webhook.Summary
+	posted chan struct{}
+}
+
+func newHook(t *testing.T) (*hook, string) {
+	h := &hook{posted: make(chan struct{}, 8)}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s with content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		var sum webhook.Summary
+		if err := json.NewDecoder(r.Body).Decode(&sum); err != nil {
+			t.Errorf("decode summary: %v", err)
+		}
+		h.mtx.Lock()
+		h.sums = append(h.sums, sum)
+		h.mtx.Unlock()
+		h.posted <- struct{}{}
+	}))
+	t.Cleanup(ts.Close)
+	return h, ts.URL
+}
+
+// wait returns the first n summaries posted, in the order they were.
+func (h *hook) wait(t *testing.T, n int) []webhook.Summary {
+	t.Helper()
+	for range n {
+		select {
+		case <-h.posted:
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing posted")
+		}
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return slices.Clone(h.sums[:n])
+}
+
+func discard(ctx context.Context, s *chat.Session) {
+	for {
+		if _, err := s.Recv(ctx); err != nil {
+			return
+		}
+	}
+}
+
+// serve dials c in the background until it is connected.
+func serve(t *testing.T, c *chat.Client, connected <-chan struct{}) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- c.Dial(context.Background()) }()
+	t.Cleanup(func() { _ = c.Close() })
+	select {
+	case <-connected:
+	case err := <-done:
+		t.Fatalf("dial: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial timed out")
+	}
+	return done
+}
+
+func TestOfflineNotification(t *testing.T) {
+	h, url := newHook(t)
+	addr, ca := chattest.StartServer(t, chat.NewHub().Serve,
+		chat.ServerOptions.MessageStore(chat.NewMemMessageStore()),
+		chat.ServerOptions.OfflineNotifier(webhook.New(url)),
+	)
+
+	connected := make(chan struct{}, 1)
+	onConnect := chat.ClientOptions.OnConnect(func() { connected <- struct{}{} })
+	recipient := chattest.NewClient(t, addr, ca, onConnect)
+	done := serve(t, recipient, connected)
+	tok, err := recipient.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := make(chan struct{}, 1)
+	sender := chattest.NewClient(t, addr, ca, onConnect, chat.ClientOptions.OnEvent(func(e chat.Event) {
+		if e, ok := e.(chat.PresenceEvent); ok && !e.Online {
+			left <- struct{}{}
+		}
+	}))
+	serve(t, sender, connected)
+	if err := recipient.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	select {
+	case <-left:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recipient did not leave the hub")
+	}
+
+	ctx := context.Background()
+	var ids []string
+	for range 2 {
+		m := chat.NewTextMessage([]byte("secret"))
+		if err := sender.SendMessage(ctx, m); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		ids = append(ids, hex.EncodeToString(m.ID[:]))
+	}
+	// notifications run concurrently, in no particular order
+	for _, sum := range h.wait(t, len(ids)) {
+		if sum.Recipient != hex.EncodeToString(tok[:]) || !slices.Contains(ids, sum.ID) {
+			t.Errorf("summary of %s for %s, want one of %s for %x", sum.ID, sum.Recipient, ids, tok)
+		}
+		ids = slices.DeleteFunc(ids, func(id string) bool { return id == sum.ID })
+		if sum.Payload != nil || sum.Size != len("secret") || sum.Type != byte(chat.MsgTypeText) {
+			t.Errorf("summary %+v", sum)
+		}
+	}
+	select {
+	case <-h.posted:
+		t.Error("a message was notified twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestIncludePayload(t *testing.T) {
+	h, url := newHook(t)
+	notify := webhook.New(url, webhook.Options.IncludePayload())
+	if err := notify(context.Background(), [16]byte{1}, chat.NewTextMessage([]byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	if sum := h.wait(t, 1)[0]; string(sum.Payload) != "hello" {
+		t.Errorf("payload %q, want %q", sum.Payload, "hello")
+	}
+}
@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// MessageStore keeps messages for recipients which are offline,
+// identified by their tokens. Expired messages are dropped when drained.
+type MessageStore interface {
+	Enqueue(ctx context.Context, recipient [16]byte, m *Message) error
+	// Drain removes and returns the messages stored for the recipient in order.
+	Drain(ctx context.Context, recipient [16]byte) ([]*Message, error)
+}
+
+// OfflineNotifier is called once for every message stored for an offline recipient.
+// It runs in its own goroutine, so retries are up to the implementation.
+type OfflineNotifier func(ctx context.Context, recipient [16]byte, m *Message) error
+
+// MemMessageStore is an in-memory MessageStore.
+type MemMessageStore struct {
+	mtx  sync.Mutex
+	msgs map[[16]byte][]*Message
+}
+
+// NewMemMessageStore creates an empty in-memory MessageStore.
+func NewMemMessageStore() *MemMessageStore {
+	return &MemMessageStore{msgs: make(map[[16]byte][]*Message)}
+}
+
+// Enqueue appends the message to the recipient's queue.
+func (s *MemMessageStore) Enqueue(_ context.Context, recipient [16]byte, m *Message) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.msgs[recipient] = append(s.msgs[recipient], m)
+	return nil
+}
+
+// Drain removes and returns the recipient's queue.
+func (s *MemMessageStore) Drain(_ context.Context, recipient [16]byte) ([]*Message, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	msgs := s.msgs[recipient]
+	delete(s.msgs, recipient)
+	return msgs, nil
+}
+
+// storeOffline stores the message sent by the session for the recipient and notifies about it.
+// The sender is nil for messages relayed by a peer.
+func (s *Server) storeOffline(ctx context.Context, sender *Session, recipient [16]byte, m *Message) error {
+	if s.cfg.store == nil {
+		return nil
+	}
+	stored := *m
+	if stored.received.IsZero() {
+		// its TTL counts from now for a message not read from a session
+		stored.received = s.cfg.src.Now()
+	}
+	if err := s.cfg.store.Enqueue(ctx, recipient, &stored); err != nil {
+		return fmt.Errorf("enqueue offline message: %w", err)
+	}
+	if s.cfg.notifier != nil {
+		ctx, lgr := s.ctx, s.cfg.logger
+		if sender != nil {
+			ctx, lgr = withSession(ctx, sender), sender.lgr
+		}
+		go func() {
+			err := s.guard("offline notifier", func() error {
+				return s.cfg.notifier(ctx, recipient, &stored)
+			})
+			if err != nil {
+				lgr.With("error", err).Warn("failed to notify offline recipient")
+			}
+		}()
+	}
+	return nil
+}
+
+// deliverOffline sends the messages stored for the session's token
+// and returns the IDs of those delivered.
+func (s *Server) deliverOffline(ctx context.Context, session *Session) ([][16]byte, error) {
+	if s.cfg.store == nil {
+		return nil, nil
+	}
+	msgs, err := s.cfg.store.Drain(ctx, session.currentToken())
+	if err != nil {
+		return nil, fmt.Errorf("drain offline messages: %w", err)
+	}
+	ids := make([][16]byte, 0, len(msgs))
+	for _, m := range msgs {
+		if session.expired(m) {
+			continue
+		}
+		if err = session.Send(ctx, m); err != nil {
+			return ids, fmt.Errorf("send offline message: %w", err)
+		}
+		ids = append(ids, m.ID)
+	}
+	return ids, nil
+}
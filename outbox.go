@@ -0,0 +1,436 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// recordHdrLen is the length of the header of a spool record:
+	// the state byte followed by the length of the frame.
+	recordHdrLen = 5
+	// spoolCompact is the size of the removed records at the start
+	// of a spool file from which it is rewritten.
+	spoolCompact = 1 << 20
+)
+
+// States of spool records.
+const (
+	recordLive byte = iota
+	recordRemoved
+)
+
+// QueueStore keeps the messages a client sends while it is disconnected,
+// oldest first, see ClientOptions.Outbox. The client serializes its calls.
+type QueueStore interface {
+	// Push appends the message.
+	Push(m *Message) error
+	// Front returns the oldest message, nil if the store is empty.
+	Front() (*Message, error)
+	// Pop removes the oldest message.
+	Pop() error
+	Len() (int, error)
+}
+
+// Outbox makes Send keep messages in a QueueStore while the client is
+// disconnected, up to limit messages, dropping the oldest one when full.
+// They are sent in order after the client connects, ahead of messages
+// sent later. A message is removed once written, or once acknowledged
+// if it asks for an ack, so the next one waits for the ack. Delivery is
+// at least once: a message whose removal a crash prevented is sent again,
+// a message at most once more for every crash, see SessionOptions.Dedupe.
+// Messages are kept in a FileQueueStore at the token file path with
+// an .outbox suffix unless OutboxStore is set.
+func (clientOptionsNamespace) Outbox(limit int) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.outbox = limit
+	}
+}
+
+// OutboxStore sets the store of the Outbox in place of the spool file.
+func (clientOptionsNamespace) OutboxStore(store QueueStore) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.queue = store
+	}
+}
+
+// outbox is the queue of messages sent while disconnected.
+type outbox struct {
+	limit int
+
+	mtx   sync.Mutex
+	store QueueStore
+	// awaiting is the ID of the message whose ack is waited for, acked
+	// is closed once it arrives.
+	awaiting [16]byte
+	acked    chan struct{}
+	// kick wakes the drain up when a message is pushed.
+	kick chan struct{}
+}
+
+func newOutbox(store QueueStore, limit int) *outbox {
+	return &outbox{store: store, limit: limit, kick: make(chan struct{}, 1)}
+}
+
+// push keeps the message if the client is disconnected or older messages
+// are waiting, dropping the oldest one if the outbox is full. It reports
+// whether the message was kept.
+func (o *outbox) push(m *Message, connected bool, lgr Logger) (bool, error) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	n, err := o.store.Len()
+	if err != nil {
+		return false, err
+	}
+	if connected && n == 0 {
+		return false, nil
+	}
+	if n >= o.limit {
+		if err := o.store.Pop(); err != nil {
+			return false, err
+		}
+		lgr.With("limit", o.limit).Warn("outbox full, dropping oldest message")
+	}
+	if err := o.store.Push(m); err != nil {
+		return false, err
+	}
+	select {
+	case o.kick <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+func (o *outbox) front() (*Message, error) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.store.Front()
+}
+
+// pop removes the message with id unless it was dropped meanwhile.
+func (o *outbox) pop(id [16]byte) error {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	m, err := o.store.Front()
+	if err != nil || m == nil || m.ID != id {
+		return err
+	}
+	return o.store.Pop()
+}
+
+// await returns a channel closed once the message with id is acknowledged.
+func (o *outbox) await(id [16]byte) <-chan struct{} {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.awaiting, o.acked = id, make(chan struct{})
+	return o.acked
+}
+
+// receipt ends the wait for an ack it contains.
+func (o *outbox) receipt(rcpt Receipt) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	for _, id := range rcpt.IDs {
+		if o.acked != nil && id == o.awaiting {
+			close(o.acked)
+			o.awaiting, o.acked = [16]byte{}, nil
+			return
+		}
+	}
+}
+
+// Pending returns the number of messages in the outbox waiting to be
+// sent, zero without ClientOptions.Outbox.
+func (c *Client) Pending() int {
+	if c.outbox == nil {
+		return 0
+	}
+	c.outbox.mtx.Lock()
+	defer c.outbox.mtx.Unlock()
+	n, err := c.outbox.store.Len()
+	if err != nil {
+		c.cfg.logger.With("error", err).Error("failed to count outbox messages")
+		return 0
+	}
+	return n
+}
+
+// spool keeps the message in the outbox if the client should not send
+// it right away, reporting whether it did.
+func (c *Client) spool(m *Message, connected bool) (bool, error) {
+	if c.outbox == nil {
+		return false, nil
+	}
+	if err := m.Validate(); err != nil {
+		return false, err
+	}
+	if err := m.Stamp(c.cfg.src); err != nil {
+		return false, err
+	}
+	kept, err := c.outbox.push(m, connected, c.cfg.logger)
+	if err != nil {
+		return false, fmt.Errorf("failed to keep message in outbox: %w", err)
+	}
+	return kept, nil
+}
+
+// drain sends the messages of the outbox in order until ctx is done
+// or sending fails, waiting for more to be pushed when it is empty.
+func (c *Client) drain(ctx context.Context, session *Session) {
+	o := c.outbox
+	for {
+		m, err := o.front()
+		if err != nil {
+			c.cfg.logger.With("error", err).Error("failed to read outbox")
+			return
+		}
+		if m == nil {
+			select {
+			case <-o.kick:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		var acked <-chan struct{}
+		if m.HasFlag(FlagAckRequested) {
+			acked = o.await(m.ID)
+		}
+		if err := session.Send(ctx, m); err != nil {
+			c.cfg.logger.With("error", err).Debug("failed to send outbox message")
+			return
+		}
+		if acked != nil {
+			select {
+			case <-acked:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := o.pop(m.ID); err != nil {
+			c.cfg.logger.With("error", err).Error("failed to remove outbox message")
+			return
+		}
+	}
+}
+
+// FileQueueStore is a QueueStore keeping messages in a spool file of
+// length-prefixed records. Removing a message marks its record, so that
+// a crash cannot bring back more than the message being removed, and the
+// file is truncated once all records are removed. A record torn by
+// a crash while it was appended is discarded. A file is used by one
+// store at a time.
+type FileQueueStore struct {
+	mtx  sync.Mutex
+	path string
+	// offs holds the offsets of the live records, loaded with the first use.
+	offs   []int64
+	size   int64
+	loaded bool
+}
+
+// NewFileQueueStore returns a store keeping messages in the named file.
+func NewFileQueueStore(path string) *FileQueueStore {
+	return &FileQueueStore{path: path}
+}
+
+// Path returns the name of the spool file of the store.
+func (f *FileQueueStore) Path() string {
+	return f.path
+}
+
+// Push appends the message to the spool file.
+func (f *FileQueueStore) Push(m *Message) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.load(); err != nil {
+		return err
+	}
+	var frame bytes.Buffer
+	if _, err := m.WriteTo(&frame); err != nil {
+		return err
+	}
+	rec := make([]byte, recordHdrLen, recordHdrLen+frame.Len())
+	rec[0] = recordLive
+	binary.BigEndian.PutUint32(rec[1:], uint32(frame.Len()))
+	rec = append(rec, frame.Bytes()...)
+	dir := filepath.Dir(f.path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to mkdir %s for spool file: %w", dir, err)
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open spool file: %w", err)
+	}
+	defer file.Close()
+	if _, err = file.WriteAt(rec, f.size); err != nil {
+		return fmt.Errorf("failed to write spool file: %w", err)
+	}
+	if err = file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync spool file: %w", err)
+	}
+	f.offs = append(f.offs, f.size)
+	f.size += int64(len(rec))
+	return nil
+}
+
+// Front returns the oldest message of the spool file.
+func (f *FileQueueStore) Front() (*Message, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	if len(f.offs) == 0 {
+		return nil, nil
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spool file: %w", err)
+	}
+	defer file.Close()
+	m, _, err := readRecord(io.NewSectionReader(file, f.offs[0], f.size-f.offs[0]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool file: %w", err)
+	}
+	return m, nil
+}
+
+// Pop marks the record of the oldest message removed.
+func (f *FileQueueStore) Pop() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.load(); err != nil {
+		return err
+	}
+	if len(f.offs) == 0 {
+		return nil
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open spool file: %w", err)
+	}
+	defer file.Close()
+	if _, err = file.WriteAt([]byte{recordRemoved}, f.offs[0]); err != nil {
+		return fmt.Errorf("failed to write spool file: %w", err)
+	}
+	if err = file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync spool file: %w", err)
+	}
+	f.offs = f.offs[1:]
+	switch {
+	case len(f.offs) == 0:
+		if err = file.Truncate(0); err != nil {
+			return fmt.Errorf("failed to truncate spool file: %w", err)
+		}
+		f.offs, f.size = nil, 0
+	case f.offs[0] >= spoolCompact && f.offs[0] > f.size-f.offs[0]:
+		return f.compact()
+	}
+	return nil
+}
+
+// Len returns the number of messages in the spool file.
+func (f *FileQueueStore) Len() (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	return len(f.offs), nil
+}
+
+// load reads the offsets of the live records once, cutting off a torn record.
+func (f *FileQueueStore) load() error {
+	if f.loaded {
+		return nil
+	}
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		f.loaded = true
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read spool file: %w", err)
+	}
+	var off int64
+	for off < int64(len(data)) {
+		_, n, err := readRecord(bytes.NewReader(data[off:]))
+		if err != nil {
+			break
+		}
+		if data[off] == recordLive {
+			f.offs = append(f.offs, off)
+		}
+		off += n
+	}
+	if off < int64(len(data)) {
+		if err := os.Truncate(f.path, off); err != nil {
+			return fmt.Errorf("failed to truncate spool file: %w", err)
+		}
+	}
+	f.size = off
+	f.loaded = true
+	return nil
+}
+
+// compact replaces the spool file with its live records.
+func (f *FileQueueStore) compact() error {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to read spool file: %w", err)
+	}
+	head := f.offs[0]
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create spool file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data[head:f.size]); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write spool file: %w", err)
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to sync spool file: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close spool file: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to replace spool file: %w", err)
+	}
+	for i := range f.offs {
+		f.offs[i] -= head
+	}
+	f.size -= head
+	return nil
+}
+
+// readRecord reads a spool record, returning its message and length.
+func readRecord(r io.Reader) (*Message, int64, error) {
+	var hdr [recordHdrLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, 0, err
+	}
+	if hdr[0] != recordLive && hdr[0] != recordRemoved {
+		return nil, 0, fmt.Errorf("invalid record state %d", hdr[0])
+	}
+	size := int64(binary.BigEndian.Uint32(hdr[1:]))
+	m := new(Message)
+	n, err := m.ReadFrom(io.LimitReader(r, size))
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return m, recordHdrLen + size, nil
+}
@@ -0,0 +1,89 @@
+package chat_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+// received returns a handler reporting the text messages it receives.
+func received() (chat.Handler, <-chan string) {
+	got := make(chan string, 8)
+	return func(ctx context.Context, s *chat.Session) {
+		for {
+			m, err := s.Recv(ctx)
+			if err != nil {
+				return
+			}
+			if m.Type == chat.MsgTypeText {
+				got <- string(m.Payload)
+			}
+		}
+	}, got
+}
+
+func TestOutboxRestart(t *testing.T) {
+	h, got := received()
+	_, addr, ca := startServer(t, h)
+	spool := filepath.Join(t.TempDir(), "spool")
+	outbox := func() []chat.ClientOption {
+		return []chat.ClientOption{
+			chat.ClientOptions.Outbox(8),
+			chat.ClientOptions.OutboxStore(chat.NewFileQueueStore(spool)),
+		}
+	}
+
+	// composed offline, then the app exits
+	offline := newClient(t, addr, ca, outbox()...)
+	for _, text := range []string{"1", "2", "3"} {
+		send(t, offline, text)
+	}
+	if n := offline.Pending(); n != 3 {
+		t.Fatalf("%d pending, want 3", n)
+	}
+
+	restarted := newClient(t, addr, ca, outbox()...)
+	if n := restarted.Pending(); n != 3 {
+		t.Fatalf("%d pending after the restart, want 3", n)
+	}
+	if err := dial(t, restarted); err != nil {
+		t.Fatal(err)
+	}
+	send(t, restarted, "4")
+	for _, want := range []string{"1", "2", "3", "4"} {
+		if text := receive(t, got); text != want {
+			t.Errorf("received %q, want %q", text, want)
+		}
+	}
+	eventually(t, func() bool { return restarted.Pending() == 0 })
+
+	// sent messages are gone from the spool
+	if n := newClient(t, addr, ca, outbox()...).Pending(); n != 0 {
+		t.Errorf("%d pending after delivery, want 0", n)
+	}
+}
+
+func TestOutboxLimit(t *testing.T) {
+	h, got := received()
+	_, addr, ca := startServer(t, h)
+	c := newClient(t, addr, ca,
+		chat.ClientOptions.Outbox(2),
+		chat.ClientOptions.OutboxStore(chat.NewFileQueueStore(filepath.Join(t.TempDir(), "spool"))))
+	for _, text := range []string{"1", "2", "3"} {
+		send(t, c, text)
+	}
+	if n := c.Pending(); n != 2 {
+		t.Fatalf("%d pending, want the limit of 2", n)
+	}
+	if err := dial(t, c); err != nil {
+		t.Fatal(err)
+	}
+	// the oldest was dropped
+	for _, want := range []string{"2", "3"} {
+		if text := receive(t, got); text != want {
+			t.Errorf("received %q, want %q", text, want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+// panicky is a handler panicking on the first message.
+func panicky(ctx context.Context, s *chat.Session) {
+	if _, err := s.Recv(ctx); err != nil {
+		return
+	}
+	panic("boom")
+}
+
+func TestHandlerPanic(t *testing.T) {
+	type report struct {
+		s         *chat.Session
+		recovered any
+		stack     []byte
+	}
+	reports := make(chan report, 1)
+	_, addr, ca := startServer(t, panicky, chat.ServerOptions.OnPanic(func(_ context.Context, s *chat.Session, recovered any, stack []byte) {
+		reports <- report{s, recovered, stack}
+	}))
+	c := newClient(t, addr, ca)
+	done := serve(t, c)
+	send(t, c, "hi")
+
+	var cerr *chat.CloseError
+	if err := receive(t, done); !errors.As(err, &cerr) || cerr.Code != codes.Internal {
+		t.Errorf("dial: %v, want close code %s", err, codes.Internal)
+	}
+	r := receive(t, reports)
+	if r.recovered != "boom" || r.s == nil {
+		t.Errorf("hook got %v for session %v", r.recovered, r.s)
+	}
+	if !strings.Contains(string(r.stack), "chat_test.panicky") {
+		t.Errorf("stack lacks the handler:\n%s", r.stack)
+	}
+}
+
+func TestHandlerPanicWithoutHook(t *testing.T) {
+	_, addr, ca := startServer(t, panicky)
+	c := newClient(t, addr, ca)
+	done := serve(t, c)
+	send(t, c, "hi")
+	var cerr *chat.CloseError
+	if err := receive(t, done); !errors.As(err, &cerr) || cerr.Code != codes.Internal {
+		t.Errorf("dial: %v, want close code %s", err, codes.Internal)
+	}
+}
+
+func TestFilterPanic(t *testing.T) {
+	const limit = 2
+	panics := make(chan chat.CallbackPanic, limit+1)
+	var rec recorder
+	h, got := received()
+	srv, addr, ca := startServer(t, h,
+		chat.ServerOptions.InboundFilter(func(_ context.Context, _ *chat.Session, m *chat.Message) (*chat.Message, error) {
+			if string(m.Payload) == "boom" {
+				panic("filter bug")
+			}
+			return m, nil
+		}),
+		chat.ServerOptions.SessionOptions(chat.SessionOptions.CallbackPanicLimit(limit)),
+		chat.ServerOptions.Logger(rec.log),
+		chat.ServerOptions.Metrics(func(m chat.Metric) {
+			if p, ok := m.(chat.CallbackPanic); ok {
+				panics <- p
+			}
+		}))
+	c := connect(t, addr, ca)
+
+	for i := range limit {
+		send(t, c, "boom")
+		p := receive(t, panics)
+		if p.Callback != "inbound filter" || p.Session == nil || p.Disabled != (i == limit-1) {
+			t.Errorf("panic %d reported as %+v", i, p)
+		}
+		if i == limit-1 {
+			break
+		}
+		// dropped, the session goes on
+		send(t, c, "fine")
+		if text := receive(t, got); text != "fine" {
+			t.Errorf("received %q, want fine", text)
+		}
+	}
+	if n := srv.Stats().CallbackPanics; n != limit {
+		t.Errorf("%d panics counted, want %d", n, limit)
+	}
+
+	// disabled for the session, messages are dropped
+	send(t, c, "fine")
+	send(t, connect(t, addr, ca), "other session")
+	if text := receive(t, got); text != "other session" {
+		t.Errorf("received %q from a session with the filter disabled", text)
+	}
+	select {
+	case text := <-got:
+		t.Errorf("received %q", text)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	var stacks, disabled int
+	for _, l := range rec.recorded() {
+		switch {
+		case l.msg == "panic in callback" && strings.Contains(fmt.Sprint(l.attrs["stack"]), "TestFilterPanic"):
+			stacks++
+		case l.lvl == chat.LogLevelError && l.msg == "callback keeps panicking, disabled for the session":
+			disabled++
+		}
+	}
+	if stacks != limit || disabled != 1 {
+		t.Errorf("%d panics logged with their stack, %d disabled, want %d and 1", stacks, disabled, limit)
+	}
+}
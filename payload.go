@@ -0,0 +1,78 @@
+package chat
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// defaultMaxPayload is the default largest payload a peer accepts.
+const defaultMaxPayload = 1 << 20
+
+// CapMaxPayload is the capability carrying the largest payload in bytes
+// its side accepts as the size parameter. Each side sends at most the
+// size of the other, see Session.MaxSendSize.
+const CapMaxPayload = "max-payload"
+
+// MaxPayloadSize sets the largest payload the server accepts from
+// clients, 1MiB by default. Clients are told in the handshake and
+// sessions receiving a larger frame are aborted with codes.FrameTooLarge.
+// Zero lifts the limit.
+func (serverOptionsNamespace) MaxPayloadSize(n int) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.maxPayload = n
+	}
+}
+
+// MaxPayloadSize sets the largest payload the client accepts from the
+// server, 1MiB by default, like ServerOptions.MaxPayloadSize.
+func (clientOptionsNamespace) MaxPayloadSize(n int) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.maxPayload = n
+	}
+}
+
+// payloadCapability returns the capability offering the limit, if any.
+func payloadCapability(limit int) []Capability {
+	if limit <= 0 {
+		return nil
+	}
+	return []Capability{{Name: CapMaxPayload, Params: map[string]string{"size": strconv.Itoa(limit)}}}
+}
+
+// maxPayload returns the limit offered by the peer among its capabilities,
+// fallback if it offered none, as peers predating the exchange do.
+func maxPayload(offered []Capability, fallback int) int {
+	for _, c := range offered {
+		if c.Name != CapMaxPayload {
+			continue
+		}
+		if n, err := strconv.Atoi(c.Params["size"]); err == nil && n > 0 {
+			return n
+		}
+	}
+	return fallback
+}
+
+// setMaxPayload sets the limits of the session: its own for receiving
+// and that offered by the peer for sending.
+func (s *Session) setMaxPayload(own int, offered []Capability) {
+	s.maxRecv = max(own, 0)
+	s.maxSend = maxPayload(offered, s.maxRecv)
+}
+
+// MaxSendSize returns the largest payload the peer accepts, as negotiated
+// in the handshake, or the limit of the session itself if the peer did not
+// tell. Send fails with ErrPayloadTooLarge for larger payloads without
+// writing anything, so applications may split them up front. Zero means
+// no limit.
+func (s *Session) MaxSendSize() int {
+	return s.maxSend
+}
+
+// checkSize checks the payload of m against the limit of the peer.
+func (s *Session) checkSize(m *Message) error {
+	if n := m.metadataLen() + len(m.Payload); s.maxSend > 0 && n > s.maxSend {
+		return fmt.Errorf("%w: %d bytes, peer accepts %d", ErrPayloadTooLarge, n, s.maxSend)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package chat_test
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+const (
+	serverLimit = 64 << 10
+	clientLimit = 1 << 10
+)
+
+// payloadServer starts a server accepting serverLimit bytes which passes
+// its sessions to the first channel and the sizes of the payloads they
+// receive to the second.
+func payloadServer(t *testing.T) (<-chan *chat.Session, <-chan int, string, *x509.CertPool) {
+	t.Helper()
+	sessions := make(chan *chat.Session, 1)
+	sizes := make(chan int, 4)
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		sessions <- s
+		for {
+			m, err := s.Recv(ctx)
+			if err != nil {
+				return
+			}
+			sizes <- len(m.Payload)
+		}
+	}, chat.ServerOptions.MaxPayloadSize(serverLimit), chat.ServerOptions.StreamHandler(discard))
+	return sessions, sizes, addr, ca
+}
+
+func TestMaxPayloadAsymmetric(t *testing.T) {
+	sessions, sizes, addr, ca := payloadServer(t)
+	got := make(chan int, 4)
+	c := connect(t, addr, ca, chat.ClientOptions.MaxPayloadSize(clientLimit),
+		chat.ClientOptions.OnMessage(func(m *chat.Message) { got <- len(m.Payload) }))
+	s := receive(t, sessions)
+
+	// server to client, within the limit of the client
+	if n := s.MaxSendSize(); n != clientLimit {
+		t.Errorf("server sends up to %d, want %d", n, clientLimit)
+	}
+	if err := s.Send(t.Context(), chat.NewBinaryMessage(make([]byte, clientLimit+1))); !errors.Is(err, chat.ErrPayloadTooLarge) {
+		t.Errorf("server send: %v, want ErrPayloadTooLarge", err)
+	}
+	// nothing of the refused message went out
+	if err := s.Send(t.Context(), chat.NewBinaryMessage(make([]byte, clientLimit))); err != nil {
+		t.Fatal(err)
+	}
+	if n := receive(t, got); n != clientLimit {
+		t.Errorf("client received %d bytes, want %d", n, clientLimit)
+	}
+
+	// client to server, within the limit of the server
+	stream, err := c.NewSession(t.Context(), "limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := stream.MaxSendSize(); n != serverLimit {
+		t.Errorf("client sends up to %d, want %d", n, serverLimit)
+	}
+	if err := c.SendMessage(t.Context(), chat.NewBinaryMessage(make([]byte, serverLimit+1))); !errors.Is(err, chat.ErrPayloadTooLarge) {
+		t.Errorf("client send: %v, want ErrPayloadTooLarge", err)
+	}
+	// beyond what the client itself accepts
+	if err := c.SendMessage(t.Context(), chat.NewBinaryMessage(make([]byte, serverLimit))); err != nil {
+		t.Fatal(err)
+	}
+	if n := receive(t, sizes); n != serverLimit {
+		t.Errorf("server received %d bytes, want %d", n, serverLimit)
+	}
+}
+
+func TestMaxPayloadLegacy(t *testing.T) {
+	// a client predating the exchange neither offers nor learns a limit
+	sessions, sizes, addr, ca := payloadServer(t)
+	c := newClient(t, addr, ca, chat.ClientOptions.MaxPayloadSize(clientLimit),
+		chat.ClientOptions.DisableCapabilities(chat.CapMaxPayload))
+	done := serve(t, c)
+	s := receive(t, sessions)
+
+	// so both sides fall back to their own limits
+	if n := s.MaxSendSize(); n != serverLimit {
+		t.Errorf("server sends up to %d, want its own %d", n, serverLimit)
+	}
+	if err := c.SendMessage(t.Context(), chat.NewBinaryMessage(make([]byte, clientLimit+1))); !errors.Is(err, chat.ErrPayloadTooLarge) {
+		t.Errorf("client send: %v, want ErrPayloadTooLarge", err)
+	}
+	if err := c.SendMessage(t.Context(), chat.NewBinaryMessage(make([]byte, clientLimit))); err != nil {
+		t.Fatal(err)
+	}
+	if n := receive(t, sizes); n != clientLimit {
+		t.Errorf("server received %d bytes, want %d", n, clientLimit)
+	}
+
+	// and the client enforces its own on receive
+	if err := s.Send(t.Context(), chat.NewBinaryMessage(make([]byte, clientLimit+1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive(t, done); !errors.Is(err, chat.ErrPayloadTooLarge) {
+		t.Errorf("dial: %v, want ErrPayloadTooLarge", err)
+	}
+}
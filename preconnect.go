@@ -0,0 +1,136 @@
+package chat
+
+import (
+	"context"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// warmConn is a connection logged in ahead by Client.Preconnect
+// and not served yet.
+type warmConn struct {
+	session *Session
+	args    handshakeArgs
+	// stop ends keepWarm once the connection is taken or dropped.
+	stop context.CancelFunc
+}
+
+// alive reports whether the connection is still open.
+func (w *warmConn) alive() bool {
+	return w.session.conn.Context().Err() == nil
+}
+
+// Preconnect dials a server and logs in ahead of need, so that the next
+// Dial serves the connection at once rather than connecting first. It
+// returns once the connection is warm, callers not wanting to wait run
+// it in a goroutine. The session is kept open with heartbeats if they
+// are negotiated. Dial connects anew if the warm connection died in the
+// meantime, and Close drops it. Preconnect does nothing if the client
+// is warm or connected already.
+func (c *Client) Preconnect(ctx context.Context) (err error) {
+	defer func() { err = categorize("preconnect", err) }()
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	c.logConfig()
+	if c.IsWarm() || c.connected() {
+		return nil
+	}
+	return c.connect(ctx, func(conn *quic.Conn) error {
+		session, args, err := c.login(ctx, conn)
+		if err != nil {
+			return err
+		}
+		wctx, stop := context.WithCancel(context.Background())
+		w := &warmConn{session: session, args: args, stop: stop}
+		c.mtx.Lock()
+		if (c.warm != nil && c.warm.alive()) || c.session != nil {
+			// a concurrent Preconnect or Dial won
+			c.mtx.Unlock()
+			stop()
+			return session.CloseSend()
+		}
+		if c.warm != nil {
+			c.warm.stop()
+		}
+		c.warm = w
+		c.mtx.Unlock()
+		if hb := session.caps.heartbeat(); hb.enabled() {
+			go session.keepWarm(wctx, hb.interval)
+		}
+		session.lgr.Info("connection warm")
+		return nil
+	})
+}
+
+// IsWarm reports whether a connection made by Preconnect is open
+// and waiting for Dial.
+func (c *Client) IsWarm() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.warm != nil && c.warm.alive()
+}
+
+// connected reports whether the client serves a session.
+func (c *Client) connected() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.session != nil
+}
+
+// takeWarm returns the warm connection for Dial to serve, nil if there
+// is none or it died.
+func (c *Client) takeWarm() *warmConn {
+	c.mtx.Lock()
+	w := c.warm
+	c.warm = nil
+	c.mtx.Unlock()
+	if w == nil {
+		return nil
+	}
+	w.stop()
+	if !w.alive() {
+		w.session.lgr.Info("warm connection died, connecting anew")
+		return nil
+	}
+	return w
+}
+
+// dropWarm closes the warm connection, reporting whether there was one.
+func (c *Client) dropWarm() bool {
+	c.mtx.Lock()
+	w := c.warm
+	c.warm = nil
+	c.mtx.Unlock()
+	if w == nil {
+		return false
+	}
+	w.stop()
+	if err := w.session.CloseSend(); err != nil {
+		w.session.lgr.With("error", err).Debug("failed to close warm session")
+	}
+	return true
+}
+
+// keepWarm pings the server every interval until ctx is done, so that
+// it keeps a session nobody reads yet open. Unlike runHeartbeat it does
+// not watch for pongs, which are only read once the session is served.
+func (s *Session) keepWarm(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// not ctx, whose end must not interrupt a ping halfway
+		pctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := s.enqueue(pctx, &Message{Type: MsgTypeControl, Payload: []byte("ping")}, PriorityHigh)
+		cancel()
+		if err != nil {
+			s.lgr.With("error", err).Debug("failed to send ping")
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package chat_test
+
+import (
+	"testing"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+func TestPreconnect(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// kill ends the warm connection, if set
+		kill       func(t *testing.T, srv *chat.Server)
+		handshakes int
+	}{
+		{"warm", nil, 1},
+		{"died", func(t *testing.T, srv *chat.Server) {
+			for _, s := range srv.Sessions() {
+				if err := srv.Disconnect(s.ID, codes.Done); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics, stats := handshakes()
+			h, got := received()
+			srv, addr, ca := startServer(t, h, metrics)
+			c := newClient(t, addr, ca)
+			if c.IsWarm() {
+				t.Fatal("warm before preconnecting")
+			}
+			if err := c.Preconnect(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+			if !c.IsWarm() {
+				t.Fatal("not warm after preconnecting")
+			}
+			receive(t, stats)
+			if tt.kill != nil {
+				tt.kill(t, srv)
+				eventually(t, func() bool { return !c.IsWarm() })
+			}
+
+			if err := dial(t, c); err != nil {
+				t.Fatal(err)
+			}
+			send(t, c, "first")
+			if text := receive(t, got); text != "first" {
+				t.Errorf("received %q, want first", text)
+			}
+			if c.IsWarm() {
+				t.Error("still warm once served")
+			}
+			// the warm connection served without dialing again
+			if n := 1 + len(stats); n != tt.handshakes {
+				t.Errorf("%d handshakes, want %d", n, tt.handshakes)
+			}
+		})
+	}
+}
+
+func TestPreconnectClose(t *testing.T) {
+	srv, addr, ca := startServer(t, discard)
+	c := newClient(t, addr, ca)
+	if err := c.Preconnect(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	// a second one keeps the warm connection
+	if err := c.Preconnect(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Sessions()); n != 1 {
+		t.Errorf("%d sessions, want the warm one", n)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c.IsWarm() {
+		t.Error("warm after closing")
+	}
+	eventually(t, func() bool { return len(srv.Sessions()) == 0 })
+}
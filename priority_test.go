@@ -0,0 +1,91 @@
+package chat_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestControlJumpsBulk(t *testing.T) {
+	const bulk = 100
+	var srv *chat.Server
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		// about a frame per 300ms, so that the bulk frames queue up
+		s.SetWriteRateLimit(500, 150)
+		var queued atomic.Int32
+		for range bulk {
+			go func() {
+				queued.Add(1)
+				_ = s.Send(ctx, chat.NewBinaryMessage(make([]byte, 100)))
+			}()
+		}
+		for queued.Load() < bulk || !throttling(srv, s.ID()) {
+			time.Sleep(time.Millisecond)
+		}
+		if err := s.SendPriority(ctx, chat.NewTextMessage([]byte("urgent")), chat.PriorityHigh); err != nil {
+			return
+		}
+		discard(ctx, s)
+	})
+	got := make(chan string, bulk+1)
+	connect(t, addr, ca, chat.ClientOptions.OnMessage(func(m *chat.Message) { got <- string(m.Payload) }))
+	for i := 0; ; i++ {
+		if receive(t, got) == "urgent" {
+			if i > 2 {
+				t.Errorf("control frame written after %d bulk frames", i)
+			}
+			return
+		}
+	}
+}
+
+// throttling reports whether the writes of the session id are delayed
+// by its write rate limit.
+func throttling(srv *chat.Server, id uint64) bool {
+	info, err := srv.SessionInfo(id)
+	return err == nil && info.Throttling
+}
+
+func TestBulkProgresses(t *testing.T) {
+	const (
+		perLevel = 60
+		// burst is the number of frames written ahead of a waiting one
+		burst = 16
+	)
+	var srv *chat.Server
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		s.SetWriteRateLimit(500, 150)
+		var queued atomic.Int32
+		for _, prio := range []chat.Priority{chat.PriorityHigh, chat.PriorityNormal, chat.PriorityLow} {
+			for range perLevel {
+				go func() {
+					queued.Add(1)
+					m := chat.NewTextMessage([]byte{byte('0' + prio)})
+					_ = s.SendPriority(ctx, m, prio)
+				}()
+			}
+		}
+		for queued.Load() < 3*perLevel || !throttling(srv, s.ID()) {
+			time.Sleep(time.Millisecond)
+		}
+		// every level saturated, the writes go on at full speed
+		s.SetWriteRateLimit(0, 0)
+		discard(ctx, s)
+	})
+	got := make(chan string, 3*perLevel)
+	connect(t, addr, ca, chat.ClientOptions.OnMessage(func(m *chat.Message) { got <- string(m.Payload) }))
+	served := make(map[string]int)
+	for range 3 * perLevel {
+		served[receive(t, got)]++
+		// every level is served once per burst of the others at the latest
+		if n := served["0"] + served["1"] + served["2"]; n == 3*(burst+1) {
+			break
+		}
+	}
+	if served["0"] < 2 || served["1"] < 2 {
+		t.Errorf("served %v of the first frames by priority, want every level served", served)
+	}
+}
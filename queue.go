@@ -0,0 +1,180 @@
+package chat
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Priority defines the order in which queued messages are written to the stream.
+type Priority int8
+
+const (
+	// PriorityLow is used for bulk traffic such as binary messages.
+	PriorityLow Priority = iota
+	// PriorityNormal is used for text messages.
+	PriorityNormal
+	// PriorityHigh is used for control messages and acks.
+	PriorityHigh
+
+	priorities = int(PriorityHigh) + 1
+)
+
+// maxBurst is how many messages of other priorities may be written in a
+// row while a message of lower priority is waiting.
+const maxBurst = 16
+
+// priority derives the default priority of a message from its type.
+func (t MsgType) priority() Priority {
+	switch t {
+	case MsgTypeControl, MsgTypeAck:
+		return PriorityHigh
+	case MsgTypeBinary:
+		return PriorityLow
+	default:
+		return PriorityNormal
+	}
+}
+
+type writeReq struct {
+	ctx  context.Context
+	m    *Message
+	done chan error
+}
+
+// sendQueue holds the messages waiting for the session writer,
+// one FIFO per priority.
+type sendQueue struct {
+	mtx    sync.Mutex
+	levels [priorities][]*writeReq
+	ready  chan struct{}
+	// starved counts the requests taken while a level was waiting.
+	starved [priorities]int
+	// fin is the request closing the send direction
+	// once all queued messages are written.
+	fin *writeReq
+	// err completes requests pushed after the writer stopped.
+	err error
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *sendQueue) push(req *writeReq, prio Priority) {
+	prio = min(max(prio, PriorityLow), PriorityHigh)
+	q.mtx.Lock()
+	if err := q.closed(); err != nil {
+		q.mtx.Unlock()
+		req.done <- err
+		return
+	}
+	q.levels[prio] = append(q.levels[prio], req)
+	q.mtx.Unlock()
+	q.wake()
+}
+
+// finish queues req to close the send direction after all queued messages.
+func (q *sendQueue) finish(req *writeReq) {
+	q.mtx.Lock()
+	if err := q.closed(); err != nil {
+		q.mtx.Unlock()
+		req.done <- err
+		return
+	}
+	q.fin = req
+	q.mtx.Unlock()
+	q.wake()
+}
+
+func (q *sendQueue) closed() error {
+	if q.err != nil {
+		return q.err
+	}
+	if q.fin != nil {
+		return ErrSendClosed
+	}
+	return nil
+}
+
+func (q *sendQueue) wake() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the highest priority request, or the request of the lower
+// level passed over most once levels were passed over maxBurst times.
+func (q *sendQueue) next() *writeReq {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	lvl := -1
+	for i := priorities - 1; i >= 0; i-- {
+		if len(q.levels[i]) == 0 {
+			q.starved[i] = 0
+		} else if lvl < 0 {
+			lvl = i
+		}
+	}
+	if lvl < 0 {
+		fin := q.fin
+		if fin != nil {
+			q.fin = nil
+			q.err = ErrSendClosed
+		}
+		return fin
+	}
+	// the lowest level wins a tie, so that every waiting level gets a turn
+	for i := range lvl {
+		if q.starved[i] >= maxBurst && q.starved[i] > q.starved[lvl] {
+			lvl = i
+		}
+	}
+	for i := range q.levels {
+		if i != lvl && len(q.levels[i]) > 0 {
+			q.starved[i]++
+		}
+	}
+	q.starved[lvl] = 0
+	req := q.levels[lvl][0]
+	q.levels[lvl][0] = nil
+	q.levels[lvl] = q.levels[lvl][1:]
+	return req
+}
+
+// pop waits for the next request until done is closed.
+// It returns a nil request once wait fires.
+func (q *sendQueue) pop(done <-chan struct{}, wait <-chan time.Time) (*writeReq, bool) {
+	for {
+		if req := q.next(); req != nil {
+			return req, true
+		}
+		select {
+		case <-q.ready:
+		case <-wait:
+			return nil, true
+		case <-done:
+			return nil, false
+		}
+	}
+}
+
+// fail completes all queued and future requests with err.
+func (q *sendQueue) fail(err error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.err == nil {
+		q.err = err
+	}
+	for i := range q.levels {
+		for _, req := range q.levels[i] {
+			req.done <- err
+		}
+		q.levels[i] = nil
+	}
+	if q.fin != nil {
+		q.fin.done <- err
+		q.fin = nil
+	}
+}
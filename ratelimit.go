@@ -0,0 +1,143 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zhmlst/chat/codes"
+)
+
+// RateLimitAction defines how the server treats a message exceeding the token rate limit.
+type RateLimitAction int8
+
+const (
+	// RateLimitDrop drops the message and warns the sender with a notice.
+	RateLimitDrop RateLimitAction = iota
+	// RateLimitDisconnect closes every session of the token with codes.RateLimited.
+	RateLimitDisconnect
+)
+
+// sweepInterval is the minimal time between removals of idle buckets.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter is a token bucket rate limiter keyed by session token,
+// or by session ID for anonymous sessions.
+type limiter[K comparable] struct {
+	rate  float64
+	burst float64
+
+	mtx     sync.Mutex
+	buckets map[K]*bucket
+	swept   time.Time
+}
+
+func newLimiter[K comparable](rate float64, burst int) *limiter[K] {
+	return &limiter[K]{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[K]*bucket),
+		swept:   time.Now(),
+	}
+}
+
+// allow reports whether one more message may pass for the key at now.
+func (l *limiter[K]) allow(key K, now time.Time) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if now.Sub(l.swept) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rekey moves the bucket of the key old to key.
+func (l *limiter[K]) rekey(old, key K) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if b, ok := l.buckets[old]; ok {
+		delete(l.buckets, old)
+		l.buckets[key] = b
+	}
+}
+
+// sweep removes buckets which have been refilled completely,
+// they are indistinguishable from absent ones.
+func (l *limiter[K]) sweep(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
+
+// allowMessage applies the token rate limit to a message received by the
+// session. Anonymous sessions have a limit of their own each.
+func (s *Server) allowMessage(ctx context.Context, session *Session) bool {
+	if s.limiter == nil {
+		return true
+	}
+	var ok bool
+	if session.anonymous() {
+		ok = s.anonymous.allow(session.id, time.Now())
+	} else {
+		ok = s.limiter.allow(session.currentToken(), time.Now())
+	}
+	if ok {
+		return true
+	}
+	lgr := session.lgr.With("op", "ratelimit")
+	detail := fmt.Sprintf("rate limit %g/s exceeded", s.cfg.rateLimit)
+	switch {
+	case s.cfg.rateLimitAction == RateLimitDisconnect && session.anonymous():
+		lgr.Warn("rate limit exceeded, disconnecting session")
+		if err := closeConn(session.conn, codes.RateLimited, detail); err != nil {
+			lgr.With("error", err).Error("failed to disconnect session")
+		}
+	case s.cfg.rateLimitAction == RateLimitDisconnect:
+		lgr.Warn("rate limit exceeded, disconnecting token sessions")
+		if err := s.disconnectToken(session.currentToken(), codes.RateLimited, detail); err != nil {
+			lgr.With("error", err).Error("failed to disconnect token sessions")
+		}
+	default:
+		lgr.Warn("rate limit exceeded, dropping message")
+		session.warnLimited()
+	}
+	return false
+}
+
+// warnLimited queues a notice of a message dropped by the rate limit
+// without waiting for it to be written, so that a peer which does not
+// read does not stall the read pump. While a notice is queued further
+// ones are skipped.
+func (s *Session) warnLimited() {
+	if s.limitWarn != nil {
+		select {
+		case <-s.limitWarn:
+		default:
+			return
+		}
+	}
+	s.limitWarn = s.post(&Message{Type: MsgTypeControl, Payload: notice(codes.RateLimited, "rate_limited", "message dropped")}, PriorityHigh)
+}
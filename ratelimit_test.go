@@ -0,0 +1,153 @@
+package chat_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+// counting returns a handler counting the messages received in n.
+func counting(n *atomic.Int64) chat.Handler {
+	return func(ctx context.Context, s *chat.Session) {
+		for {
+			if _, err := s.Recv(ctx); err != nil {
+				return
+			}
+			n.Add(1)
+		}
+	}
+}
+
+// sharedToken returns an option making clients share one token.
+func sharedToken(t *testing.T) chat.ClientOption {
+	return chat.ClientOptions.TokenFile(filepath.Join(t.TempDir(), "token"))
+}
+
+// send sends text from c, failing the test on error.
+func send(t *testing.T, c *chat.Client, text string) {
+	t.Helper()
+	if err := c.SendText(context.Background(), text); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+}
+
+func TestTokenRateLimitDrop(t *testing.T) {
+	var n atomic.Int64
+	_, addr, ca := startServer(t, counting(&n), chat.ServerOptions.TokenRateLimit(0.001, 4))
+	tok := sharedToken(t)
+	notices := [2]chan chat.NoticeEvent{make(chan chat.NoticeEvent, 4), make(chan chat.NoticeEvent, 4)}
+	var cs [2]*chat.Client
+	for i := range cs {
+		cs[i] = connect(t, addr, ca, tok, chat.ClientOptions.OnEvent(func(e chat.Event) {
+			if e, ok := e.(chat.NoticeEvent); ok {
+				notices[i] <- e
+			}
+		}))
+	}
+
+	// the connections use up the burst of the token together
+	for i := range 4 {
+		send(t, cs[i%2], "hello")
+	}
+	eventually(t, func() bool { return n.Load() == 4 })
+	for i, c := range cs {
+		send(t, c, "one too many")
+		if e := receive(t, notices[i]); e.Code != codes.RateLimited {
+			t.Errorf("client %d notice %+v, want code %s", i, e, codes.RateLimited)
+		}
+	}
+	if got := n.Load(); got != 4 {
+		t.Errorf("handler received %d messages, want 4", got)
+	}
+}
+
+func TestTokenRateLimitDisconnect(t *testing.T) {
+	var n atomic.Int64
+	_, addr, ca := startServer(t, counting(&n),
+		chat.ServerOptions.TokenRateLimit(0.001, 4),
+		chat.ServerOptions.RateLimitAction(chat.RateLimitDisconnect),
+	)
+	tok := sharedToken(t)
+	var cs [2]*chat.Client
+	var done [2]<-chan error
+	for i := range cs {
+		cs[i] = newClient(t, addr, ca, tok)
+		done[i] = serve(t, cs[i])
+	}
+
+	for i := range 5 {
+		send(t, cs[i%2], "hello")
+	}
+	for i := range cs {
+		err := receive(t, done[i])
+		var cerr *chat.CloseError
+		if !errors.As(err, &cerr) || cerr.Code != codes.RateLimited {
+			t.Errorf("client %d: %v, want close code %s", i, err, codes.RateLimited)
+		}
+	}
+}
+
+func TestGuestRateLimit(t *testing.T) {
+	var n atomic.Int64
+	_, addr, ca := startServer(t, counting(&n),
+		chat.ServerOptions.AllowGuests(),
+		chat.ServerOptions.TokenRateLimit(0.001, 2),
+	)
+	notices := [2]chan chat.NoticeEvent{make(chan chat.NoticeEvent, 4), make(chan chat.NoticeEvent, 4)}
+	var cs [2]*chat.Client
+	for i := range cs {
+		cs[i] = connect(t, addr, ca, chat.ClientOptions.Guest(), chat.ClientOptions.OnEvent(func(e chat.Event) {
+			if e, ok := e.(chat.NoticeEvent); ok {
+				notices[i] <- e
+			}
+		}))
+	}
+
+	// every guest has a burst of its own
+	for i := range 4 {
+		send(t, cs[i%2], "hello")
+	}
+	eventually(t, func() bool { return n.Load() == 4 })
+	for i, c := range cs {
+		send(t, c, "one too many")
+		if e := receive(t, notices[i]); e.Code != codes.RateLimited {
+			t.Errorf("guest %d notice %+v, want code %s", i, e, codes.RateLimited)
+		}
+	}
+	if got := n.Load(); got != 4 {
+		t.Errorf("handler received %d messages, want 4", got)
+	}
+}
+
+func TestRateLimitPeerNotReading(t *testing.T) {
+	const flood = 20000
+	var n atomic.Int64
+	_, addr, ca := startServer(t, counting(&n),
+		chat.ServerOptions.NoAuth(),
+		chat.ServerOptions.TokenRateLimit(0.001, 1),
+	)
+	_, stream := bareLogin(t, addr, ca)
+	// more notices than fit the flow control window of the stream,
+	// which the peer does not read
+	var buf bytes.Buffer
+	for range flood {
+		m := chat.NewTextMessage([]byte("x"))
+		if _, err := m.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.SetWriteDeadline(time.Now().Add(waitTimeout)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write(buf.Bytes()); err != nil {
+		t.Fatalf("flood stalled: %v", err)
+	}
+	eventually(t, func() bool { return n.Load() == 1 })
+}
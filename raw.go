@@ -0,0 +1,57 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/quic-go/quic-go"
+	"github.com/zhmlst/chat/codes"
+)
+
+// ErrProtocolMismatch is returned by handshakes between a peer running
+// raw sessions and one running the token handshake. The connection is
+// closed with codes.ProtocolError.
+var ErrProtocolMismatch = errors.New("protocol mismatch")
+
+// RawSessions skips the token handshake, the TokenRepo is never consulted.
+// The handler gets a session on the first stream of every connection right
+// after a hello exchanging the session ID and the capabilities, so that it
+// can authenticate the client itself over the framed message API.
+// Sessions are anonymous, as with guests. Clients need
+// ClientOptions.RawSessions, others are refused with codes.ProtocolError.
+func (serverOptionsNamespace) RawSessions() ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.raw = true
+	}
+}
+
+// RawSessions skips the token handshake, the mirror image of
+// ServerOptions.RawSessions, which the server needs to run with.
+// No token file is used.
+func (clientOptionsNamespace) RawSessions() ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.raw = true
+	}
+}
+
+// rawLogin sends the hello of a raw session, refusing a server expecting
+// the token handshake.
+func (c *Client) rawLogin(ctx context.Context, conn *quic.Conn, stream io.ReadWriter, hs *HandshakeStats) (handshakeArgs, error) {
+	hello := handshakeArgs{wantSID: true, caps: c.offer(), instance: c.ServerInstance()}
+	r, err := hs.exchange(ctx, stream, c.cfg.src, [16]byte{}, hello.format("raw"))
+	if err != nil {
+		return handshakeArgs{}, err
+	}
+	if err := redirection(r.Payload); err != nil {
+		return handshakeArgs{}, err
+	}
+	args, ok := admitted(r.Payload)
+	if !ok {
+		if err := closeConn(conn, codes.ProtocolError, "raw session refused"); err != nil {
+			c.cfg.logger.With("error", err).Debug("failed to close conn")
+		}
+		return handshakeArgs{}, ErrProtocolMismatch
+	}
+	return args, nil
+}
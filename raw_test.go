@@ -0,0 +1,127 @@
+package chat_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+// sign answers a challenge with the key shared out of band.
+func sign(key []byte, challenge string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(challenge))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// challenger is a handler authenticating clients itself: it sends
+// a challenge, expects it signed with key, welcomes the client and
+// then echoes what it sends.
+func challenger(key []byte) chat.Handler {
+	return func(ctx context.Context, s *chat.Session) {
+		challenge := rand.Text()
+		if err := s.Send(ctx, chat.NewTextMessage([]byte("challenge "+challenge))); err != nil {
+			return
+		}
+		m, err := s.Recv(ctx)
+		if err != nil {
+			return
+		}
+		if !hmac.Equal(m.Payload, []byte(sign(key, challenge))) {
+			s.Abort(codes.Forbidden)
+			<-ctx.Done()
+			return
+		}
+		if err := s.Send(ctx, chat.NewTextMessage([]byte("welcome"))); err != nil {
+			return
+		}
+		for {
+			m, err := s.Recv(ctx)
+			if err != nil {
+				return
+			}
+			if err := s.Send(ctx, chat.NewTextMessage(append([]byte("echo "), m.Payload...))); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// responder serves a raw client answering challenges with key and
+// returns it along with the other text messages it receives and the
+// error Dial returns.
+func responder(t *testing.T, addr string, ca *x509.CertPool, key []byte) (*chat.Client, <-chan string, <-chan error) {
+	t.Helper()
+	got := make(chan string, 4)
+	var c *chat.Client
+	c = newClient(t, addr, ca,
+		chat.ClientOptions.RawSessions(),
+		chat.ClientOptions.OnMessage(func(m *chat.Message) {
+			challenge, ok := strings.CutPrefix(string(m.Payload), "challenge ")
+			if !ok {
+				got <- string(m.Payload)
+				return
+			}
+			go func() { _ = c.SendText(context.Background(), sign(key, challenge)) }()
+		}))
+	return c, got, serve(t, c)
+}
+
+func TestRawSessions(t *testing.T) {
+	key := []byte("shared out of band")
+	_, addr, ca := startServer(t, challenger(key), chat.ServerOptions.RawSessions())
+
+	c, got, _ := responder(t, addr, ca, key)
+	if text := receive(t, got); text != "welcome" {
+		t.Fatalf("received %q, want the welcome", text)
+	}
+	send(t, c, "hello")
+	if text := receive(t, got); text != "echo hello" {
+		t.Errorf("received %q, want the echo", text)
+	}
+
+	// refused by the handler rather than the handshake
+	_, _, done := responder(t, addr, ca, []byte("guessed"))
+	var rerr *chat.StreamResetError
+	if err := receive(t, done); !errors.As(err, &rerr) || rerr.Code != codes.Forbidden {
+		t.Errorf("dial with the wrong key: %v, want a forbidden reset", err)
+	}
+}
+
+func TestRawSessionsMismatch(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		server []chat.ServerOption
+		client []chat.ClientOption
+	}{
+		{"raw client", nil, []chat.ClientOption{chat.ClientOptions.RawSessions()}},
+		{"raw server", []chat.ServerOption{chat.ServerOptions.RawSessions()}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			handled := make(chan struct{}, 1)
+			_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+				handled <- struct{}{}
+				discard(ctx, s)
+			}, tt.server...)
+			c := newClient(t, addr, ca, tt.client...)
+			// failing fast, with the server telling why
+			var cerr *chat.CloseError
+			if err := c.Dial(t.Context()); !errors.As(err, &cerr) || cerr.Code != codes.ProtocolError || !cerr.Remote {
+				t.Errorf("dial: %v, want the protocol error of the server", err)
+			}
+			select {
+			case <-handled:
+				t.Error("mismatched session handled")
+			default:
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// readDeadliner is a reader whose blocked reads a deadline interrupts,
+// such as a *quic.Stream.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// ReadFromContext is like ReadFrom but gives up with the error of ctx
+// once it is done. If r has a read deadline, as a *quic.Stream has, the
+// deadline of ctx is set for the read and cleared after it, and
+// cancelling ctx interrupts the read through it. Otherwise r is closed
+// on cancellation if it is an io.Closer, any other reader is only
+// checked for ctx before reading. The stream is out of sync after an
+// interrupted read.
+func (m *Message) ReadFromContext(ctx context.Context, r io.Reader) (n int64, err error) {
+	err = readContext(ctx, r, nil, func() (err error) {
+		n, err = m.ReadFrom(r)
+		return err
+	})
+	return n, err
+}
+
+// readMessageContext reads the next message from r until ctx is done,
+// see ReadFromContext.
+func readMessageContext(ctx context.Context, r io.Reader) (*Message, error) {
+	var m *Message
+	err := readContext(ctx, r, nil, func() (err error) {
+		m, err = readMessage(r)
+		return err
+	})
+	return m, err
+}
+
+// readContext runs read, which reads from r, until ctx is done, see
+// ReadFromContext. base returns the read deadline of r outside of read,
+// which is restored after it, nil meaning none.
+func readContext(ctx context.Context, r io.Reader, base func() time.Time, read func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return read()
+	}
+	switch r := r.(type) {
+	case readDeadliner:
+		var restore time.Time
+		if base != nil {
+			restore = base()
+		}
+		if d, ok := ctx.Deadline(); ok {
+			if err := r.SetReadDeadline(earliest(restore, d)); err != nil {
+				return err
+			}
+		}
+		fired := make(chan struct{})
+		stop := context.AfterFunc(ctx, func() {
+			defer close(fired)
+			_ = r.SetReadDeadline(time.Now())
+		})
+		err := read()
+		if !stop() {
+			<-fired
+		}
+		if base != nil {
+			restore = base()
+		}
+		if rerr := r.SetReadDeadline(restore); rerr != nil && err == nil {
+			err = rerr
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if cerr := ctx.Err(); cerr != nil {
+				return cerr
+			}
+			// the timer of ctx may not have fired yet
+			if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+				return context.DeadlineExceeded
+			}
+		}
+		return err
+	case io.Closer:
+		stop := context.AfterFunc(ctx, func() { _ = r.Close() })
+		err := read()
+		if !stop() && err != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return read()
+}
@@ -0,0 +1,91 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestReadFromContext(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// silent returns a reader nothing is written to
+		silent func(t *testing.T) io.Reader
+	}{
+		{"deadline", func(t *testing.T) io.Reader {
+			r, w := net.Pipe()
+			t.Cleanup(func() { _ = r.Close(); _ = w.Close() })
+			return r
+		}},
+		{"closer", func(t *testing.T) io.Reader {
+			r, w := io.Pipe()
+			t.Cleanup(func() { _ = w.Close() })
+			return r
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, want := range []error{context.Canceled, context.DeadlineExceeded} {
+				ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+				if want == context.Canceled {
+					ctx, cancel = context.WithCancel(t.Context())
+					time.AfterFunc(20*time.Millisecond, cancel)
+				}
+				start := time.Now()
+				var m chat.Message
+				_, err := m.ReadFromContext(ctx, tt.silent(t))
+				cancel()
+				if !errors.Is(err, want) {
+					t.Errorf("read returned %v, want %v", err, want)
+				}
+				if d := time.Since(start); d > time.Second {
+					t.Errorf("read returned %s after cancellation", d)
+				}
+			}
+		})
+	}
+}
+
+func TestReadFromContextDeadlineCleared(t *testing.T) {
+	r, w := net.Pipe()
+	defer r.Close()
+	defer w.Close()
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+	var m chat.Message
+	if _, err := m.ReadFromContext(ctx, r); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("read returned %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// the next read outlives the deadline of the previous one
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		sent := chat.NewTextMessage([]byte("late"))
+		_, _ = sent.WriteTo(w)
+	}()
+	if _, err := m.ReadFromContext(t.Context(), r); err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Payload) != "late" {
+		t.Errorf("read %q, want late", m.Payload)
+	}
+}
+
+func TestReadFromContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	// a reader that could not be interrupted is not read at all
+	r := strings.NewReader("unread")
+	var m chat.Message
+	if _, err := m.ReadFromContext(ctx, r); !errors.Is(err, context.Canceled) {
+		t.Errorf("read returned %v, want %v", err, context.Canceled)
+	}
+	if r.Len() != len("unread") {
+		t.Error("read after cancellation")
+	}
+}
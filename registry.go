@@ -0,0 +1,240 @@
+package chat
+
+import (
+	"cmp"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"slices"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/zhmlst/chat/codes"
+)
+
+// ErrSessionNotFound is returned when no active session has the requested ID.
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionInfo describes an active session.
+type SessionInfo struct {
+	ID         uint64    `json:"id"`
+	SID        string    `json:"sid"`
+	RemoteAddr string    `json:"remote_addr"`
+	Guest      bool      `json:"guest"`
+	Started    time.Time `json:"started"`
+	// Label is set for sessions opened on additional streams, see Client.NewSession.
+	Label string `json:"label,omitempty"`
+	// Throttling reports whether a write is delayed by the write rate limit,
+	// Throttled is the total time writes have been delayed.
+	Throttling bool          `json:"throttling"`
+	Throttled  time.Duration `json:"throttled"`
+	// Streams counts the sessions open on additional streams of the
+	// connection, RefusedStreams those refused by MaxStreamsPerConnection.
+	Streams        int64  `json:"streams,omitempty"`
+	RefusedStreams uint64 `json:"refused_streams,omitempty"`
+	// ClockSkew is the offset of the peer clock, see Session.ClockSkew.
+	ClockSkew time.Duration `json:"clock_skew"`
+	// MutedUntil is when the mute of the session ends, zero if it is
+	// not muted, MuteReason why it is, see Server.Mute.
+	MutedUntil time.Time `json:"muted_until,omitzero"`
+	MuteReason string    `json:"mute_reason,omitempty"`
+}
+
+// Stats holds server counters.
+type Stats struct {
+	Sessions int       `json:"sessions"`
+	Conns    int       `json:"conns"`
+	Accepted uint64    `json:"accepted"`
+	Started  time.Time `json:"started"`
+	// SinkDropped counts records dropped because the sink queue was full.
+	SinkDropped uint64 `json:"sink_dropped"`
+	// Expired counts messages dropped because their TTL had passed.
+	Expired uint64 `json:"expired"`
+	// Duplicates counts messages dropped by SessionOptions.Dedupe.
+	Duplicates uint64 `json:"duplicates"`
+	// Drops counts messages and events dropped by all sessions,
+	// see Session.Stats.
+	Drops Drops `json:"drops"`
+	// Forbidden counts connections refused by AllowCIDR and DenyCIDR.
+	Forbidden uint64 `json:"forbidden"`
+	// Muted counts messages dropped from muted sessions, see Server.Mute.
+	Muted uint64 `json:"muted"`
+	// ProtocolViolations counts frames dropped by ServerOptions.Strict.
+	ProtocolViolations uint64 `json:"protocol_violations"`
+	// AccessDropped counts access records dropped because the queue was full.
+	AccessDropped uint64 `json:"access_dropped"`
+	// HandshakeFailures counts connections which failed the handshake.
+	HandshakeFailures uint64 `json:"handshake_failures"`
+	// RetriesSent counts the QUIC Retry packets sent to validate client
+	// addresses, ValidationsFailed the clients presenting an invalid token,
+	// see ServerOptions.RequireAddressValidation.
+	RetriesSent       uint64 `json:"retries_sent"`
+	ValidationsFailed uint64 `json:"validations_failed"`
+	// TokenMismatches counts frames dropped as their token was not that of
+	// the session, see ServerOptions.PerMessageAuth.
+	TokenMismatches uint64 `json:"token_mismatches"`
+	// Relayed counts messages forwarded to peers, RelayFailed those stored
+	// offline instead as the link failed, see ServerOptions.Cluster.
+	Relayed     uint64 `json:"relayed"`
+	RelayFailed uint64 `json:"relay_failed"`
+	// CallbackPanics counts the panics recovered from user callbacks,
+	// see SessionOptions.CallbackPanicLimit.
+	CallbackPanics uint64 `json:"callback_panics"`
+	// BytesIn and BytesOut count the bytes of all connections, including open ones.
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+	// AcceptErrors counts failed accepts, LastAcceptError is the latest of them.
+	AcceptErrors    uint64 `json:"accept_errors"`
+	LastAcceptError string `json:"last_accept_error,omitempty"`
+	// Pumps is the number of running session goroutines,
+	// such as writers and Input, Output and Events pumps.
+	Pumps int64 `json:"pumps"`
+}
+
+func (s *Session) info() SessionInfo {
+	info := SessionInfo{
+		ID:      s.id,
+		SID:     hex.EncodeToString(s.sid[:]),
+		Guest:   s.guest,
+		Started: s.started,
+		Label:   s.label,
+	}
+	if l := s.wlim.Load(); l != nil {
+		info.Throttling, info.Throttled = l.state()
+	}
+	info.Streams = s.streams.Load()
+	info.RefusedStreams = s.refusedStreams.Load()
+	info.ClockSkew = s.ClockSkew()
+	info.MutedUntil, info.MuteReason, _ = s.Muted()
+	if s.conn != nil {
+		info.RemoteAddr = s.conn.RemoteAddr().String()
+	}
+	return info
+}
+
+func (s *Server) nextID() uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.lastID++
+	return s.lastID
+}
+
+func (s *Server) register(session *Session) {
+	s.mtx.Lock()
+	s.sessions[session.id] = session
+	s.mtx.Unlock()
+	s.presenceChanged(session)
+}
+
+func (s *Server) unregister(session *Session) {
+	s.mtx.Lock()
+	delete(s.sessions, session.id)
+	s.mtx.Unlock()
+	s.presenceChanged(session)
+	s.account(session)
+}
+
+// Sessions returns information about all active sessions ordered by ID.
+func (s *Server) Sessions() []SessionInfo {
+	s.mtx.Lock()
+	infos := make([]SessionInfo, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		infos = append(infos, session.info())
+	}
+	s.mtx.Unlock()
+	slices.SortFunc(infos, func(a, b SessionInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return infos
+}
+
+// SessionInfo returns information about the active session with the given ID.
+func (s *Server) SessionInfo(id uint64) (SessionInfo, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return SessionInfo{}, ErrSessionNotFound
+	}
+	return session.info(), nil
+}
+
+// Disconnect closes the connection of the session with the given ID using code.
+func (s *Server) Disconnect(id uint64, code codes.Code) error {
+	s.mtx.Lock()
+	session, ok := s.sessions[id]
+	s.mtx.Unlock()
+	if !ok {
+		return ErrSessionNotFound
+	}
+	return closeConn(session.conn, code, "disconnected by the server")
+}
+
+// disconnectToken closes the connections of all sessions authenticated with tok.
+func (s *Server) disconnectToken(tok [16]byte, code codes.Code, detail string) error {
+	s.mtx.Lock()
+	var conns []*quic.Conn
+	for _, session := range s.sessions {
+		if session.currentToken() == tok {
+			conns = append(conns, session.conn)
+		}
+	}
+	s.mtx.Unlock()
+	var errs []error
+	for _, conn := range conns {
+		errs = append(errs, closeConn(conn, code, detail))
+	}
+	return errors.Join(errs...)
+}
+
+// Stats returns a snapshot of the server counters.
+func (s *Server) Stats() Stats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	stats := Stats{
+		Sessions: len(s.sessions),
+		Conns:    len(s.conns),
+		Accepted: s.accepted,
+		Started:  s.started,
+
+		SinkDropped: s.sinkDropped,
+		Expired:     s.expired,
+		Duplicates:  s.duplicates,
+		Forbidden:   s.forbidden,
+		Muted:       s.mutedDropped,
+		Drops:       s.drops,
+
+		ProtocolViolations: s.protoViolations,
+		AccessDropped:      s.accessDropped,
+		HandshakeFailures:  s.handshakeFailures,
+		RetriesSent:        s.retriesSent,
+		ValidationsFailed:  s.validationsFailed,
+		TokenMismatches:    s.tokenMismatches,
+		Relayed:            s.relayedOut,
+		RelayFailed:        s.relayFailed,
+		CallbackPanics:     s.callbackPanics,
+		BytesIn:            s.bytesIn,
+		BytesOut:           s.bytesOut,
+		Pumps:              s.pumps.Load(),
+		AcceptErrors:       s.acceptErrors,
+	}
+	if s.lastAcceptErr != nil {
+		stats.LastAcceptError = s.lastAcceptErr.Error()
+	}
+	for conn := range s.conns {
+		cs := conn.ConnectionStats()
+		stats.BytesIn += cs.BytesReceived
+		stats.BytesOut += cs.BytesSent
+	}
+	return stats
+}
+
+// publishExpvar publishes the server stats as an expvar variable,
+// computed on every read.
+func (s *Server) publishExpvar(name string) {
+	if expvar.Get(name) != nil {
+		s.cfg.logger.With("name", name).Error("expvar already published")
+		return
+	}
+	expvar.Publish(name, expvar.Func(func() any { return s.Stats() }))
+}
@@ -0,0 +1,218 @@
+package chat
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// replayTokens bounds the number of tokens with a replay buffer.
+// The buffer of the token written to least recently is dropped first.
+const replayTokens = 1024
+
+// ReplayBuffer keeps the last n text and binary messages written to the
+// sessions of every token, so that a client resuming after a reconnect
+// gets the messages it missed, see ClientOptions.Resume.
+func (serverOptionsNamespace) ReplayBuffer(n int) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.replayBuffer = n
+	}
+}
+
+// Resume makes the client present the ID of the last message it received
+// when it reconnects, so that a server with a ReplayBuffer sends the
+// messages written in between first. The client also keeps up to pending
+// sent messages asking for an ack until they are acknowledged, and sends
+// them again after reconnecting. The outcome is reported by a ResumeEvent.
+func (clientOptionsNamespace) Resume(pending int) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.resume = max(pending, 1)
+	}
+}
+
+// ResumeEvent reports how the server answered a resume after reconnecting.
+// Gap is set when the server could not replay the missed messages,
+// so some of them may be lost.
+type ResumeEvent struct {
+	Gap bool
+}
+
+func (ResumeEvent) event() {}
+
+type replayRing struct {
+	msgs    []Message
+	written time.Time
+}
+
+// replays holds the replay buffers of tokens.
+type replays struct {
+	size int
+
+	mtx   sync.Mutex
+	rings map[[16]byte]*replayRing
+}
+
+func newReplays(size int) *replays {
+	return &replays{size: size, rings: make(map[[16]byte]*replayRing)}
+}
+
+// retain adds the message written to a session of the token.
+// A message already in the buffer, e.g. replayed, is not added again.
+func (r *replays) retain(tok [16]byte, m *Message) {
+	if m.Type != MsgTypeText && m.Type != MsgTypeBinary {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	ring, ok := r.rings[tok]
+	if !ok {
+		if len(r.rings) >= replayTokens {
+			r.evict()
+		}
+		ring = &replayRing{msgs: make([]Message, 0, r.size)}
+		r.rings[tok] = ring
+	}
+	ring.written = time.Now()
+	if slices.ContainsFunc(ring.msgs, func(o Message) bool { return o.ID == m.ID }) {
+		return
+	}
+	if len(ring.msgs) == r.size {
+		ring.msgs = slices.Delete(ring.msgs, 0, 1)
+	}
+	ring.msgs = append(ring.msgs, *m)
+}
+
+// evict drops the buffer written to least recently.
+func (r *replays) evict() {
+	var oldest [16]byte
+	var at time.Time
+	for tok, ring := range r.rings {
+		if at.IsZero() || ring.written.Before(at) {
+			oldest, at = tok, ring.written
+		}
+	}
+	delete(r.rings, oldest)
+}
+
+// rekey moves the buffer of the token old to tok, unless tok has one.
+func (r *replays) rekey(old, tok [16]byte) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	ring, ok := r.rings[old]
+	if !ok {
+		return
+	}
+	delete(r.rings, old)
+	if _, ok := r.rings[tok]; !ok {
+		r.rings[tok] = ring
+	}
+}
+
+// after returns the messages written to the token after the one with id,
+// or false if that message is not in the buffer.
+func (r *replays) after(tok [16]byte, id [16]byte) ([]*Message, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	ring, ok := r.rings[tok]
+	if !ok {
+		return nil, false
+	}
+	i := slices.IndexFunc(ring.msgs, func(m Message) bool { return m.ID == id })
+	if i < 0 {
+		return nil, false
+	}
+	msgs := make([]*Message, 0, len(ring.msgs)-i-1)
+	for _, m := range ring.msgs[i+1:] {
+		msgs = append(msgs, &m)
+	}
+	return msgs, true
+}
+
+// resume looks up the messages the client missed after id. It reports
+// false if there is a gap because they are not in the replay buffer.
+func (s *Server) resume(tok [16]byte, id [16]byte) ([]*Message, bool) {
+	if s.replay == nil || tok == [16]byte{} {
+		return nil, false
+	}
+	return s.replay.after(tok, id)
+}
+
+// replayTo writes the messages the session missed before anything else
+// queued for it after the handshake.
+func (s *Server) replayTo(ctx context.Context, session *Session, msgs []*Message) {
+	for _, m := range msgs {
+		if session.expired(m) {
+			continue
+		}
+		if err := session.enqueue(ctx, m, m.Type.priority()); err != nil {
+			session.lgr.With("error", err).Warn("failed to replay message")
+			return
+		}
+	}
+	if len(msgs) > 0 {
+		session.lgr.With("messages", len(msgs)).Info("replayed missed messages")
+	}
+}
+
+// sent keeps the message for resending until it is acknowledged.
+func (c *Client) sent(m *Message) error {
+	if c.cfg.resume == 0 || !m.HasFlag(FlagAckRequested) {
+		return nil
+	}
+	if err := m.Stamp(c.cfg.src); err != nil {
+		return err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(c.pending) == c.cfg.resume {
+		c.pending = slices.Delete(c.pending, 0, 1)
+	}
+	c.pending = append(c.pending, m)
+	return nil
+}
+
+// received records the last message received and drops
+// acknowledged messages from the pending ones and the outbox.
+func (c *Client) received(m *Message) {
+	if c.outbox != nil && m.Type == MsgTypeAck {
+		if rcpt, err := m.Receipt(); err == nil && rcpt.Kind == AckDelivery {
+			c.outbox.receipt(rcpt)
+		}
+	}
+	if c.cfg.resume == 0 {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	switch m.Type {
+	case MsgTypeText, MsgTypeBinary:
+		if m.ID != [16]byte{} {
+			c.lastID = m.ID
+		}
+	case MsgTypeAck:
+		rcpt, err := m.Receipt()
+		if err != nil || rcpt.Kind != AckDelivery {
+			return
+		}
+		c.pending = slices.DeleteFunc(c.pending, func(p *Message) bool {
+			return slices.Contains(rcpt.IDs, p.ID)
+		})
+	}
+}
+
+// resend sends the pending messages again after reconnecting.
+func (c *Client) resend(ctx context.Context, session *Session) {
+	c.mtx.Lock()
+	pending := slices.Clone(c.pending)
+	c.mtx.Unlock()
+	for _, m := range pending {
+		if err := session.Send(ctx, m); err != nil {
+			c.cfg.logger.With("error", err).Warn("failed to resend message")
+			return
+		}
+	}
+	if len(pending) > 0 {
+		c.cfg.logger.With("messages", len(pending)).Info("resent unacknowledged messages")
+	}
+}
@@ -0,0 +1,139 @@
+package chat_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+// resumer returns options making a client resume and report what it
+// receives on the returned channels.
+func resumer() ([]chat.ClientOption, <-chan string, <-chan chat.ResumeEvent) {
+	texts := make(chan string, 8)
+	resumes := make(chan chat.ResumeEvent, 1)
+	return []chat.ClientOption{
+		chat.ClientOptions.Resume(8),
+		chat.ClientOptions.OnMessage(func(m *chat.Message) {
+			if m.Type == chat.MsgTypeText {
+				texts <- string(m.Payload)
+			}
+		}),
+		chat.ClientOptions.OnEvent(func(e chat.Event) {
+			if e, ok := e.(chat.ResumeEvent); ok {
+				resumes <- e
+			}
+		}),
+	}, texts, resumes
+}
+
+// sendTo sends text to the sessions of tok.
+func sendTo(t *testing.T, srv *chat.Server, tok [16]byte, text string) {
+	t.Helper()
+	// one ID for every session of the token
+	m := chat.NewTextMessage([]byte(text))
+	if err := srv.SendTo(context.Background(), tok, m); err != nil {
+		t.Fatalf("send %s: %v", text, err)
+	}
+}
+
+func TestResumeReplaysGap(t *testing.T) {
+	srv, addr, ca := startServer(t, discard, chat.ServerOptions.ReplayBuffer(16))
+	tokFile := sharedToken(t)
+	opts, texts, resumes := resumer()
+	c := newClient(t, addr, ca, append(opts, tokFile)...)
+	if err := dial(t, c); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := c.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another session of the token has the missed messages written to it
+	connect(t, addr, ca, tokFile)
+
+	sendTo(t, srv, tok, "1")
+	if text := receive(t, texts); text != "1" {
+		t.Fatalf("received %q, want 1", text)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return len(srv.Sessions()) == 1 })
+	sendTo(t, srv, tok, "2")
+	sendTo(t, srv, tok, "3")
+
+	if err := dial(t, c); err != nil {
+		t.Fatal(err)
+	}
+	if e := receive(t, resumes); e.Gap {
+		t.Error("resumed with a gap")
+	}
+	sendTo(t, srv, tok, "4")
+	for _, want := range []string{"2", "3", "4"} {
+		if text := receive(t, texts); text != want {
+			t.Errorf("received %q, want %q", text, want)
+		}
+	}
+}
+
+func TestResumeReportsGap(t *testing.T) {
+	srv, addr, ca := startServer(t, discard)
+	opts, texts, resumes := resumer()
+	c := newClient(t, addr, ca, opts...)
+	if err := dial(t, c); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := c.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendTo(t, srv, tok, "1")
+	receive(t, texts)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return len(srv.Sessions()) == 0 })
+
+	// no replay buffer, so whatever was missed is lost
+	if err := dial(t, c); err != nil {
+		t.Fatal(err)
+	}
+	if e := receive(t, resumes); !e.Gap {
+		t.Error("resumed without a gap")
+	}
+}
+
+func TestResumeResendsPending(t *testing.T) {
+	got := make(chan string, 4)
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		for {
+			m, err := s.Recv(ctx)
+			if err != nil {
+				return
+			}
+			got <- string(m.Payload)
+		}
+	})
+	c := newClient(t, addr, ca, chat.ClientOptions.Resume(8))
+	if err := dial(t, c); err != nil {
+		t.Fatal(err)
+	}
+	m := chat.NewTextMessage([]byte("unacked"))
+	m.SetFlag(chat.FlagAckRequested, true)
+	if err := c.SendMessage(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, got)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// never acknowledged, so sent again on the next connection
+	if err := dial(t, c); err != nil {
+		t.Fatal(err)
+	}
+	if text := receive(t, got); text != "unacked" {
+		t.Errorf("received %q, want the pending message", text)
+	}
+}
@@ -0,0 +1,47 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/quic-go/quic-go"
+	"github.com/zhmlst/chat/codes"
+)
+
+// StreamResetError is returned when the peer reset the session stream
+// with a code, e.g. by Session.Abort, rather than closing it.
+// It wraps the *quic.StreamError it was translated from.
+type StreamResetError struct {
+	Code codes.Code
+	// Name is the name of a built-in or registered code,
+	// empty if the code is unknown, see codes.Register.
+	Name string
+
+	err error
+}
+
+func (e *StreamResetError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("stream reset by peer with code %d", uint64(e.Code))
+	}
+	return fmt.Sprintf("stream reset by peer: %s", e.Name)
+}
+
+func (e *StreamResetError) Unwrap() error {
+	return e.err
+}
+
+// peerReset translates err into a StreamResetError if the peer reset the
+// stream, recording it as the error and context cause the session ended with.
+func (s *Session) peerReset(err error) error {
+	var serr *quic.StreamError
+	if !errors.As(err, &serr) || !serr.Remote {
+		return err
+	}
+	code := codes.Code(serr.ErrorCode)
+	name, _ := codes.Name(code)
+	rerr := &StreamResetError{Code: code, Name: name, err: err}
+	s.setErr(rerr)
+	s.cancel(rerr)
+	return rerr
+}
@@ -0,0 +1,85 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+// codeUploadAborted is an application defined code for TestStreamReset.
+const codeUploadAborted codes.Code = 0x4242
+
+func init() {
+	codes.Register(codeUploadAborted, "upload_aborted")
+}
+
+func TestStreamReset(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		code     codes.Code
+		wantName string
+	}{
+		{"built-in", codes.PolicyViolation, codes.PolicyViolation.String()},
+		{"registered", codeUploadAborted, "upload_aborted"},
+		{"unknown", 0x4243, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+				if _, err := s.Recv(ctx); err != nil {
+					return
+				}
+				s.Abort(tt.code)
+				<-ctx.Done()
+			})
+			c := newClient(t, addr, ca)
+			errCh := serve(t, c)
+			send(t, c, "upload")
+
+			err := receive(t, errCh)
+			var rerr *chat.StreamResetError
+			if !errors.As(err, &rerr) {
+				t.Fatalf("dial: %v, want a StreamResetError", err)
+			}
+			if rerr.Code != tt.code || rerr.Name != tt.wantName {
+				t.Errorf("reset with %d %q, want %d %q", uint64(rerr.Code), rerr.Name, uint64(tt.code), tt.wantName)
+			}
+		})
+	}
+}
+
+func TestStreamResetByClient(t *testing.T) {
+	type ended struct{ err, cause error }
+	ends := make(chan ended, 1)
+	received := make(chan struct{}, 1)
+	_, addr, ca := startServer(t, discard, chat.ServerOptions.StreamHandler(func(ctx context.Context, s *chat.Session) {
+		for {
+			if _, err := s.Recv(ctx); err != nil {
+				ends <- ended{s.Err(), context.Cause(s.Context())}
+				return
+			}
+			received <- struct{}{}
+		}
+	}))
+	c := connect(t, addr, ca)
+	s, err := c.NewSession(t.Context(), "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Send(t.Context(), chat.NewTextMessage([]byte("chunk"))); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, received)
+	s.Abort(codeUploadAborted)
+
+	// told apart from the network failing
+	e := receive(t, ends)
+	for _, err := range []error{e.err, e.cause} {
+		var rerr *chat.StreamResetError
+		if !errors.As(err, &rerr) || rerr.Code != codeUploadAborted || rerr.Name != "upload_aborted" {
+			t.Errorf("session ended with %v, want the upload_aborted reset", err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+)
+
+// TokenDeleter is implemented by a TokenRepo able to delete tokens.
+// The server uses it to retire tokens replaced by rotation.
+type TokenDeleter interface {
+	DeleteToken(ctx context.Context, tok [16]byte) error
+}
+
+// ErrNoToken is returned when rotating the token of a session without one.
+var ErrNoToken = errors.New("session has no token")
+
+// rotationPending bounds how long the server waits for a client to confirm
+// a rotated token. Until then both tokens are accepted, afterwards
+// the old token stays valid as if the rotation never happened.
+const rotationPending = 24 * time.Hour
+
+type rotation struct {
+	old     [16]byte
+	started time.Time
+}
+
+// RotateToken issues a new token to the session and pushes it to the client.
+// The old token is deleted once the client confirms it saved the new one,
+// either by acknowledging the rotation or by logging in with the new token.
+func (s *Server) RotateToken(id uint64) error {
+	s.mtx.Lock()
+	session, ok := s.sessions[id]
+	s.mtx.Unlock()
+	if !ok {
+		return ErrSessionNotFound
+	}
+	return s.rotateToken(session.ctx, session)
+}
+
+func (s *Server) rotateToken(ctx context.Context, session *Session) error {
+	if session.anonymous() {
+		return ErrNoToken
+	}
+	tok, err := s.newToken(ctx)
+	if err != nil {
+		return err
+	}
+	if err = s.saveToken(ctx, tok); err != nil {
+		return err
+	}
+	if err = s.saveScopes(ctx, tok, session.scopes); err != nil {
+		return err
+	}
+
+	now := s.cfg.src.Now()
+	s.mtx.Lock()
+	for t, r := range s.rotations {
+		if now.Sub(r.started) > rotationPending {
+			delete(s.rotations, t)
+		}
+	}
+	s.rotations[tok] = rotation{old: session.currentToken(), started: now}
+	s.mtx.Unlock()
+
+	if err = session.control(append([]byte("rotate "), tok[:]...)); err != nil {
+		return fmt.Errorf("failed to send rotated token: %w", err)
+	}
+	session.lgr.Info("token rotation started")
+	return nil
+}
+
+// autoRotate rotates the session token every interval until ctx is done.
+func (s *Server) autoRotate(ctx context.Context, session *Session, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.rotateToken(ctx, session); err != nil {
+				session.lgr.With("error", err).Error("failed to rotate token")
+			}
+		}
+	}
+}
+
+// rotated handles the client acknowledging a rotated token.
+func (s *Server) rotated(ctx context.Context, session *Session, m *Message) bool {
+	tok, ok := bytes.CutPrefix(m.Payload, []byte("rotated "))
+	if m.Type != MsgTypeControl || !ok || len(tok) != 16 {
+		return false
+	}
+	old := session.currentToken()
+	s.confirmRotation(ctx, [16]byte(tok), &old)
+	return true
+}
+
+// confirmRotation moves the sessions of the token replaced by tok to tok
+// and deletes it. If old is not nil, the rotation must have replaced it.
+func (s *Server) confirmRotation(ctx context.Context, tok [16]byte, old *[16]byte) {
+	s.mtx.Lock()
+	r, ok := s.rotations[tok]
+	if ok && (old == nil || r.old == *old) {
+		delete(s.rotations, tok)
+	} else {
+		ok = false
+	}
+	s.mtx.Unlock()
+	if !ok {
+		return
+	}
+	s.rekey(r.old, tok)
+	lgr := s.cfg.logger.With("op", "rotation")
+	d, ok := s.cfg.tokenRepo.(TokenDeleter)
+	if !ok {
+		lgr.Debug("token repo cannot delete, old token stays valid")
+		return
+	}
+	if err := d.DeleteToken(ctx, r.old); err != nil {
+		lgr.With("error", err).Error("failed to delete old token")
+		return
+	}
+	lgr.Info("token rotation completed")
+}
+
+// rekey moves the sessions of the token old, and the rate limit, usage
+// and replay buffer of the token, to tok, which replaced it.
+func (s *Server) rekey(old, tok [16]byte) {
+	s.mtx.Lock()
+	for _, session := range s.sessions {
+		if session.currentToken() == old {
+			session.setToken(tok)
+		}
+	}
+	if sessions, ok := s.byToken[old]; ok {
+		delete(s.byToken, old)
+		if moved := s.byToken[tok]; moved != nil {
+			maps.Copy(moved, sessions)
+		} else {
+			s.byToken[tok] = sessions
+		}
+	}
+	s.mtx.Unlock()
+	if s.limiter != nil {
+		s.limiter.rekey(old, tok)
+	}
+	s.usage.rekey(old, tok)
+	if s.replay != nil {
+		s.replay.rekey(old, tok)
+	}
+}
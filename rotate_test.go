@@ -0,0 +1,149 @@
+package chat_test
+
+import (
+	"context"
+	"crypto/x509"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+)
+
+// valid reports whether repo holds tok, failing the test on error.
+func valid(t *testing.T, repo *chattest.TokenRepo, tok [16]byte) bool {
+	t.Helper()
+	ok, err := repo.HasToken(context.Background(), tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+// rotate connects a client and rotates the token of its session, whose
+// ID the handler sends to ids. It returns the client along with its old
+// token and the new one, which the client has saved.
+func rotate(t *testing.T, srv *chat.Server, addr string, ca *x509.CertPool, ids <-chan uint64, tokFile chat.ClientOption) (*chat.Client, [16]byte, [16]byte) {
+	t.Helper()
+	rotated := make(chan chat.TokenRotatedEvent, 1)
+	c := connect(t, addr, ca, tokFile, chat.ClientOptions.OnEvent(func(e chat.Event) {
+		if e, ok := e.(chat.TokenRotatedEvent); ok {
+			rotated <- e
+		}
+	}))
+	old, err := c.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.RotateToken(receive(t, ids)); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	tok := receive(t, rotated).Token
+	if saved, err := c.Token(); err != nil || saved != tok {
+		t.Fatalf("client token %x, %v, want %x", saved, err, tok)
+	}
+	return c, old, tok
+}
+
+func TestRotateToken(t *testing.T) {
+	repo := &chattest.TokenRepo{}
+	ids := make(chan uint64, 1)
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		ids <- s.ID()
+		discard(ctx, s)
+	}, chat.ServerOptions.TokenRepo(repo))
+	_, old, tok := rotate(t, srv, addr, ca, ids, sharedToken(t))
+
+	// the client acknowledges, retiring the old token
+	eventually(t, func() bool { return !valid(t, repo, old) })
+	if !valid(t, repo, tok) {
+		t.Error("new token not saved")
+	}
+}
+
+func TestRotateTokenAckLost(t *testing.T) {
+	repo := &chattest.TokenRepo{}
+	ids := make(chan uint64, 4)
+	lose := make(chan struct{})
+	var first atomic.Bool
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		ids <- s.ID()
+		if first.CompareAndSwap(false, true) {
+			// the connection ends before the acknowledgement is read
+			select {
+			case <-lose:
+			case <-ctx.Done():
+			}
+			return
+		}
+		discard(ctx, s)
+	}, chat.ServerOptions.TokenRepo(repo))
+	tokFile := sharedToken(t)
+	_, old, tok := rotate(t, srv, addr, ca, ids, tokFile)
+
+	// both tokens stay valid until the client shows it has the new one
+	if !valid(t, repo, old) || !valid(t, repo, tok) {
+		t.Fatal("a token was retired without acknowledgement")
+	}
+	close(lose)
+	c := connect(t, addr, ca, tokFile)
+	if got, err := c.Token(); err != nil || got != tok {
+		t.Fatalf("logged in with %x, %v, want %x", got, err, tok)
+	}
+	eventually(t, func() bool { return !valid(t, repo, old) })
+	if !valid(t, repo, tok) {
+		t.Error("new token retired")
+	}
+}
+
+func TestRotateTokenTwice(t *testing.T) {
+	repo := &chattest.TokenRepo{}
+	ids := make(chan uint64, 1)
+	got := make(chan string, 1)
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		ids <- s.ID()
+		for {
+			m, err := s.Recv(ctx)
+			if err != nil {
+				return
+			}
+			if m.Type == chat.MsgTypeText {
+				got <- string(m.Payload)
+			}
+		}
+	}, chat.ServerOptions.TokenRepo(repo), chat.ServerOptions.PerMessageAuth(1))
+	rotated := make(chan [16]byte, 1)
+	c := connect(t, addr, ca, sharedToken(t), chat.ClientOptions.OnEvent(func(e chat.Event) {
+		if e, ok := e.(chat.TokenRotatedEvent); ok {
+			rotated <- e.Token
+		}
+	}))
+	id := receive(t, ids)
+	prev, err := c.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 2 {
+		if err := srv.RotateToken(id); err != nil {
+			t.Fatalf("rotation %d: %v", i+1, err)
+		}
+		tok := receive(t, rotated)
+		// each confirmed rotation retires the token it replaced
+		eventually(t, func() bool { return !valid(t, repo, prev) })
+		if !valid(t, repo, tok) {
+			t.Fatalf("rotation %d retired the new token", i+1)
+		}
+		// frames carry the new token
+		send(t, c, "after rotation")
+		if text := receive(t, got); text != "after rotation" {
+			t.Errorf("received %q after rotation %d", text, i+1)
+		}
+		if _, ok := srv.Usage(tok); !ok {
+			t.Errorf("no usage of the token of rotation %d", i+1)
+		}
+		prev = tok
+	}
+	if n := srv.Stats().TokenMismatches; n != 0 {
+		t.Errorf("%d frame token mismatches", n)
+	}
+}
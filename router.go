@@ -0,0 +1,88 @@
+package chat
+
+import (
+	"context"
+	"sync"
+)
+
+// MessageHandler handles a single received message.
+type MessageHandler func(ctx context.Context, s *Session, m *Message)
+
+// Router dispatches received messages to handlers registered by message type.
+// Its Serve method satisfies the Handler signature.
+type Router struct {
+	mtx      sync.RWMutex
+	routes   map[MsgType]MessageHandler
+	fallback MessageHandler
+}
+
+// NewRouter creates a router without routes.
+func NewRouter() *Router {
+	return &Router{routes: make(map[MsgType]MessageHandler)}
+}
+
+// On registers the handler for messages of the given type.
+func (r *Router) On(typ MsgType, h MessageHandler) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.routes[typ] = h
+}
+
+// OnText registers the handler for text messages.
+func (r *Router) OnText(h MessageHandler) { r.On(MsgTypeText, h) }
+
+// OnBinary registers the handler for binary messages.
+func (r *Router) OnBinary(h MessageHandler) { r.On(MsgTypeBinary, h) }
+
+// OnControl registers the handler for control messages which are not
+// known events, delivered as RawControlEvent. A router with a control
+// handler consumes the events of the sessions it serves.
+func (r *Router) OnControl(h MessageHandler) { r.On(MsgTypeControl, h) }
+
+// Fallback registers the handler for messages of unregistered types.
+// Without it such messages are dropped.
+func (r *Router) Fallback(h MessageHandler) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.fallback = h
+}
+
+// Serve receives messages from the session until its stream ends,
+// dispatching each one, and closes the stream afterwards.
+func (r *Router) Serve(ctx context.Context, s *Session) {
+	defer func() { _ = s.CloseSend() }()
+
+	r.mtx.RLock()
+	control, ok := r.routes[MsgTypeControl]
+	r.mtx.RUnlock()
+	if ok {
+		go func() {
+			for ev := range s.Events(ctx) {
+				if raw, ok := ev.(RawControlEvent); ok {
+					control(ctx, s, raw.Message)
+				}
+			}
+		}()
+	}
+
+	for {
+		m, err := s.Recv(ctx)
+		if err != nil {
+			return
+		}
+		if s.expired(m) {
+			continue
+		}
+		r.mtx.RLock()
+		h, ok := r.routes[m.Type]
+		if !ok {
+			h = r.fallback
+		}
+		r.mtx.RUnlock()
+		if h == nil {
+			s.lgr.With("type", m.Type).Debug("no route for message, dropping")
+			continue
+		}
+		h(ctx, s, m)
+	}
+}
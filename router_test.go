@@ -0,0 +1,71 @@
+package chat_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+// reply returns a message handler answering with the prefixed payload.
+func reply(prefix string) chat.MessageHandler {
+	return func(ctx context.Context, s *chat.Session, m *chat.Message) {
+		_ = s.Send(ctx, chat.NewTextMessage(append([]byte(prefix), m.Payload...)))
+	}
+}
+
+// routed connects a client to a server with the router and returns it
+// along with the text messages it receives.
+func routed(t *testing.T, r *chat.Router) (*chat.Client, <-chan string) {
+	t.Helper()
+	_, addr, ca := startServer(t, r.Serve)
+	got := make(chan string, 8)
+	c := connect(t, addr, ca, chat.ClientOptions.OnMessage(func(m *chat.Message) {
+		if m.Type == chat.MsgTypeText {
+			got <- string(m.Payload)
+		}
+	}))
+	return c, got
+}
+
+func TestRouterDispatch(t *testing.T) {
+	r := chat.NewRouter()
+	r.OnText(reply("text: "))
+	r.OnBinary(reply("binary: "))
+	r.Fallback(func(ctx context.Context, s *chat.Session, m *chat.Message) {
+		_ = s.Send(ctx, chat.NewTextMessage(fmt.Appendf(nil, "fallback: %d", m.Type)))
+	})
+	c, got := routed(t, r)
+
+	ctx := context.Background()
+	msgs := []*chat.Message{
+		chat.NewTextMessage([]byte("hi")),
+		{Type: chat.MsgTypeBinary, Payload: []byte("bin")},
+		chat.NewAck(chat.Receipt{Kind: chat.AckRead, IDs: [][16]byte{{1}}}),
+	}
+	want := []string{"text: hi", "binary: bin", fmt.Sprintf("fallback: %d", chat.MsgTypeAck)}
+	for i, m := range msgs {
+		if err := c.SendMessage(ctx, m); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		if text := receive(t, got); text != want[i] {
+			t.Errorf("received %q, want %q", text, want[i])
+		}
+	}
+}
+
+func TestRouterDropsUnrouted(t *testing.T) {
+	r := chat.NewRouter()
+	r.OnText(reply(""))
+	c, got := routed(t, r)
+
+	ctx := context.Background()
+	if err := c.SendMessage(ctx, &chat.Message{Type: chat.MsgTypeBinary, Payload: []byte("dropped")}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	send(t, c, "kept")
+	if text := receive(t, got); text != "kept" {
+		t.Errorf("received %q, want %q", text, "kept")
+	}
+}
@@ -0,0 +1,69 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ScopedTokenRepo is implemented by a TokenRepo storing scopes along with
+// tokens. The server saves the scopes granted when issuing a token and
+// loads them on login, see Session.HasScope.
+type ScopedTokenRepo interface {
+	TokenRepo
+	SaveTokenScopes(ctx context.Context, tok [16]byte, scopes []string) error
+	TokenScopes(ctx context.Context, tok [16]byte) ([]string, error)
+}
+
+// HasScope reports whether the token of the session carries the scope.
+func (s *Session) HasScope(scope string) bool {
+	return slices.Contains(s.scopes, scope)
+}
+
+// Scopes returns the scopes of the session token.
+func (s *Session) Scopes() []string {
+	return slices.Clone(s.scopes)
+}
+
+// parseScopes splits the arguments of a scoped token request
+// into the requested scopes and the registration payload.
+func parseScopes(arg []byte) (scopes []string, pld []byte) {
+	raw, pld, _ := bytes.Cut(arg, []byte(" "))
+	for sc := range strings.SplitSeq(string(raw), ",") {
+		if sc != "" {
+			scopes = append(scopes, sc)
+		}
+	}
+	return scopes, pld
+}
+
+// saveScopes stores the scopes granted to a new token.
+func (s *Server) saveScopes(ctx context.Context, tok [16]byte, scopes []string) error {
+	if len(scopes) == 0 {
+		return nil
+	}
+	repo, ok := s.cfg.tokenRepo.(ScopedTokenRepo)
+	if !ok {
+		s.cfg.logger.Warn("token repo cannot store scopes, token issued without them")
+		return nil
+	}
+	if err := repo.SaveTokenScopes(ctx, tok, scopes); err != nil {
+		return fmt.Errorf("failed to save token scopes: %w", err)
+	}
+	return nil
+}
+
+// loadScopes returns the scopes of a token, if the token repo stores any.
+func (s *Server) loadScopes(ctx context.Context, tok [16]byte) ([]string, error) {
+	repo, ok := s.cfg.tokenRepo.(ScopedTokenRepo)
+	if !ok {
+		return nil, nil
+	}
+	scopes, err := repo.TokenScopes(ctx, tok)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token scopes: %w", err)
+	}
+	return scopes, nil
+}
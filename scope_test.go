@@ -0,0 +1,89 @@
+package chat_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+// writersOnly grants the write scope to token requests carrying the
+// writer code only, trimming it from the others.
+func writersOnly(_ context.Context, req *chat.TokenRequest) error {
+	if !bytes.Equal(req.Payload, []byte("writer")) {
+		req.Scopes = slices.DeleteFunc(req.Scopes, func(s string) bool { return s == "write" })
+	}
+	return nil
+}
+
+// readOnly echoes the messages of sessions with the write scope
+// and rejects the others with a notice.
+func readOnly(ctx context.Context, s *chat.Session) {
+	for {
+		m, err := s.Recv(ctx)
+		if err != nil {
+			return
+		}
+		if !s.HasScope("write") {
+			err = s.SendError(ctx, codes.Forbidden, "read_only", "scopes "+strings.Join(s.Scopes(), ","))
+		} else {
+			err = s.Send(ctx, chat.NewTextMessage(m.Payload))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// scoped connects a client asking for the read and write scopes and
+// returns the channels of the notices and echoes it receives.
+func scoped(t *testing.T, addr string, ca *x509.CertPool, opts ...chat.ClientOption) (*chat.Client, <-chan chat.NoticeEvent, <-chan string) {
+	t.Helper()
+	notices := make(chan chat.NoticeEvent, 1)
+	echoes := make(chan string, 1)
+	opts = append([]chat.ClientOption{
+		chat.ClientOptions.Scopes("read", "write"),
+		chat.ClientOptions.OnEvent(func(e chat.Event) {
+			if e, ok := e.(chat.NoticeEvent); ok {
+				notices <- e
+			}
+		}),
+		chat.ClientOptions.OnMessage(func(m *chat.Message) { echoes <- string(m.Payload) }),
+	}, opts...)
+	return connect(t, addr, ca, opts...), notices, echoes
+}
+
+func TestScopeDeniesWrite(t *testing.T) {
+	_, addr, ca := startServer(t, readOnly,
+		chat.ServerOptions.TokenApprover(writersOnly))
+
+	c, notices, _ := scoped(t, addr, ca)
+	send(t, c, "hello")
+	n := receive(t, notices)
+	if n.Code != codes.Forbidden || n.Message != "scopes read" {
+		t.Errorf("notice %+v, want %s with scopes read", n, codes.Forbidden)
+	}
+
+	tokens := filepath.Join(t.TempDir(), "token")
+	c, _, echoes := scoped(t, addr, ca,
+		chat.ClientOptions.RegistrationPayload([]byte("writer")),
+		chat.ClientOptions.TokenFile(tokens))
+	send(t, c, "hello")
+	if got := receive(t, echoes); got != "hello" {
+		t.Errorf("echo %q, want %q", got, "hello")
+	}
+	_ = c.Close()
+
+	// the scopes are loaded with the token on the next login
+	c, _, echoes = scoped(t, addr, ca, chat.ClientOptions.TokenFile(tokens))
+	send(t, c, "again")
+	if got := receive(t, echoes); got != "again" {
+		t.Errorf("echo after login %q, want %q", got, "again")
+	}
+}
@@ -1,15 +1,26 @@
 package chat
 
 import (
+	"cmp"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/quic-go/quic-go"
 	"github.com/zhmlst/chat/codes"
+	"github.com/zhmlst/chat/keygen"
 )
 
 // TokenRepo defines the type that stores tokens.
@@ -28,24 +39,135 @@ func (NopTokenRepo) SaveToken(context.Context, [16]byte) error { return nil }
 func (NopTokenRepo) HasToken(context.Context, [16]byte) (bool, error) { return false, nil }
 
 type serverConfig struct {
-	address     string
-	handler     Handler
-	tlsCertFile string
-	tlsKeyFile  string
-	logger      Logger
-	tokenRepo   TokenRepo
+	addresses     []string
+	bestEffort    bool
+	handler       Handler
+	streamHandler Handler
+	maxStreams    int
+	maxConns      int
+	maxPayload    int
+	healthAddr    string
+	tlsCertFile   string
+	tlsKeyFile    string
+	tlsCert       *tls.Certificate
+	devTLS        bool
+	logger        Logger
+	tokenRepo     TokenRepo
+	allow0RTT     bool
+	noAuth        bool
+	raw           bool
+	strict        int
+	instance      string
+	onMismatch    func(ctx context.Context, m AffinityMismatch) string
+	allowGuests   bool
+	approver      TokenApprover
+	tokenGen      TokenGenerator
+	adminSecret   *[16]byte
+	clusterSecret *[16]byte
+	peers         []string
+	peerOpts      []ClientOption
+
+	// tokenFrames is the violation limit of PerMessageAuth, zero if off.
+	tokenFrames        int
+	requireTokenFrames bool
+	// tokenRepoLag is the TokenRepoLag, zero if the repo is consistent.
+	tokenRepoLag time.Duration
+	// ids replaces the IDs of src, see IDGenerator.
+	ids IDGenerator
+
+	rateLimit       float64
+	rateBurst       int
+	rateLimitAction RateLimitAction
+	duplicateLogin  DuplicateLoginPolicy
+	addrValidation  AddressValidationPolicy
+	halfOpen        int
+	writeRate       float64
+	writeBurst      int
+
+	inboundFilter  MessageFilter
+	outboundFilter MessageFilter
+	filterTimeout  time.Duration
+	maxViolations  int
+
+	sink         MessageSink
+	sinkQueue    int
+	sinkOverflow SinkOverflow
+
+	store    MessageStore
+	notifier OfflineNotifier
+
+	handlerTimeout time.Duration
+	rotateEvery    time.Duration
+	heartbeat      heartbeat
+	caps           []Capability
+	noCaps         []string
+	onPanic        PanicHook
+
+	breakerFailures int
+	breakerCooldown time.Duration
+
+	skewThreshold time.Duration
+	skewPolicy    SkewPolicy
+	metrics       MetricsHook
+
+	ipFilter ipFilter
+	ipErr    error
+
+	accessLog AccessLog
+	expvar    string
+
+	usageEvery  time.Duration
+	usageSink   UsageSink
+	usageTokens int
+
+	wrapListener func(Listener) Listener
+
+	sessionOpts  []SessionOption
+	replayBuffer int
+
+	src Source
 }
 
 func defaultServerConfig() serverConfig {
 	return serverConfig{
-		address:     "localhost:4242",
+		addresses:   []string{DefaultAddr},
 		tlsCertFile: "cert.pem",
 		tlsKeyFile:  "key.pem",
 		logger:      NopLogger,
 		tokenRepo:   NopTokenRepo{},
+		tokenGen:    RandTokenGenerator,
+
+		filterTimeout: defaultFilterTimeout,
+		sinkQueue:     defaultSinkQueue,
+		usageTokens:   defaultUsageTokens,
+		src:           DefaultSource,
+		maxPayload:    defaultMaxPayload,
+		instance:      rand.Text(),
+
+		breakerFailures: defaultBreakerFailures,
+		breakerCooldown: defaultBreakerCooldown,
+		skewThreshold:   defaultSkewThreshold,
 	}
 }
 
+// TokenRequest describes a client asking the server to issue a new token.
+type TokenRequest struct {
+	RemoteAddr net.Addr
+	TLS        tls.ConnectionState
+	// Payload is the opaque registration payload attached by the client, e.g. an invite code.
+	Payload []byte
+	// Scopes are the scopes requested by the client. They are granted
+	// to the token unless the TokenApprover removes them.
+	Scopes []string
+}
+
+// TokenApprover decides whether a token may be issued for the request.
+// A non-nil error denies the request. The approver may trim req.Scopes.
+type TokenApprover func(ctx context.Context, req *TokenRequest) error
+
+// TokenGenerator mints new tokens.
+type TokenGenerator func(ctx context.Context) ([16]byte, error)
+
 // ServerOption applies option to server.
 type ServerOption func(cfg *serverConfig)
 
@@ -54,10 +176,11 @@ var ServerOptions serverOptionsNamespace
 
 type serverOptionsNamespace struct{}
 
+// Address sets the only address the server listens on.
+//
+// Deprecated: Use Addresses, which takes several.
 func (serverOptionsNamespace) Address(addr string) ServerOption {
-	return func(cfg *serverConfig) {
-		cfg.address = addr
-	}
+	return ServerOptions.Addresses(addr)
 }
 
 func (serverOptionsNamespace) Handler(hlr Handler) ServerOption {
@@ -66,6 +189,15 @@ func (serverOptionsNamespace) Handler(hlr Handler) ServerOption {
 	}
 }
 
+// StreamHandler sets the handler of sessions the client opens on
+// additional streams of its connection, see Client.NewSession.
+// It defaults to the Handler.
+func (serverOptionsNamespace) StreamHandler(hlr Handler) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.streamHandler = hlr
+	}
+}
+
 func (serverOptionsNamespace) TLSCertFile(file string) ServerOption {
 	return func(cfg *serverConfig) {
 		cfg.tlsCertFile = file
@@ -78,6 +210,22 @@ func (serverOptionsNamespace) TLSKeyFile(file string) ServerOption {
 	}
 }
 
+// TLSCertificate sets the certificate of the server,
+// taking precedence over TLSCertFile and TLSKeyFile.
+func (serverOptionsNamespace) TLSCertificate(crt tls.Certificate) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.tlsCert = &crt
+	}
+}
+
+// DevTLS makes the server use a self-signed certificate for localhost
+// generated at startup. Clients have to skip verification or pin it.
+func (serverOptionsNamespace) DevTLS() ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.devTLS = true
+	}
+}
+
 func (serverOptionsNamespace) Logger(lgr Logger) ServerOption {
 	return func(cfg *serverConfig) {
 		cfg.logger = lgr
@@ -90,12 +238,300 @@ func (serverOptionsNamespace) TokenRepo(repo TokenRepo) ServerOption {
 	}
 }
 
+// Allow0RTT lets resuming clients send the handshake in 0-RTT data.
+// Token issuance and the session handler still wait for the TLS
+// handshake to complete, so replayed early data cannot reach them.
+func (serverOptionsNamespace) Allow0RTT() ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.allow0RTT = true
+	}
+}
+
+// NoAuth admits every login regardless of the presented token.
+func (serverOptionsNamespace) NoAuth() ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.noAuth = true
+	}
+}
+
+// AllowGuests admits clients asking for a guest session without consulting the TokenRepo.
+func (serverOptionsNamespace) AllowGuests() ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.allowGuests = true
+	}
+}
+
+func (serverOptionsNamespace) TokenApprover(approver TokenApprover) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.approver = approver
+	}
+}
+
+func (serverOptionsNamespace) TokenGenerator(gen TokenGenerator) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.tokenGen = gen
+	}
+}
+
+// AdminHandler routes clients logging in with the given secret as token
+// to the built-in admin handler instead of the configured Handler,
+// see ClientOptions.AdminSecret.
+func (serverOptionsNamespace) AdminHandler(secret [16]byte) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.adminSecret = &secret
+	}
+}
+
+// TokenRateLimit limits the messages received from all sessions of a token
+// to rate per second with the given burst. Sessions without a token, of
+// guests and of servers without authentication, are limited each alike.
+func (serverOptionsNamespace) TokenRateLimit(rate float64, burst int) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.rateLimit = rate
+		cfg.rateBurst = burst
+	}
+}
+
+// RateLimitAction sets how messages exceeding the TokenRateLimit are
+// treated. The default is RateLimitDrop.
+func (serverOptionsNamespace) RateLimitAction(action RateLimitAction) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.rateLimitAction = action
+	}
+}
+
+// DuplicateLoginPolicy sets how logins of a token with active sessions
+// are treated. The default is DuplicateAllowAll.
+func (serverOptionsNamespace) DuplicateLoginPolicy(policy DuplicateLoginPolicy) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.duplicateLogin = policy
+	}
+}
+
+// WriteRateLimit limits the bytes written to every session to rate
+// per second with the given burst, see Session.SetWriteRateLimit.
+func (serverOptionsNamespace) WriteRateLimit(rate float64, burst int) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.writeRate = rate
+		cfg.writeBurst = burst
+	}
+}
+
+// InboundFilter sets the filter applied to messages received from clients.
+func (serverOptionsNamespace) InboundFilter(f MessageFilter) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.inboundFilter = f
+	}
+}
+
+// OutboundFilter sets the filter applied to messages sent to clients.
+func (serverOptionsNamespace) OutboundFilter(f MessageFilter) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.outboundFilter = f
+	}
+}
+
+// FilterTimeout sets how long a message filter may take, one second by
+// default. The filter must honour the context it is passed, see MessageFilter.
+func (serverOptionsNamespace) FilterTimeout(d time.Duration) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.filterTimeout = d
+	}
+}
+
+// MaxViolations disconnects a session after n inbound messages rejected
+// by the filter. Zero never disconnects.
+func (serverOptionsNamespace) MaxViolations(n int) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.maxViolations = n
+	}
+}
+
+// MessageSink sets the sink receiving every inbound text and binary message.
+func (serverOptionsNamespace) MessageSink(sink MessageSink) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.sink = sink
+	}
+}
+
+// SinkQueue sets the number of records buffered for the sink and
+// what happens when the buffer is full.
+func (serverOptionsNamespace) SinkQueue(size int, overflow SinkOverflow) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.sinkQueue = size
+		cfg.sinkOverflow = overflow
+	}
+}
+
+// MessageStore sets the store keeping messages for offline recipients.
+func (serverOptionsNamespace) MessageStore(store MessageStore) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.store = store
+	}
+}
+
+// OfflineNotifier sets the hook called for every message stored for an offline recipient.
+func (serverOptionsNamespace) OfflineNotifier(notifier OfflineNotifier) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.notifier = notifier
+	}
+}
+
+// HandlerTimeout sets a deadline on the context passed to the handler.
+// A handler still running a grace period after the deadline, as long as
+// d up to five seconds, gets its stream and connection closed with
+// codes.HandlerTimeout.
+func (serverOptionsNamespace) HandlerTimeout(d time.Duration) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.handlerTimeout = d
+	}
+}
+
+// Source sets the source of IDs and timestamps for messages sent by sessions.
+func (serverOptionsNamespace) Source(src Source) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.src = src
+	}
+}
+
+// TokenRotation rotates the token of every authenticated session
+// after each interval, see Server.RotateToken.
+func (serverOptionsNamespace) TokenRotation(interval time.Duration) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.rotateEvery = interval
+	}
+}
+
+// AllowCIDR allows connections only from the given CIDRs or addresses.
+// It may be given several times, see also DenyCIDR.
+func (serverOptionsNamespace) AllowCIDR(cidrs ...string) ServerOption {
+	return func(cfg *serverConfig) {
+		prefixes, err := parsePrefixes(cidrs)
+		cfg.ipErr = errors.Join(cfg.ipErr, err)
+		cfg.ipFilter.allow = append(cfg.ipFilter.allow, prefixes...)
+	}
+}
+
+// DenyCIDR refuses connections from the given CIDRs or addresses,
+// even if they are inside an allowed CIDR.
+func (serverOptionsNamespace) DenyCIDR(cidrs ...string) ServerOption {
+	return func(cfg *serverConfig) {
+		prefixes, err := parsePrefixes(cidrs)
+		cfg.ipErr = errors.Join(cfg.ipErr, err)
+		cfg.ipFilter.deny = append(cfg.ipFilter.deny, prefixes...)
+	}
+}
+
+// AccessLog sets the hook receiving one record per terminated connection.
+func (serverOptionsNamespace) AccessLog(hook AccessLog) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.accessLog = hook
+	}
+}
+
+// Expvar publishes Server.Stats under the given name
+// so that it is served by the expvar /debug/vars handler.
+func (serverOptionsNamespace) Expvar(name string) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.expvar = name
+	}
+}
+
+// WrapListener sets a function wrapping the listener of the server,
+// e.g. to observe or filter accepted connections.
+func (serverOptionsNamespace) WrapListener(wrap func(Listener) Listener) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.wrapListener = wrap
+	}
+}
+
+// PanicHook is called with the recovered value and the stack trace
+// when a handler panics.
+type PanicHook func(ctx context.Context, s *Session, recovered any, stack []byte)
+
+// OnPanic sets the hook reporting handler panics, e.g. to an error
+// tracker. The connection is closed with codes.Internal after it returns.
+func (serverOptionsNamespace) OnPanic(hook PanicHook) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.onPanic = hook
+	}
+}
+
+// maxLoggedStack bounds the length of a panic stack trace written to the log.
+const maxLoggedStack = 4096
+
+// handlerGrace is the longest time a handler has to return after its
+// timeout, shorter timeouts grant as much grace as they last.
+const handlerGrace = 5 * time.Second
+
+// Listener is satisfied by both *quic.Listener and *quic.EarlyListener.
+type Listener interface {
+	Accept(ctx context.Context) (*quic.Conn, error)
+	Close() error
+	Addr() net.Addr
+}
+
 // Server provides chat sessions.
 type Server struct {
-	cfg        serverConfig
-	lnr        *quic.Listener
-	conns      map[*quic.Conn]struct{}
+	cfg    serverConfig
+	lnrs   []Listener
+	trs    []*quic.Transport // transports of lnrs, see closeTransports
+	topics *Topics
+	conns  map[*quic.Conn]struct{}
+	// closed is set by Stop and Shutdown, after which accepted
+	// connections are no longer tracked in conns and sessionsWG.
+	closed     bool
+	state      ServerState
+	health     *http.Server
+	sessions   map[uint64]*Session
+	byToken    map[[16]byte]map[uint64]*Session
 	sessionsWG sync.WaitGroup
+	lastID     uint64
+	accepted   uint64
+	started    time.Time
+	limiter    *limiter[[16]byte]
+	anonymous  *limiter[uint64]
+	breaker    *breaker
+	replay     *replays
+	rotations  map[[16]byte]rotation
+	cluster    *cluster
+
+	sinkq       chan sinkItem
+	sinkDone    chan struct{}
+	sinkDropped uint64
+	expired     uint64
+	duplicates  uint64
+	forbidden   uint64
+	// mutedDropped counts messages of muted sessions, see Mute.
+	mutedDropped uint64
+	// protoViolations counts violations of the protocol, see ServerOptions.Strict.
+	protoViolations uint64
+	drops           Drops
+
+	accessq       chan AccessRecord
+	accessDone    chan struct{}
+	accessDropped uint64
+
+	usage     *usageLRU
+	usageDone chan struct{}
+
+	handshakeFailures uint64
+	// halfOpen is the number of QUIC handshakes in flight,
+	// see ServerOptions.RequireAddressValidation.
+	halfOpen          atomic.Int64
+	retriesSent       uint64
+	validationsFailed uint64
+	tokenMismatches   uint64
+	relayedOut        uint64
+	relayFailed       uint64
+	callbackPanics    uint64
+	acceptErrors      uint64
+	lastAcceptErr     error
+	bytesIn           uint64
+	bytesOut          uint64
+	pumps             atomic.Int64
+
+	level levelVar
 
 	mtx    sync.Mutex
 	ctx    context.Context
@@ -108,17 +544,80 @@ func NewServer(opts ...ServerOption) *Server {
 	for _, opt := range opts {
 		opt(&cfg)
 	}
-	return &Server{
-		cfg:   cfg,
-		conns: make(map[*quic.Conn]struct{}),
+	if cfg.ids != nil {
+		cfg.src.IDs = cfg.ids
+	}
+	s := &Server{
+		cfg:       cfg,
+		conns:     make(map[*quic.Conn]struct{}),
+		sessions:  make(map[uint64]*Session),
+		byToken:   make(map[[16]byte]map[uint64]*Session),
+		rotations: make(map[[16]byte]rotation),
+		topics:    newTopics(),
+		usage:     newUsageLRU(cfg.usageTokens),
+	}
+	if cfg.rateLimit > 0 {
+		s.limiter = newLimiter[[16]byte](cfg.rateLimit, cfg.rateBurst)
+		s.anonymous = newLimiter[uint64](cfg.rateLimit, cfg.rateBurst)
+	}
+	s.breaker = s.newBreaker()
+	if cfg.replayBuffer > 0 {
+		s.replay = newReplays(cfg.replayBuffer)
+	}
+	if cfg.clusterSecret != nil {
+		s.cluster = &cluster{remote: make(map[string]map[[16]byte]struct{})}
 	}
+	if cfg.sink != nil {
+		s.sinkq = make(chan sinkItem, cfg.sinkQueue)
+		s.sinkDone = make(chan struct{})
+	}
+	if cfg.accessLog != nil {
+		s.accessq = make(chan AccessRecord, defaultAccessQueue)
+		s.accessDone = make(chan struct{})
+	}
+	if cfg.usageSink != nil && cfg.usageEvery > 0 {
+		s.usageDone = make(chan struct{})
+	}
+	s.cfg.logger = cfg.logger.leveled(&s.level)
+	if cfg.expvar != "" {
+		s.publishExpvar(cfg.expvar)
+	}
+	return s
+}
+
+// SetLogLevel sets the minimum level of messages passed to the logger.
+// It takes effect immediately, also for running sessions.
+func (s *Server) SetLogLevel(lvl LogLevel) {
+	s.level.Store(lvl)
+}
+
+// LogLevel returns the minimum level of messages passed to the logger.
+func (s *Server) LogLevel() LogLevel {
+	return s.level.Load()
 }
 
 // Run starts the QUIC server and begins accepting incoming connections.
-func (s *Server) Run() error {
-	crt, err := tls.LoadX509KeyPair(s.cfg.tlsCertFile, s.cfg.tlsKeyFile)
-	if err != nil {
-		return fmt.Errorf("load cert: %w", err)
+func (s *Server) Run() (err error) {
+	defer func() { err = categorize("run", err) }()
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	s.cfg.logger.With("config", s.ConfigSummary()).Info("server configuration")
+	if err := s.serveHealth(); err != nil {
+		return err
+	}
+	var crt tls.Certificate
+	switch {
+	case s.cfg.tlsCert != nil:
+		crt = *s.cfg.tlsCert
+	case s.cfg.devTLS:
+		if crt, err = keygen.TLSCert(nil, 24*time.Hour); err != nil {
+			return errors.Join(fmt.Errorf("generate dev cert: %w", err), s.stopped())
+		}
+	default:
+		if crt, err = tls.LoadX509KeyPair(s.cfg.tlsCertFile, s.cfg.tlsKeyFile); err != nil {
+			return errors.Join(fmt.Errorf("load cert: %w", err), s.stopped())
+		}
 	}
 
 	tlsCfg := &tls.Config{
@@ -126,111 +625,439 @@ func (s *Server) Run() error {
 		NextProtos:   []string{"quic-raw"},
 	}
 
-	quicCfg := &quic.Config{}
+	quicCfg := &quic.Config{
+		Allow0RTT: s.cfg.allow0RTT,
+		Tracer:    mtuTracer,
+	}
+	if s.cfg.maxStreams > 0 {
+		// the login stream and room for refusing excess streams
+		quicCfg.MaxIncomingStreams = int64(s.cfg.maxStreams) + 1 + maxStreamRefusals
+	}
 
-	lnr, err := quic.ListenAddr(s.cfg.address, tlsCfg, quicCfg)
+	links, err := s.peerLinks()
+	if err != nil {
+		return errors.Join(err, s.stopped())
+	}
+	lnrs, trs, err := s.listenAll(tlsCfg, quicCfg)
 	if err != nil {
-		return fmt.Errorf("listen %s: %w", s.cfg.address, err)
+		return errors.Join(err, s.stopped())
 	}
 
 	s.mtx.Lock()
-	s.lnr = lnr
+	s.lnrs = lnrs
+	s.trs = trs
+	s.state = StateServing
+	s.started = time.Now()
 	s.ctx, s.cancel = context.WithCancel(context.Background())
 	s.mtx.Unlock()
+	switch repo := s.cfg.tokenRepo.(type) {
+	case *MemTokenRepo:
+		repo.attach(s.ctx.Done(), s.tokenEvicted)
+	case *BatchingTokenRepo:
+		repo.attach(s.cfg.logger, s.cfg.metrics)
+	}
+
+	if s.sinkq != nil {
+		go s.runSink()
+	}
+	if s.accessq != nil {
+		go s.runAccessLog()
+	}
+	if s.usageDone != nil {
+		go s.runUsage()
+	}
+	if s.cluster != nil {
+		s.connectPeers(links)
+	}
 
 	return s.serve()
 }
 
-func closeConn(conn *quic.Conn, code codes.Code) error {
-	return conn.CloseWithError(quic.ApplicationErrorCode(code), code.String())
+// Addr returns the first address the server listens on,
+// or nil if it is not running, see Addrs.
+func (s *Server) Addr() net.Addr {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.lnrs) == 0 {
+		return nil
+	}
+	return s.lnrs[0].Addr()
 }
 
-func (s *Server) serve() (err error) {
+// maxCloseReason bounds the reason phrase of a connection close,
+// which has to fit in a single packet.
+const maxCloseReason = 256
+
+// closeConn closes the connection with the code and the reason phrase
+// made of its name and the detail, see closeReason.
+func closeConn(conn *quic.Conn, code codes.Code, detail string) error {
+	return conn.CloseWithError(quic.ApplicationErrorCode(code), closeReason(code, detail))
+}
+
+// closeReason formats the reason phrase of a connection close as
+// "<code name>: <detail>", or just the name without detail. The detail
+// is cut to keep the phrase within maxCloseReason bytes.
+func closeReason(code codes.Code, detail string) string {
+	reason := code.String()
+	if detail == "" {
+		return reason
+	}
+	reason += ": " + detail
+	if len(reason) <= maxCloseReason {
+		return reason
+	}
+	reason = reason[:maxCloseReason]
+	for !utf8.ValidString(reason) {
+		reason = reason[:len(reason)-1]
+	}
+	return reason
+}
+
+// accept serves the connections accepted by the listener until it is closed.
+func (s *Server) accept(lnr Listener) (err error) {
 	defer func() {
-		if cerr := s.lnr.Close(); cerr != nil {
-			err = errors.Join(err, fmt.Errorf("close listener: %w", cerr))
+		if cerr := lnr.Close(); cerr != nil {
+			err = errors.Join(err, fmt.Errorf("close listener %s: %w", lnr.Addr(), cerr))
 		}
 	}()
 
+	var backoff time.Duration
 	for {
-		conn, err := s.lnr.Accept(s.ctx)
+		conn, err := lnr.Accept(s.ctx)
 		if err != nil {
 			if errors.Is(err, quic.ErrServerClosed) ||
 				errors.Is(err, context.Canceled) {
 				return nil
 			}
-			return errors.Join(fmt.Errorf("accept connection: %w", err), s.Stop())
+			s.mtx.Lock()
+			s.acceptErrors++
+			s.lastAcceptErr = err
+			s.mtx.Unlock()
+			if !transient(err) {
+				return errors.Join(fmt.Errorf("accept connection: %w", err), s.stop())
+			}
+			backoff = nextBackoff(backoff)
+			s.cfg.logger.With("error", err, "retry", backoff).Warn("transient accept error")
+			select {
+			case <-time.After(backoff):
+			case <-s.ctx.Done():
+				return nil
+			}
+			continue
 		}
+		backoff = 0
+		s.established(conn)
 		lgr := s.cfg.logger.With("addr", conn.RemoteAddr().String())
+		if !s.cfg.ipFilter.allowed(conn.RemoteAddr()) {
+			lgr.Warn("address forbidden, closing connection")
+			s.mtx.Lock()
+			s.forbidden++
+			s.mtx.Unlock()
+			if err := closeConn(conn, codes.Forbidden, "address not allowed"); err != nil {
+				lgr.With("error", err).Error("failed to close conn")
+			}
+			s.logAccess(conn, AccessRecord{
+				RemoteAddr: conn.RemoteAddr().String(),
+				Outcome:    OutcomeForbidden,
+				Started:    time.Now(),
+			})
+			continue
+		}
+		if code, ok := s.track(conn); !ok {
+			lgr.With("code", code).Info("not serving connection, closing it")
+			detail := ""
+			if code == codes.ToManyConns {
+				detail = fmt.Sprintf("limit of %d connections reached", s.cfg.maxConns)
+			}
+			if err := closeConn(conn, code, detail); err != nil {
+				lgr.With("error", err).Error("failed to close conn")
+			}
+			continue
+		}
 		lgr.Info("connection accepted")
+		go s.serveConn(conn, lgr)
+	}
+}
+
+// track registers the accepted connection and counts it in sessionsWG,
+// unless the server is closed, so that Shutdown never waits on a
+// connection added after it started waiting. The code to close an
+// untracked connection with is returned too, see MaxConns.
+func (s *Server) track(conn *quic.Conn) (codes.Code, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return codes.StopServer, false
+	}
+	if s.cfg.maxConns > 0 && len(s.conns) >= s.cfg.maxConns {
+		return codes.ToManyConns, false
+	}
+	s.conns[conn] = struct{}{}
+	s.accepted++
+	s.sessionsWG.Add(1)
+	return codes.Done, true
+}
 
+// close stops tracking connections accepted from now on and returns
+// those tracked so far, along with the transports to close after them.
+func (s *Server) close() ([]*quic.Conn, []*quic.Transport) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.closed = true
+	conns := make([]*quic.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.conns = make(map[*quic.Conn]struct{})
+	trs := s.trs
+	s.trs = nil
+	return conns, trs
+}
+
+func (s *Server) serveConn(c *quic.Conn, lgr Logger) {
+	code := codes.Done
+	detail := ""
+	rec := AccessRecord{
+		RemoteAddr: c.RemoteAddr().String(),
+		Outcome:    OutcomeFailed,
+		Started:    time.Now(),
+	}
+	defer func() {
+		if err := closeConn(c, code, detail); err != nil {
+			lgr.With("error", err).Error("failed to close conn")
+		}
+		s.logAccess(c, rec)
+		cs := c.ConnectionStats()
 		s.mtx.Lock()
-		s.conns[conn] = struct{}{}
+		delete(s.conns, c)
+		s.bytesIn += cs.BytesReceived
+		s.bytesOut += cs.BytesSent
 		s.mtx.Unlock()
+		s.sessionsWG.Done()
+	}()
+	session, err := NewSession(nil, lgr, s.cfg.sessionOpts...)
+	if err != nil {
+		lgr.With("error", err).Error("failed to create session")
+		return
+	}
+	session.srv = s
+	session.src = s.cfg.src
+	session.conn = c
+	session.SetWriteRateLimit(s.cfg.writeRate, s.cfg.writeBurst)
+	session.setMaxPayload(s.cfg.maxPayload, nil)
+	session.id = s.nextID()
+	if _, err = io.ReadFull(s.cfg.src.Rand, session.sid[:]); err != nil {
+		lgr.With("error", err).Error("failed to generate session ID")
+		return
+	}
+	lgr = lgr.With("session", session.id, "sid", hex.EncodeToString(session.sid[:]))
+	session.lgr = lgr
+	ctx, cancel := context.WithCancelCause(withSession(s.ctx, session))
+	defer cancel(ErrSessionClosed)
+	stop := context.AfterFunc(c.Context(), func() {
+		cancel(context.Cause(c.Context()))
+	})
+	defer stop()
+	session.ctx, session.cancel = ctx, cancel
 
-		s.sessionsWG.Add(1)
-		go func(c *quic.Conn) {
-			defer func() {
-				if err := closeConn(c, codes.Done); err != nil {
-					lgr.With("error", err).Error("failed to close conn")
-				}
-				s.mtx.Lock()
-				delete(s.conns, c)
-				s.mtx.Unlock()
-				s.sessionsWG.Done()
-			}()
-			stream, err := s.handshake(s.ctx, c)
-			if err != nil {
-				lgr.With("error", err).Error("failed handshake")
-				return
+	_, lgn, err := s.handshake(ctx, session)
+	defer func() {
+		// a confirmed rotation moved the session to its new token
+		s.releaseToken(session, cmp.Or(session.currentToken(), lgn.token))
+	}()
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrGuestDenied):
+			code = codes.GuestDenied
+			rec.Outcome = OutcomeGuestDenied
+		case errors.Is(err, ErrTokenDenied):
+			code = codes.InvalidToken
+			rec.Outcome = OutcomeTokenDenied
+		case errors.Is(err, ErrDuplicateLogin):
+			code = codes.DuplicateLogin
+			rec.Outcome = OutcomeDuplicate
+		case errors.Is(err, ErrTokenFramesRequired):
+			code, detail = codes.ProtocolError, ErrTokenFramesRequired.Error()
+		case errors.Is(err, ErrAuthUnavailable):
+			code, detail = codes.Internal, ErrAuthUnavailable.Error()
+		case errors.Is(err, ErrRedirected):
+			code, detail = codes.Redirected, lgn.redirect
+			rec.Outcome = OutcomeRedirected
+			s.handshakeDone(session, &rec)
+			lgr.With("to", lgn.redirect).Info("client redirected")
+			return
+		case errors.Is(err, ErrProtocolMismatch):
+			code, detail = codes.ProtocolError, "token handshake expected"
+			if s.cfg.raw {
+				detail = "raw session expected"
 			}
-			session, err := NewSession(stream, lgr)
-			if err != nil {
-				lgr.With("error", err).Error("failed to create session")
-				return
+		}
+		s.handshakeDone(session, &rec)
+		lgr.With("error", err).Error("failed handshake")
+		s.mtx.Lock()
+		s.handshakeFailures++
+		s.mtx.Unlock()
+		return
+	}
+	tlsStart := time.Now()
+	select {
+	case <-c.HandshakeComplete():
+	case <-c.Context().Done():
+		s.handshakeDone(session, &rec)
+		lgr.Error("connection closed before handshake complete")
+		return
+	}
+	session.hs.TLS += time.Since(tlsStart)
+	session.guest = lgn.guest
+	session.token = lgn.token
+	session.scopes = lgn.scopes
+	session.started = time.Now()
+	rec.SessionID = session.id
+	rec.SID = hex.EncodeToString(session.sid[:])
+	switch {
+	case lgn.admin:
+		rec.Outcome = OutcomeAdmin
+	case lgn.peer:
+		rec.Outcome = OutcomePeer
+	case lgn.guest:
+		rec.Outcome = OutcomeGuest
+	case lgn.raw:
+		rec.Outcome = OutcomeRaw
+	default:
+		rec.Outcome = OutcomeAuthenticated
+	}
+	s.handshakeDone(session, &rec)
+	lgr.With(session.TransportInfo().attrs()...).Debug("transport negotiated")
+	if !session.anonymous() {
+		rec.TokenHash = tokenHash(session.currentToken())
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			code = codes.Internal
+			stack := debug.Stack()
+			lgr.With("panic", r, "stack", string(stack[:min(len(stack), maxLoggedStack)])).Error("panic in handler")
+			if s.cfg.onPanic != nil {
+				s.cfg.onPanic(ctx, session, r, stack)
 			}
-			defer func() {
-				if r := recover(); r != nil {
-					lgr.With("panic", r).Error("panic in handler")
-				}
-			}()
-			start := time.Now()
-			s.cfg.handler(s.ctx, session)
-			lgr.With("duration", time.Since(start)).Info("exit session")
-		}(conn)
+		}
+	}()
+	if lgn.admin {
+		lgr.Info("admin session started")
+		s.adminHandler(ctx, session)
+		return
+	}
+	if lgn.peer {
+		lgr.Info("peer link started")
+		s.servePeer(ctx, session)
+		return
+	}
+	s.register(session)
+	defer s.unregister(session)
+	go s.acceptStreams(ctx, session)
+	if hb := session.caps.heartbeat(); hb.enabled() {
+		go session.runHeartbeat(ctx, hb)
 	}
+	s.replayTo(ctx, session, lgn.replay)
+	if s.cfg.rotateEvery > 0 && !session.anonymous() {
+		rctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go s.autoRotate(rctx, session, s.cfg.rotateEvery)
+	}
+	if s.cfg.handlerTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.handlerTimeout)
+		defer cancel()
+		timer := time.AfterFunc(s.cfg.handlerTimeout+min(s.cfg.handlerTimeout, handlerGrace), func() {
+			lgr.Error("handler exceeded its timeout, closing connection")
+			session.Abort(codes.HandlerTimeout)
+			_ = closeConn(c, codes.HandlerTimeout, "")
+		})
+		defer timer.Stop()
+	}
+	s.cfg.handler(ctx, session)
+	lgr.With("duration", time.Since(session.started)).Info("exit session")
 }
 
-// ErrServerNotRunning indicates that a server operation was attempted while the server is not running.
+// ErrServerNotRunning indicates that a server operation was attempted while the server is not running,
+// e.g. stopping a server Run has not started.
 var ErrServerNotRunning = errors.New("server not running")
 
-// Stop terminates the server immediately, closing all active connections.
-func (s *Server) Stop() error {
-	s.cancel()
-	cerr := s.lnr.Close()
+// running reports whether Run started serving, so that there is anything to stop.
+func (s *Server) running() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.cancel != nil
+}
 
+// announceDrain tells every session that the server closes it at the
+// deadline of ctx, sent as unknown if there is none. It returns once
+// the announcements are written or ctx is done.
+func (s *Server) announceDrain(ctx context.Context) {
+	var ms int64
+	if deadline, ok := ctx.Deadline(); ok {
+		ms = deadline.UnixMilli()
+	}
+	pld := []byte("drain " + strconv.FormatInt(ms, 10))
 	s.mtx.Lock()
-	conns := make([]*quic.Conn, 0, len(s.conns))
-	for conn := range s.conns {
-		conns = append(conns, conn)
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
 	}
-	s.conns = make(map[*quic.Conn]struct{})
 	s.mtx.Unlock()
 
+	var wg sync.WaitGroup
+	for _, session := range sessions {
+		wg.Go(func() {
+			m := &Message{Type: MsgTypeControl, Payload: pld}
+			if err := session.enqueue(ctx, m, PriorityHigh); err != nil {
+				session.lgr.With("error", err).Warn("failed to announce drain")
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// Stop terminates the server immediately, closing all active connections.
+func (s *Server) Stop() error {
+	if !s.running() {
+		return categorize("stop", ErrServerNotRunning)
+	}
+	return categorize("stop", s.stop())
+}
+
+func (s *Server) stop() error {
+	conns, trs := s.close()
+	s.cancel()
+	cerr := closeListeners(s.lnrs)
+
 	errs := []error{cerr}
 	for _, conn := range conns {
 		if conn == nil {
 			continue
 		}
-		errs = append(errs, closeConn(conn, codes.StopServer))
+		errs = append(errs, closeConn(conn, codes.StopServer, "server stopped"))
 	}
+	errs = append(errs, closeTransports(trs))
+	ctx, cancel := context.WithTimeout(context.Background(), tokenFlushTimeout)
+	defer cancel()
+	errs = append(errs, s.flushTokens(ctx), s.stopped())
 	return errors.Join(errs...)
 }
 
 // Shutdown gracefully stops the server, waiting for all active sessions to complete or until the given context expires.
-func (s *Server) Shutdown(ctx context.Context) error {
+// Clients are told the deadline of ctx first, see DrainEvent.
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+	defer func() { err = categorize("shutdown", err) }()
+	if !s.running() {
+		return ErrServerNotRunning
+	}
+	s.mtx.Lock()
+	s.closed = true
+	s.state = StateDraining
+	s.mtx.Unlock()
+	s.announceDrain(ctx)
 	s.cancel()
-	cerr := s.lnr.Close()
+	cerr := closeListeners(s.lnrs)
 
 	done := make(chan struct{})
 	go func() {
@@ -242,21 +1069,34 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	case <-done:
 	case <-ctx.Done():
 	}
-
-	s.mtx.Lock()
-	conns := make([]*quic.Conn, 0, len(s.conns))
-	for conn := range s.conns {
-		conns = append(conns, conn)
+	if s.sinkDone != nil {
+		select {
+		case <-s.sinkDone:
+		case <-ctx.Done():
+		}
+	}
+	if s.accessDone != nil {
+		select {
+		case <-s.accessDone:
+		case <-ctx.Done():
+		}
+	}
+	if s.usageDone != nil {
+		select {
+		case <-s.usageDone:
+		case <-ctx.Done():
+		}
 	}
-	s.conns = make(map[*quic.Conn]struct{})
-	s.mtx.Unlock()
 
+	conns, trs := s.close()
 	errs := []error{cerr}
 	for _, conn := range conns {
 		if conn == nil {
 			continue
 		}
-		errs = append(errs, closeConn(conn, codes.StopServer))
+		errs = append(errs, closeConn(conn, codes.StopServer, "shutdown deadline passed"))
 	}
+	errs = append(errs, closeTransports(trs))
+	errs = append(errs, s.flushTokens(ctx), s.stopped())
 	return errors.Join(errs...)
 }
@@ -3,64 +3,385 @@
 package chat
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"os"
-	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/quic-go/quic-go"
-	"github.com/zhmlst/chat/internal/msg"
+	"github.com/zhmlst/chat/codes"
 )
 
 const (
-	buflen = 4096
-	chansz = 8
+	chansz    = 8
+	recentIDs = 256
 )
 
 // Session represents a QUIC session stream.
 type Session struct {
-	stream *quic.Stream
-	lgr    Logger
+	stream  *quic.Stream
+	lgr     Logger
+	guest   bool
+	id      uint64
+	sid     [16]byte
+	conn    *quic.Conn
+	started time.Time
+	// tokenMtx guards token, which a confirmed rotation replaces after
+	// login, and replaced, the token it replaced.
+	tokenMtx sync.Mutex
+	token    [16]byte
+	replaced [16]byte
+	scopes   []string
+	label    string
+	srv      *Server
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+
+	violations int
+	// limitWarn receives once the last rate limit notice is written.
+	limitWarn <-chan error
+	// protoViolations counts violations of the protocol, see ServerOptions.Strict.
+	protoViolations atomic.Int64
+	// tokenMismatches counts frames with another token, see ServerOptions.PerMessageAuth.
+	tokenMismatches atomic.Int64
+	// hs times the server handshake of the session.
+	hs     HandshakeStats
+	events chan Event
+	drops  drops
+	// recent holds IDs of the latest messages received from the peer.
+	recent *idLRU
+	src    Source
+	// ids overrides the IDs of src, see SessionOptions.IDGenerator.
+	ids IDGenerator
+	// cbs counts the panics of user callbacks, see CallbackPanicLimit.
+	cbs callbacks
+	// dedupe holds IDs of received messages if Dedupe is enabled.
+	dedupe     *idLRU
+	duplicates atomic.Uint64
+	// mute is set by Server.Mute.
+	mute mute
+	// lastSend and lastRecv are the times of the latest frames
+	// in unix nanoseconds, see runHeartbeat.
+	lastSend atomic.Int64
+	lastRecv atomic.Int64
+	traffic  traffic
+	// transcript records the frames of the session, see SessionOptions.Transcript.
+	transcript *transcript
+	e2e        e2e
+	skew       skew
+	// caps are the capabilities negotiated in the handshake,
+	// nil if there was no negotiation.
+	caps capabilities
+	// streams counts the sessions open on additional streams of the
+	// connection of a server session, see MaxStreamsPerConnection.
+	streams        atomic.Int64
+	refusedStreams atomic.Uint64
+
+	outq   *sendQueue
+	writer sync.Once
+	// coalesceAll coalesces frames unless they ask otherwise, see FlushMode.
+	coalesceAll bool
+	wlim        atomic.Pointer[writeLimiter]
+	codec       codec
+	// maxRecv and maxSend are the largest payloads received and sent,
+	// zero if unlimited, see MaxSendSize.
+	maxRecv int
+	maxSend int
+	// wdeadline is the write deadline in unix nanoseconds, zero if none.
+	wdeadline    atomic.Int64
+	writeTimeout time.Duration
+	closeTimeout time.Duration
+
+	wmtx  sync.Mutex
+	typed time.Time
+
+	// rmtx guards the read deadline state and the pump error.
+	rmtx      sync.Mutex
+	rdeadline time.Time
+	rpartial  []byte
+	err       error
+
+	// chmtx guards the channels.
+	chmtx    sync.Mutex
+	chans    map[uint16]*Channel
+	autoOpen bool
 }
 
 // NewSession a new chat session.
-func NewSession(stream *quic.Stream, lgr Logger) (*Session, error) {
-	return &Session{
+func NewSession(stream *quic.Stream, lgr Logger, opts ...SessionOption) (*Session, error) {
+	s := &Session{
 		stream: stream,
 		lgr:    lgr,
-	}, nil
+		events: make(chan Event, chansz),
+		recent: newIDLRU(recentIDs),
+		src:    DefaultSource,
+		outq:   newSendQueue(),
+		cbs:    callbacks{limit: defaultCallbackPanics},
+
+		closeTimeout: defaultCloseTimeout,
+	}
+	s.ctx, s.cancel = context.WithCancelCause(context.Background())
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// ID returns the identifier the server registered the session under.
+// It is zero for sessions not created by a Server.
+func (s *Session) ID() uint64 {
+	return s.id
+}
+
+// SessionID returns the random ID the server generated for the connection
+// of the session and sent to the client in the handshake, so that logs
+// of both ends can be correlated. Sessions opened on additional streams
+// share it. It is zero for sessions not created by a Server or Client.
+func (s *Session) SessionID() [16]byte {
+	return s.sid
+}
+
+// Logger returns the logger of the session. On a server it carries
+// the session ID and the remote address of the client.
+func (s *Session) Logger() Logger {
+	return s.lgr
+}
+
+// Context returns the context of the session. It is cancelled with
+// a *StreamResetError as cause when the peer resets the stream. On a server
+// it is also cancelled when the connection of the session closes, with
+// the close error as cause.
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// anonymous reports whether the session has no token identifying its user.
+func (s *Session) anonymous() bool {
+	return s.guest || s.currentToken() == [16]byte{}
+}
+
+// currentToken returns the token of the session, see Server.RotateToken.
+func (s *Session) currentToken() [16]byte {
+	s.tokenMtx.Lock()
+	defer s.tokenMtx.Unlock()
+	return s.token
+}
+
+// setToken replaces the token of the session by tok.
+func (s *Session) setToken(tok [16]byte) {
+	s.tokenMtx.Lock()
+	defer s.tokenMtx.Unlock()
+	s.token, s.replaced = tok, s.token
+}
+
+// IsGuest reports whether the session was admitted as a guest without a token.
+func (s *Session) IsGuest() bool {
+	return s.guest
+}
+
+// Recv reads the next message of channel 0 from the session stream.
+// Messages of other channels are passed to them, see Channel.
+// Messages dropped by the server's rate limit or inbound filter are skipped,
+// control messages are delivered to Events instead. Cancelling ctx
+// interrupts a blocked Recv, a frame interrupted is completed by the next.
+func (s *Session) Recv(ctx context.Context) (*Message, error) {
+	for {
+		m, err := s.recv(ctx)
+		if err != nil {
+			return nil, categorize("recv", err)
+		}
+		if m.Channel == 0 {
+			return m, nil
+		}
+		s.routeChannel(ctx, m)
+	}
+}
+
+// recv reads the next message of any channel.
+func (s *Session) recv(ctx context.Context) (*Message, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		m, err := s.rcvMessage(ctx)
+		if errors.Is(err, ErrUnknownFlag) || errors.Is(err, ErrInvalidMetadata) {
+			s.lgr.With("error", err).Warn("skipping message")
+			continue
+		}
+		if errors.Is(err, ErrPayloadTooLarge) {
+			s.lgr.With("error", err).Warn("frame too large, aborting session")
+			s.Abort(codes.FrameTooLarge)
+			return nil, err
+		}
+		if err != nil {
+			return nil, s.peerReset(err)
+		}
+		if s.srv != nil {
+			if s.tokenMismatch(m) {
+				continue
+			}
+			if merr := s.codec.malformed(m); merr != nil && s.protocolViolation(merr) {
+				continue
+			}
+			s.srv.checkSkew(s, m)
+		}
+		if pinged(m) {
+			continue
+		}
+		if s.srv != nil && s.srv.rotated(ctx, s, m) {
+			continue
+		}
+		if s.srv != nil && s.srv.topicCommand(ctx, s, m) {
+			continue
+		}
+		if s.channelClosed(m) {
+			continue
+		}
+		if ev, ok := s.parseEvent(m); ok {
+			if _, ok := ev.(RawControlEvent); ok {
+				cmd, _, _ := bytes.Cut(m.Payload, []byte(" "))
+				if s.protocolViolation(fmt.Errorf("%w: control command %q", ErrMalformedFrame, cmd)) {
+					continue
+				}
+			}
+			if e, ok := ev.(EditEvent); ok && s.srv != nil {
+				if ev = s.srv.inboundEdit(ctx, s, m, e); ev == nil {
+					continue
+				}
+			}
+			s.dispatchEvent(ev)
+			continue
+		}
+		if s.duplicate(ctx, m) {
+			continue
+		}
+		if s.srv == nil && m.HasFlag(FlagEncrypted) {
+			if err := s.decrypt(m); err != nil {
+				s.lgr.With("error", err, "id", m.ID).Debug("dropping encrypted message")
+				continue
+			}
+		}
+		if s.srv != nil {
+			if m = s.srv.inbound(ctx, s, m); m == nil {
+				continue
+			}
+			s.srv.archive(s, m, false)
+		}
+		// only accepted messages may be edited or deleted
+		if m.Type == MsgTypeText || m.Type == MsgTypeBinary {
+			s.recent.add(m.ID)
+		}
+		return m, nil
+	}
 }
 
-// Input returns a channel that receives incoming data from the session stream.
+// inbound passes a message received by the session through its mute,
+// the rate limit and the inbound filter. It returns the message to
+// deliver, nil if it is dropped.
+func (s *Server) inbound(ctx context.Context, session *Session, m *Message) *Message {
+	if s.muted(ctx, session, m) {
+		return nil
+	}
+	if !s.allowMessage(ctx, session) {
+		return nil
+	}
+	return s.filterInbound(ctx, session, m)
+}
+
+// inboundEdit passes the new payload of an edit received in the control
+// message m like a text message with the ID of the edited message, see
+// inbound. It returns the edit to dispatch, nil if it is dropped, as it
+// is if the edited message is not one the session sent.
+func (s *Server) inboundEdit(ctx context.Context, session *Session, m *Message, e EditEvent) Event {
+	if !session.ownMessage(e.ID) {
+		return nil
+	}
+	edit := &Message{Type: MsgTypeText, ID: e.ID, Timestamp: m.Timestamp, Payload: e.Payload}
+	if edit = s.inbound(ctx, session, edit); edit == nil {
+		return nil
+	}
+	edit.ID = e.ID
+	s.archive(session, edit, true)
+	e.Payload = edit.Payload
+	return e
+}
+
+// Send writes the message to the session stream at the default priority
+// of its type: control messages and acks first, binary messages last.
+// A message dropped by the server's outbound filter is not an error,
+// an invalid one is, see Message.Validate. Send returns once ctx is done,
+// interrupting the write of the message; a frame interrupted halfway
+// leaves the stream unusable and the session is aborted, see WriteTimeout.
+func (s *Session) Send(ctx context.Context, m *Message) error {
+	return s.SendPriority(ctx, m, m.Type.priority())
+}
+
+// SendPriority writes the message to the session stream ahead of
+// queued messages of lower priority. Lower priority messages
+// still progress when higher priority ones keep coming.
+func (s *Session) SendPriority(ctx context.Context, m *Message, prio Priority) (err error) {
+	defer func() { err = categorize("send", err) }()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	if err := s.checkSize(m); err != nil {
+		return err
+	}
+	if s.srv != nil {
+		var err error
+		if m, err = s.srv.filterOutbound(ctx, s, m); err != nil || m == nil {
+			return err
+		}
+	}
+	return s.enqueue(ctx, m, prio)
+}
+
+// Input returns a channel that receives payloads of incoming text and binary messages.
 func (s *Session) Input(ctx context.Context) <-chan []byte {
 	ch := make(chan []byte, chansz)
-	buf := make([]byte, buflen)
 	go func() {
+		defer s.trackPump()()
 		defer close(ch)
 		for {
-			n, err := s.stream.Read(buf)
+			m, err := s.Recv(ctx)
 			if err != nil {
+				s.setErr(err)
 				return
 			}
+			if m.Type != MsgTypeText && m.Type != MsgTypeBinary {
+				s.lgr.With("type", m.Type).Debug("skipping non-data message")
+				continue
+			}
 			select {
 			case <-ctx.Done():
 				return
 			case <-s.stream.Context().Done():
 				return
-			case ch <- append([]byte(nil), buf[:n]...):
+			case ch <- m.Payload:
 			}
 		}
 	}()
 	return ch
 }
 
-// Output returns a channel where writing to it sends data to the session stream.
+// Output returns a channel where writing to it sends text messages to the session stream.
 func (s *Session) Output(ctx context.Context) chan<- []byte {
 	ch := make(chan []byte, chansz)
 	go func() {
-		defer func() { _ = s.stream.Close() }()
+		defer s.trackPump()()
+		defer func() { _ = s.CloseSend() }()
 		for {
 			select {
 			case <-ctx.Done():
@@ -71,7 +392,13 @@ func (s *Session) Output(ctx context.Context) chan<- []byte {
 				if !ok {
 					return
 				}
-				if _, err := s.stream.Write(buf); err != nil {
+				err := s.Send(ctx, &Message{Type: MsgTypeText, Payload: buf})
+				if errors.Is(err, ErrMessageRejected) {
+					s.lgr.With("error", err).Warn("outbound message rejected")
+					continue
+				}
+				if err != nil {
+					s.setErr(err)
 					return
 				}
 			}
@@ -80,6 +407,59 @@ func (s *Session) Output(ctx context.Context) chan<- []byte {
 	return ch
 }
 
+// trackPump counts a running session goroutine in the server stats
+// and returns the function to call when it exits.
+func (s *Session) trackPump() func() {
+	if s.srv == nil {
+		return func() {}
+	}
+	s.srv.pumps.Add(1)
+	return func() { s.srv.pumps.Add(-1) }
+}
+
+// CloseSend closes the send direction once the queued messages are written.
+// The peer reads them followed by io.EOF, while the session keeps receiving
+// until the peer closes its direction too. Sending afterwards fails with ErrSendClosed.
+// A peer which does not read them in time gets the session aborted, see CloseTimeout.
+func (s *Session) CloseSend() error {
+	s.writer.Do(func() { go s.writeLoop() })
+	req := &writeReq{ctx: context.Background(), done: make(chan error, 1)}
+	s.outq.finish(req)
+	deadline := s.closeDeadline()
+	if deadline.IsZero() {
+		return <-req.done
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case err := <-req.done:
+		return err
+	case <-timer.C:
+		s.lgr.Warn("queued messages not written in time, aborting session")
+		s.Abort(codes.SlowConsumer)
+		return fmt.Errorf("close send: %w", os.ErrDeadlineExceeded)
+	}
+}
+
+// Close closes the send direction like CloseSend and stops receiving.
+func (s *Session) Close() error {
+	err := s.CloseSend()
+	s.stream.CancelRead(quic.StreamErrorCode(codes.Done))
+	return err
+}
+
+// Abort closes both directions immediately, discarding queued messages.
+// The peer gets the code as the stream error.
+func (s *Session) Abort(code codes.Code) {
+	s.stream.CancelWrite(quic.StreamErrorCode(code))
+	s.stream.CancelRead(quic.StreamErrorCode(code))
+}
+
+// control sends a control message to the peer.
+func (s *Session) control(pld []byte) error {
+	return s.sendMessage(&Message{Type: MsgTypeControl, Payload: pld})
+}
+
 // Handler defines a function type for handling sessions.
 type Handler func(ctx context.Context, s *Session)
 
@@ -88,220 +468,457 @@ var (
 	// does not match the expected size or format.
 	ErrInvalidToken = errors.New("invalid token")
 
+	// ErrAuthRequired is returned to a client running without authentication
+	// when the server refuses its login.
+	ErrAuthRequired = errors.New("server requires authentication")
+
+	// ErrGuestDenied is returned when a guest session is requested
+	// from a server that does not admit guests.
+	ErrGuestDenied = errors.New("guests not allowed")
+
+	// ErrTokenDenied is returned when the server refuses to issue a token.
+	ErrTokenDenied = errors.New("token denied")
+
+	// ErrSendClosed is returned when sending on a session after CloseSend.
+	ErrSendClosed = errors.New("send direction closed")
+
+	// ErrSessionClosed is the cause of a session context
+	// cancelled because the session ended.
+	ErrSessionClosed = errors.New("session closed")
+
 	// ErrInternal is returned when an unexpected internal server error occurs,
 	// such as failures in the handshake process or token handling.
 	ErrInternal = errors.New("internal server error")
+
+	// ErrLoginRefused is returned when the server refuses a valid token,
+	// e.g. because of its duplicate login policy.
+	ErrLoginRefused = errors.New("login refused")
 )
 
-func (c *Client) token(stream *quic.Stream, rep bool) (tok [16]byte, err error) {
+func (c *Client) token(ctx context.Context, stream io.ReadWriter, rep bool, hs *HandshakeStats) (tok [16]byte, err error) {
 	lgr := c.cfg.logger.With("op", "token")
-	rawtok, err := os.ReadFile(c.cfg.token)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		return tok, fmt.Errorf("failed to read token file: %w", err)
+	if c.cfg.secret != nil {
+		if rep {
+			return tok, ErrLoginRefused
+		}
+		return *c.cfg.secret, nil
+	}
+	tok, err = c.store.Token(c.server(), c.cfg.identity)
+	if err != nil {
+		return tok, err
+	}
+	if tok != [16]byte{} && !rep {
+		lgr.Debug("using existing token")
+		return tok, nil
 	}
-	if len(rawtok) != cap(tok) || rep {
+	// another process sharing the token file may have refreshed it meanwhile
+	tok, fetched, err := c.store.Refresh(c.server(), c.cfg.identity, tok, func() ([16]byte, error) {
 		lgr.With("rep", rep).Debug("requesting new token")
-		m, err := msg.New(stream)
-		if err != nil {
-			return tok, fmt.Errorf("failed to create message: %w", err)
-		}
-		m.SetType(msg.TypeControl)
-		if _, err = m.Write([]byte("ack")); err != nil {
-			return tok, fmt.Errorf("failed to write message: %w", err)
-		}
-		r, err := msg.Rcv(stream)
-		if err != nil {
-			return tok, fmt.Errorf("failed to receive message: %w", err)
-		}
-		rawtok, err = r.ReadFull()
-		if err != nil {
-			return tok, fmt.Errorf("failed to read message: %w", err)
-		}
-		if len(rawtok) != cap(tok) {
-			return tok, fmt.Errorf("%w: %s", ErrInvalidToken, string(rawtok))
-		}
-		lgr.Debug("received new token, saving")
-		if err := c.saveToken([16]byte(rawtok)); err != nil {
-			return tok, err
-		}
+		return c.requestToken(ctx, stream, hs)
+	})
+	if err != nil {
+		return tok, err
+	}
+	if fetched {
 		lgr.Info("new token saved")
 	} else {
-		lgr.Debug("using existing token")
+		lgr.Info("using token refreshed by another process")
 	}
-	return [16]byte(rawtok), nil
+	return tok, nil
 }
 
-func (c *Client) saveToken(tok [16]byte) (err error) {
-	lgr := c.cfg.logger.With("module", "saveToken")
-	dir := filepath.Dir(c.cfg.token)
-	if err = os.MkdirAll(dir, 0o755); err != nil {
-		return fmt.Errorf("failed to mkdir %s for token file: %w", dir, err)
+// requestToken asks the server to issue a new token.
+func (c *Client) requestToken(ctx context.Context, stream io.ReadWriter, hs *HandshakeStats) (tok [16]byte, err error) {
+	ack := []byte("ack")
+	if len(c.cfg.scopes) > 0 {
+		ack = []byte("scoped-ack " + strings.Join(c.cfg.scopes, ","))
+	}
+	if len(c.cfg.regPld) > 0 {
+		ack = append(append(ack, ' '), c.cfg.regPld...)
 	}
-	file, err := os.OpenFile(c.cfg.token, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	r, err := hs.exchange(ctx, stream, c.cfg.src, [16]byte{}, ack)
 	if err != nil {
-		return fmt.Errorf("failed to open token file: %w", err)
+		return tok, err
 	}
-	defer func() {
-		if cerr := file.Close(); cerr != nil {
-			err = errors.Join(err, fmt.Errorf("failed to close token file: %w", cerr))
-		}
-	}()
-	if _, err = file.Write(tok[:]); err != nil {
-		return fmt.Errorf("failed to save token file %s: %w", c.cfg.token, err)
+	rawtok := r.Payload
+	if string(rawtok) == "denied" {
+		return tok, ErrTokenDenied
+	}
+	if arg, ok := bytes.CutPrefix(rawtok, []byte("notice ")); ok {
+		n, _ := parseNotice(arg)
+		return tok, fmt.Errorf("%w: %s", ErrLoginRefused, n.Message)
 	}
-	lgr.Info("token file written")
+	if len(rawtok) != len(tok) {
+		return tok, fmt.Errorf("%w: %s", ErrInvalidToken, string(rawtok))
+	}
+	return [16]byte(rawtok), nil
+}
+
+func (c *Client) saveToken(tok [16]byte) error {
+	if err := c.store.SetToken(c.server(), c.cfg.identity, tok); err != nil {
+		return err
+	}
+	c.cfg.logger.With("module", "saveToken").Info("token file written")
 	return nil
 }
 
-func (c *Client) handshake(ctx context.Context, conn *quic.Conn) (stream *quic.Stream, err error) {
+func (c *Client) handshake(ctx context.Context, conn *quic.Conn, hs *HandshakeStats) (stream *quic.Stream, args handshakeArgs, err error) {
 	lgr := c.cfg.logger.With("module", "handshake", "addr", conn.RemoteAddr().String())
 	lgr.Info("starting handshake")
 
+	start := time.Now()
 	stream, err = conn.OpenStreamSync(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open stream: %w", err)
+		return nil, args, fmt.Errorf("failed to open stream: %w", err)
 	}
+	hs.Stream = time.Since(start)
 	lgr.Debug("stream opened")
-	// close stream on handshake failure
-	defer func() {
+	rw := c.cfg.transcript.teeFrames(stream, 0, conn.RemoteAddr())
+	// close stream on handshake failure, error paths return a nil stream
+	defer func(stream *quic.Stream) {
 		if err != nil {
 			if cerr := stream.Close(); cerr != nil {
 				err = errors.Join(err, fmt.Errorf("failed to close stream: %w", cerr))
 			}
 		}
-	}()
+	}(stream)
+
+	if c.cfg.raw {
+		if args, err = c.rawLogin(ctx, conn, rw, hs); err != nil {
+			return nil, args, err
+		}
+		lgr.Info("raw session admitted")
+		return stream, args, nil
+	}
+
+	if c.cfg.guest {
+		if args, err = c.guestLogin(ctx, rw, hs); err != nil {
+			return nil, args, err
+		}
+		lgr.Info("guest session admitted")
+		return stream, args, nil
+	}
 
 	attempt, maxAttempts := 1, 3
 tok:
-	tok, err := c.token(stream, attempt > 1)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get token: %w", err)
+	var tok [16]byte
+	retries := 0
+	if !c.cfg.noAuth {
+		tok, err = c.token(ctx, rw, attempt > 1, hs)
+		if err != nil {
+			return nil, args, fmt.Errorf("failed to get token: %w", err)
+		}
+		lgr.With("attempt", attempt).Debug("token obtained")
 	}
-	lgr.With("attempt", attempt).Debug("token obtained")
 
-	m, err := msg.New(stream)
+login:
+	r, err := hs.exchange(ctx, rw, c.cfg.src, tok, c.loginArg("login"))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create message: %w", err)
+		return nil, args, err
 	}
-	m.SetType(msg.TypeControl)
-	m.SetToken(tok)
-	if _, err = m.Write([]byte("login")); err != nil {
-		return nil, fmt.Errorf("failed to write message: %w", err)
+	lgr.With("attempt", attempt).Debug("login response received")
+	resp := r.Payload
+	if err := redirection(resp); err != nil {
+		return nil, args, err
 	}
-	lgr.With("attempt", attempt).Debug("login message sent")
+	args, ok := admitted(resp)
 
-	r, err := msg.Rcv(stream)
-	if err != nil {
-		return nil, fmt.Errorf("failed to receive message: %w", err)
+	if !ok && c.cfg.noAuth {
+		return nil, args, ErrAuthRequired
 	}
-	resp, err := r.ReadFull()
-	if err != nil {
-		return nil, fmt.Errorf("failed to read message: %w", err)
+	if arg, ok := bytes.CutPrefix(resp, []byte("notice ")); ok {
+		n, _ := parseNotice(arg)
+		return nil, args, fmt.Errorf("%w: %s", ErrLoginRefused, n.Message)
 	}
-
-	if string(resp) != "ok" {
+	if delay, retry := c.loginRetry(resp, retries); !ok && retry {
+		retries++
+		lgr.With("attempt", attempt, "retry", retries, "delay", delay).Warn("token unknown to the server, retrying it")
+		if err := sleep(ctx, delay); err != nil {
+			return nil, args, err
+		}
+		goto login
+	}
+	if !ok {
 		lgr.With("attempt", attempt).Warn("login response not ok, retrying")
 		if attempt > maxAttempts {
-			return nil, ErrInternal
+			return nil, args, ErrInternal
 		}
 		attempt++
 		goto tok
 	}
 
-	lgr.With("attempt", attempt).Info("handshake completed successfully")
-	return stream, nil
+	lgr.With("attempt", attempt, "sid", hex.EncodeToString(args.sid[:])).Info("handshake completed successfully")
+	c.mtx.Lock()
+	c.loginToken = tok
+	c.mtx.Unlock()
+	return stream, args, nil
+}
+
+func (c *Client) guestLogin(ctx context.Context, stream io.ReadWriter, hs *HandshakeStats) (handshakeArgs, error) {
+	r, err := hs.exchange(ctx, stream, c.cfg.src, [16]byte{}, c.loginArg("guest"))
+	if err != nil {
+		return handshakeArgs{}, err
+	}
+	if err := redirection(r.Payload); err != nil {
+		return handshakeArgs{}, err
+	}
+	args, ok := admitted(r.Payload)
+	if !ok {
+		return handshakeArgs{}, ErrGuestDenied
+	}
+	return args, nil
+}
+
+// maxTokenAttempts bounds how many times a colliding token is regenerated.
+const maxTokenAttempts = 3
+
+// ErrTokenCollision is returned when the token generator keeps producing
+// tokens that already exist in the TokenRepo.
+var ErrTokenCollision = errors.New("token collision")
+
+// RandTokenGenerator generates tokens from crypto/rand.
+func RandTokenGenerator(context.Context) (tok [16]byte, err error) {
+	_, err = rand.Read(tok[:])
+	return tok, err
+}
+
+func (s *Server) newToken(ctx context.Context) (tok [16]byte, err error) {
+	for range maxTokenAttempts {
+		tok, err = s.cfg.tokenGen(ctx)
+		if err != nil {
+			return tok, fmt.Errorf("failed to generate token: %w", err)
+		}
+		has, err := s.hasToken(ctx, tok)
+		if err != nil {
+			return tok, err
+		}
+		if !has {
+			return tok, nil
+		}
+		s.cfg.logger.Warn("generated token already exists, regenerating")
+	}
+	return tok, ErrTokenCollision
+}
+
+// login describes how a client was admitted by the server handshake.
+type login struct {
+	guest bool
+	admin bool
+	// peer is set for a server of the cluster, see ServerOptions.Cluster.
+	peer bool
+	raw  bool
+	// redirect is the address the client was redirected to.
+	redirect string
+	token    [16]byte
+	scopes   []string
+	// replay are the messages missed by a resuming client.
+	replay []*Message
 }
 
-func (s *Server) handshake(ctx context.Context, conn *quic.Conn) (stream *quic.Stream, err error) {
-	lgr := s.cfg.logger.With("addr", conn.RemoteAddr().String(), "op", "handshake")
+func (s *Server) handshake(ctx context.Context, session *Session) (stream *quic.Stream, lgn login, err error) {
+	conn := session.conn
+	lgr := session.lgr.With("op", "handshake")
 	lgr.Debug("accepting stream")
 
+	hs := &session.hs
+	// responses are stamped like the messages of the session
+	src := session.source()
+	start := time.Now()
 	stream, err = conn.AcceptStream(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to accept stream: %w", err)
+		return nil, lgn, fmt.Errorf("failed to accept stream: %w", err)
 	}
-	defer func() {
+	hs.Stream = time.Since(start)
+	session.stream = stream
+	rw := session.transcript.teeFrames(stream, session.id, conn.RemoteAddr())
+	// close stream on handshake failure, error paths return a nil stream
+	defer func(stream *quic.Stream) {
+		if errors.Is(err, ErrAuthUnavailable) {
+			pld := notice(codes.Internal, "auth_unavailable", ErrAuthUnavailable.Error())
+			if werr := writeControl(rw, src, [16]byte{}, pld); werr != nil {
+				err = errors.Join(err, fmt.Errorf("failed to write response: %w", werr))
+			}
+		}
 		if err != nil {
 			if cerr := stream.Close(); cerr != nil {
 				err = errors.Join(err, fmt.Errorf("failed to close stream: %w", cerr))
 			}
 		}
-	}()
+	}(stream)
 
 rcv:
-	r, err := msg.Rcv(stream)
+	start = time.Now()
+	var r *Message
+	err = readContext(ctx, rw, nil, func() (err error) {
+		r, err = session.codec.read(rw, 0)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to receive message: %w", err)
+		return nil, lgn, fmt.Errorf("failed to receive message: %w", err)
+	}
+	hs.roundTrip(start)
+	if merr := session.codec.malformed(r); merr != nil && session.protocolViolation(merr) {
+		goto rcv
 	}
+	session.sampleSkew(r.Timestamp, s.cfg.src.Now())
 	lgr.Debug("message received")
 
-	pld, err := r.ReadFull()
-	if err != nil {
-		return nil, fmt.Errorf("failed to read message: %w", err)
+	cmd, arg, _ := bytes.Cut(r.Payload, []byte(" "))
+	if s.cfg.raw != (string(cmd) == "raw") {
+		lgr.With("cmd", string(cmd), "raw", s.cfg.raw).Warn("peer runs the other handshake")
+		return nil, lgn, ErrProtocolMismatch
 	}
+	switch string(cmd) {
+	case "raw":
+		resp, aerr := s.admitted(ctx, arg, session, &lgn)
+		if err := writeControl(rw, src, [16]byte{}, resp); err != nil {
+			return nil, lgn, fmt.Errorf("failed to write response: %w", err)
+		}
+		if aerr != nil {
+			return nil, lgn, aerr
+		}
+		lgr.Info("raw session admitted")
+		lgn.raw = true
+		return stream, lgn, nil
 
-	switch string(pld) {
-	case "ack":
+	case "ack", "scoped-ack":
 		l := lgr.With("phase", "ack")
 		l.Debug("processing ack")
-		var tok [16]byte
-		if _, err = rand.Read(tok[:]); err != nil {
-			return nil, fmt.Errorf("failed to generate token: %w", err)
+		// token issuance is not idempotent, never serve it from replayable 0-RTT data
+		start = time.Now()
+		select {
+		case <-conn.HandshakeComplete():
+		case <-ctx.Done():
+			return nil, lgn, ctx.Err()
 		}
-		if err = s.cfg.tokenRepo.SaveToken(ctx, tok); err != nil {
-			return nil, fmt.Errorf("failed to save token: %w", err)
+		hs.TLS += time.Since(start)
+		req := TokenRequest{
+			RemoteAddr: conn.RemoteAddr(),
+			TLS:        conn.ConnectionState().TLS,
+			Payload:    arg,
 		}
-		l.Info("generated and saved token")
-
-		m, err := msg.New(stream)
+		if string(cmd) == "scoped-ack" {
+			req.Scopes, req.Payload = parseScopes(arg)
+		}
+		if s.cfg.approver != nil {
+			aerr := session.guard("token approver", func() error { return s.cfg.approver(ctx, &req) })
+			if aerr != nil {
+				l.With("error", aerr).Warn("token request denied")
+				if err := writeControl(rw, src, [16]byte{}, []byte("denied")); err != nil {
+					return nil, lgn, fmt.Errorf("failed to write response: %w", err)
+				}
+				return nil, lgn, fmt.Errorf("%w: %w", ErrTokenDenied, aerr)
+			}
+		}
+		start = time.Now()
+		tok, err := s.newToken(ctx)
+		hs.tokenRepo(start)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create token message: %w", err)
+			return nil, lgn, err
 		}
-		m.SetType(msg.TypeControl)
-		if _, err = m.Write(tok[:]); err != nil {
-			return nil, fmt.Errorf("failed to send token: %w", err)
+		start = time.Now()
+		err = s.saveToken(ctx, tok)
+		hs.tokenRepo(start)
+		if err != nil {
+			return nil, lgn, err
+		}
+		start = time.Now()
+		if err = s.saveScopes(ctx, tok, req.Scopes); err != nil {
+			return nil, lgn, err
+		}
+		if _, ok := s.cfg.tokenRepo.(ScopedTokenRepo); ok && len(req.Scopes) > 0 {
+			hs.tokenRepo(start)
+		}
+		l.With("scopes", req.Scopes).Info("generated and saved token")
+
+		if err := writeControl(rw, src, [16]byte{}, tok[:]); err != nil {
+			return nil, lgn, fmt.Errorf("failed to send token: %w", err)
 		}
 		l.Debug("token sent")
 
 	case "login":
 		l := lgr.With("phase", "login")
 		l.Debug("processing login")
-		tok := r.Token()
-		has, err := s.cfg.tokenRepo.HasToken(ctx, tok)
-		if err != nil {
-			return nil, fmt.Errorf("failed to check token: %w", err)
+		if s.cfg.adminSecret != nil && subtle.ConstantTimeCompare(r.Token[:], s.cfg.adminSecret[:]) == 1 {
+			lgn.admin = true
 		}
-
-		m, err := msg.New(stream)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create response message: %w", err)
+		if s.cfg.clusterSecret != nil && subtle.ConstantTimeCompare(r.Token[:], s.cfg.clusterSecret[:]) == 1 {
+			lgn.peer = true
+		}
+		has := s.cfg.noAuth || lgn.admin || lgn.peer
+		if !has {
+			start = time.Now()
+			has, err = s.hasToken(ctx, r.Token)
+			hs.tokenRepo(start)
+			if err != nil {
+				return nil, lgn, err
+			}
 		}
-		m.SetType(msg.TypeControl)
 
 		if !has {
-			if _, err = m.Write([]byte("no")); err != nil {
-				return nil, fmt.Errorf("failed to write response: %w", err)
+			if err := writeControl(rw, src, [16]byte{}, s.unknownToken(arg)); err != nil {
+				return nil, lgn, fmt.Errorf("failed to write response: %w", err)
 			}
 			l.Warn("unknown token, asking client to retry")
 			goto rcv
 		}
 
-		if _, err = m.Write([]byte("ok")); err != nil {
-			return nil, fmt.Errorf("failed to write response: %w", err)
+		if !lgn.admin && !lgn.peer {
+			start = time.Now()
+			if lgn.scopes, err = s.loadScopes(ctx, r.Token); err != nil {
+				return nil, lgn, err
+			}
+			if _, ok := s.cfg.tokenRepo.(ScopedTokenRepo); ok {
+				hs.tokenRepo(start)
+			}
+			if err = s.claimToken(session, r.Token); err != nil {
+				l.Warn("token already logged in, refusing login")
+				pld := notice(codes.DuplicateLogin, "duplicate_login", "token already logged in")
+				if werr := writeControl(rw, src, [16]byte{}, pld); werr != nil {
+					err = errors.Join(err, fmt.Errorf("failed to write response: %w", werr))
+				}
+				return nil, lgn, err
+			}
+		}
+		// released by serveConn, also on failure from here on
+		lgn.token = r.Token
+		resp, aerr := s.admitted(ctx, arg, session, &lgn)
+		if err := writeControl(rw, src, [16]byte{}, resp); err != nil {
+			return nil, lgn, fmt.Errorf("failed to write response: %w", err)
+		}
+		if aerr != nil {
+			return nil, lgn, aerr
+		}
+		l.With("scopes", lgn.scopes).Info("client authenticated")
+		s.confirmRotation(ctx, r.Token, nil)
+		return stream, lgn, nil
+
+	case "guest":
+		l := lgr.With("phase", "guest")
+		if !s.cfg.allowGuests {
+			if err := writeControl(rw, src, [16]byte{}, []byte("denied")); err != nil {
+				return nil, lgn, fmt.Errorf("failed to write response: %w", err)
+			}
+			l.Warn("guest denied")
+			return nil, lgn, ErrGuestDenied
+		}
+		resp, aerr := s.admitted(ctx, arg, session, &lgn)
+		if err := writeControl(rw, src, [16]byte{}, resp); err != nil {
+			return nil, lgn, fmt.Errorf("failed to write response: %w", err)
 		}
-		l.Info("client authenticated")
-		return stream, nil
+		if aerr != nil {
+			return nil, lgn, aerr
+		}
+		l.Info("guest admitted")
+		lgn.guest = true
+		return stream, lgn, nil
 
 	default:
 		l := lgr.With("phase", "unknown")
 		l.Warn("unknown message type, responding no")
-		m, err := msg.New(stream)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create response message: %w", err)
-		}
-		m.SetType(msg.TypeControl)
-		if _, err = m.Write([]byte("no")); err != nil {
-			return nil, fmt.Errorf("failed to write response: %w", err)
+		session.protocolViolation(fmt.Errorf("%w: handshake command %q", ErrMalformedFrame, cmd))
+		if err := writeControl(rw, src, [16]byte{}, []byte("no")); err != nil {
+			return nil, lgn, fmt.Errorf("failed to write response: %w", err)
 		}
 	}
 	goto rcv
@@ -0,0 +1,62 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+// handled is a running handler with the context it was given.
+type handled struct {
+	id  uint64
+	ctx context.Context
+}
+
+func TestSessionContextIsolated(t *testing.T) {
+	started := make(chan handled, 2)
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		started <- handled{s.ID(), ctx}
+		for {
+			m, err := s.Recv(ctx)
+			if err != nil {
+				return
+			}
+			if err := s.Send(ctx, chat.NewTextMessage(m.Payload)); err != nil {
+				return
+			}
+		}
+	})
+	connect(t, addr, ca)
+	kicked := receive(t, started)
+	echoes := make(chan string, 1)
+	neighbour := connect(t, addr, ca, chat.ClientOptions.OnMessage(func(m *chat.Message) { echoes <- string(m.Payload) }))
+	other := receive(t, started)
+
+	if err := srv.Disconnect(kicked.id, codes.PolicyViolation); err != nil {
+		t.Fatalf("disconnect: %v", err)
+	}
+	receive(t, kicked.ctx.Done())
+	if cause := context.Cause(kicked.ctx); errors.Is(cause, context.Canceled) {
+		t.Errorf("cancelled with cause %v, want the close of the connection", cause)
+	}
+
+	// the neighbour goes on
+	if err := other.ctx.Err(); err != nil {
+		t.Fatalf("neighbour cancelled: %v", err)
+	}
+	send(t, neighbour, "still here")
+	if text := receive(t, echoes); text != "still here" {
+		t.Errorf("echoed %q", text)
+	}
+
+	// Shutdown cancels the sessions left through the server context
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	receive(t, other.ctx.Done())
+}
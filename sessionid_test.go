@@ -0,0 +1,55 @@
+package chat_test
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestSessionIDCorrelates(t *testing.T) {
+	var srvLog, cliLog recorder
+	sids := make(chan [16]byte, 1)
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		s.Logger().Info("handled")
+		sids <- s.SessionID()
+		discard(ctx, s)
+	}, chat.ServerOptions.Logger(srvLog.log))
+	c := connect(t, addr, ca, chat.ClientOptions.Logger(cliLog.log))
+
+	sid := receive(t, sids)
+	if sid == ([16]byte{}) {
+		t.Fatal("zero session ID")
+	}
+	if got := c.SessionID(); got != sid {
+		t.Errorf("client session ID %x, server %x", got, sid)
+	}
+	tok, err := c.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sid == tok {
+		t.Error("session ID is the token")
+	}
+
+	// both ends log with the session ID
+	logged := func(rec *recorder) bool {
+		for _, l := range rec.recorded() {
+			if l.attrs["sid"] == hex.EncodeToString(sid[:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if !logged(&srvLog) {
+		t.Error("server lines lack the session ID")
+	}
+	eventually(t, func() bool { return logged(&cliLog) })
+
+	// and every connection gets its own
+	c2 := connect(t, addr, ca)
+	if sid2 := receive(t, sids); sid2 == sid || c2.SessionID() != sid2 {
+		t.Errorf("second session ID %x, client %x, first %x", sid2, c2.SessionID(), sid)
+	}
+}
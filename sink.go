@@ -0,0 +1,161 @@
+package chat
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// MessageRecord describes an inbound message passed to the MessageSink.
+type MessageRecord struct {
+	ID        [16]byte  `json:"id"`
+	Type      MsgType   `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	SessionID uint64    `json:"session_id"`
+	// TokenHash is the hex encoded SHA-256 of the sender token, empty for guests.
+	TokenHash string `json:"token_hash,omitempty"`
+	Payload   []byte `json:"payload"`
+	Size      int    `json:"size"`
+	// Encrypted marks a payload encrypted end to end, stored as received.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// OriginalTimestamp is the timestamp of the sender, set if Timestamp
+	// is the time of receipt because of its clock skew, see SkewRewrite.
+	OriginalTimestamp time.Time `json:"original_timestamp,omitzero"`
+	// Edited marks the new payload of the message with ID, edited by
+	// its sender, see Session.EditMessage.
+	Edited bool `json:"edited,omitempty"`
+}
+
+// MessageSink archives inbound messages. It is called from a dedicated
+// goroutine in the order the messages were received.
+type MessageSink func(ctx context.Context, rec MessageRecord) error
+
+// SinkOverflow defines what happens when the sink queue is full.
+type SinkOverflow int8
+
+const (
+	// SinkDrop drops the record and counts it in Stats.SinkDropped.
+	SinkDrop SinkOverflow = iota
+	// SinkBlock blocks the receiving session until the queue has room.
+	SinkBlock
+)
+
+const defaultSinkQueue = 1024
+
+type sinkItem struct {
+	session *Session
+	rec     MessageRecord
+}
+
+// archive queues an inbound text or binary message for the sink,
+// or the new payload of an edited one.
+func (s *Server) archive(session *Session, m *Message, edited bool) {
+	if s.sinkq == nil || (m.Type != MsgTypeText && m.Type != MsgTypeBinary) {
+		return
+	}
+	rec := MessageRecord{
+		ID:        m.ID,
+		Type:      m.Type,
+		Timestamp: m.Timestamp,
+		SessionID: session.id,
+		Payload:   m.Payload,
+		Size:      len(m.Payload),
+		Encrypted: m.HasFlag(FlagEncrypted),
+
+		OriginalTimestamp: m.original,
+		Edited:            edited,
+	}
+	if !session.guest {
+		rec.TokenHash = tokenHash(session.currentToken())
+	}
+	item := sinkItem{session: session, rec: rec}
+	if s.cfg.sinkOverflow == SinkBlock {
+		select {
+		case s.sinkq <- item:
+		case <-s.ctx.Done():
+		}
+		return
+	}
+	select {
+	case s.sinkq <- item:
+	default:
+		s.mtx.Lock()
+		s.sinkDropped++
+		s.mtx.Unlock()
+		session.lgr.Warn("sink queue is full, dropping record")
+	}
+}
+
+// tokenHash returns the hex encoded SHA-256 of the token.
+func tokenHash(tok [16]byte) string {
+	sum := sha256.Sum256(tok[:])
+	return hex.EncodeToString(sum[:])
+}
+
+// runSink passes queued records to the sink until the server stops,
+// then drains what is left in the queue.
+func (s *Server) runSink() {
+	defer close(s.sinkDone)
+	lgr := s.cfg.logger.With("module", "sink")
+	write := func(ctx context.Context, item sinkItem) {
+		err := item.session.guard("sink", func() error {
+			return s.cfg.sink(withSession(ctx, item.session), item.rec)
+		})
+		if err != nil {
+			lgr.With("error", err).Error("failed to sink message")
+		}
+	}
+	for {
+		select {
+		case item := <-s.sinkq:
+			write(s.ctx, item)
+		case <-s.ctx.Done():
+			for {
+				select {
+				case item := <-s.sinkq:
+					write(context.Background(), item)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// JSONLSink is a reference MessageSink appending records to a file as JSON lines.
+type JSONLSink struct {
+	mtx  sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// OpenJSONLSink opens or creates the named file for appending records.
+func OpenJSONLSink(name string) (*JSONLSink, error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("open sink file: %w", err)
+	}
+	return &JSONLSink{
+		file: file,
+		enc:  json.NewEncoder(file),
+	}, nil
+}
+
+// Sink writes the record as a single JSON line.
+func (j *JSONLSink) Sink(_ context.Context, rec MessageRecord) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return j.enc.Encode(rec)
+}
+
+// Close closes the underlying file.
+func (j *JSONLSink) Close() error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return j.file.Close()
+}
@@ -0,0 +1,175 @@
+package chat_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+// records collects the records of a sink.
+type records struct {
+	mtx  sync.Mutex
+	recs []chat.MessageRecord
+}
+
+func (r *records) sink(_ context.Context, rec chat.MessageRecord) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.recs = append(r.recs, rec)
+	return nil
+}
+
+func (r *records) len() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return len(r.recs)
+}
+
+// blocked returns a sink blocking until release is closed, then
+// counting the records in n.
+func blocked(release <-chan struct{}, n *atomic.Int64) chat.MessageSink {
+	return func(context.Context, chat.MessageRecord) error {
+		<-release
+		n.Add(1)
+		return nil
+	}
+}
+
+func TestMessageSinkOrder(t *testing.T) {
+	var recs records
+	var n atomic.Int64
+	_, addr, ca := startServer(t, counting(&n), chat.ServerOptions.MessageSink(recs.sink))
+	c := connect(t, addr, ca)
+	for i := range 20 {
+		send(t, c, fmt.Sprint(i))
+	}
+	eventually(t, func() bool { return recs.len() == 20 })
+	for i, rec := range recs.recs {
+		if string(rec.Payload) != fmt.Sprint(i) || rec.Size != len(rec.Payload) {
+			t.Errorf("record %d has payload %q of size %d", i, rec.Payload, rec.Size)
+		}
+		if rec.Type != chat.MsgTypeText || rec.TokenHash == "" || rec.Timestamp.IsZero() {
+			t.Errorf("record %d: %+v", i, rec)
+		}
+		if rec.SessionID != recs.recs[0].SessionID {
+			t.Errorf("record %d of session %d, want %d", i, rec.SessionID, recs.recs[0].SessionID)
+		}
+	}
+}
+
+func TestMessageSinkDrop(t *testing.T) {
+	release := make(chan struct{})
+	var sunk, n atomic.Int64
+	srv, addr, ca := startServer(t, counting(&n),
+		chat.ServerOptions.MessageSink(blocked(release, &sunk)),
+		chat.ServerOptions.SinkQueue(1, chat.SinkDrop),
+	)
+	c := connect(t, addr, ca)
+	for range 5 {
+		send(t, c, "hello")
+	}
+	// the session is not stalled by the sink
+	eventually(t, func() bool { return n.Load() == 5 })
+	close(release)
+	eventually(t, func() bool { return sunk.Load()+int64(srv.Stats().SinkDropped) == 5 })
+	if dropped := srv.Stats().SinkDropped; dropped < 3 {
+		t.Errorf("%d records dropped, want at least 3", dropped)
+	}
+}
+
+func TestMessageSinkBlock(t *testing.T) {
+	release := make(chan struct{})
+	var sunk, n atomic.Int64
+	srv, addr, ca := startServer(t, counting(&n),
+		chat.ServerOptions.MessageSink(blocked(release, &sunk)),
+		chat.ServerOptions.SinkQueue(1, chat.SinkBlock),
+	)
+	c := connect(t, addr, ca)
+	for range 5 {
+		send(t, c, "hello")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := n.Load(); got >= 5 {
+		t.Errorf("handler received %d messages while the sink was blocked", got)
+	}
+	close(release)
+	eventually(t, func() bool { return sunk.Load() == 5 && n.Load() == 5 })
+	if dropped := srv.Stats().SinkDropped; dropped != 0 {
+		t.Errorf("%d records dropped", dropped)
+	}
+}
+
+func TestMessageSinkFailure(t *testing.T) {
+	logged := make(chan string, 8)
+	c, got := echoed(t,
+		chat.ServerOptions.MessageSink(func(context.Context, chat.MessageRecord) error {
+			return errors.New("disk full")
+		}),
+		chat.ServerOptions.Logger(func(lvl chat.LogLevel, msg string, _ ...any) {
+			if lvl == chat.LogLevelError {
+				select {
+				case logged <- msg:
+				default:
+				}
+			}
+		}),
+	)
+	for _, text := range []string{"one", "two"} {
+		send(t, c, text)
+		if echo := receive(t, got); echo != text {
+			t.Errorf("received %q, want %q", echo, text)
+		}
+	}
+	if msg := receive(t, logged); msg != "failed to sink message" {
+		t.Errorf("logged %q", msg)
+	}
+}
+
+func TestJSONLSink(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "archive.jsonl")
+	sink, err := chat.OpenJSONLSink(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n atomic.Int64
+	srv, addr, ca := startServer(t, counting(&n), chat.ServerOptions.MessageSink(sink.Sink))
+	c := connect(t, addr, ca)
+	send(t, c, "one")
+	send(t, c, "two")
+	eventually(t, func() bool { return n.Load() == 2 })
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var texts []string
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var rec chat.MessageRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		texts = append(texts, string(rec.Payload))
+	}
+	if fmt.Sprint(texts) != "[one two]" {
+		t.Errorf("archived %q, want one and two", texts)
+	}
+}
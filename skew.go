@@ -0,0 +1,91 @@
+package chat
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// defaultSkewThreshold is the clock skew beyond which timestamps are
+// treated according to the SkewPolicy.
+const defaultSkewThreshold = time.Minute
+
+// SkewPolicy defines what the server does with text and binary messages
+// whose timestamp is off its own clock by more than the ClockSkew threshold.
+type SkewPolicy int8
+
+const (
+	// SkewMeasure keeps the timestamps as sent, the offset of the peer
+	// clock is only measured, see Session.ClockSkew.
+	SkewMeasure SkewPolicy = iota
+	// SkewRewrite replaces the timestamp with the time the message was
+	// received, keeping the original, see Message.OriginalTimestamp.
+	SkewRewrite
+)
+
+// ClockSkew sets how far the timestamps of a peer may be off the server
+// clock, 1m by default, and what happens to messages beyond it. The skew
+// is measured on every frame, from the handshake on, in either case.
+// A zero threshold keeps all timestamps as sent.
+func (serverOptionsNamespace) ClockSkew(threshold time.Duration, policy SkewPolicy) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.skewThreshold = threshold
+		cfg.skewPolicy = policy
+	}
+}
+
+// skew is the measured offset of the peer clock.
+type skew struct {
+	// offset is in nanoseconds, positive if the peer clock is ahead.
+	offset  atomic.Int64
+	sampled atomic.Bool
+	warned  atomic.Bool
+}
+
+// ClockSkew returns the estimated offset of the peer clock from that of
+// the server, positive if the peer is ahead, averaged over the frames
+// received. It includes the network delay and is zero for client sessions.
+func (s *Session) ClockSkew() time.Duration {
+	return time.Duration(s.skew.offset.Load())
+}
+
+// sampleSkew adds the offset of a frame sent at ts and received at now
+// to the estimate, weighting it by 1/8.
+func (s *Session) sampleSkew(ts, now time.Time) {
+	if ts.IsZero() {
+		return
+	}
+	sample := int64(ts.Sub(now))
+	if !s.skew.sampled.Swap(true) {
+		s.skew.offset.Store(sample)
+		return
+	}
+	// only the receiving goroutine updates the estimate
+	cur := s.skew.offset.Load()
+	s.skew.offset.Store(cur + (sample-cur)/8)
+}
+
+// checkSkew measures the skew of a received frame and applies the
+// SkewPolicy to text and binary messages beyond the threshold.
+func (s *Server) checkSkew(session *Session, m *Message) {
+	session.sampleSkew(m.Timestamp, m.received)
+	off := m.Timestamp.Sub(m.received)
+	if m.Timestamp.IsZero() || s.cfg.skewThreshold <= 0 || off.Abs() <= s.cfg.skewThreshold {
+		return
+	}
+	if !session.skew.warned.Swap(true) {
+		session.lgr.With("skew", off, "rewrite", s.cfg.skewPolicy == SkewRewrite).Warn("peer clock is off")
+	}
+	if s.cfg.skewPolicy != SkewRewrite || (m.Type != MsgTypeText && m.Type != MsgTypeBinary) {
+		return
+	}
+	m.original = m.Timestamp
+	m.Timestamp = m.received.UTC().Truncate(time.Millisecond)
+}
+
+// OriginalTimestamp returns the timestamp the sender gave the message
+// if the server replaced it with the time of receipt because of the
+// skew of the sender clock, see SkewRewrite, and zero otherwise.
+// It is not sent to other peers.
+func (m *Message) OriginalTimestamp() time.Time {
+	return m.original
+}
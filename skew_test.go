@@ -0,0 +1,70 @@
+package chat_test
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestClockSkew(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		policy  chat.SkewPolicy
+		ahead   time.Duration // of the client clock
+		rewrite bool
+	}{
+		{"measure ahead", chat.SkewMeasure, 2 * time.Hour, false},
+		{"measure behind", chat.SkewMeasure, -2 * time.Hour, false},
+		{"rewrite ahead", chat.SkewRewrite, 2 * time.Hour, true},
+		{"rewrite behind", chat.SkewRewrite, -2 * time.Hour, true},
+		{"rewrite in sync", chat.SkewRewrite, 0, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			type received struct {
+				m    *chat.Message
+				skew time.Duration
+			}
+			got := make(chan received, 1)
+			clk := &manualClock{now: time.Now().Add(-tt.ahead)}
+			_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+				m, err := s.Recv(ctx)
+				if err != nil {
+					return
+				}
+				got <- received{m, s.ClockSkew()}
+				discard(ctx, s)
+			},
+				chat.ServerOptions.Source(chat.Source{Rand: rand.Reader, Now: clk.Now}),
+				chat.ServerOptions.ClockSkew(time.Minute, tt.policy))
+			c := connect(t, addr, ca)
+
+			m := chat.NewTextMessage([]byte("hello"))
+			sent := time.Now().UTC().Truncate(time.Millisecond)
+			m.Timestamp = sent
+			if err := c.SendMessage(context.Background(), m); err != nil {
+				t.Fatal(err)
+			}
+			r := receive(t, got)
+
+			// measured under either policy, network delay aside
+			if d := r.skew - tt.ahead; d.Abs() > time.Second {
+				t.Errorf("skew %v, want about %v", r.skew, tt.ahead)
+			}
+			if !tt.rewrite {
+				if !r.m.Timestamp.Equal(sent) || !r.m.OriginalTimestamp().IsZero() {
+					t.Errorf("timestamp %v, original %v, want %v kept", r.m.Timestamp, r.m.OriginalTimestamp(), sent)
+				}
+				return
+			}
+			if want := clk.Now().UTC().Truncate(time.Millisecond); !r.m.Timestamp.Equal(want) {
+				t.Errorf("timestamp %v, want the server time %v", r.m.Timestamp, want)
+			}
+			if !r.m.OriginalTimestamp().Equal(sent) {
+				t.Errorf("original timestamp %v, want %v", r.m.OriginalTimestamp(), sent)
+			}
+		})
+	}
+}
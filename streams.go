@@ -0,0 +1,206 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/zhmlst/chat/codes"
+)
+
+// helloTimeout bounds how long the server waits for the hello
+// of a session opened on an additional stream.
+const helloTimeout = 10 * time.Second
+
+// maxStreamRefusals is how many streams beyond MaxStreamsPerConnection
+// are refused before the connection is closed with codes.RateLimited.
+const maxStreamRefusals = 3
+
+// MaxStreamsPerConnection limits the sessions a client may have open on
+// additional streams of its connection at once. Excess streams are refused
+// with a notice, see ErrStreamRefused, and the connection is closed with
+// codes.RateLimited after more than three refusals. QUIC itself caps the
+// open streams slightly above the limit. Zero means no limit.
+func (serverOptionsNamespace) MaxStreamsPerConnection(n int) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.maxStreams = n
+	}
+}
+
+// ErrStreamRefused is returned when the server refuses a new session stream.
+var ErrStreamRefused = errors.New("stream refused")
+
+// Label returns the label the client opened the session with,
+// empty for the session which logged in.
+func (s *Session) Label() string {
+	return s.label
+}
+
+// NewSession opens a session on a new stream of the active connection.
+// It shares the login of the connection, so only the label is sent to
+// the server. The session ends with the connection.
+func (c *Client) NewSession(ctx context.Context, label string) (*Session, error) {
+	c.mtx.Lock()
+	main := c.session
+	c.mtx.Unlock()
+	if main == nil {
+		return nil, ErrClientClosed
+	}
+	stream, err := main.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	if err = writeControl(stream, c.cfg.src, [16]byte{}, []byte("hello "+label)); err != nil {
+		stream.CancelRead(quic.StreamErrorCode(codes.Done))
+		return nil, fmt.Errorf("failed to write hello: %w", err)
+	}
+	r, err := readMessageContext(ctx, stream)
+	if err != nil {
+		stream.CancelWrite(quic.StreamErrorCode(codes.Done))
+		return nil, fmt.Errorf("failed to receive message: %w", err)
+	}
+	if string(r.Payload) != "ok" {
+		stream.CancelWrite(quic.StreamErrorCode(codes.Done))
+		if arg, ok := bytes.CutPrefix(r.Payload, []byte("notice ")); ok {
+			n, _ := parseNotice(arg)
+			return nil, fmt.Errorf("%w: %s", ErrStreamRefused, n.Message)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrStreamRefused, r.Payload)
+	}
+	session, err := NewSession(stream, main.lgr.With("label", label), c.cfg.sessionOpts...)
+	if err != nil {
+		return nil, err
+	}
+	session.src = c.cfg.src
+	session.conn = main.conn
+	session.sid = main.sid
+	session.caps = main.caps
+	session.token = main.currentToken()
+	session.maxRecv, session.maxSend = main.maxRecv, main.maxSend
+	session.label = label
+	session.started = time.Now()
+	return session, nil
+}
+
+// acceptStreams serves sessions the client opens on additional streams
+// of the connection of parent until ctx is done. Streams are counted
+// from their acceptance until their session ends.
+func (s *Server) acceptStreams(ctx context.Context, parent *Session) {
+	for {
+		stream, err := parent.conn.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		open := parent.streams.Add(1)
+		s.sessionsWG.Add(1)
+		go s.serveStream(ctx, parent, stream, s.cfg.maxStreams > 0 && open > int64(s.cfg.maxStreams))
+	}
+}
+
+// refuseStream answers the hello of a stream beyond the limit with a notice
+// and closes the connection of parent once it was refused too often.
+func (s *Server) refuseStream(parent *Session, stream *quic.Stream, lgr Logger) {
+	refused := parent.refusedStreams.Add(1)
+	lgr = lgr.With("refused", refused)
+	lgr.Warn("too many streams, refusing stream")
+	pld := notice(codes.RateLimited, "too_many_streams", "too many streams")
+	if err := writeControl(stream, s.cfg.src, [16]byte{}, pld); err != nil {
+		lgr.With("error", err).Debug("failed to write refusal")
+	}
+	stream.CancelRead(quic.StreamErrorCode(codes.RateLimited))
+	_ = stream.Close()
+	if refused > maxStreamRefusals {
+		lgr.Warn("too many refused streams, closing connection")
+		if err := closeConn(parent.conn, codes.RateLimited, fmt.Sprintf("%d streams refused", refused)); err != nil {
+			lgr.With("error", err).Error("failed to close conn")
+		}
+	}
+}
+
+// serveStream runs the stream handler for a session opened on an
+// additional stream. It inherits the login of parent. A stream over
+// the limit is refused after its hello.
+func (s *Server) serveStream(ctx context.Context, parent *Session, stream *quic.Stream, over bool) {
+	defer s.sessionsWG.Done()
+	defer parent.streams.Add(-1)
+	lgr := parent.lgr.With("op", "stream")
+
+	hctx, stop := context.WithTimeout(ctx, helloTimeout)
+	r, err := readMessageContext(hctx, stream)
+	stop()
+	var label []byte
+	ok := err == nil && r.Type == MsgTypeControl
+	if ok {
+		label, ok = bytes.CutPrefix(r.Payload, []byte("hello "))
+	}
+	if !ok {
+		lgr.With("error", err).Warn("invalid stream hello, closing stream")
+		stream.CancelRead(quic.StreamErrorCode(codes.PolicyViolation))
+		stream.CancelWrite(quic.StreamErrorCode(codes.PolicyViolation))
+		return
+	}
+	if over {
+		s.refuseStream(parent, stream, lgr)
+		return
+	}
+
+	session, err := NewSession(stream, lgr, s.cfg.sessionOpts...)
+	if err != nil {
+		lgr.With("error", err).Error("failed to create session")
+		return
+	}
+	session.srv = s
+	session.src = s.cfg.src
+	session.conn = parent.conn
+	session.sid = parent.sid
+	session.caps = parent.caps
+	session.maxRecv, session.maxSend = parent.maxRecv, parent.maxSend
+	session.guest = parent.guest
+	session.token = parent.currentToken()
+	session.scopes = parent.scopes
+	session.label = string(label)
+	session.SetWriteRateLimit(s.cfg.writeRate, s.cfg.writeBurst)
+	session.id = s.nextID()
+	lgr = s.cfg.logger.With("addr", parent.conn.RemoteAddr().String(), "session", session.id,
+		"sid", hex.EncodeToString(session.sid[:]), "label", session.label)
+	session.lgr = lgr
+	ctx, cancel := context.WithCancelCause(withSession(ctx, session))
+	defer cancel(ErrSessionClosed)
+	session.ctx, session.cancel = ctx, cancel
+
+	if err = writeControl(stream, session.source(), [16]byte{}, []byte("ok")); err != nil {
+		lgr.With("error", err).Error("failed to write response")
+		return
+	}
+	session.started = time.Now()
+	s.register(session)
+	defer s.unregister(session)
+	defer func() {
+		if err := session.Close(); err != nil {
+			lgr.With("error", err).Debug("failed to close stream")
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			lgr.With("panic", r, "stack", string(stack[:min(len(stack), maxLoggedStack)])).Error("panic in stream handler")
+			if s.cfg.onPanic != nil {
+				s.cfg.onPanic(ctx, session, r, stack)
+			}
+			session.Abort(codes.Internal)
+		}
+	}()
+
+	lgr.Info("stream session started")
+	hlr := s.cfg.streamHandler
+	if hlr == nil {
+		hlr = s.cfg.handler
+	}
+	hlr(ctx, session)
+	lgr.With("duration", time.Since(session.started)).Info("exit stream session")
+}
@@ -0,0 +1,103 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+// labelled answers every message with the label of the session.
+func labelled(ctx context.Context, s *chat.Session) {
+	for {
+		if _, err := s.Recv(ctx); err != nil {
+			return
+		}
+		if err := s.Send(ctx, chat.NewTextMessage([]byte(s.Label()))); err != nil {
+			return
+		}
+	}
+}
+
+// ask sends a message on the session and returns the payload of the answer.
+func ask(t *testing.T, ctx context.Context, s *chat.Session) string {
+	t.Helper()
+	if err := s.Send(ctx, chat.NewTextMessage([]byte("who"))); err != nil {
+		t.Fatalf("send on %s: %v", s.Label(), err)
+	}
+	m, err := s.Recv(ctx)
+	if err != nil {
+		t.Fatalf("recv on %s: %v", s.Label(), err)
+	}
+	return string(m.Payload)
+}
+
+func TestSessionsShareConnection(t *testing.T) {
+	srv, addr, ca := startServer(t, discard, chat.ServerOptions.StreamHandler(labelled))
+	c := connect(t, addr, ca)
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+
+	for _, label := range []string{"room-a", "room-b"} {
+		s, err := c.NewSession(ctx, label)
+		if err != nil {
+			t.Fatalf("new session %s: %v", label, err)
+		}
+		if got := ask(t, ctx, s); got != label {
+			t.Errorf("session %s served as %q", label, got)
+		}
+	}
+	if stats := srv.Stats(); stats.Accepted != 1 || stats.Conns != 1 {
+		t.Errorf("%d connections accepted, %d open, want 1 of each", stats.Accepted, stats.Conns)
+	}
+}
+
+func TestMaxStreamsPerConnection(t *testing.T) {
+	const limit = 2
+	srv, addr, ca := startServer(t, discard,
+		chat.ServerOptions.StreamHandler(labelled),
+		chat.ServerOptions.MaxStreamsPerConnection(limit))
+	c := newClient(t, addr, ca)
+	errCh := serve(t, c)
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+
+	var open []*chat.Session
+	for i := range limit {
+		s, err := c.NewSession(ctx, fmt.Sprint("room-", i))
+		if err != nil {
+			t.Fatalf("new session %d: %v", i, err)
+		}
+		open = append(open, s)
+	}
+	for i := range 3 {
+		if _, err := c.NewSession(ctx, "extra"); !errors.Is(err, chat.ErrStreamRefused) {
+			t.Fatalf("extra session %d: %v, want ErrStreamRefused", i, err)
+		}
+	}
+	// the sessions within the limit keep working
+	for _, s := range open {
+		if got := ask(t, ctx, s); got != s.Label() {
+			t.Errorf("session %s served as %q", s.Label(), got)
+		}
+	}
+	var main chat.SessionInfo
+	for _, info := range srv.Sessions() {
+		if info.Label == "" {
+			main = info
+		}
+	}
+	if main.Streams != limit || main.RefusedStreams != 3 {
+		t.Errorf("%d streams open, %d refused, want %d and 3", main.Streams, main.RefusedStreams, limit)
+	}
+
+	// and abuse ends the connection
+	_, _ = c.NewSession(ctx, "extra")
+	var cerr *chat.CloseError
+	if err := receive(t, errCh); !errors.As(err, &cerr) || cerr.Code != codes.RateLimited {
+		t.Errorf("dial: %v, want closed with RateLimited", err)
+	}
+}
@@ -0,0 +1,71 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zhmlst/chat/codes"
+)
+
+// ErrMalformedFrame describes frames a strict server counts as protocol
+// violations, see ServerOptions.Strict.
+var ErrMalformedFrame = errors.New("malformed frame")
+
+// Strict makes the server count frames of an unknown type, with a non-zero
+// reserved field or a token on other than a control message, and control
+// messages it cannot parse, handshake commands included, as protocol
+// violations. They are logged, counted in Stats.ProtocolViolations and
+// dropped, and the connection is closed with codes.ProtocolError on the
+// violationLimit-th violation of a session. Custom control commands, which
+// a lenient server delivers as RawControlEvent, are violations too.
+// Servers are lenient by default.
+func (serverOptionsNamespace) Strict(violationLimit int) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.strict = violationLimit
+	}
+}
+
+// malformed checks the message read last against the header it was
+// read from, returning an error matching ErrMalformedFrame if a strict
+// server must not accept it.
+func (c *codec) malformed(m *Message) error {
+	var reason string
+	switch {
+	case m.Type > MsgTypeAck:
+		reason = fmt.Sprintf("type %d", m.Type)
+	case c.rhdr[offReserved] != 0:
+		reason = "reserved byte set"
+	case !m.HasFlag(FlagTTL) && [4]byte(c.rhdr[offTTL:]) != [4]byte{}:
+		reason = "TTL without its flag"
+	case !m.HasFlag(FlagChannel) && [2]byte(c.rhdr[offChan:]) != [2]byte{}:
+		reason = "channel without its flag"
+	case m.Token != [16]byte{} && m.Type != MsgTypeControl:
+		reason = ErrUnexpectedToken.Error()
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrMalformedFrame, reason)
+}
+
+// protocolViolation counts the violation of a strict server's session,
+// closing the connection at the limit. It reports whether the server
+// is strict, in which case the frame is to be dropped.
+func (s *Session) protocolViolation(err error) bool {
+	srv := s.srv
+	if srv == nil || srv.cfg.strict == 0 {
+		return false
+	}
+	n := s.protoViolations.Add(1)
+	srv.mtx.Lock()
+	srv.protoViolations++
+	srv.mtx.Unlock()
+	lgr := s.lgr.With("error", err, "violations", n)
+	lgr.Warn("protocol violation")
+	if n == int64(srv.cfg.strict) {
+		lgr.Warn("too many protocol violations, disconnecting")
+		if cerr := closeConn(s.conn, codes.ProtocolError, fmt.Sprintf("%d protocol violations", n)); cerr != nil {
+			lgr.With("error", cerr).Error("failed to close conn")
+		}
+	}
+	return true
+}
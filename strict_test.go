@@ -0,0 +1,122 @@
+package chat_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+// bareLogin logs in to a server without authentication over a QUIC
+// connection of its own, so that frames the client would refuse to send
+// can be written to the returned stream.
+func bareLogin(t *testing.T, addr string, ca *x509.CertPool) (*quic.Conn, *quic.Stream) {
+	t.Helper()
+	conn, err := quic.DialAddr(t.Context(), addr, &tls.Config{RootCAs: ca, NextProtos: []string{"quic-raw"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.CloseWithError(0, "") })
+	stream, err := conn.OpenStreamSync(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFrame(t, stream, chat.NewControlMessage("login"))
+	var r chat.Message
+	if _, err := r.ReadFrom(stream); err != nil {
+		t.Fatal(err)
+	}
+	if string(r.Payload) != "ok" && !strings.HasPrefix(string(r.Payload), "ok ") {
+		t.Fatalf("login refused: %s", r.Payload)
+	}
+	return conn, stream
+}
+
+// writeFrame stamps and writes m as is.
+func writeFrame(t *testing.T, stream *quic.Stream, m *chat.Message) {
+	t.Helper()
+	if err := m.Stamp(chat.DefaultSource); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.WriteTo(stream); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	const limit = 3
+	for _, tt := range []struct {
+		name string
+		bad  func() *chat.Message
+	}{
+		{"unknown type", func() *chat.Message { return &chat.Message{Type: 0xFF, Payload: []byte("?")} }},
+		{"unknown control", func() *chat.Message { return chat.NewControlMessage("frobnicate") }},
+		{"token on text", func() *chat.Message {
+			m := chat.NewTextMessage([]byte("x"))
+			m.Token = [16]byte{1}
+			return m
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, strict := range []bool{false, true} {
+				got := make(chan string, limit)
+				opts := []chat.ServerOption{chat.ServerOptions.NoAuth()}
+				if strict {
+					opts = append(opts, chat.ServerOptions.Strict(limit))
+				}
+				srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+					for {
+						m, err := s.Recv(ctx)
+						if err != nil {
+							return
+						}
+						if m.Type == chat.MsgTypeText && m.Token == [16]byte{} {
+							got <- string(m.Payload)
+						}
+					}
+				}, opts...)
+				conn, stream := bareLogin(t, addr, ca)
+
+				for range limit - 1 {
+					writeFrame(t, stream, tt.bad())
+				}
+				// still served below the limit
+				writeFrame(t, stream, chat.NewTextMessage([]byte("fine")))
+				if text := receive(t, got); text != "fine" {
+					t.Fatalf("received %q, want fine", text)
+				}
+				writeFrame(t, stream, tt.bad())
+				writeFrame(t, stream, chat.NewTextMessage([]byte("after")))
+
+				if !strict {
+					if text := receive(t, got); text != "after" {
+						t.Errorf("lenient server: received %q, want after", text)
+					}
+					if n := srv.Stats().ProtocolViolations; n != 0 {
+						t.Errorf("lenient server counted %d violations", n)
+					}
+					continue
+				}
+				select {
+				case <-conn.Context().Done():
+				case <-time.After(waitTimeout):
+					t.Fatal("strict server kept the connection")
+				}
+				var appErr *quic.ApplicationError
+				if err := context.Cause(conn.Context()); !errors.As(err, &appErr) || codes.Code(appErr.ErrorCode) != codes.ProtocolError {
+					t.Errorf("strict server closed with %v, want %v", err, codes.ProtocolError)
+				}
+				if n := srv.Stats().ProtocolViolations; n != limit {
+					t.Errorf("strict server counted %d violations, want %d", n, limit)
+				}
+			}
+		})
+	}
+}
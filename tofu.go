@@ -0,0 +1,138 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrServerKeyChanged is returned when a server presents another key
+// than the one trusted on first use, see ClientOptions.TOFU.
+var ErrServerKeyChanged = errors.New("server key changed")
+
+// ErrServerKeyRejected is returned when the confirm function
+// does not trust the key of a server seen for the first time.
+var ErrServerKeyRejected = errors.New("server key rejected")
+
+// KeyChangedError describes a server presenting another key than the trusted one.
+// It matches ErrServerKeyChanged.
+type KeyChangedError struct {
+	Addr      string
+	Known     string
+	Presented string
+}
+
+func (e *KeyChangedError) Error() string {
+	return fmt.Sprintf("%s for %s: known %s, presented %s", ErrServerKeyChanged, e.Addr, e.Known, e.Presented)
+}
+
+func (e *KeyChangedError) Unwrap() error {
+	return ErrServerKeyChanged
+}
+
+// TOFU trusts the key a server presents on the first connection and
+// records its fingerprint in the store file, one "address fingerprint"
+// line per server. Later connections fail with a KeyChangedError
+// if the server presents another key. It replaces certificate verification.
+func (clientOptionsNamespace) TOFU(storePath string) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.tofu = &keyStore{path: storePath}
+	}
+}
+
+// ConfirmServerKey sets the function asked whether to trust the key
+// of a server seen for the first time, see TOFU. Without it every
+// first key is trusted.
+func (clientOptionsNamespace) ConfirmServerKey(fn func(addr, fingerprint string) bool) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.confirmKey = fn
+	}
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the public key
+// of the certificate, as recorded by ClientOptions.TOFU.
+func Fingerprint(crt *x509.Certificate) string {
+	sum := sha256.Sum256(crt.RawSubjectPublicKeyInfo)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// keyStore is the file of fingerprints trusted on first use.
+type keyStore struct {
+	mtx  sync.Mutex
+	path string
+}
+
+// lookup returns the fingerprint trusted for addr, empty if there is none.
+func (k *keyStore) lookup(addr string) (string, error) {
+	data, err := os.ReadFile(k.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("read key store: %w", err)
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		host, fp, ok := strings.Cut(strings.TrimSpace(sc.Text()), " ")
+		if ok && host == addr {
+			return fp, nil
+		}
+	}
+	return "", sc.Err()
+}
+
+// trust appends the fingerprint of addr to the store.
+func (k *keyStore) trust(addr, fp string) error {
+	if err := os.MkdirAll(filepath.Dir(k.path), 0o700); err != nil {
+		return fmt.Errorf("create key store dir: %w", err)
+	}
+	f, err := os.OpenFile(k.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("open key store: %w", err)
+	}
+	if _, err = fmt.Fprintf(f, "%s %s\n", addr, fp); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("write key store: %w", err)
+	}
+	return f.Close()
+}
+
+// verifyTOFU returns the TLS verification of the connection
+// to addr checking the server key against the store.
+func (c *Client) verifyTOFU(addr string) func(tls.ConnectionState) error {
+	k := c.cfg.tofu
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("server presented no certificate")
+		}
+		fp := Fingerprint(cs.PeerCertificates[0])
+		k.mtx.Lock()
+		defer k.mtx.Unlock()
+		known, err := k.lookup(addr)
+		if err != nil {
+			return err
+		}
+		switch {
+		case known == fp:
+			return nil
+		case known != "":
+			return &KeyChangedError{Addr: addr, Known: known, Presented: fp}
+		case c.cfg.confirmKey != nil && !c.cfg.confirmKey(addr, fp):
+			return fmt.Errorf("%w: %s for %s", ErrServerKeyRejected, fp, addr)
+		}
+		if err := k.trust(addr, fp); err != nil {
+			return err
+		}
+		c.cfg.logger.With("addr", addr, "fingerprint", fp).Warn("trusting server key on first use")
+		return nil
+	}
+}
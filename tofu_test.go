@@ -0,0 +1,74 @@
+package chat_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestTOFU(t *testing.T) {
+	srv, addr, _ := startServer(t, discard)
+	store := chat.ClientOptions.TOFU(filepath.Join(t.TempDir(), "known_servers"))
+
+	// no pool trusts the server, the first key is trusted instead
+	var confirmed string
+	connect(t, addr, nil, store, chat.ClientOptions.ConfirmServerKey(func(a, fp string) bool {
+		confirmed = a + " " + fp
+		return true
+	})).Close()
+	if !strings.HasPrefix(confirmed, addr+" sha256:") {
+		t.Fatalf("confirmed %q, want the fingerprint of %s", confirmed, addr)
+	}
+	connect(t, addr, nil, store).Close()
+
+	// a server with another key on the same address
+	if err := srv.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	startServer(t, discard, chat.ServerOptions.Addresses(addr))
+	err := dial(t, newClient(t, addr, nil, store))
+	var kerr *chat.KeyChangedError
+	if !errors.As(err, &kerr) || !errors.Is(err, chat.ErrServerKeyChanged) {
+		t.Fatalf("dial with a swapped key: %v, want a KeyChangedError", err)
+	}
+	if kerr.Addr != addr || kerr.Known != strings.TrimPrefix(confirmed, addr+" ") || kerr.Presented == kerr.Known {
+		t.Errorf("key changed error %+v", kerr)
+	}
+}
+
+func TestTOFUServers(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "known_servers")
+	store := chat.ClientOptions.TOFU(file)
+	var addrs []string
+	for range 2 {
+		_, addr, _ := startServer(t, discard)
+		connect(t, addr, nil, store).Close()
+		addrs = append(addrs, addr)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], addrs[0]+" ") || !strings.HasPrefix(lines[1], addrs[1]+" ") {
+		t.Errorf("key store %q, want a line per server", data)
+	}
+}
+
+func TestTOFURejected(t *testing.T) {
+	_, addr, _ := startServer(t, discard)
+	file := filepath.Join(t.TempDir(), "known_servers")
+	err := dial(t, newClient(t, addr, nil,
+		chat.ClientOptions.TOFU(file),
+		chat.ClientOptions.ConfirmServerKey(func(string, string) bool { return false })))
+	if !errors.Is(err, chat.ErrServerKeyRejected) {
+		t.Errorf("dial: %v, want ErrServerKeyRejected", err)
+	}
+	if _, err := os.Stat(file); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("rejected key stored: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zhmlst/chat/codes"
+)
+
+// CapTokenFrames is the capability of clients carrying the token they
+// logged in with in every frame, offered by servers checking it, see
+// ServerOptions.PerMessageAuth. Clients always offer it.
+const CapTokenFrames = "token-frames"
+
+// ErrTokenFramesRequired is returned by server handshakes refusing a client
+// which does not carry its token in every frame, see ServerOptions.RequirePerMessageAuth.
+var ErrTokenFramesRequired = errors.New("token frames required")
+
+// PerMessageAuth makes the server check the token of every frame received
+// from clients negotiating CapTokenFrames against the token they logged in
+// with, rather than trusting the stream after the login. Frames with
+// another token are logged, counted in Stats.TokenMismatches and dropped,
+// and the connection is closed with codes.ProtocolError on the
+// violationLimit-th of a session. Handlers get frames without the token.
+// Clients not offering the capability are admitted unchecked, see
+// RequirePerMessageAuth.
+func (serverOptionsNamespace) PerMessageAuth(violationLimit int) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.tokenFrames = violationLimit
+	}
+}
+
+// RequirePerMessageAuth refuses clients logging in with a token which do
+// not negotiate CapTokenFrames, with a notice and codes.ProtocolError.
+// It needs PerMessageAuth. Guests and raw sessions have no token to check.
+func (serverOptionsNamespace) RequirePerMessageAuth() ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.requireTokenFrames = true
+	}
+}
+
+// tokenCapability returns the capability offered by a server checking
+// the tokens of frames, if it does.
+func (s *Server) tokenCapability() []Capability {
+	if s.cfg.tokenFrames == 0 {
+		return nil
+	}
+	return []Capability{{Name: CapTokenFrames}}
+}
+
+// requireTokenFrames returns the refusal of a client logging in without
+// CapTokenFrames, if the server requires it.
+func (s *Server) requireTokenFrames(session *Session, lgn *login) ([]byte, error) {
+	if !s.cfg.requireTokenFrames || lgn.admin || lgn.peer || lgn.token == [16]byte{} || session.HasCapability(CapTokenFrames) {
+		return nil, nil
+	}
+	return notice(codes.ProtocolError, "token_frames_required", "client must carry its token in every frame"), ErrTokenFramesRequired
+}
+
+// tokenMismatch checks the token of a frame received by a server session
+// negotiating CapTokenFrames and clears it, so that it is neither seen by
+// handlers nor relayed. It reports whether the frame is to be dropped.
+func (s *Session) tokenMismatch(m *Message) bool {
+	if !s.HasCapability(CapTokenFrames) {
+		return false
+	}
+	tok := m.Token
+	m.Token = [16]byte{}
+	s.tokenMtx.Lock()
+	// frames written before the client saw a rotation confirmed carry
+	// the token it replaced
+	ok := tok == s.token || tok == s.replaced && tok != [16]byte{}
+	s.tokenMtx.Unlock()
+	if ok {
+		return false
+	}
+	srv := s.srv
+	n := s.tokenMismatches.Add(1)
+	srv.mtx.Lock()
+	srv.tokenMismatches++
+	srv.mtx.Unlock()
+	lgr := s.lgr.With("type", m.Type, "mismatches", n)
+	lgr.Warn("frame token does not match the session, dropping it")
+	if n == int64(srv.cfg.tokenFrames) {
+		lgr.Warn("too many frame token mismatches, disconnecting")
+		if err := closeConn(s.conn, codes.ProtocolError, fmt.Sprintf("%d frame token mismatches", n)); err != nil {
+			lgr.With("error", err).Error("failed to close conn")
+		}
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package chat_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/codes"
+)
+
+// tokenLogin gets a token and logs in with it negotiating
+// chat.CapTokenFrames over a QUIC connection of its own, so that frames
+// with any token can be written to the returned stream.
+func tokenLogin(t *testing.T, addr string, ca *x509.CertPool) (*quic.Conn, *quic.Stream, [16]byte) {
+	t.Helper()
+	conn, err := quic.DialAddr(t.Context(), addr, &tls.Config{RootCAs: ca, NextProtos: []string{"quic-raw"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.CloseWithError(0, "") })
+	stream, err := conn.OpenStreamSync(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFrame(t, stream, chat.NewControlMessage("ack"))
+	var r chat.Message
+	if _, err := r.ReadFrom(stream); err != nil || len(r.Payload) != 16 {
+		t.Fatalf("no token issued: %q, %v", r.Payload, err)
+	}
+	tok := [16]byte(r.Payload)
+	login := chat.NewControlMessage("login caps +" + chat.CapTokenFrames)
+	login.Token = tok
+	writeFrame(t, stream, login)
+	if _, err := r.ReadFrom(stream); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(r.Payload), "ok ") || !strings.Contains(string(r.Payload), chat.CapTokenFrames) {
+		t.Fatalf("login without token frames: %s", r.Payload)
+	}
+	return conn, stream, tok
+}
+
+// tokenText returns a text message carrying tok.
+func tokenText(text string, tok [16]byte) *chat.Message {
+	m := chat.NewTextMessage([]byte(text))
+	m.Token = tok
+	return m
+}
+
+func TestPerMessageAuth(t *testing.T) {
+	const limit = 2
+	got := make(chan string, 4)
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		for {
+			m, err := s.Recv(ctx)
+			if err != nil {
+				return
+			}
+			if m.Type == chat.MsgTypeText && m.Token == [16]byte{} {
+				got <- string(m.Payload)
+			}
+		}
+	}, chat.ServerOptions.PerMessageAuth(limit))
+
+	// stamped by clients
+	send(t, connect(t, addr, ca), "stamped")
+	if text := receive(t, got); text != "stamped" {
+		t.Errorf("received %q, want stamped", text)
+	}
+
+	conn, stream, tok := tokenLogin(t, addr, ca)
+	other := tok
+	other[0] ^= 1
+	// frames with another token are dropped, the limit-th one closes
+	for _, m := range []*chat.Message{
+		tokenText("forged", other),
+		tokenText("own", tok),
+		tokenText("bare", [16]byte{}),
+	} {
+		writeFrame(t, stream, m)
+	}
+	if text := receive(t, got); text != "own" {
+		t.Errorf("received %q, want own", text)
+	}
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(waitTimeout):
+		t.Fatal("connection kept past the mismatch limit")
+	}
+	var appErr *quic.ApplicationError
+	if err := context.Cause(conn.Context()); !errors.As(err, &appErr) || codes.Code(appErr.ErrorCode) != codes.ProtocolError {
+		t.Errorf("closed with %v, want %v", err, codes.ProtocolError)
+	}
+	select {
+	case text := <-got:
+		t.Errorf("received %q with another token", text)
+	default:
+	}
+	if n := srv.Stats().TokenMismatches; n != limit {
+		t.Errorf("%d mismatches counted, want %d", n, limit)
+	}
+}
+
+func TestRequirePerMessageAuth(t *testing.T) {
+	legacy := chat.ClientOptions.DisableCapabilities(chat.CapTokenFrames)
+	for _, tt := range []struct {
+		name    string
+		opts    []chat.ServerOption
+		refused bool
+	}{
+		{"optional", []chat.ServerOption{chat.ServerOptions.PerMessageAuth(1)}, false},
+		{"mandatory", []chat.ServerOption{chat.ServerOptions.PerMessageAuth(1), chat.ServerOptions.RequirePerMessageAuth()}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr, ca := startServer(t, discard, append(tt.opts, chat.ServerOptions.AllowGuests())...)
+			err := dial(t, newClient(t, addr, ca, legacy))
+			var e *chat.Error
+			switch {
+			case !tt.refused && err != nil:
+				t.Errorf("legacy client refused: %v", err)
+			case tt.refused && (!errors.As(err, &e) || e.Code != codes.ProtocolError):
+				t.Errorf("legacy client: %v, want refused with %v", err, codes.ProtocolError)
+			}
+			// guests have no token to carry
+			if err := dial(t, newClient(t, addr, ca, legacy, chat.ClientOptions.Guest())); err != nil {
+				t.Errorf("legacy guest refused: %v", err)
+			}
+		})
+	}
+}
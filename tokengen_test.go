@@ -0,0 +1,64 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+)
+
+// sequence generates the tokens 1, 2, 3... with a tenant prefix,
+// counting its calls in n.
+func sequence(n *atomic.Uint32) chat.TokenGenerator {
+	return func(context.Context) (tok [16]byte, err error) {
+		copy(tok[:], "tenant-a")
+		tok[15] = byte(n.Add(1))
+		return tok, nil
+	}
+}
+
+func TestTokenGenerator(t *testing.T) {
+	var n atomic.Uint32
+	repo := &chattest.TokenRepo{}
+	_, addr, ca := startServer(t, discard,
+		chat.ServerOptions.TokenRepo(repo),
+		chat.ServerOptions.TokenGenerator(sequence(&n)),
+	)
+	for i := range 2 {
+		connect(t, addr, ca)
+		var want [16]byte
+		copy(want[:], "tenant-a")
+		want[15] = byte(i + 1)
+		if has, _ := repo.HasToken(context.Background(), want); !has {
+			t.Errorf("token %x was not saved", want)
+		}
+	}
+	if got := n.Load(); got != 2 {
+		t.Errorf("generator called %d times, want 2", got)
+	}
+}
+
+func TestTokenGeneratorCollision(t *testing.T) {
+	var n atomic.Uint32
+	gen := sequence(&n)
+	_, addr, ca := startServer(t, discard,
+		chat.ServerOptions.TokenGenerator(func(ctx context.Context) ([16]byte, error) {
+			tok, err := gen(ctx)
+			tok[15] = 1
+			return tok, err
+		}),
+	)
+	connect(t, addr, ca)
+	err := dial(t, newClient(t, addr, ca))
+	var cerr *chat.CloseError
+	if !errors.As(err, &cerr) || !cerr.Remote {
+		t.Fatalf("dial: %v, want the server to close the connection", err)
+	}
+	// once for the first client, then the bounded attempts of the second
+	if got := n.Load(); got != 4 {
+		t.Errorf("generator called %d times, want 4", got)
+	}
+}
@@ -0,0 +1,222 @@
+package chat
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// minTokenSweep bounds how often MemTokenRepo sweeps expired tokens.
+const minTokenSweep = time.Second
+
+// MemTokenRepo is an in-memory TokenRepo and TokenDeleter. Since every
+// client connecting to a server gets a token, it can be bounded: beyond
+// maxEntries tokens the token used least recently is evicted, and with
+// a ttl tokens unused for that long are evicted by a goroutine sweeping
+// them, started with the first token saved. Zero disables either. A server
+// running with the repo stops the goroutine when it stops, see Close.
+// Sessions of an evicted token are not ended, but their clients cannot
+// log in with it again.
+type MemTokenRepo struct {
+	max int
+	ttl time.Duration
+
+	mtx   sync.Mutex
+	ll    *list.List
+	items map[[16]byte]*list.Element
+	// sweeping is set while the sweep goroutine runs, stop ends it.
+	sweeping bool
+	stop     chan struct{}
+	// done and onEvict come from the server running with the repo.
+	done    <-chan struct{}
+	onEvict func(tok [16]byte)
+
+	evictions atomic.Uint64
+}
+
+type memToken struct {
+	tok  [16]byte
+	used time.Time
+}
+
+// NewMemTokenRepo creates an empty in-memory repo holding up to maxEntries
+// tokens, each evicted once unused for ttl.
+func NewMemTokenRepo(maxEntries int, ttl time.Duration) *MemTokenRepo {
+	return &MemTokenRepo{
+		max:   maxEntries,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[[16]byte]*list.Element),
+	}
+}
+
+// SaveToken adds the token, evicting the token used least recently if
+// the repo is full.
+func (r *MemTokenRepo) SaveToken(_ context.Context, tok [16]byte) error {
+	r.mtx.Lock()
+	if e, ok := r.items[tok]; ok {
+		e.Value.(*memToken).used = time.Now()
+		r.ll.MoveToFront(e)
+		r.mtx.Unlock()
+		return nil
+	}
+	r.items[tok] = r.ll.PushFront(&memToken{tok: tok, used: time.Now()})
+	var evicted [][16]byte
+	if r.max > 0 && r.ll.Len() > r.max {
+		evicted = append(evicted, r.evict(r.ll.Back()))
+	}
+	if r.ttl > 0 && !r.sweeping && !closed(r.done) {
+		r.sweeping = true
+		r.stop = make(chan struct{})
+		go r.sweep(r.stop, r.done)
+	}
+	r.mtx.Unlock()
+	r.evicted(evicted)
+	return nil
+}
+
+// HasToken reports whether the repo holds the token, which counts as using it.
+func (r *MemTokenRepo) HasToken(_ context.Context, tok [16]byte) (bool, error) {
+	r.mtx.Lock()
+	e, ok := r.items[tok]
+	if !ok {
+		r.mtx.Unlock()
+		return false, nil
+	}
+	t := e.Value.(*memToken)
+	if r.ttl > 0 && time.Since(t.used) >= r.ttl {
+		r.evict(e)
+		r.mtx.Unlock()
+		r.evicted([][16]byte{tok})
+		return false, nil
+	}
+	t.used = time.Now()
+	r.ll.MoveToFront(e)
+	r.mtx.Unlock()
+	return true, nil
+}
+
+// DeleteToken removes the token. It does not count as an eviction.
+func (r *MemTokenRepo) DeleteToken(_ context.Context, tok [16]byte) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if e, ok := r.items[tok]; ok {
+		r.ll.Remove(e)
+		delete(r.items, tok)
+	}
+	return nil
+}
+
+// Len returns the number of tokens in the repo.
+func (r *MemTokenRepo) Len() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.ll.Len()
+}
+
+// Evictions returns the number of tokens evicted for the cap or the ttl.
+func (r *MemTokenRepo) Evictions() uint64 {
+	return r.evictions.Load()
+}
+
+// Close stops the sweep goroutine. It is started again by the next
+// token saved.
+func (r *MemTokenRepo) Close() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.sweeping {
+		close(r.stop)
+		r.sweeping = false
+	}
+	return nil
+}
+
+// attach ties the sweep goroutine to a server running until done,
+// which is told about evictions.
+func (r *MemTokenRepo) attach(done <-chan struct{}, onEvict func(tok [16]byte)) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.done, r.onEvict = done, onEvict
+	if r.sweeping {
+		// restart the goroutine to watch the new server
+		close(r.stop)
+		r.stop = make(chan struct{})
+		go r.sweep(r.stop, done)
+	}
+}
+
+// evict removes the token of e and returns it. The caller holds the mutex
+// and passes the token to evicted once it released it.
+func (r *MemTokenRepo) evict(e *list.Element) [16]byte {
+	t := r.ll.Remove(e).(*memToken)
+	delete(r.items, t.tok)
+	r.evictions.Add(1)
+	return t.tok
+}
+
+// evicted tells the server about evicted tokens.
+func (r *MemTokenRepo) evicted(toks [][16]byte) {
+	if len(toks) == 0 {
+		return
+	}
+	r.mtx.Lock()
+	onEvict := r.onEvict
+	r.mtx.Unlock()
+	if onEvict == nil {
+		return
+	}
+	for _, tok := range toks {
+		onEvict(tok)
+	}
+}
+
+// closed reports whether done is closed, false for nil.
+func closed(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// sweep evicts expired tokens every half ttl until stop is closed
+// or the server is done.
+func (r *MemTokenRepo) sweep(stop <-chan struct{}, done <-chan struct{}) {
+	tick := time.NewTicker(max(r.ttl/2, minTokenSweep))
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-stop:
+			return
+		case <-done:
+			r.mtx.Lock()
+			if r.stop == stop {
+				r.sweeping = false
+			}
+			r.mtx.Unlock()
+			return
+		}
+		var evicted [][16]byte
+		r.mtx.Lock()
+		for e := r.ll.Back(); e != nil && time.Since(e.Value.(*memToken).used) >= r.ttl; e = r.ll.Back() {
+			evicted = append(evicted, r.evict(e))
+		}
+		r.mtx.Unlock()
+		r.evicted(evicted)
+	}
+}
+
+// tokenEvicted logs the eviction of a token with active sessions,
+// which go on.
+func (s *Server) tokenEvicted(tok [16]byte) {
+	s.mtx.Lock()
+	n := len(s.byToken[tok])
+	s.mtx.Unlock()
+	if n > 0 {
+		s.cfg.logger.With("sessions", n).Warn("evicted token of active sessions")
+	}
+}
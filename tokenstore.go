@@ -0,0 +1,186 @@
+package chat
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/zhmlst/chat/internal/filelock"
+)
+
+// FileTokenStore keeps the tokens of a client in one JSON file,
+// keyed by server address and identity. A file holding a single
+// raw token, as written by keygen.WriteTokenFile, is migrated:
+// its token is adopted by the first server and identity it is
+// looked up for. The file is locked while it is read and written, so that
+// processes sharing it do not corrupt it, see Refresh.
+type FileTokenStore struct {
+	mtx  sync.Mutex
+	path string
+}
+
+// NewFileTokenStore returns a store keeping tokens in the named file.
+func NewFileTokenStore(path string) *FileTokenStore {
+	return &FileTokenStore{path: path}
+}
+
+// Path returns the name of the file of the store.
+func (f *FileTokenStore) Path() string {
+	return f.path
+}
+
+// storeKey returns the key of the token of identity on server.
+func storeKey(server, identity string) string {
+	if identity == "" {
+		return server
+	}
+	return identity + "@" + server
+}
+
+// Token returns the token of identity on server,
+// or a zero token when the store has none.
+func (f *FileTokenStore) Token(server, identity string) (_ [16]byte, err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	l, err := f.lock()
+	if err != nil {
+		return [16]byte{}, err
+	}
+	defer unlock(l, &err)
+	toks, legacy, err := f.load()
+	if err != nil {
+		return [16]byte{}, err
+	}
+	key := storeKey(server, identity)
+	if legacy != nil {
+		toks[key] = hex.EncodeToString(legacy)
+		if err := f.write(toks); err != nil {
+			return [16]byte{}, fmt.Errorf("failed to migrate token file: %w", err)
+		}
+	}
+	raw, err := hex.DecodeString(toks[key])
+	if err != nil || len(raw) != 16 {
+		return [16]byte{}, nil
+	}
+	return [16]byte(raw), nil
+}
+
+// SetToken saves the token of identity on server.
+func (f *FileTokenStore) SetToken(server, identity string, tok [16]byte) (err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	l, err := f.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock(l, &err)
+	toks, _, err := f.load()
+	if err != nil {
+		return err
+	}
+	toks[storeKey(server, identity)] = hex.EncodeToString(tok[:])
+	return f.write(toks)
+}
+
+// Refresh replaces stale, the token of identity on server as last read,
+// with the one returned by fetch, e.g. a new one issued by the server,
+// holding the lock of the file meanwhile. If another process sharing
+// the file has replaced stale already, its token is returned instead
+// without calling fetch, so that both processes use the same one.
+// fetched reports whether fetch was called.
+func (f *FileTokenStore) Refresh(server, identity string, stale [16]byte, fetch func() ([16]byte, error)) (tok [16]byte, fetched bool, err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	l, err := f.lock()
+	if err != nil {
+		return tok, false, err
+	}
+	defer unlock(l, &err)
+	toks, legacy, err := f.load()
+	if err != nil {
+		return tok, false, err
+	}
+	key := storeKey(server, identity)
+	if legacy != nil {
+		toks[key] = hex.EncodeToString(legacy)
+	}
+	if raw, err := hex.DecodeString(toks[key]); err == nil && len(raw) == 16 && [16]byte(raw) != stale {
+		return [16]byte(raw), false, nil
+	}
+	if tok, err = fetch(); err != nil {
+		return [16]byte{}, true, err
+	}
+	toks[key] = hex.EncodeToString(tok[:])
+	return tok, true, f.write(toks)
+}
+
+// lock locks the file next to the token file, which is replaced on
+// every write and cannot be locked itself.
+func (f *FileTokenStore) lock() (*filelock.File, error) {
+	l, err := filelock.Lock(f.path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock token file: %w", err)
+	}
+	return l, nil
+}
+
+// unlock releases the lock, setting err if it fails and err is nil.
+func unlock(l *filelock.File, err *error) {
+	if uerr := l.Unlock(); uerr != nil && *err == nil {
+		*err = fmt.Errorf("failed to unlock token file: %w", uerr)
+	}
+}
+
+// load reads the tokens of the file. A single raw token is returned as legacy.
+func (f *FileTokenStore) load() (toks map[string]string, legacy []byte, err error) {
+	toks = make(map[string]string)
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return toks, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+	if len(data) == 16 && !json.Valid(data) {
+		return toks, data, nil
+	}
+	if len(data) == 0 {
+		return toks, nil, nil
+	}
+	if err = json.Unmarshal(data, &toks); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse token file: %w", err)
+	}
+	return toks, nil, nil
+}
+
+// write replaces the file with toks.
+func (f *FileTokenStore) write(toks map[string]string) error {
+	data, err := json.MarshalIndent(toks, "", "\t")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(f.path)
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to mkdir %s for token file: %w", dir, err)
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(f.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create token file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(append(data, '\n')); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write token file: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close token file: %w", err)
+	}
+	if err = os.Chmod(tmp.Name(), 0o640); err != nil {
+		return fmt.Errorf("failed to chmod token file: %w", err)
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
@@ -0,0 +1,171 @@
+package chat_test
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/keygen"
+)
+
+// issuing returns a token approver counting the tokens issued in n.
+func issuing(n *atomic.Int64) chat.ServerOption {
+	return chat.ServerOptions.TokenApprover(func(context.Context, *chat.TokenRequest) error {
+		n.Add(1)
+		return nil
+	})
+}
+
+func TestTokenPerServer(t *testing.T) {
+	tokFile := sharedToken(t)
+	var (
+		issued [2]atomic.Int64
+		addrs  [2]string
+		cas    [2]*x509.CertPool
+		toks   [2][16]byte
+	)
+	for i := range addrs {
+		_, addrs[i], cas[i] = startServer(t, discard, issuing(&issued[i]))
+		c := connect(t, addrs[i], cas[i], tokFile)
+		var err error
+		if toks[i], err = c.Token(); err != nil {
+			t.Fatal(err)
+		}
+		_ = c.Close()
+	}
+	if toks[0] == toks[1] {
+		t.Fatal("both servers share a token")
+	}
+
+	// every server is logged in to with the token it issued
+	for i := range addrs {
+		c := connect(t, addrs[i], cas[i], tokFile)
+		tok, err := c.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok != toks[i] {
+			t.Errorf("server %d token %x, want %x", i, tok, toks[i])
+		}
+		if n := issued[i].Load(); n != 1 {
+			t.Errorf("server %d issued %d tokens, want 1", i, n)
+		}
+	}
+}
+
+func TestTokenPerIdentity(t *testing.T) {
+	_, addr, ca := startServer(t, discard)
+	tokFile := sharedToken(t)
+	toks := make(map[[16]byte]string)
+	for _, id := range []string{"alice", "bob"} {
+		c := connect(t, addr, ca, tokFile, chat.ClientOptions.Identity(id))
+		tok, err := c.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other, ok := toks[tok]; ok {
+			t.Errorf("%s shares the token of %s", id, other)
+		}
+		toks[tok] = id
+	}
+}
+
+func TestTokenFileMigration(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	tok := [16]byte{1, 2, 3}
+	if err := keygen.WriteTokenFile(file, tok); err != nil {
+		t.Fatal(err)
+	}
+	store := chat.NewFileTokenStore(file)
+	got, err := store.Token("a:4242", "")
+	if err != nil || got != tok {
+		t.Fatalf("token of the migrated file %x, %v, want %x", got, err, tok)
+	}
+	// adopted by the first server only
+	if got, err = store.Token("b:4242", ""); err != nil || got != ([16]byte{}) {
+		t.Errorf("token of another server %x, %v, want none", got, err)
+	}
+	if err := store.SetToken("b:4242", "bob", [16]byte{4}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var toks map[string]string
+	if err := json.Unmarshal(data, &toks); err != nil {
+		t.Fatalf("token file %q: %v", data, err)
+	}
+	want := map[string]string{
+		"a:4242":     "01020300000000000000000000000000",
+		"bob@b:4242": "04000000000000000000000000000000",
+	}
+	if !maps.Equal(toks, want) {
+		t.Errorf("token file %v, want %v", toks, want)
+	}
+}
+
+func TestTokenFileShared(t *testing.T) {
+	var issued atomic.Int64
+	_, addr, ca := startServer(t, discard, issuing(&issued))
+	tokFile := sharedToken(t)
+	// processes sharing a file, each with a store of its own
+	connected := make(chan *chat.Client, 2)
+	for range 2 {
+		var c *chat.Client
+		c = newClient(t, addr, ca, tokFile, chat.ClientOptions.OnConnect(func() { connected <- c }))
+		go func() { _ = c.Dial(context.Background()) }()
+		t.Cleanup(func() { _ = c.Close() })
+	}
+	var toks [2][16]byte
+	for i := range toks {
+		var err error
+		if toks[i], err = receive(t, connected).Token(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if toks[0] != toks[1] || toks[0] == ([16]byte{}) {
+		t.Errorf("clients logged in with %x and %x, want one token", toks[0], toks[1])
+	}
+	if n := issued.Load(); n != 1 {
+		t.Errorf("%d tokens issued, want 1", n)
+	}
+}
+
+func TestTokenStoreRefresh(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens")
+	var fetches atomic.Int64
+	fetch := func() ([16]byte, error) {
+		n := fetches.Add(1)
+		// long enough for the other refresh to wait for the lock
+		time.Sleep(20 * time.Millisecond)
+		return [16]byte{byte(n)}, nil
+	}
+	toks := make(chan [16]byte, 2)
+	for range 2 {
+		go func() {
+			tok, _, err := chat.NewFileTokenStore(file).Refresh("a:4242", "", [16]byte{}, fetch)
+			if err != nil {
+				t.Error(err)
+			}
+			toks <- tok
+		}()
+	}
+	if a, b := receive(t, toks), receive(t, toks); a != b || a != ([16]byte{1}) {
+		t.Errorf("refreshed %x and %x, want the one fetched", a, b)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("%d fetches, want 1", n)
+	}
+	if tok, err := chat.NewFileTokenStore(file).Token("a:4242", ""); err != nil || tok != ([16]byte{1}) {
+		t.Errorf("stored %x, %v", tok, err)
+	}
+}
@@ -0,0 +1,341 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/zhmlst/chat/codes"
+)
+
+const (
+	// maxTopicLen bounds the length of topics and patterns.
+	maxTopicLen = 256
+	// maxClientTopics bounds the subscriptions a client manages itself.
+	maxClientTopics = 256
+)
+
+// ErrInvalidTopic is returned for topics and patterns which are empty,
+// too long, contain whitespace or an empty segment, or a wildcard other
+// than the whole last segment of a pattern.
+var ErrInvalidTopic = errors.New("invalid topic")
+
+// validTopic checks a topic, or a pattern if wildcard is set.
+func validTopic(topic string, wildcard bool) error {
+	if topic == "" || len(topic) > maxTopicLen || strings.ContainsFunc(topic, unicode.IsSpace) {
+		return fmt.Errorf("%w: %q", ErrInvalidTopic, topic)
+	}
+	segs := strings.Split(topic, ".")
+	for i, seg := range segs {
+		if seg == "" || (strings.Contains(seg, "*") && (!wildcard || seg != "*" || i != len(segs)-1)) {
+			return fmt.Errorf("%w: %q", ErrInvalidTopic, topic)
+		}
+	}
+	return nil
+}
+
+// topicNode is a node of the subscription trie, one per topic segment.
+type topicNode struct {
+	children map[string]*topicNode
+	// exact subscribed to the topic ending here, wild to all topics below.
+	exact map[*Session]struct{}
+	wild  map[*Session]struct{}
+}
+
+func (n *topicNode) empty() bool {
+	return len(n.children) == 0 && len(n.exact) == 0 && len(n.wild) == 0
+}
+
+// Topics is the registry of topic subscriptions of a server, see
+// Server.Topics. Topics are dot-separated segments like news.sports,
+// patterns are topics which may end with a * segment matching one or more
+// segments, so that news.* matches news.sports and news.sports.scores.
+// Clients manage their own subscriptions with Client.Subscribe and
+// Client.Unsubscribe. Subscriptions end with their session.
+type Topics struct {
+	mtx  sync.Mutex
+	root topicNode
+	// subs holds the patterns of each subscribed session.
+	subs map[*Session]map[string]struct{}
+	// stops unregister the cleanup of each subscribed session.
+	stops map[*Session]func() bool
+}
+
+func newTopics() *Topics {
+	return &Topics{
+		subs:  make(map[*Session]map[string]struct{}),
+		stops: make(map[*Session]func() bool),
+	}
+}
+
+// Topics returns the topic registry of the server.
+func (s *Server) Topics() *Topics {
+	return s.topics
+}
+
+// Subscribe subscribes the session to the topics matching the pattern.
+// Subscribing twice has no effect.
+func (t *Topics) Subscribe(s *Session, pattern string) error {
+	if err := validTopic(pattern, true); err != nil {
+		return err
+	}
+	if s.ctx != nil && s.ctx.Err() != nil {
+		return ErrSessionClosed
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if _, ok := t.subs[s][pattern]; ok {
+		return nil
+	}
+	if t.subs[s] == nil {
+		t.subs[s] = make(map[string]struct{})
+		if s.ctx != nil {
+			t.stops[s] = context.AfterFunc(s.ctx, func() { t.drop(s) })
+		}
+	}
+	t.subs[s][pattern] = struct{}{}
+	n := &t.root
+	prefix, wild := strings.CutSuffix(pattern, "*")
+	for seg := range strings.SplitSeq(strings.TrimSuffix(prefix, "."), ".") {
+		if seg == "" {
+			break // the pattern is just *
+		}
+		next, ok := n.children[seg]
+		if !ok {
+			next = &topicNode{}
+			if n.children == nil {
+				n.children = make(map[string]*topicNode)
+			}
+			n.children[seg] = next
+		}
+		n = next
+	}
+	set := &n.exact
+	if wild {
+		set = &n.wild
+	}
+	if *set == nil {
+		*set = make(map[*Session]struct{})
+	}
+	(*set)[s] = struct{}{}
+	return nil
+}
+
+// Unsubscribe removes the subscription of the session to the pattern
+// and reports whether it had one.
+func (t *Topics) Unsubscribe(s *Session, pattern string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if _, ok := t.subs[s][pattern]; !ok {
+		return false
+	}
+	t.remove(s, pattern)
+	if len(t.subs[s]) == 0 {
+		t.forget(s)
+	}
+	return true
+}
+
+// Subscriptions returns the patterns the session is subscribed to, sorted.
+func (t *Topics) Subscriptions(s *Session) []string {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	patterns := make([]string, 0, len(t.subs[s]))
+	for p := range t.subs[s] {
+		patterns = append(patterns, p)
+	}
+	slices.Sort(patterns)
+	return patterns
+}
+
+// remove removes the pattern of the session from the trie, pruning
+// the nodes left empty. The caller holds the mutex.
+func (t *Topics) remove(s *Session, pattern string) {
+	delete(t.subs[s], pattern)
+	prefix, wild := strings.CutSuffix(pattern, "*")
+	path := []*topicNode{&t.root}
+	var segs []string
+	for seg := range strings.SplitSeq(strings.TrimSuffix(prefix, "."), ".") {
+		if seg == "" {
+			break
+		}
+		next := path[len(path)-1].children[seg]
+		if next == nil {
+			return
+		}
+		path = append(path, next)
+		segs = append(segs, seg)
+	}
+	n := path[len(path)-1]
+	if wild {
+		delete(n.wild, s)
+	} else {
+		delete(n.exact, s)
+	}
+	for i := len(path) - 1; i > 0 && path[i].empty(); i-- {
+		delete(path[i-1].children, segs[i-1])
+	}
+}
+
+// forget drops the bookkeeping of a session without subscriptions.
+// The caller holds the mutex.
+func (t *Topics) forget(s *Session) {
+	delete(t.subs, s)
+	if stop, ok := t.stops[s]; ok {
+		stop()
+		delete(t.stops, s)
+	}
+}
+
+// drop removes all subscriptions of a session which ended.
+func (t *Topics) drop(s *Session) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for pattern := range t.subs[s] {
+		t.remove(s, pattern)
+	}
+	delete(t.subs, s)
+	delete(t.stops, s)
+}
+
+// subscribers returns the sessions subscribed to the topic, each once.
+func (t *Topics) subscribers(topic string) []*Session {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	found := make(map[*Session]struct{})
+	n := &t.root
+	for seg := range strings.SplitSeq(topic, ".") {
+		for s := range n.wild {
+			found[s] = struct{}{}
+		}
+		if n = n.children[seg]; n == nil {
+			break
+		}
+	}
+	if n != nil {
+		for s := range n.exact {
+			found[s] = struct{}{}
+		}
+	}
+	sessions := make([]*Session, 0, len(found))
+	for s := range found {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// Publish sends the message to all sessions subscribed to the topic and
+// returns how many it was written to. The message is encoded once and
+// written to the subscribers concurrently, Publish returns once all
+// writes are done or ctx is. Failed writes count as DropRelay.
+func (t *Topics) Publish(ctx context.Context, topic string, m *Message) (int, error) {
+	if err := validTopic(topic, false); err != nil {
+		return 0, err
+	}
+	if err := m.Validate(); err != nil {
+		return 0, err
+	}
+	shared := *m
+	shared.encode()
+	var (
+		wg   sync.WaitGroup
+		mtx  sync.Mutex
+		sent int
+	)
+	for _, s := range t.subscribers(topic) {
+		wg.Go(func() {
+			relay := shared
+			if err := s.Send(ctx, &relay); err != nil {
+				s.lgr.With("error", err, "topic", topic).Debug("failed to publish message")
+				s.dropped(DropRelay)
+				return
+			}
+			mtx.Lock()
+			sent++
+			mtx.Unlock()
+		})
+	}
+	wg.Wait()
+	return sent, nil
+}
+
+// topicCommand handles a client subscribing or unsubscribing itself.
+func (s *Server) topicCommand(ctx context.Context, session *Session, m *Message) bool {
+	if m.Type != MsgTypeControl {
+		return false
+	}
+	cmd, pattern, _ := bytes.Cut(m.Payload, []byte(" "))
+	switch string(cmd) {
+	case "subscribe":
+		reason, err := "invalid_topic", validTopic(string(pattern), true)
+		if err == nil && len(s.topics.Subscriptions(session)) >= maxClientTopics {
+			reason, err = "too_many_topics", fmt.Errorf("at most %d subscriptions", maxClientTopics)
+		}
+		if err == nil {
+			err = s.topics.Subscribe(session, string(pattern))
+		}
+		if err != nil {
+			session.lgr.With("error", err).Debug("refusing subscription")
+			if err := session.SendError(ctx, codes.PolicyViolation, reason, err.Error()); err != nil {
+				session.lgr.With("error", err).Error("failed to send rejection")
+			}
+		}
+	case "unsubscribe":
+		s.topics.Unsubscribe(session, string(pattern))
+	default:
+		return false
+	}
+	return true
+}
+
+// Subscribe subscribes the client to the topics matching the pattern,
+// see Topics. Subscriptions are renewed whenever the client connects.
+func (c *Client) Subscribe(ctx context.Context, pattern string) error {
+	if err := validTopic(pattern, true); err != nil {
+		return err
+	}
+	c.mtx.Lock()
+	if c.topics == nil {
+		c.topics = make(map[string]struct{})
+	}
+	c.topics[pattern] = struct{}{}
+	session := c.session
+	c.mtx.Unlock()
+	if session == nil {
+		return nil
+	}
+	return session.enqueue(ctx, NewControlMessage("subscribe", []byte(pattern)), PriorityHigh)
+}
+
+// Unsubscribe removes the subscription of the client to the pattern.
+func (c *Client) Unsubscribe(ctx context.Context, pattern string) error {
+	c.mtx.Lock()
+	delete(c.topics, pattern)
+	session := c.session
+	c.mtx.Unlock()
+	if session == nil {
+		return nil
+	}
+	return session.enqueue(ctx, NewControlMessage("unsubscribe", []byte(pattern)), PriorityHigh)
+}
+
+// resubscribe renews the subscriptions of the client on a new connection.
+func (c *Client) resubscribe(ctx context.Context, session *Session) {
+	c.mtx.Lock()
+	patterns := make([]string, 0, len(c.topics))
+	for p := range c.topics {
+		patterns = append(patterns, p)
+	}
+	c.mtx.Unlock()
+	for _, p := range patterns {
+		if err := session.enqueue(ctx, NewControlMessage("subscribe", []byte(p)), PriorityHigh); err != nil {
+			c.cfg.logger.With("error", err, "topic", p).Error("failed to subscribe")
+			return
+		}
+	}
+}
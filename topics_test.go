@@ -0,0 +1,132 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+// subscriber is a client subscribed to topics along with its session
+// on the server and the text messages it receives.
+type subscriber struct {
+	c    *chat.Client
+	s    *chat.Session
+	msgs chan string
+}
+
+func TestTopics(t *testing.T) {
+	sessions := make(chan *chat.Session, 1)
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		sessions <- s
+		discard(ctx, s)
+	})
+	topics := srv.Topics()
+	subscribe := func(patterns ...string) *subscriber {
+		t.Helper()
+		sub := &subscriber{msgs: make(chan string, 8)}
+		sub.c = connect(t, addr, ca, chat.ClientOptions.OnMessage(func(m *chat.Message) {
+			if m.Type == chat.MsgTypeText {
+				sub.msgs <- string(m.Payload)
+			}
+		}))
+		sub.s = receive(t, sessions)
+		for _, p := range patterns {
+			if err := sub.c.Subscribe(t.Context(), p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		slices.Sort(patterns)
+		eventually(t, func() bool { return slices.Equal(topics.Subscriptions(sub.s), patterns) })
+		return sub
+	}
+	subs := map[string]*subscriber{
+		"wild":   subscribe("news.*"),
+		"exact":  subscribe("news.sports"),
+		"all":    subscribe("*"),
+		"both":   subscribe("news.*", "news.sports", "weather"),
+		"others": subscribe("weather"),
+	}
+	// publish sends a message to the topic and checks it reached exactly
+	// the subscribers named, once each
+	publish := func(topic string, want ...string) {
+		t.Helper()
+		n, err := topics.Publish(t.Context(), topic, chat.NewTextMessage([]byte(topic)))
+		if err != nil {
+			t.Fatalf("publish %s: %v", topic, err)
+		}
+		if n != len(want) {
+			t.Errorf("published %s to %d, want %d", topic, n, len(want))
+		}
+		for name, sub := range subs {
+			// written after what was published
+			if err := sub.s.Send(t.Context(), chat.NewTextMessage([]byte("end"))); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for text := receive(t, sub.msgs); text != "end"; text = receive(t, sub.msgs) {
+				got = append(got, text)
+			}
+			wantGot := []string(nil)
+			if slices.Contains(want, name) {
+				wantGot = []string{topic}
+			}
+			if !slices.Equal(got, wantGot) {
+				t.Errorf("%s received %q of %s, want %q", name, got, topic, wantGot)
+			}
+		}
+	}
+
+	publish("news.sports", "wild", "exact", "all", "both")
+	publish("news.sports.scores", "wild", "all", "both")
+	// a wildcard matches one segment or more
+	publish("news", "all")
+	publish("weather", "all", "both", "others")
+	publish("sports", "all")
+
+	if err := subs["wild"].c.Unsubscribe(t.Context(), "news.*"); err != nil {
+		t.Fatal(err)
+	}
+	if !topics.Unsubscribe(subs["both"].s, "news.*") {
+		t.Error("unsubscribing news.* of both: no subscription")
+	}
+	if topics.Unsubscribe(subs["both"].s, "news.*") {
+		t.Error("unsubscribed news.* of both twice")
+	}
+	eventually(t, func() bool { return len(topics.Subscriptions(subs["wild"].s)) == 0 })
+	publish("news.sports", "exact", "all", "both")
+	publish("news.weather", "all")
+
+	// subscriptions end with their session
+	for _, name := range []string{"all", "others"} {
+		gone := subs[name]
+		delete(subs, name)
+		gone.c.Close()
+		eventually(t, func() bool { return len(topics.Subscriptions(gone.s)) == 0 })
+	}
+	publish("weather", "both")
+}
+
+func TestTopicsInvalid(t *testing.T) {
+	sessions := make(chan *chat.Session, 1)
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		sessions <- s
+		discard(ctx, s)
+	})
+	c := connect(t, addr, ca)
+	s := receive(t, sessions)
+	for _, pattern := range []string{"", "news.", ".news", "news..sports", "news.*.scores", "news*", "news sports"} {
+		if err := srv.Topics().Subscribe(s, pattern); !errors.Is(err, chat.ErrInvalidTopic) {
+			t.Errorf("subscribe %q: %v, want ErrInvalidTopic", pattern, err)
+		}
+		if err := c.Subscribe(t.Context(), pattern); !errors.Is(err, chat.ErrInvalidTopic) {
+			t.Errorf("client subscribe %q: %v, want ErrInvalidTopic", pattern, err)
+		}
+	}
+	// topics published to have no wildcard
+	if _, err := srv.Topics().Publish(t.Context(), "news.*", chat.NewTextMessage([]byte("x"))); !errors.Is(err, chat.ErrInvalidTopic) {
+		t.Errorf("publish to a pattern: %v, want ErrInvalidTopic", err)
+	}
+}
@@ -0,0 +1,286 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// transcriptQueue bounds the records waiting to be written,
+	// beyond which records are dropped rather than block the session.
+	transcriptQueue = 1024
+	// transcriptPrefix is how much of a payload TranscriptTruncated keeps.
+	transcriptPrefix = 32
+)
+
+// TranscriptPayloads defines how much of the text and binary payloads
+// a transcript records. Control and ack payloads, which make up the
+// protocol, are always recorded in full, so that handshakes can be replayed.
+type TranscriptPayloads int8
+
+const (
+	// TranscriptFull records payloads as they are.
+	TranscriptFull TranscriptPayloads = iota
+	// TranscriptTruncated records the first 32 bytes of payloads
+	// and the hash of the whole.
+	TranscriptTruncated
+	// TranscriptHashed records only the hash of payloads.
+	TranscriptHashed
+)
+
+// TranscriptDir is the direction of a recorded frame.
+type TranscriptDir string
+
+const (
+	TranscriptSent     TranscriptDir = "sent"
+	TranscriptReceived TranscriptDir = "received"
+)
+
+// TranscriptRecord is a line of a transcript, see SessionOptions.Transcript.
+type TranscriptRecord struct {
+	Time time.Time     `json:"time"`
+	Dir  TranscriptDir `json:"dir,omitempty"`
+	// Session is the ID of the session on a server, see Session.ID.
+	Session uint64 `json:"session,omitempty"`
+	Remote  string `json:"remote,omitempty"`
+	// Header is the framed header, tokens included.
+	Header []byte `json:"header,omitempty"`
+	// Size is the length of the payload, which may be recorded in part.
+	Size    int    `json:"size,omitempty"`
+	Payload []byte `json:"payload,omitempty"`
+	// Hash is the hex encoded SHA-256 of a payload not recorded in full.
+	Hash string `json:"hash,omitempty"`
+	// Dropped is set on a marker record in place of that many records
+	// dropped because the transcript could not keep up.
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// Message returns the recorded frame, with the payload as recorded.
+func (r *TranscriptRecord) Message() (*Message, error) {
+	if len(r.Header) != hdrLen {
+		return nil, fmt.Errorf("%w: header of %d bytes", ErrMalformedFrame, len(r.Header))
+	}
+	m := new(Message)
+	m.parseHeader((*[hdrLen]byte)(r.Header))
+	m.Payload = r.Payload
+	return m, nil
+}
+
+// Transcript records every frame sent and received by the session,
+// the handshake included on a server, as JSON lines of TranscriptRecord
+// written to w. Records are written by a goroutine of their own and
+// dropped rather than slow the session down, leaving a marker record.
+// The transcript holds tokens, keep it private. Passed to many sessions,
+// as by ServerOptions.SessionOptions, the option writes them all to w.
+func (sessionOptionsNamespace) Transcript(w io.Writer, payloads TranscriptPayloads) SessionOption {
+	t := newTranscript(w, payloads)
+	return func(s *Session) {
+		s.transcript = t
+	}
+}
+
+// Transcript records the frames of every session of the server to w,
+// see SessionOptions.Transcript.
+func (serverOptionsNamespace) Transcript(w io.Writer, payloads TranscriptPayloads) ServerOption {
+	return ServerOptions.SessionOptions(SessionOptions.Transcript(w, payloads))
+}
+
+// Transcript records the frames of the handshakes and sessions
+// of the client to w, see SessionOptions.Transcript.
+func (clientOptionsNamespace) Transcript(w io.Writer, payloads TranscriptPayloads) ClientOption {
+	t := newTranscript(w, payloads)
+	return func(cfg *clientConfig) {
+		cfg.transcript = t
+		cfg.sessionOpts = append(cfg.sessionOpts, func(s *Session) {
+			s.transcript = t
+		})
+	}
+}
+
+// transcript writes the records of one or more sessions. A write error
+// ends the transcript, later records are discarded.
+type transcript struct {
+	payloads TranscriptPayloads
+	w        *bufio.Writer
+	enc      *json.Encoder
+	err      error
+
+	q chan TranscriptRecord
+	// running is set while a goroutine writes queued records.
+	running atomic.Bool
+	// mtx orders the drops with the queued records.
+	mtx     sync.Mutex
+	dropped uint64
+}
+
+func newTranscript(w io.Writer, payloads TranscriptPayloads) *transcript {
+	bw := bufio.NewWriter(w)
+	return &transcript{
+		payloads: payloads,
+		w:        bw,
+		enc:      json.NewEncoder(bw),
+		q:        make(chan TranscriptRecord, transcriptQueue),
+	}
+}
+
+// record queues the record of m, starting a writer if none runs.
+func (t *transcript) record(dir TranscriptDir, session uint64, remote string, m *Message) {
+	hdr := m.header()
+	r := TranscriptRecord{
+		Time:    time.Now(),
+		Dir:     dir,
+		Session: session,
+		Remote:  remote,
+		Header:  hdr[:],
+		Size:    len(m.Payload),
+	}
+	switch {
+	case m.Type != MsgTypeText && m.Type != MsgTypeBinary || t.payloads == TranscriptFull:
+		r.Payload = bytes.Clone(m.Payload)
+	case len(m.Payload) > 0:
+		sum := sha256.Sum256(m.Payload)
+		r.Hash = hex.EncodeToString(sum[:])
+		if t.payloads == TranscriptTruncated {
+			r.Payload = bytes.Clone(m.Payload[:min(len(m.Payload), transcriptPrefix)])
+		}
+	}
+	t.mtx.Lock()
+	if t.dropped > 0 && t.queue(TranscriptRecord{Time: r.Time, Dropped: t.dropped}) {
+		t.dropped = 0
+	}
+	if t.dropped > 0 || !t.queue(r) {
+		t.dropped++
+	}
+	t.mtx.Unlock()
+	if t.running.CompareAndSwap(false, true) {
+		go t.run()
+	}
+}
+
+// queue queues r unless the queue is full. The caller holds the mutex.
+func (t *transcript) queue(r TranscriptRecord) bool {
+	select {
+	case t.q <- r:
+		return true
+	default:
+		return false
+	}
+}
+
+// run writes queued records until there are none left, then flushes them.
+func (t *transcript) run() {
+	for {
+		for drained := false; !drained; {
+			select {
+			case r := <-t.q:
+				t.write(r)
+			default:
+				drained = true
+			}
+		}
+		var dropped uint64
+		t.mtx.Lock()
+		if len(t.q) == 0 {
+			dropped, t.dropped = t.dropped, 0
+		}
+		t.mtx.Unlock()
+		if dropped > 0 {
+			t.write(TranscriptRecord{Time: time.Now(), Dropped: dropped})
+		}
+		if t.err == nil {
+			t.err = t.w.Flush()
+		}
+		t.running.Store(false)
+		// a record queued since the queue was drained may have found
+		// the writer still running
+		if len(t.q) == 0 || !t.running.CompareAndSwap(false, true) {
+			return
+		}
+	}
+}
+
+func (t *transcript) write(r TranscriptRecord) {
+	if t.err == nil {
+		t.err = t.enc.Encode(r)
+	}
+}
+
+// transcribe records m sent or received by the session, if it has a transcript.
+func (s *Session) transcribe(dir TranscriptDir, m *Message) {
+	if s.transcript == nil {
+		return
+	}
+	var remote string
+	if s.conn != nil {
+		remote = s.conn.RemoteAddr().String()
+	}
+	s.transcript.record(dir, s.id, remote, m)
+}
+
+// teeFrames records the frames read and written through rw by a handshake,
+// before the session reads and writes messages, if t is not nil.
+func (t *transcript) teeFrames(rw io.ReadWriter, session uint64, remote net.Addr) io.ReadWriter {
+	if t == nil {
+		return rw
+	}
+	return &frameTee{ReadWriter: rw, t: t, session: session, remote: remote.String()}
+}
+
+// frameTee splits the bytes read and written into frames to record them.
+type frameTee struct {
+	io.ReadWriter
+	t       *transcript
+	session uint64
+	remote  string
+	in, out []byte
+}
+
+func (f *frameTee) Read(p []byte) (int, error) {
+	n, err := f.ReadWriter.Read(p)
+	f.in = f.frames(TranscriptReceived, append(f.in, p[:n]...))
+	return n, err
+}
+
+// SetReadDeadline sets the read deadline of the stream teed, so that
+// reads through the tee can be interrupted.
+func (f *frameTee) SetReadDeadline(t time.Time) error {
+	d, ok := f.ReadWriter.(readDeadliner)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return d.SetReadDeadline(t)
+}
+
+func (f *frameTee) Write(p []byte) (int, error) {
+	n, err := f.ReadWriter.Write(p)
+	f.out = f.frames(TranscriptSent, append(f.out, p[:n]...))
+	return n, err
+}
+
+// frames records the complete frames at the start of buf
+// and returns the rest.
+func (f *frameTee) frames(dir TranscriptDir, buf []byte) []byte {
+	for len(buf) >= hdrLen {
+		end := hdrLen + int(binary.BigEndian.Uint32(buf[offLen:]))
+		if len(buf) < end {
+			break
+		}
+		var m Message
+		m.parseHeader((*[hdrLen]byte)(buf))
+		m.Payload = buf[hdrLen:end]
+		f.t.record(dir, f.session, f.remote, &m)
+		buf = buf[end:]
+	}
+	return buf
+}
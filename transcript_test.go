@@ -0,0 +1,144 @@
+package chat_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+// transcriptBuffer is a transcript shared by its writer and the test.
+type transcriptBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *transcriptBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+// records decodes the records written so far.
+func (b *transcriptBuffer) records(t *testing.T) []chat.TranscriptRecord {
+	t.Helper()
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	var recs []chat.TranscriptRecord
+	dec := json.NewDecoder(bytes.NewReader(b.buf.Bytes()))
+	for dec.More() {
+		var r chat.TranscriptRecord
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, r)
+	}
+	return recs
+}
+
+// transcribed is a recorded frame as the test expects it.
+type transcribed struct {
+	dir     chat.TranscriptDir
+	typ     chat.MsgType
+	payload string
+	size    int
+	hash    string
+}
+
+// frames returns the frames of the records, failing on a dropped marker.
+func frames(t *testing.T, recs []chat.TranscriptRecord) []transcribed {
+	t.Helper()
+	var fs []transcribed
+	for _, r := range recs {
+		if r.Dropped > 0 {
+			t.Fatalf("%d records dropped", r.Dropped)
+		}
+		m, err := r.Message()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs = append(fs, transcribed{r.Dir, m.Type, string(m.Payload), r.Size, r.Hash})
+	}
+	return fs
+}
+
+func TestTranscript(t *testing.T) {
+	var clientT, serverT transcriptBuffer
+	sessions := make(chan uint64, 1)
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		sessions <- s.ID()
+		if _, err := s.Recv(ctx); err != nil {
+			return
+		}
+		_ = s.Send(ctx, chat.NewTextMessage([]byte("hi")))
+		discard(ctx, s)
+	}, chat.ServerOptions.Transcript(&serverT, chat.TranscriptHashed))
+	got := make(chan string, 1)
+	c := connect(t, addr, ca,
+		chat.ClientOptions.Transcript(&clientT, chat.TranscriptFull),
+		chat.ClientOptions.OnMessage(func(m *chat.Message) { got <- string(m.Payload) }))
+	send(t, c, "hello")
+	if text := receive(t, got); text != "hi" {
+		t.Fatalf("received %q, want hi", text)
+	}
+	session := receive(t, sessions)
+	hash := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	for _, tt := range []struct {
+		name string
+		buf  *transcriptBuffer
+		// the commands sent and received in the handshake
+		sent, received string
+		// the text frames, in order
+		texts []transcribed
+	}{
+		{"client", &clientT, "login", "ok", []transcribed{
+			{chat.TranscriptSent, chat.MsgTypeText, "hello", 5, ""},
+			{chat.TranscriptReceived, chat.MsgTypeText, "hi", 2, ""},
+		}},
+		{"server", &serverT, "ok", "login", []transcribed{
+			{chat.TranscriptReceived, chat.MsgTypeText, "", 5, hash("hello")},
+			{chat.TranscriptSent, chat.MsgTypeText, "", 2, hash("hi")},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var fs, texts []transcribed
+			eventually(t, func() bool {
+				fs = frames(t, tt.buf.records(t))
+				texts = slices.DeleteFunc(slices.Clone(fs), func(f transcribed) bool { return f.typ != chat.MsgTypeText })
+				return len(texts) >= len(tt.texts)
+			})
+			var sent, received bool
+			for _, f := range fs {
+				switch {
+				case f.typ != chat.MsgTypeControl:
+				case f.dir == chat.TranscriptSent:
+					sent = sent || strings.HasPrefix(f.payload, tt.sent)
+				default:
+					received = received || strings.HasPrefix(f.payload, tt.received)
+				}
+			}
+			if !sent || !received {
+				t.Errorf("handshake without %s sent (%v) or %s received (%v): %+v", tt.sent, sent, tt.received, received, fs)
+			}
+			if !slices.Equal(texts, tt.texts) {
+				t.Errorf("text frames %+v, want %+v", texts, tt.texts)
+			}
+		})
+	}
+	for _, r := range serverT.records(t) {
+		if r.Session != session || r.Remote == "" {
+			t.Errorf("server record of session %d from %q, want %d", r.Session, r.Remote, session)
+		}
+	}
+}
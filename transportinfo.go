@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// TransportInfo describes the QUIC connection of a session for diagnostics.
+type TransportInfo struct {
+	// Version is the negotiated QUIC version, e.g. "v1".
+	Version string
+	// MTU is the largest packet size in bytes path MTU discovery found
+	// the path to carry so far, zero until its first probe got through.
+	MTU int
+	// Datagrams is set if both ends negotiated QUIC datagrams.
+	Datagrams bool
+	// ALPN is the negotiated application protocol.
+	ALPN string
+}
+
+type pathMTUKey struct{}
+
+// withPathMTU attaches to ctx the holder of the path MTU of the
+// connection it is passed to when dialing or accepting, see mtuTracer.
+func withPathMTU(ctx context.Context) context.Context {
+	return context.WithValue(ctx, pathMTUKey{}, new(atomic.Int64))
+}
+
+// mtuTracer records the path MTU found for a connection in the holder
+// attached to its context, if any.
+func mtuTracer(ctx context.Context, _ logging.Perspective, _ quic.ConnectionID) *logging.ConnectionTracer {
+	mtu, ok := ctx.Value(pathMTUKey{}).(*atomic.Int64)
+	if !ok {
+		return nil
+	}
+	return &logging.ConnectionTracer{
+		UpdatedMTU: func(size logging.ByteCount, _ bool) {
+			mtu.Store(int64(size))
+		},
+	}
+}
+
+// transportInfo returns the current transport state of the connection.
+func transportInfo(conn *quic.Conn) TransportInfo {
+	state := conn.ConnectionState()
+	info := TransportInfo{
+		Version:   state.Version.String(),
+		Datagrams: state.SupportsDatagrams,
+		ALPN:      state.TLS.NegotiatedProtocol,
+	}
+	if mtu, ok := conn.Context().Value(pathMTUKey{}).(*atomic.Int64); ok {
+		info.MTU = int(mtu.Load())
+	}
+	return info
+}
+
+// attrs returns the info as logger attributes.
+func (i TransportInfo) attrs() []any {
+	return []any{"quic_version", i.Version, "mtu", i.MTU, "datagrams", i.Datagrams, "alpn", i.ALPN}
+}
+
+// TransportInfo returns the current state of the connection of the session,
+// zero if it has none, e.g. a session made with NewSession.
+func (s *Session) TransportInfo() TransportInfo {
+	if s.conn == nil {
+		return TransportInfo{}
+	}
+	return transportInfo(s.conn)
+}
+
+// TransportInfo returns the current state of the active connection,
+// zero when the client is not connected.
+func (c *Client) TransportInfo() TransportInfo {
+	c.mtx.Lock()
+	session := c.session
+	c.mtx.Unlock()
+	if session == nil {
+		return TransportInfo{}
+	}
+	return session.TransportInfo()
+}
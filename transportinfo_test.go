@@ -0,0 +1,55 @@
+package chat_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestTransportInfo(t *testing.T) {
+	infos := make(chan chat.TransportInfo, 1)
+	opt, recs := accessLog()
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		for {
+			if _, err := s.Recv(ctx); err != nil {
+				return
+			}
+			select {
+			case infos <- s.TransportInfo():
+			default:
+			}
+		}
+	}, opt)
+	c := newClient(t, addr, ca)
+	if info := c.TransportInfo(); info != (chat.TransportInfo{}) {
+		t.Errorf("info %+v before connecting", info)
+	}
+	if err := dial(t, c); err != nil {
+		t.Fatal(err)
+	}
+
+	// path MTU discovery takes a few round trips
+	var client, server chat.TransportInfo
+	eventually(t, func() bool {
+		send(t, c, "probe")
+		client, server = c.TransportInfo(), receive(t, infos)
+		return client.MTU > 0 && server.MTU > 0
+	})
+	for side, info := range map[string]chat.TransportInfo{"client": client, "server": server} {
+		if info.Version != "v1" || info.ALPN != "quic-raw" || info.MTU < 1200 || info.MTU > 65536 {
+			t.Errorf("%s: %+v", side, info)
+		}
+	}
+	if client.Datagrams != server.Datagrams {
+		t.Errorf("datagrams negotiated by the client: %v, by the server: %v", client.Datagrams, server.Datagrams)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rec := receive(t, recs)
+	if rec.Version != server.Version || rec.ALPN != server.ALPN || rec.MTU < server.MTU || rec.Datagrams != server.Datagrams {
+		t.Errorf("access record of %s %s, mtu %d, datagrams %v, want those of %+v", rec.Version, rec.ALPN, rec.MTU, rec.Datagrams, server)
+	}
+}
@@ -0,0 +1,91 @@
+package chat
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrNoTrustAnchors is returned by Dial when neither the system pool nor
+// any of the Certs files could be loaded and nothing else makes the
+// client trust a server, such as Insec or TOFU.
+var ErrNoTrustAnchors = errors.New("no trust anchors")
+
+// TrustInfo describes the sources the client trusts servers by,
+// as loaded by the last Dial.
+type TrustInfo struct {
+	// RootCAs is set if the pool of the RootCAs option replaced
+	// the system pool and the Certs files.
+	RootCAs bool
+	// System is set if the system pool was loaded,
+	// SystemErr is why it was not.
+	System    bool
+	SystemErr error
+	// Files are the Certs files loaded.
+	Files []string
+	// Insecure and TOFU are set if the Insec and TOFU options
+	// were in effect.
+	Insecure bool
+	TOFU     bool
+}
+
+// SystemCertPool replaces x509.SystemCertPool as the loader
+// of the system pool, e.g. to simulate its failure in tests.
+func (clientOptionsNamespace) SystemCertPool(load func() (*x509.CertPool, error)) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.sysPool = load
+	}
+}
+
+// TrustInfo returns the sources the client trusted servers by
+// when it last dialed, zero before the first Dial.
+func (c *Client) TrustInfo() TrustInfo {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.trust
+}
+
+// rootCAs returns the certificate authorities trusted for the server.
+// Without the system pool it carries on with the Certs files, as long
+// as something makes the client trust a server.
+func (c *Client) rootCAs() (*x509.CertPool, error) {
+	info := TrustInfo{Insecure: c.cfg.insec, TOFU: c.cfg.tofu != nil}
+	defer func() {
+		c.mtx.Lock()
+		c.trust = info
+		c.mtx.Unlock()
+	}()
+	if c.cfg.roots != nil {
+		info.RootCAs = true
+		return c.cfg.roots, nil
+	}
+	crts, err := c.cfg.sysPool()
+	if err != nil {
+		info.SystemErr = err
+		crts = x509.NewCertPool()
+	} else {
+		info.System = true
+	}
+	for _, certfile := range c.cfg.certs {
+		crt, err := os.ReadFile(certfile)
+		if err != nil {
+			c.cfg.logger.With("error", err).Error("failed to read cert")
+			continue
+		}
+		if !crts.AppendCertsFromPEM(crt) {
+			c.cfg.logger.With("file", certfile).Warn("failed to append cert")
+			continue
+		}
+		info.Files = append(info.Files, certfile)
+	}
+	lgr := c.cfg.logger.With("system", info.System, "files", info.Files, "insecure", info.Insecure, "tofu", info.TOFU)
+	if !info.System {
+		if len(info.Files) == 0 && !info.Insecure && !info.TOFU {
+			return nil, fmt.Errorf("%w: get system certs: %w", ErrNoTrustAnchors, info.SystemErr)
+		}
+		lgr.With("error", info.SystemErr).Warn("system cert pool unavailable, trusting the remaining sources only")
+	}
+	lgr.Debug("trust sources loaded")
+	return crts, nil
+}
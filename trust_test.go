@@ -0,0 +1,89 @@
+package chat_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/keygen"
+)
+
+// errNoSystemPool is the failure of the system pool in TestTrustSources.
+var errNoSystemPool = errors.New("no system pool")
+
+func TestTrustSources(t *testing.T) {
+	certPEM, keyPEM, err := keygen.Cert([]string{"127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, addr, _ := startServer(t, discard, chat.ServerOptions.TLSCertificate(crt))
+
+	failing := chat.ClientOptions.SystemCertPool(func() (*x509.CertPool, error) { return nil, errNoSystemPool })
+	system := chat.ClientOptions.SystemCertPool(func() (*x509.CertPool, error) { return x509.NewCertPool(), nil })
+	for _, tt := range []struct {
+		name    string
+		opts    []chat.ClientOption
+		want    chat.TrustInfo
+		warned  bool
+		refused bool
+	}{
+		{
+			name: "system pool and files",
+			opts: []chat.ClientOption{system, chat.ClientOptions.Certs([]string{certFile})},
+			want: chat.TrustInfo{System: true, Files: []string{certFile}},
+		},
+		{
+			name:   "files without system pool",
+			opts:   []chat.ClientOption{failing, chat.ClientOptions.Certs([]string{certFile})},
+			want:   chat.TrustInfo{SystemErr: errNoSystemPool, Files: []string{certFile}},
+			warned: true,
+		},
+		{
+			name:   "insecure without system pool",
+			opts:   []chat.ClientOption{failing, chat.ClientOptions.Insec(true)},
+			want:   chat.TrustInfo{SystemErr: errNoSystemPool, Insecure: true},
+			warned: true,
+		},
+		{
+			name:    "nothing to trust",
+			opts:    []chat.ClientOption{failing, chat.ClientOptions.Certs([]string{filepath.Join(t.TempDir(), "missing.pem")})},
+			want:    chat.TrustInfo{SystemErr: errNoSystemPool},
+			refused: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var rec recorder
+			// no RootCAs, which would replace the other sources
+			opts := append([]chat.ClientOption{chat.ClientOptions.RootCAs(nil), chat.ClientOptions.Logger(rec.log)}, tt.opts...)
+			c := newClient(t, addr, nil, opts...)
+			err := dial(t, c)
+			if tt.refused != errors.Is(err, chat.ErrNoTrustAnchors) || !tt.refused && err != nil {
+				t.Fatalf("dial: %v, refused %v", err, tt.refused)
+			}
+
+			info := c.TrustInfo()
+			if info.System != tt.want.System || !errors.Is(info.SystemErr, tt.want.SystemErr) ||
+				!slices.Equal(info.Files, tt.want.Files) || info.Insecure != tt.want.Insecure || info.RootCAs {
+				t.Errorf("trust info %+v, want %+v", info, tt.want)
+			}
+			warned := slices.ContainsFunc(rec.recorded(), func(l line) bool { return l.lvl == chat.LogLevelWarn })
+			if warned != tt.warned {
+				t.Errorf("warned %v, want %v", warned, tt.warned)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package chat_test
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+// manualClock is a clock moving only when told to.
+type manualClock struct {
+	mtx sync.Mutex
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Add(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestTTLExpiresOffline(t *testing.T) {
+	clk := &manualClock{now: time.Now()}
+	srv, addr, ca := startServer(t, chat.NewHub().Serve,
+		chat.ServerOptions.Source(chat.Source{Rand: rand.Reader, Now: clk.Now}),
+		chat.ServerOptions.MessageStore(chat.NewMemMessageStore()),
+	)
+	tokFile := sharedToken(t)
+	recipient := connect(t, addr, ca, tokFile)
+	tok, err := recipient.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recipient.Close(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return len(srv.Sessions()) == 0 })
+
+	ctx := context.Background()
+	for text, ttl := range map[string]time.Duration{"gone": time.Minute, "kept": time.Hour, "forever": 0} {
+		m := chat.NewTextMessage([]byte(text))
+		m.SetTTL(ttl)
+		if err := srv.SendTo(ctx, tok, m); err != nil {
+			t.Fatalf("send %s: %v", text, err)
+		}
+	}
+	clk.Add(2 * time.Minute)
+
+	got := make(chan string, 3)
+	connect(t, addr, ca, tokFile, chat.ClientOptions.OnMessage(func(m *chat.Message) { got <- string(m.Payload) }))
+	seen := map[string]bool{receive(t, got): true, receive(t, got): true}
+	if !seen["kept"] || !seen["forever"] {
+		t.Errorf("delivered %v, want kept and forever", seen)
+	}
+	select {
+	case text := <-got:
+		t.Errorf("delivered %q after its TTL", text)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := srv.Stats().Expired; n != 1 {
+		t.Errorf("%d expired, want 1", n)
+	}
+}
@@ -0,0 +1,139 @@
+package chat_test
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+// typing is the control message a session sends for SendTyping.
+func typing() *chat.Message {
+	return &chat.Message{Type: chat.MsgTypeControl, Payload: []byte("typing")}
+}
+
+func TestSendTypingRateLimited(t *testing.T) {
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		for range 3 {
+			if err := s.SendTyping(ctx); err != nil {
+				return
+			}
+		}
+		if err := s.Send(ctx, chat.NewTextMessage([]byte("done"))); err != nil {
+			return
+		}
+		discard(ctx, s)
+	})
+	events := make(chan chat.TypingEvent, 4)
+	done := make(chan struct{}, 1)
+	connect(t, addr, ca,
+		chat.ClientOptions.OnEvent(func(e chat.Event) {
+			if e, ok := e.(chat.TypingEvent); ok {
+				events <- e
+			}
+		}),
+		chat.ClientOptions.OnMessage(func(*chat.Message) { done <- struct{}{} }),
+	)
+	receive(t, done)
+	receive(t, events)
+	select {
+	case <-events:
+		t.Error("typing events sent within the rate limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTypingNotInRecv(t *testing.T) {
+	events := make(chan chat.Event, 4)
+	msgs := make(chan *chat.Message, 4)
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		go func() {
+			for ev := range s.Events(ctx) {
+				events <- ev
+			}
+		}()
+		for {
+			m, err := s.Recv(ctx)
+			if err != nil {
+				return
+			}
+			msgs <- m
+		}
+	})
+	c := connect(t, addr, ca)
+	if err := c.SendMessage(context.Background(), typing()); err != nil {
+		t.Fatalf("send typing: %v", err)
+	}
+	send(t, c, "hi")
+	if m := receive(t, msgs); m.Type != chat.MsgTypeText || string(m.Payload) != "hi" {
+		t.Errorf("Recv returned %v %q, want the text", m.Type, m.Payload)
+	}
+	if ev, ok := receive(t, events).(chat.TypingEvent); !ok {
+		t.Errorf("event %#v, want a TypingEvent", ev)
+	}
+}
+
+func TestTypingRelayedByHub(t *testing.T) {
+	_, addr, ca := startServer(t, chat.NewHub().Serve)
+	joined := make(chan chat.PresenceEvent, 4)
+	a := connect(t, addr, ca, chat.ClientOptions.OnEvent(func(e chat.Event) {
+		if e, ok := e.(chat.PresenceEvent); ok && e.Online {
+			joined <- e
+		}
+	}))
+	events := make(chan chat.TypingEvent, 4)
+	connect(t, addr, ca, chat.ClientOptions.OnEvent(func(e chat.Event) {
+		if e, ok := e.(chat.TypingEvent); ok {
+			events <- e
+		}
+	}))
+	// typing events reach the members of the hub at the time
+	receive(t, joined)
+	if err := a.SendMessage(context.Background(), typing()); err != nil {
+		t.Fatalf("send typing: %v", err)
+	}
+	if e := receive(t, events); e.Sender == 0 {
+		t.Errorf("relayed typing event %+v lacks the sender", e)
+	}
+}
+
+func TestSendTypingClock(t *testing.T) {
+	clk := &manualClock{now: time.Now()}
+	sent := make(chan error, 1)
+	_, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		for range 2 {
+			sent <- s.SendTyping(ctx)
+			// the interval passes on the clock of the session only
+			clk.Add(3 * time.Second)
+		}
+		discard(ctx, s)
+	}, chat.ServerOptions.Source(chat.Source{Rand: rand.Reader, Now: clk.Now}))
+	events := make(chan chat.TypingEvent, 4)
+	connect(t, addr, ca, chat.ClientOptions.OnEvent(func(e chat.Event) {
+		if e, ok := e.(chat.TypingEvent); ok {
+			events <- e
+		}
+	}))
+	for range 2 {
+		if err := receive(t, sent); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, events)
+	}
+}
+
+func TestSendTypingCancelled(t *testing.T) {
+	s := stalled(t)
+	// a typing event which could not be sent does not hold back the next
+	for range 2 {
+		ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+		err := s.SendTyping(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("typing behind a stalled write: %v, want %v", err, context.DeadlineExceeded)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package chat
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultUsageTokens bounds the number of tokens whose usage is kept.
+const defaultUsageTokens = 10000
+
+// Usage is the traffic of a token summed over its sessions.
+// Bytes count whole frames, messages only text and binary ones.
+type Usage struct {
+	BytesIn     uint64 `json:"bytes_in"`
+	BytesOut    uint64 `json:"bytes_out"`
+	MessagesIn  uint64 `json:"messages_in"`
+	MessagesOut uint64 `json:"messages_out"`
+	// LastSeen is when traffic of the token was last accounted.
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func (u *Usage) add(o Usage) {
+	u.BytesIn += o.BytesIn
+	u.BytesOut += o.BytesOut
+	u.MessagesIn += o.MessagesIn
+	u.MessagesOut += o.MessagesOut
+	u.LastSeen = o.LastSeen
+}
+
+// UsageRecord is the traffic of a token since the previous call of the UsageSink.
+type UsageRecord struct {
+	// TokenHash is the hex encoded SHA-256 of the token.
+	TokenHash string `json:"token_hash"`
+	Usage
+}
+
+// UsageSink receives the usage of every token with traffic since its previous call.
+// It is called from a dedicated goroutine, a last time after the server stopped.
+type UsageSink func(recs []UsageRecord)
+
+// UsageSink calls sink every interval with the traffic of tokens
+// since the previous call, e.g. to ship it to a metering system.
+func (serverOptionsNamespace) UsageSink(interval time.Duration, sink UsageSink) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.usageEvery = interval
+		cfg.usageSink = sink
+	}
+}
+
+// UsageTokens bounds the number of tokens whose usage is kept in memory.
+// The usage of the least recently active tokens is dropped first.
+func (serverOptionsNamespace) UsageTokens(n int) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.usageTokens = n
+	}
+}
+
+// traffic counts the traffic of a session not yet accounted to its token.
+type traffic struct {
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+	messagesIn  atomic.Uint64
+	messagesOut atomic.Uint64
+}
+
+// received counts a frame read from the session stream.
+func (t *traffic) received(m *Message) {
+	t.bytesIn.Add(uint64(hdrLen + len(m.Payload)))
+	if m.Type == MsgTypeText || m.Type == MsgTypeBinary {
+		t.messagesIn.Add(1)
+	}
+}
+
+// sent counts n bytes of m written to the session stream.
+func (t *traffic) sent(m *Message, n int64) {
+	t.bytesOut.Add(uint64(n))
+	if m.Type == MsgTypeText || m.Type == MsgTypeBinary {
+		t.messagesOut.Add(1)
+	}
+}
+
+// take returns the counted traffic and resets the counters.
+func (t *traffic) take() Usage {
+	return Usage{
+		BytesIn:     t.bytesIn.Swap(0),
+		BytesOut:    t.bytesOut.Swap(0),
+		MessagesIn:  t.messagesIn.Swap(0),
+		MessagesOut: t.messagesOut.Swap(0),
+	}
+}
+
+type usageEntry struct {
+	tok     [16]byte
+	total   Usage
+	pending Usage
+}
+
+// usageLRU keeps the usage per token, evicting the least recently active token.
+type usageLRU struct {
+	mtx   sync.Mutex
+	size  int
+	ll    *list.List
+	items map[[16]byte]*list.Element
+}
+
+func newUsageLRU(size int) *usageLRU {
+	return &usageLRU{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[[16]byte]*list.Element),
+	}
+}
+
+func (l *usageLRU) add(tok [16]byte, u Usage) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	e, ok := l.items[tok]
+	if ok {
+		l.ll.MoveToFront(e)
+	} else {
+		e = l.ll.PushFront(&usageEntry{tok: tok})
+		l.items[tok] = e
+	}
+	entry := e.Value.(*usageEntry)
+	entry.total.add(u)
+	entry.pending.add(u)
+	if l.ll.Len() > l.size {
+		e := l.ll.Back()
+		l.ll.Remove(e)
+		delete(l.items, e.Value.(*usageEntry).tok)
+	}
+}
+
+// rekey moves the usage of the token old to tok, adding it to that of tok.
+func (l *usageLRU) rekey(old, tok [16]byte) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	e, ok := l.items[old]
+	if !ok {
+		return
+	}
+	delete(l.items, old)
+	entry := e.Value.(*usageEntry)
+	if dst, ok := l.items[tok]; ok {
+		l.ll.Remove(e)
+		dst.Value.(*usageEntry).total.add(entry.total)
+		dst.Value.(*usageEntry).pending.add(entry.pending)
+		return
+	}
+	entry.tok = tok
+	l.items[tok] = e
+}
+
+func (l *usageLRU) get(tok [16]byte) (Usage, bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	e, ok := l.items[tok]
+	if !ok {
+		return Usage{}, false
+	}
+	return e.Value.(*usageEntry).total, true
+}
+
+// drain returns the usage added since the previous call.
+func (l *usageLRU) drain() []UsageRecord {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	var recs []UsageRecord
+	for e := l.ll.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*usageEntry)
+		if entry.pending == (Usage{}) {
+			continue
+		}
+		recs = append(recs, UsageRecord{TokenHash: tokenHash(entry.tok), Usage: entry.pending})
+		entry.pending = Usage{}
+	}
+	return recs
+}
+
+// account adds the traffic of the session to the usage of its token.
+func (s *Server) account(session *Session) {
+	if session.anonymous() {
+		return
+	}
+	u := session.traffic.take()
+	if u == (Usage{}) {
+		return
+	}
+	u.LastSeen = time.Now()
+	s.usage.add(session.currentToken(), u)
+}
+
+// accountAll accounts the traffic of the active sessions matching keep.
+func (s *Server) accountAll(keep func(*Session) bool) {
+	s.mtx.Lock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		if keep(session) {
+			sessions = append(sessions, session)
+		}
+	}
+	s.mtx.Unlock()
+	for _, session := range sessions {
+		s.account(session)
+	}
+}
+
+// Usage returns the traffic of the token, including its active sessions,
+// and whether any is known. Usage of tokens evicted by UsageTokens is lost.
+func (s *Server) Usage(tok [16]byte) (Usage, bool) {
+	s.accountAll(func(session *Session) bool { return session.currentToken() == tok })
+	return s.usage.get(tok)
+}
+
+// runUsage passes the usage to the sink every interval until the server
+// has stopped and all connections are served, then passes the rest.
+func (s *Server) runUsage() {
+	defer close(s.usageDone)
+	stop := make(chan struct{})
+	go func() {
+		<-s.ctx.Done()
+		s.sessionsWG.Wait()
+		close(stop)
+	}()
+	ticker := time.NewTicker(s.cfg.usageEvery)
+	defer ticker.Stop()
+	all := func(*Session) bool { return true }
+	sink := func(recs []UsageRecord) {
+		_ = s.guard("usage sink", func() error {
+			s.cfg.usageSink(recs)
+			return nil
+		})
+	}
+	for {
+		select {
+		case <-ticker.C:
+			s.accountAll(all)
+			if recs := s.usage.drain(); len(recs) > 0 {
+				sink(recs)
+			}
+		case <-stop:
+			if recs := s.usage.drain(); len(recs) > 0 {
+				sink(recs)
+			}
+			return
+		}
+	}
+}
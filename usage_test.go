@@ -0,0 +1,117 @@
+package chat_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestUsageSumsSessions(t *testing.T) {
+	var n atomic.Int64
+	srv, addr, ca := startServer(t, counting(&n))
+	tokFile := sharedToken(t)
+	cs := []*chat.Client{connect(t, addr, ca, tokFile), connect(t, addr, ca, tokFile)}
+	tok, err := cs[0].Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cs {
+		for range 3 {
+			send(t, c, "metered")
+		}
+	}
+	eventually(t, func() bool { return n.Load() == 6 })
+	for _, c := range cs {
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, func() bool { return len(srv.Sessions()) == 0 })
+
+	u, ok := srv.Usage(tok)
+	if !ok {
+		t.Fatal("no usage of the token")
+	}
+	if u.MessagesIn != 6 || u.BytesIn < 6*uint64(len("metered")) {
+		t.Errorf("usage %+v, want 6 messages in", u)
+	}
+	if _, ok := srv.Usage([16]byte{1}); ok {
+		t.Error("usage of an unknown token")
+	}
+}
+
+func TestUsageSink(t *testing.T) {
+	var (
+		mtx  sync.Mutex
+		recs []chat.UsageRecord
+	)
+	var n atomic.Int64
+	_, addr, ca := startServer(t, counting(&n),
+		chat.ServerOptions.UsageSink(10*time.Millisecond, func(rs []chat.UsageRecord) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			recs = append(recs, rs...)
+		}))
+	c := connect(t, addr, ca)
+	tok, err := c.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(t, c, "metered")
+	eventually(t, func() bool { return n.Load() == 1 })
+
+	// long sessions are accounted periodically, not only when they end
+	var sum chat.Usage
+	eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		sum = chat.Usage{}
+		for _, r := range recs {
+			sum.MessagesIn += r.MessagesIn
+			sum.BytesIn += r.BytesIn
+		}
+		return sum.MessagesIn == 1
+	})
+	hash := sha256.Sum256(tok[:])
+	mtx.Lock()
+	defer mtx.Unlock()
+	for _, r := range recs {
+		if r.TokenHash != hex.EncodeToString(hash[:]) {
+			t.Errorf("record of token hash %s, want %x", r.TokenHash, hash)
+		}
+		if r.LastSeen.IsZero() || time.Since(r.LastSeen) > waitTimeout {
+			t.Errorf("record last seen %v", r.LastSeen)
+		}
+	}
+	if sum.BytesIn < uint64(len("metered")) {
+		t.Errorf("%d bytes in, want at least the payload", sum.BytesIn)
+	}
+}
+
+func TestUsageTokensEvicts(t *testing.T) {
+	srv, addr, ca := startServer(t, discard, chat.ServerOptions.UsageTokens(1))
+	var toks [2][16]byte
+	for i := range toks {
+		c := connect(t, addr, ca)
+		send(t, c, "metered")
+		var err error
+		if toks[i], err = c.Token(); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+		eventually(t, func() bool { return len(srv.Sessions()) == 0 })
+	}
+	if _, ok := srv.Usage(toks[0]); ok {
+		t.Error("usage of the least recent token kept beyond the limit")
+	}
+	if _, ok := srv.Usage(toks[1]); !ok {
+		t.Error("usage of the latest token dropped")
+	}
+}
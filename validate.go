@@ -0,0 +1,124 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidConfig is matched by every problem reported by
+// Server.Validate and Client.Validate.
+var ErrInvalidConfig = errors.New("invalid config")
+
+// problems collects the problems of a config.
+type problems []error
+
+func (p *problems) add(format string, args ...any) {
+	*p = append(*p, fmt.Errorf("%w: "+format, append([]any{ErrInvalidConfig}, args...)...))
+}
+
+// check adds the problem if bad.
+func (p *problems) check(bad bool, format string, args ...any) {
+	if bad {
+		p.add(format, args...)
+	}
+}
+
+func (p problems) err() error {
+	return errors.Join(p...)
+}
+
+// validate checks the heartbeat configured with a Heartbeat option.
+func (h heartbeat) validate(p *problems) {
+	p.check(h.interval < 0 || h.timeout < 0, "heartbeat interval and timeout must not be negative")
+	p.check(h.enabled() && h.interval >= h.timeout, "heartbeat interval %s must be shorter than its timeout %s", h.interval, h.timeout)
+}
+
+// validate checks the source configured with a Source option.
+func (src Source) validate(p *problems) {
+	p.check(src.Rand == nil || src.Now == nil, "source needs both Rand and Now")
+}
+
+// Validate checks the options of the server and returns an error
+// listing every problem found, each matching ErrInvalidConfig.
+// Run validates the server before it starts listening.
+func (s *Server) Validate() error {
+	cfg := &s.cfg
+	var p problems
+	p.check(len(cfg.addresses) == 0, "no addresses")
+	for _, addr := range cfg.addresses {
+		p.check(addr == "", "address is empty")
+	}
+	p.check(cfg.handler == nil, "handler is nil, set one with ServerOptions.Handler")
+	p.check(cfg.tlsCert == nil && !cfg.devTLS && (cfg.tlsCertFile == "" || cfg.tlsKeyFile == ""),
+		"no TLS certificate, set TLSCertificate, DevTLS or both TLSCertFile and TLSKeyFile")
+	p.check(cfg.tokenRepo == nil && !cfg.raw, "token repo is nil")
+	p.check(cfg.tokenGen == nil, "token generator is nil")
+	if cfg.ipErr != nil {
+		p.add("%v", cfg.ipErr)
+	}
+	p.check(cfg.rateLimit < 0, "token rate limit %v is negative", cfg.rateLimit)
+	p.check(cfg.rateLimit > 0 && cfg.rateBurst < 1, "token rate limit burst %d is less than 1", cfg.rateBurst)
+	p.check(cfg.writeRate > 0 && cfg.writeBurst < 1, "write rate limit burst %d is less than 1", cfg.writeBurst)
+	p.check(cfg.filterTimeout < 0, "filter timeout %s is negative", cfg.filterTimeout)
+	p.check(cfg.maxViolations < 0, "max violations %d is negative", cfg.maxViolations)
+	p.check(cfg.strict < 0, "strict violation limit %d is negative", cfg.strict)
+	p.check(cfg.tokenFrames < 0, "per message auth violation limit %d is negative", cfg.tokenFrames)
+	p.check(cfg.requireTokenFrames && cfg.tokenFrames == 0, "RequirePerMessageAuth needs PerMessageAuth")
+	p.check(cfg.tokenRepoLag < 0, "token repo lag %s is negative", cfg.tokenRepoLag)
+	p.check(cfg.sinkQueue < 0, "sink queue %d is negative", cfg.sinkQueue)
+	p.check(cfg.handlerTimeout < 0, "handler timeout %s is negative", cfg.handlerTimeout)
+	p.check(cfg.rotateEvery < 0, "token rotation interval %s is negative", cfg.rotateEvery)
+	p.check(cfg.usageSink != nil && cfg.usageEvery <= 0, "usage sink interval %s is not positive", cfg.usageEvery)
+	p.check(cfg.usageTokens < 1, "usage tokens %d is less than 1", cfg.usageTokens)
+	p.check(cfg.replayBuffer < 0, "replay buffer %d is negative", cfg.replayBuffer)
+	p.check(cfg.maxPayload < 0, "max payload size %d is negative", cfg.maxPayload)
+	p.check(!validInstance(cfg.instance), "instance ID %q is empty or contains whitespace", cfg.instance)
+	p.check(cfg.maxConns < 0, "max conns %d is negative", cfg.maxConns)
+	p.check(cfg.maxStreams < 0, "max streams per connection %d is negative", cfg.maxStreams)
+	p.check(cfg.skewThreshold < 0, "clock skew threshold %s is negative", cfg.skewThreshold)
+	p.check(cfg.breakerFailures < 0, "token repo breaker failures %d is negative", cfg.breakerFailures)
+	p.check(cfg.breakerFailures > 0 && cfg.breakerCooldown <= 0, "token repo breaker cooldown %s is not positive", cfg.breakerCooldown)
+	p.check(cfg.addrValidation < ValidateNever || cfg.addrValidation > ValidateUnderLoad,
+		"unknown address validation policy %d", cfg.addrValidation)
+	p.check(cfg.halfOpen < 0, "half-open handshake threshold %d is negative", cfg.halfOpen)
+	p.check(len(cfg.peers) > 0 && cfg.clusterSecret == nil, "peers without a cluster secret, set one with ServerOptions.Cluster")
+	for _, addr := range cfg.peers {
+		p.check(addr == "", "peer address is empty")
+	}
+	p.check(cfg.clusterSecret != nil && cfg.adminSecret != nil && *cfg.clusterSecret == *cfg.adminSecret,
+		"cluster secret is the admin secret")
+	for _, c := range cfg.caps {
+		c.validate(&p)
+	}
+	cfg.heartbeat.validate(&p)
+	cfg.src.validate(&p)
+	return p.err()
+}
+
+// Validate checks the options of the client and returns an error
+// listing every problem found, each matching ErrInvalidConfig.
+// Dial validates the client before it connects.
+func (c *Client) Validate() error {
+	cfg := &c.cfg
+	var p problems
+	p.check(len(cfg.servers) == 0, "no server addresses")
+	for _, addr := range cfg.servers {
+		p.check(addr == "", "server address is empty")
+	}
+	p.check(cfg.token == "" && !cfg.guest && !cfg.noAuth && !cfg.raw, "token file is empty")
+	p.check(cfg.guest && cfg.noAuth, "guest and no auth exclude each other")
+	p.check(cfg.raw && (cfg.guest || cfg.noAuth), "raw sessions exclude guest and no auth")
+	p.check(cfg.tofu != nil && cfg.tofu.path == "", "TOFU store path is empty")
+	p.check(cfg.roots == nil && cfg.sysPool == nil, "system cert pool loader is nil")
+	p.check(cfg.resume < 0, "resume pending %d is negative", cfg.resume)
+	p.check(cfg.maxPayload < 0, "max payload size %d is negative", cfg.maxPayload)
+	p.check(cfg.outbox < 0, "outbox limit %d is negative", cfg.outbox)
+	p.check(cfg.loginRetries < 0, "login retries %d is negative", cfg.loginRetries)
+	p.check(cfg.loginRetries > 0 && cfg.loginBackoff <= 0, "login retry backoff %s is not positive", cfg.loginBackoff)
+	for _, c := range cfg.caps {
+		c.validate(&p)
+	}
+	cfg.heartbeat.validate(&p)
+	cfg.src.validate(&p)
+	return p.err()
+}
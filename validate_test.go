@@ -0,0 +1,127 @@
+package chat_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+	"github.com/zhmlst/chat/chattest"
+)
+
+// validServer returns the options of a server passing validation, opts applied last.
+func validServer(opts ...chat.ServerOption) []chat.ServerOption {
+	return append([]chat.ServerOption{
+		chat.ServerOptions.Addresses("127.0.0.1:0"),
+		chat.ServerOptions.DevTLS(),
+		chat.ServerOptions.TokenRepo(&chattest.TokenRepo{}),
+		chat.ServerOptions.Handler(discard),
+	}, opts...)
+}
+
+func TestServerValidate(t *testing.T) {
+	if err := chat.NewServer(validServer()...).Validate(); err != nil {
+		t.Fatalf("valid server: %v", err)
+	}
+	for _, tt := range []struct {
+		name string
+		opt  chat.ServerOption
+		want string
+	}{
+		{"no addresses", chat.ServerOptions.Addresses(), "no addresses"},
+		{"empty address", chat.ServerOptions.Addresses(""), "address is empty"},
+		{"nil handler", chat.ServerOptions.Handler(nil), "handler is nil"},
+		{"nil token repo", chat.ServerOptions.TokenRepo(nil), "token repo is nil"},
+		{"negative rate limit", chat.ServerOptions.TokenRateLimit(-1, 1), "token rate limit -1 is negative"},
+		{"rate limit without burst", chat.ServerOptions.TokenRateLimit(1, 0), "burst 0 is less than 1"},
+		{"write rate without burst", chat.ServerOptions.WriteRateLimit(1, 0), "write rate limit burst"},
+		{"negative handler timeout", chat.ServerOptions.HandlerTimeout(-time.Second), "handler timeout -1s is negative"},
+		{"negative replay buffer", chat.ServerOptions.ReplayBuffer(-1), "replay buffer -1 is negative"},
+		{"negative max conns", chat.ServerOptions.MaxConns(-1), "max conns -1 is negative"},
+		{"usage sink without interval", chat.ServerOptions.UsageSink(0, func([]chat.UsageRecord) {}), "usage sink interval"},
+		{"no usage tokens", chat.ServerOptions.UsageTokens(0), "usage tokens 0"},
+		{"heartbeat over timeout", chat.ServerOptions.Heartbeat(time.Minute, time.Second), "heartbeat interval 1m0s must be shorter"},
+		{"source without clock", chat.ServerOptions.Source(chat.Source{Rand: zeros{}}), "source needs both"},
+		{"instance with space", chat.ServerOptions.InstanceID("a b"), "instance ID"},
+		{"peers without secret", chat.ServerOptions.Peers("127.0.0.1:1"), "peers without a cluster secret"},
+		{"invalid CIDR", chat.ServerOptions.AllowCIDR("10.0.0.0/33"), "10.0.0.0/33"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := chat.NewServer(validServer(tt.opt)...).Validate()
+			if !errors.Is(err, chat.ErrInvalidConfig) || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("validate: %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerValidateNoTLS(t *testing.T) {
+	srv := chat.NewServer(
+		chat.ServerOptions.Addresses("127.0.0.1:0"),
+		chat.ServerOptions.TLSCertFile(""),
+		chat.ServerOptions.TokenRepo(&chattest.TokenRepo{}),
+		chat.ServerOptions.Handler(discard),
+	)
+	if err := srv.Validate(); !errors.Is(err, chat.ErrInvalidConfig) || !strings.Contains(err.Error(), "no TLS certificate") {
+		t.Errorf("validate: %v, want no TLS certificate", err)
+	}
+}
+
+func TestServerValidateEveryProblem(t *testing.T) {
+	srv := chat.NewServer(validServer(
+		chat.ServerOptions.Handler(nil),
+		chat.ServerOptions.MaxConns(-1),
+		chat.ServerOptions.ReplayBuffer(-1),
+	)...)
+	err := srv.Validate()
+	var joined interface{ Unwrap() []error }
+	if !errors.As(err, &joined) || len(joined.Unwrap()) != 3 {
+		t.Fatalf("validate: %v, want 3 problems", err)
+	}
+	// Run refuses the server before listening
+	if rerr := srv.Run(); !errors.Is(rerr, chat.ErrInvalidConfig) {
+		t.Errorf("run: %v, want ErrInvalidConfig", rerr)
+	}
+	if srv.Addr() != nil {
+		t.Error("invalid server listening")
+	}
+}
+
+func TestClientValidate(t *testing.T) {
+	valid := func(opts ...chat.ClientOption) *chat.Client {
+		return chat.NewClient(append([]chat.ClientOption{
+			chat.ClientOptions.Servers([]string{"127.0.0.1:1"}),
+			chat.ClientOptions.TokenFile("token"),
+		}, opts...)...)
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("valid client: %v", err)
+	}
+	for _, tt := range []struct {
+		name string
+		opt  chat.ClientOption
+		want string
+	}{
+		{"no servers", chat.ClientOptions.Servers(nil), "no server addresses"},
+		{"empty server", chat.ClientOptions.Servers([]string{""}), "server address is empty"},
+		{"no token file", chat.ClientOptions.TokenFile(""), "token file is empty"},
+		{"empty TOFU store", chat.ClientOptions.TOFU(""), "TOFU store path is empty"},
+		{"negative payload", chat.ClientOptions.MaxPayloadSize(-1), "max payload size -1"},
+		{"heartbeat over timeout", chat.ClientOptions.Heartbeat(time.Minute, time.Second), "must be shorter"},
+		{"source without rand", chat.ClientOptions.Source(chat.Source{Now: time.Now}), "source needs both"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := valid(tt.opt).Validate()
+			if !errors.Is(err, chat.ErrInvalidConfig) || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("validate: %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	// Dial refuses the client before connecting
+	c := valid(chat.ClientOptions.Guest(), chat.ClientOptions.NoAuth())
+	if err := c.Dial(t.Context()); !errors.Is(err, chat.ErrInvalidConfig) {
+		t.Errorf("dial: %v, want ErrInvalidConfig", err)
+	}
+}
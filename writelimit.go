@@ -0,0 +1,104 @@
+package chat
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// writeLimiter is a token bucket limiting the bytes written per second.
+// Unlike limiter it delays writes instead of refusing them.
+type writeLimiter struct {
+	rate  float64
+	burst float64
+
+	mtx       sync.Mutex
+	tokens    float64
+	last      time.Time
+	waiting   int
+	throttled time.Duration
+}
+
+func newWriteLimiter(rate float64, burst int, now time.Time) *writeLimiter {
+	return &writeLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// reserve takes n bytes from the bucket at now and returns how long
+// the write must wait for them. Frames larger than the burst go into debt.
+func (l *writeLimiter) reserve(n int, now time.Time) time.Duration {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait delays for d unless ctx or done end first. The reserved n bytes
+// are returned to the bucket if the write does not happen.
+func (l *writeLimiter) wait(ctx context.Context, done <-chan struct{}, n int, d time.Duration) error {
+	l.mtx.Lock()
+	l.waiting++
+	l.mtx.Unlock()
+	start := time.Now()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-done:
+		err = ErrSessionClosed
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.waiting--
+	l.throttled += time.Since(start)
+	if err != nil {
+		l.tokens += float64(n)
+	}
+	return err
+}
+
+func (l *writeLimiter) state() (throttling bool, throttled time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.waiting > 0, l.throttled
+}
+
+// SetWriteRateLimit limits the bytes the session writes to rate per second
+// with the given burst. Writes exceeding the limit are delayed, not dropped.
+// Control messages and acks are not limited. A rate of zero or less
+// removes the limit.
+func (s *Session) SetWriteRateLimit(rate float64, burst int) {
+	if rate <= 0 {
+		s.wlim.Store(nil)
+		return
+	}
+	s.wlim.Store(newWriteLimiter(rate, burst, s.src.Now()))
+}
+
+// throttle delays the write of m according to the write rate limit.
+func (s *Session) throttle(req *writeReq, done <-chan struct{}) error {
+	l := s.wlim.Load()
+	if l == nil || req.m.Type == MsgTypeControl || req.m.Type == MsgTypeAck {
+		return nil
+	}
+	n := hdrLen + len(req.m.Payload)
+	d := l.reserve(n, s.src.Now())
+	if d <= 0 {
+		return nil
+	}
+	return l.wait(req.ctx, done, n, d)
+}
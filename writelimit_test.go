@@ -0,0 +1,47 @@
+package chat_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestWriteRateLimit(t *testing.T) {
+	const (
+		rate  = 1 << 20
+		burst = 64 << 10
+		size  = 1 << 20
+	)
+	throttled := make(chan time.Duration, 1)
+	var srv *chat.Server
+	srv, addr, ca := startServer(t, func(ctx context.Context, s *chat.Session) {
+		for range size / burst {
+			if err := s.Send(ctx, chat.NewBinaryMessage(make([]byte, burst))); err != nil {
+				return
+			}
+		}
+		info, err := srv.SessionInfo(s.ID())
+		if err != nil {
+			return
+		}
+		throttled <- info.Throttled
+		discard(ctx, s)
+	}, chat.ServerOptions.WriteRateLimit(rate, burst))
+
+	start := time.Now()
+	got := make(chan int, size/burst)
+	connect(t, addr, ca, chat.ClientOptions.OnMessage(func(m *chat.Message) { got <- len(m.Payload) }))
+	for n := 0; n < size; {
+		n += receive(t, got)
+	}
+	// the burst goes out at once, the rest at the rate
+	elapsed, want := time.Since(start), time.Duration(size-burst)*time.Second/rate
+	if elapsed < want*3/4 || elapsed > 4*want {
+		t.Errorf("sent %d bytes in %s, want about %s", size, elapsed, want)
+	}
+	if d := receive(t, throttled); d < want/2 {
+		t.Errorf("throttled for %s, want about %s", d, want)
+	}
+}
@@ -0,0 +1,42 @@
+package chat_test
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/zhmlst/chat"
+)
+
+func TestZeroRTTResumption(t *testing.T) {
+	_, addr, ca := startServer(t, discard, chat.ServerOptions.Allow0RTT())
+	// a round trip of 40ms makes the round trip saved stand out
+	addr = delayProxy(t, addr, 20*time.Millisecond)
+	cache := tls.NewLRUClientSessionCache(4)
+	c := newClient(t, addr, ca, chat.ClientOptions.SessionCache(cache))
+
+	start := time.Now()
+	if err := dial(t, c); err != nil {
+		t.Fatalf("first dial: %v", err)
+	}
+	first := time.Since(start)
+	if c.Resumed() {
+		t.Error("first connection resumed")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	eventually(t, func() bool { return c.SessionID() == [16]byte{} })
+
+	start = time.Now()
+	if err := dial(t, c); err != nil {
+		t.Fatalf("second dial: %v", err)
+	}
+	second := time.Since(start)
+	if !c.Resumed() {
+		t.Error("second connection did not resume")
+	}
+	if second >= first {
+		t.Errorf("resumed connection took %s, first %s", second, first)
+	}
+}